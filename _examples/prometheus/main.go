@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+
+	"github.com/Azure/azure-amqp-common-go/aad"
+	"github.com/Azure/azure-event-hubs-go"
+	"github.com/Azure/azure-event-hubs-go/eph"
+	"github.com/Azure/azure-event-hubs-go/storage"
+	ehprometheus "github.com/Azure/azure-event-hubs-go/storage/prometheus"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func main() {
+	ctx := context.Background()
+
+	// register the lease and checkpoint metrics with the application's registry and serve them for scraping
+	registry := prometheus.NewRegistry()
+	recorder, err := ehprometheus.NewPrometheusRecorder(registry)
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	go func() {
+		log.Fatal(http.ListenAndServe(":9090", nil))
+	}()
+
+	accountName := mustGetenv("STORAGE_ACCOUNT_NAME")
+	containerName := mustGetenv("STORAGE_CONTAINER_NAME")
+	cred, err := storage.NewAADSASCredential(mustGetenv("AZURE_SUBSCRIPTION_ID"), mustGetenv("AZURE_RESOURCE_GROUP"), accountName, containerName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the recorder observes the leaser from the moment eph.New calls SetEventHostProcessor on it
+	leaserCheckpointer, err := storage.NewStorageLeaserCheckpointer(cred, accountName, containerName, azure.PublicCloud, storage.WithMetricsRecorder(recorder))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	provider, err := aad.NewJWTProvider(aad.JWTProviderWithEnvironmentVars())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	host, err := eph.New(ctx, mustGetenv("EVENTHUB_NAMESPACE"), mustGetenv("EVENTHUB_NAME"), provider, leaserCheckpointer, leaserCheckpointer)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := host.RegisterHandler(ctx, func(ctx context.Context, event *eventhub.Event) error {
+		fmt.Println(string(event.Data))
+		return nil
+	}); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := host.StartNonBlocking(ctx); err != nil {
+		log.Fatal(err)
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, os.Kill)
+	<-signalChan
+
+	if err := host.Close(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func mustGetenv(key string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		panic("Environment variable '" + key + "' required for this example.")
+	}
+	return v
+}
@@ -75,6 +75,20 @@ type (
 		partitionIDs  []string
 		noBanner      bool
 		env           *azure.Environment
+		throughput    *throughputBalancer
+		ownerIdentity string
+		defaultStart  *persist.Checkpoint
+		onShutdown    func([]FinalCheckpoint)
+		pumpFactory   PumpFactory
+	}
+
+	// FinalCheckpoint describes the checkpoint a partition was left at when the EventProcessorHost shut down. Err is the
+	// error from releasing the partition's lease, which includes failing to persist the final checkpoint.
+	FinalCheckpoint struct {
+		PartitionID string
+		Checkpoint  persist.Checkpoint
+		Epoch       int64
+		Err         error
 	}
 
 	// EventProcessorHostOption provides configuration options for an EventProcessorHost
@@ -109,6 +123,39 @@ func WithEnvironment(env azure.Environment) EventProcessorHostOption {
 	}
 }
 
+// WithOwnerIdentity configures the identity the EventProcessorHost records as the owner of the leases it holds, such
+// as a hostname and UUID which is stable for the lifetime of a pod. By default the owner is the name of the
+// EventProcessorHost. The identity must be unique to each EventProcessorHost sharing the leases.
+func WithOwnerIdentity(id string) EventProcessorHostOption {
+	return func(host *EventProcessorHost) error {
+		if id == "" {
+			return errors.New("owner identity must not be empty")
+		}
+		host.ownerIdentity = id
+		return nil
+	}
+}
+
+// WithDefaultStartPosition configures the position the EventProcessorHost starts receiving from for partitions which
+// have no checkpoint, such as persist.NewCheckpointFromEndOfStream(). By default, partitions without a checkpoint are
+// received from the start of the stream.
+func WithDefaultStartPosition(checkpoint persist.Checkpoint) EventProcessorHostOption {
+	return func(host *EventProcessorHost) error {
+		host.defaultStart = &checkpoint
+		return nil
+	}
+}
+
+// WithShutdownReport configures the EventProcessorHost to call report on Close with the final checkpoint of each
+// partition it owned, after the receivers have stopped and the leases have been released. This is useful for auditing
+// the position each partition was committed at during a deploy.
+func WithShutdownReport(report func([]FinalCheckpoint)) EventProcessorHostOption {
+	return func(host *EventProcessorHost) error {
+		host.onShutdown = report
+		return nil
+	}
+}
+
 // NewFromConnectionString builds a new Event Processor Host from an Event Hub connection string which can be found in
 // the Azure portal
 func NewFromConnectionString(ctx context.Context, connStr string, leaser Leaser, checkpointer Checkpointer, opts ...EventProcessorHostOption) (*EventProcessorHost, error) {
@@ -329,6 +376,22 @@ func (h *EventProcessorHost) GetName() string {
 	return h.name
 }
 
+// GetOwnerIdentity returns the identity recorded as the owner of the leases held by the EventProcessorHost
+func (h *EventProcessorHost) GetOwnerIdentity() string {
+	if h.ownerIdentity != "" {
+		return h.ownerIdentity
+	}
+	return h.name
+}
+
+// GetDefaultStartPosition returns the checkpoint to start receiving from for partitions which have no checkpoint
+func (h *EventProcessorHost) GetDefaultStartPosition() persist.Checkpoint {
+	if h.defaultStart != nil {
+		return *h.defaultStart
+	}
+	return persist.NewCheckpointFromStartOfStream()
+}
+
 // GetPartitionIDs fetches the partition IDs for the Event Hub
 func (h *EventProcessorHost) GetPartitionIDs() []string {
 	return h.partitionIDs
@@ -345,7 +408,12 @@ func (h *EventProcessorHost) Close(ctx context.Context) error {
 		fmt.Println("shutting down...")
 	}
 	if h.scheduler != nil {
-		if err := h.scheduler.Stop(ctx); err != nil {
+		finals, err := h.scheduler.Stop(ctx)
+		if h.onShutdown != nil {
+			h.onShutdown(finals)
+		}
+
+		if err != nil {
 			if h.client != nil {
 				_ = h.client.Close(ctx)
 			}
@@ -361,6 +429,9 @@ func (h *EventProcessorHost) Close(ctx context.Context) error {
 		_ = h.checkpointer.Close()
 	}
 
+	if h.client == nil {
+		return nil
+	}
 	return h.client.Close(ctx)
 }
 
@@ -383,8 +454,17 @@ func (h *EventProcessorHost) setup(ctx context.Context) error {
 
 		scheduler := newScheduler(h)
 
+		if bulk, ok := h.leaser.(BulkLeaseEnsurer); ok {
+			if _, err := bulk.EnsureLeases(ctx, h.partitionIDs); err != nil {
+				log.For(ctx).Error(err)
+			}
+		} else {
+			for _, partitionID := range h.partitionIDs {
+				h.leaser.EnsureLease(ctx, partitionID)
+			}
+		}
+
 		for _, partitionID := range h.partitionIDs {
-			h.leaser.EnsureLease(ctx, partitionID)
 			h.checkpointer.EnsureCheckpoint(ctx, partitionID)
 		}
 
@@ -25,7 +25,9 @@ package eph
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"math"
 	"sync/atomic"
 )
 
@@ -42,7 +44,11 @@ type (
 		SetEventHostProcessor(eph *EventProcessorHost)
 	}
 
-	// Leaser provides the functionality needed to persist and coordinate leases for partitions
+	// Leaser provides the functionality needed to persist and coordinate leases for partitions.
+	//
+	// ReleaseLease may return an error along with true when the lease was released, but something which should have
+	// happened first failed, such as uploading the partition's final checkpoint. The partition is no longer owned in
+	// that case, so the error is only a report of what was lost.
 	Leaser interface {
 		io.Closer
 		StoreProvisioner
@@ -56,11 +62,33 @@ type (
 		UpdateLease(ctx context.Context, partitionID string) (LeaseMarker, bool, error)
 	}
 
+	// BulkLeaseEnsurer is optionally implemented by a Leaser which can ensure the leases for many partitions at once. If
+	// only some of the leases can be ensured, the ensured leases are returned along with the error.
+	BulkLeaseEnsurer interface {
+		EnsureLeases(ctx context.Context, partitionIDs []string) ([]LeaseMarker, error)
+	}
+
 	// Lease represents the information needed to coordinate partitions
 	Lease struct {
-		PartitionID string `json:"partitionID"`
-		Epoch       int64  `json:"epoch"`
-		Owner       string `json:"owner"`
+		PartitionID     string          `json:"partitionID"`
+		Epoch           int64           `json:"epoch"`
+		Owner           string          `json:"owner"`
+		AcquisitionKind AcquisitionKind `json:"-"`
+	}
+
+	// AcquisitionKind describes how a lease was most recently taken by its owner
+	AcquisitionKind int
+
+	// AcquisitionKindGetter is implemented by LeaseMarkers which record how they were most recently acquired
+	AcquisitionKindGetter interface {
+		GetAcquisitionKind() AcquisitionKind
+	}
+
+	// LeaseHolderChecker is optionally implemented by a LeaseMarker which can tell whether it is currently held by a
+	// given owner. Unlike IsExpired, this distinguishes a lease still held by its recorded owner from one which has
+	// since been taken by another host.
+	LeaseHolderChecker interface {
+		IsHeldBy(ctx context.Context, owner string) bool
 	}
 
 	// LeaseMarker provides the functionality expected of a partition lease with an owner
@@ -74,6 +102,41 @@ type (
 	}
 )
 
+const (
+	// MaxEpoch is the largest epoch a lease can reach. A lease at MaxEpoch can no longer be acquired, since a new owner
+	// would not have a higher epoch with which to fence out the previous owner.
+	MaxEpoch int64 = math.MaxInt64
+)
+
+var (
+	// ErrEpochExhausted is returned when acquiring a lease whose epoch has reached MaxEpoch
+	ErrEpochExhausted = errors.New("the lease epoch has reached its maximum and can no longer be used to fence receivers")
+
+	// ErrStoreNotFound is returned by a Leaser when the store holding the leases, such as a storage container, doesn't
+	// exist. The scheduler responds by ensuring the store exists before its next scan.
+	ErrStoreNotFound = errors.New("the lease store does not exist")
+)
+
+const (
+	// KindAcquired indicates the lease was acquired from a blob which was not leased by another host
+	KindAcquired AcquisitionKind = iota
+	// KindChanged indicates the lease was changed away from another host which still held it, either because the
+	// lease expired without being released or because two hosts believe they own the partition
+	KindChanged
+)
+
+// String returns the name of the AcquisitionKind
+func (k AcquisitionKind) String() string {
+	switch k {
+	case KindAcquired:
+		return "acquired"
+	case KindChanged:
+		return "changed"
+	default:
+		return "unknown"
+	}
+}
+
 // GetPartitionID returns the partition which belongs to this lease
 func (l *Lease) GetPartitionID() string {
 	return l.PartitionID
@@ -84,9 +147,32 @@ func (l *Lease) GetOwner() string {
 	return l.Owner
 }
 
-// IncrementEpoch increase the time on the lease by one
+// IncrementEpoch increases the epoch of the lease by one and returns the new epoch.
+//
+// The epoch is a fencing token: it starts at 0 when the lease is created, increases by one each time the lease is
+// acquired, and is used as the epoch of the partition's receiver so a receiver opened by a newer owner disconnects any
+// older one. The epoch never goes negative or wraps around: a negative epoch, which can only come from a corrupt lease,
+// restarts at 1, and an epoch of MaxEpoch stays at MaxEpoch.
 func (l *Lease) IncrementEpoch() int64 {
-	return atomic.AddInt64(&l.Epoch, 1)
+	for {
+		current := atomic.LoadInt64(&l.Epoch)
+		next := current + 1
+		switch {
+		case current == MaxEpoch:
+			return current
+		case current < 0:
+			next = 1
+		}
+
+		if atomic.CompareAndSwapInt64(&l.Epoch, current, next) {
+			return next
+		}
+	}
+}
+
+// GetAcquisitionKind returns how the lease was most recently acquired by its owner
+func (l *Lease) GetAcquisitionKind() AcquisitionKind {
+	return l.AcquisitionKind
 }
 
 // GetEpoch returns the value of the epoch
@@ -0,0 +1,53 @@
+package eph
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaseEpochIncreasesMonotonically(t *testing.T) {
+	lease := new(Lease)
+	last := lease.GetEpoch()
+	for i := 0; i < 1000; i++ {
+		next := lease.IncrementEpoch()
+		assert.Equal(t, last+1, next)
+		assert.Equal(t, next, lease.GetEpoch())
+		last = next
+	}
+}
+
+func TestLeaseEpochRestartsWhenNegative(t *testing.T) {
+	lease := &Lease{Epoch: -42}
+	assert.Equal(t, int64(1), lease.IncrementEpoch())
+	assert.Equal(t, int64(2), lease.IncrementEpoch())
+}
+
+func TestLeaseEpochDoesNotOverflow(t *testing.T) {
+	lease := &Lease{Epoch: MaxEpoch - 1}
+	assert.Equal(t, MaxEpoch, lease.IncrementEpoch())
+	assert.Equal(t, MaxEpoch, lease.IncrementEpoch(), "the epoch should not wrap around")
+	assert.True(t, lease.GetEpoch() > 0)
+}
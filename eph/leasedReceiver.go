@@ -30,13 +30,12 @@ import (
 	"time"
 
 	"github.com/Azure/azure-amqp-common-go/log"
-	"github.com/Azure/azure-event-hubs-go"
 	"github.com/opentracing/opentracing-go"
 )
 
 type (
 	leasedReceiver struct {
-		handle    *eventhub.ListenerHandle
+		pump      PartitionPump
 		processor *EventProcessorHost
 		lease     LeaseMarker
 		done      func()
@@ -54,8 +53,6 @@ func (lr *leasedReceiver) Run(ctx context.Context) error {
 	span, ctx := lr.startConsumerSpanFromContext(ctx, "eph.leasedReceiver.Run")
 	defer span.Finish()
 
-	partitionID := lr.lease.GetPartitionID()
-	epoch := lr.lease.GetEpoch()
 	lr.dlog(ctx, "running...")
 
 	go func() {
@@ -66,11 +63,11 @@ func (lr *leasedReceiver) Run(ctx context.Context) error {
 		lr.periodicallyRenewLease(ctx)
 	}()
 
-	handle, err := lr.processor.client.Receive(ctx, partitionID, lr.processor.compositeHandlers(), eventhub.ReceiveWithEpoch(epoch))
+	pump, err := lr.processor.startPump(ctx, lr.lease, lr.processor.compositeHandlers())
 	if err != nil {
 		return err
 	}
-	lr.handle = handle
+	lr.pump = pump
 	lr.listenForClose()
 	return nil
 }
@@ -83,8 +80,8 @@ func (lr *leasedReceiver) Close(ctx context.Context) error {
 		lr.done()
 	}
 
-	if lr.handle != nil {
-		return lr.handle.Close(ctx)
+	if lr.pump != nil {
+		return lr.pump.Close(ctx)
 	}
 
 	return nil
@@ -92,7 +89,7 @@ func (lr *leasedReceiver) Close(ctx context.Context) error {
 
 func (lr *leasedReceiver) listenForClose() {
 	go func() {
-		<-lr.handle.Done()
+		<-lr.pump.Done()
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 		span, ctx := lr.startConsumerSpanFromContext(ctx, "eph.leasedReceiver.listenForClose")
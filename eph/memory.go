@@ -196,6 +196,14 @@ func (l *memoryLease) IsExpired(_ context.Context) bool {
 	return !l.leaser.store.isLeased(l.PartitionID)
 }
 
+// IsHeldBy indicates that the lease is currently leased by the owner
+func (l *memoryLease) IsHeldBy(_ context.Context, owner string) bool {
+	if !l.leaser.store.isLeased(l.PartitionID) {
+		return false
+	}
+	return l.leaser.store.getLease(l.PartitionID).Owner == owner
+}
+
 func (l *memoryLease) expireAfter(d time.Duration) {
 	l.expirationTime = time.Now().Add(d)
 }
@@ -289,20 +297,26 @@ func (ml *memoryLeaserCheckpointer) AcquireLease(ctx context.Context, partitionI
 		return nil, false, err
 	}
 
+	if lease.GetEpoch() >= MaxEpoch {
+		return nil, false, ErrEpochExhausted
+	}
+
 	newToken := uuidToken.String()
 	if ml.store.isLeased(partitionID) {
 		// is leased by someone else due to a race to acquire
 		if !ml.store.changeLease(partitionID, newToken, lease.Token, ml.leaseDuration) {
 			return nil, false, errors.New("failed to change lease")
 		}
+		lease.AcquisitionKind = KindChanged
 	} else {
 		if !ml.store.acquireLease(partitionID, newToken, ml.leaseDuration) {
 			return nil, false, errors.New("failed to acquire lease")
 		}
+		lease.AcquisitionKind = KindAcquired
 	}
 
 	lease.Token = newToken
-	lease.Owner = ml.processor.GetName()
+	lease.Owner = ml.processor.GetOwnerIdentity()
 	lease.IncrementEpoch()
 	if !ml.store.storeLease(partitionID, newToken, lease) {
 		return nil, false, errors.New("failed to store lease after acquiring or changing")
@@ -376,10 +390,10 @@ func (ml *memoryLeaserCheckpointer) GetCheckpoint(ctx context.Context, partition
 	defer span.Finish()
 
 	lease, ok := ml.leases[partitionID]
-	if ok {
+	if ok && lease.Checkpoint != nil {
 		return *lease.Checkpoint, ok
 	}
-	return persist.NewCheckpointFromStartOfStream(), ok
+	return ml.processor.GetDefaultStartPosition(), ok
 }
 
 func (ml *memoryLeaserCheckpointer) EnsureCheckpoint(ctx context.Context, partitionID string) (persist.Checkpoint, error) {
@@ -392,12 +406,12 @@ func (ml *memoryLeaserCheckpointer) EnsureCheckpoint(ctx context.Context, partit
 	lease, ok := ml.leases[partitionID]
 	if ok {
 		if lease.Checkpoint == nil {
-			checkpoint := persist.NewCheckpointFromStartOfStream()
+			checkpoint := ml.processor.GetDefaultStartPosition()
 			lease.Checkpoint = &checkpoint
 		}
 		return *lease.Checkpoint, nil
 	}
-	return persist.NewCheckpointFromStartOfStream(), nil
+	return ml.processor.GetDefaultStartPosition(), nil
 }
 
 func (ml *memoryLeaserCheckpointer) UpdateCheckpoint(ctx context.Context, partitionID string, checkpoint persist.Checkpoint) error {
@@ -0,0 +1,238 @@
+package eph
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-event-hubs-go"
+)
+
+const (
+	minOrderedFlushInterval = 10 * time.Millisecond
+)
+
+type (
+	// TimeOrderedConsumer merges the events from all of the partitions owned by an EventProcessorHost into a single
+	// stream ordered by enqueued time.
+	//
+	// Ordering is best-effort: each event is held for the reorder window after it arrives, and events held at the same
+	// time are delivered in enqueued time order. An event which arrives more than the window after a later enqueued
+	// event has been delivered is delivered out of order. A larger window gives better ordering at the cost of latency.
+	//
+	// Handle blocks until the event has been delivered, so each partition's receiver is held back while its event waits
+	// in the window and the handler's error is returned to the receiver as though the handler had been called directly.
+	TimeOrderedConsumer struct {
+		window       time.Duration
+		handler      eventhub.Handler
+		enqueuedTime func(*eventhub.Event) time.Time
+		now          func() time.Time
+		pending      orderedEvents
+		byArrival    []*orderedEvent
+		arrivals     uint64
+		mu           sync.Mutex
+		deliverMu    sync.Mutex
+		done         chan struct{}
+		closeOnce    sync.Once
+	}
+
+	orderedEvent struct {
+		ctx       context.Context
+		event     *eventhub.Event
+		enqueued  time.Time
+		arrivedAt time.Time
+		arrival   uint64
+		result    chan error
+		popped    bool
+		cancelled bool
+	}
+
+	// orderedEvents is a min-heap of events by enqueued time, then by arrival
+	orderedEvents []*orderedEvent
+)
+
+// NewTimeOrderedConsumer creates a TimeOrderedConsumer which delivers events to handler ordered by enqueued time
+// within the reorder window. Register the consumer's Handle func with the EventProcessorHost to feed it events, and
+// Close the consumer when done to deliver the events still being held.
+func NewTimeOrderedConsumer(window time.Duration, handler eventhub.Handler) *TimeOrderedConsumer {
+	c := newTimeOrderedConsumer(window, handler)
+	go c.flushLoop()
+	return c
+}
+
+func newTimeOrderedConsumer(window time.Duration, handler eventhub.Handler) *TimeOrderedConsumer {
+	return &TimeOrderedConsumer{
+		window:  window,
+		handler: handler,
+		enqueuedTime: func(event *eventhub.Event) time.Time {
+			return event.GetCheckpoint().EnqueueTime
+		},
+		now:  time.Now,
+		done: make(chan struct{}),
+	}
+}
+
+// Handle holds the event until its reorder window has passed, then delivers it to the handler with ctx and returns
+// the handler's error. If ctx is done before the event is delivered, the event is dropped and ctx.Err() is returned.
+// It is an eventhub.Handler, so it can be passed directly to RegisterHandler.
+func (c *TimeOrderedConsumer) Handle(ctx context.Context, event *eventhub.Event) error {
+	c.mu.Lock()
+	c.arrivals++
+	oe := &orderedEvent{
+		ctx:       ctx,
+		event:     event,
+		enqueued:  c.enqueuedTime(event),
+		arrivedAt: c.now(),
+		arrival:   c.arrivals,
+		result:    make(chan error, 1),
+	}
+	heap.Push(&c.pending, oe)
+	c.byArrival = append(c.byArrival, oe)
+	c.mu.Unlock()
+
+	if c.window <= 0 {
+		c.flush(false)
+	}
+
+	select {
+	case err := <-oe.result:
+		return err
+	case <-ctx.Done():
+		c.mu.Lock()
+		if oe.popped {
+			// the handler already has the event, so its result is the one to report
+			c.mu.Unlock()
+			return <-oe.result
+		}
+		oe.cancelled = true
+		c.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Close stops the consumer and delivers all of the events it is still holding in enqueued time order
+func (c *TimeOrderedConsumer) Close(ctx context.Context) error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	c.flush(true)
+	return nil
+}
+
+func (c *TimeOrderedConsumer) flushLoop() {
+	interval := c.window / 4
+	if interval < minOrderedFlushInterval {
+		interval = minOrderedFlushInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			c.flush(false)
+		}
+	}
+}
+
+// flush delivers the events which have been held for at least the reorder window, or all events if all is true. Each
+// event is handled with the context it was passed to Handle with, and the result is sent back to its Handle call.
+func (c *TimeOrderedConsumer) flush(all bool) {
+	c.deliverMu.Lock()
+	defer c.deliverMu.Unlock()
+
+	for {
+		c.mu.Lock()
+		oldest, ok := c.oldestArrival()
+		if !ok {
+			c.mu.Unlock()
+			return
+		}
+
+		// only the oldest arrival bounds what can be released, since anything enqueued before it may still arrive
+		if !all && c.now().Sub(oldest) < c.window {
+			c.mu.Unlock()
+			return
+		}
+		next := heap.Pop(&c.pending).(*orderedEvent)
+		next.popped = true
+		cancelled := next.cancelled
+		c.mu.Unlock()
+
+		if cancelled {
+			continue
+		}
+		next.result <- c.handler(next.ctx, next.event)
+	}
+}
+
+// oldestArrival returns when the earliest arriving pending event arrived, dropping events which have already been
+// delivered or cancelled from the front of the arrival queue; must be called with mu held
+func (c *TimeOrderedConsumer) oldestArrival() (time.Time, bool) {
+	for len(c.byArrival) > 0 && (c.byArrival[0].popped || c.byArrival[0].cancelled) {
+		c.byArrival[0] = nil
+		c.byArrival = c.byArrival[1:]
+	}
+
+	// cancelled events can't be removed from the middle of the heap, so drain them once nothing else is waiting
+	if len(c.byArrival) == 0 {
+		for len(c.pending) > 0 {
+			heap.Pop(&c.pending).(*orderedEvent).popped = true
+		}
+		return time.Time{}, false
+	}
+	return c.byArrival[0].arrivedAt, true
+}
+
+func (oe orderedEvents) Len() int {
+	return len(oe)
+}
+
+func (oe orderedEvents) Less(i, j int) bool {
+	if oe[i].enqueued.Equal(oe[j].enqueued) {
+		return oe[i].arrival < oe[j].arrival
+	}
+	return oe[i].enqueued.Before(oe[j].enqueued)
+}
+
+func (oe orderedEvents) Swap(i, j int) {
+	oe[i], oe[j] = oe[j], oe[i]
+}
+
+func (oe *orderedEvents) Push(x interface{}) {
+	*oe = append(*oe, x.(*orderedEvent))
+}
+
+func (oe *orderedEvents) Pop() interface{} {
+	old := *oe
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*oe = old[:n-1]
+	return item
+}
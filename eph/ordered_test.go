@@ -0,0 +1,220 @@
+package eph
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-event-hubs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type orderedRecorder struct {
+	ids  []string
+	fail map[string]error
+	mu   sync.Mutex
+}
+
+func TestTimeOrderedConsumerOrdersWithinWindow(t *testing.T) {
+	rec := new(orderedRecorder)
+	c, clock, enqueued := newTestOrderedConsumer(time.Minute, rec)
+	defer c.Close(context.Background())
+
+	// events from different partitions arrive out of enqueued time order
+	start := clock.now
+	enqueued["p1-b"] = start.Add(3 * time.Second)
+	enqueued["p0-a"] = start.Add(1 * time.Second)
+	enqueued["p1-a"] = start.Add(2 * time.Second)
+	enqueued["p0-b"] = start.Add(4 * time.Second)
+	var results []<-chan error
+	for i, id := range []string{"p1-b", "p0-a", "p1-a", "p0-b"} {
+		results = append(results, handleAsync(context.Background(), c, id))
+		waitForPending(t, c, i+1)
+		clock.advance(time.Second)
+	}
+
+	c.flush(false)
+	assert.Empty(t, rec.delivered(), "nothing should be delivered before the window has passed")
+
+	clock.advance(time.Minute)
+	c.flush(false)
+	assert.Equal(t, []string{"p0-a", "p1-a", "p1-b", "p0-b"}, rec.delivered())
+	for _, result := range results {
+		assert.NoError(t, <-result)
+	}
+}
+
+func TestTimeOrderedConsumerHoldsRecentEvents(t *testing.T) {
+	rec := new(orderedRecorder)
+	c, clock, enqueued := newTestOrderedConsumer(10*time.Second, rec)
+	defer c.Close(context.Background())
+
+	start := clock.now
+	enqueued["old"] = start
+	enqueued["new"] = start.Add(20 * time.Second)
+	oldResult := handleAsync(context.Background(), c, "old")
+	waitForPending(t, c, 1)
+	clock.advance(15 * time.Second)
+	newResult := handleAsync(context.Background(), c, "new")
+	waitForPending(t, c, 2)
+
+	c.flush(false)
+	assert.Equal(t, []string{"old"}, rec.delivered(), "only the event held for the full window should be delivered")
+	assert.NoError(t, <-oldResult)
+
+	require.NoError(t, c.Close(context.Background()))
+	assert.Equal(t, []string{"old", "new"}, rec.delivered(), "close should deliver everything still held")
+	assert.NoError(t, <-newResult)
+}
+
+func TestTimeOrderedConsumerKeepsArrivalOrderForTies(t *testing.T) {
+	rec := new(orderedRecorder)
+	c, clock, enqueued := newTestOrderedConsumer(time.Second, rec)
+
+	var results []<-chan error
+	for i, id := range []string{"a", "b", "c"} {
+		enqueued[id] = clock.now
+		results = append(results, handleAsync(context.Background(), c, id))
+		waitForPending(t, c, i+1)
+	}
+
+	require.NoError(t, c.Close(context.Background()))
+	assert.Equal(t, []string{"a", "b", "c"}, rec.delivered())
+	for _, result := range results {
+		assert.NoError(t, <-result)
+	}
+}
+
+func TestTimeOrderedConsumerReturnsHandlerError(t *testing.T) {
+	rec := &orderedRecorder{fail: map[string]error{"bad": errors.New("boom")}}
+	c, _, _ := newTestOrderedConsumer(0, rec)
+
+	assert.NoError(t, c.Handle(context.Background(), &eventhub.Event{ID: "good"}))
+	assert.EqualError(t, c.Handle(context.Background(), &eventhub.Event{ID: "bad"}), "boom")
+}
+
+func TestTimeOrderedConsumerDeliversWithCallersContext(t *testing.T) {
+	type ctxKey struct{}
+	var got interface{}
+	c := newTimeOrderedConsumer(0, func(ctx context.Context, event *eventhub.Event) error {
+		got = ctx.Value(ctxKey{})
+		return nil
+	})
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "receiver")
+	require.NoError(t, c.Handle(ctx, &eventhub.Event{ID: "a"}))
+	assert.Equal(t, "receiver", got)
+}
+
+func TestTimeOrderedConsumerDropsCancelledEvents(t *testing.T) {
+	rec := new(orderedRecorder)
+	c, clock, enqueued := newTestOrderedConsumer(time.Minute, rec)
+
+	enqueued["kept"] = clock.now.Add(time.Second)
+	enqueued["cancelled"] = clock.now
+	kept := handleAsync(context.Background(), c, "kept")
+	waitForPending(t, c, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled := handleAsync(ctx, c, "cancelled")
+	waitForPending(t, c, 2)
+	cancel()
+	assert.Equal(t, context.Canceled, <-cancelled)
+
+	clock.advance(time.Minute)
+	c.flush(false)
+	assert.NoError(t, <-kept)
+	assert.Equal(t, []string{"kept"}, rec.delivered(), "the cancelled event should not be delivered")
+}
+
+func handleAsync(ctx context.Context, c *TimeOrderedConsumer, id string) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- c.Handle(ctx, &eventhub.Event{ID: id})
+	}()
+	return result
+}
+
+// waitForPending waits until n events have been handed to the consumer, since Handle blocks until delivery
+func waitForPending(t *testing.T, c *TimeOrderedConsumer, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		arrivals := c.arrivals
+		c.mu.Unlock()
+		if arrivals >= uint64(n) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d events to be handled", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type testClock struct {
+	now time.Time
+	mu  sync.Mutex
+}
+
+func (tc *testClock) advance(d time.Duration) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.now = tc.now.Add(d)
+}
+
+func (tc *testClock) get() time.Time {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.now
+}
+
+func newTestOrderedConsumer(window time.Duration, rec *orderedRecorder) (*TimeOrderedConsumer, *testClock, map[string]time.Time) {
+	clock := &testClock{now: time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)}
+	enqueued := make(map[string]time.Time)
+	// the flush loop isn't started so the tests control when events are released
+	c := newTimeOrderedConsumer(window, rec.handle)
+	c.now = clock.get
+	c.enqueuedTime = func(event *eventhub.Event) time.Time {
+		return enqueued[event.ID]
+	}
+	return c, clock, enqueued
+}
+
+func (r *orderedRecorder) handle(ctx context.Context, event *eventhub.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ids = append(r.ids, event.ID)
+	return r.fail[event.ID]
+}
+
+func (r *orderedRecorder) delivered() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.ids...)
+}
@@ -0,0 +1,71 @@
+package eph
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Azure/azure-event-hubs-go"
+)
+
+type (
+	// PartitionPump receives the events of a single partition and passes them to a handler until it is closed
+	PartitionPump interface {
+		// Done is closed when the pump stops receiving, such as when its receiver is disconnected by a newer epoch
+		Done() <-chan struct{}
+		Close(ctx context.Context) error
+	}
+
+	// PumpFactory starts a PartitionPump for a partition whose lease this host has acquired. The pump should pass each
+	// event it receives to handler, which dispatches to all of the registered handlers, and should use the epoch of the
+	// lease so it is disconnected if another host acquires the partition.
+	PumpFactory func(ctx context.Context, lease LeaseMarker, handler eventhub.Handler) (PartitionPump, error)
+)
+
+// WithPumpFactory configures how the EventProcessorHost starts receiving from each partition it owns. By default, a
+// receiver is opened on the Event Hub with the lease's epoch. This allows tests to substitute pumps which replay canned
+// events, and allows custom receive strategies.
+func WithPumpFactory(factory PumpFactory) EventProcessorHostOption {
+	return func(host *EventProcessorHost) error {
+		if factory == nil {
+			return errors.New("pump factory must not be nil")
+		}
+		host.pumpFactory = factory
+		return nil
+	}
+}
+
+// startPump starts the PartitionPump for the lease using the configured PumpFactory, or by receiving from the Event
+// Hub if there isn't one
+func (h *EventProcessorHost) startPump(ctx context.Context, lease LeaseMarker, handler eventhub.Handler) (PartitionPump, error) {
+	if h.pumpFactory != nil {
+		return h.pumpFactory(ctx, lease, handler)
+	}
+
+	handle, err := h.client.Receive(ctx, lease.GetPartitionID(), handler, eventhub.ReceiveWithEpoch(lease.GetEpoch()))
+	if err != nil {
+		return nil, err
+	}
+	return handle, nil
+}
@@ -0,0 +1,108 @@
+package eph
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-event-hubs-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	scriptedPump struct {
+		done      chan struct{}
+		closeOnce sync.Once
+	}
+)
+
+func TestPumpFactoryFeedsScriptedEvents(t *testing.T) {
+	script := map[string][]string{
+		"0": {"a", "b", "c"},
+		"1": {"d", "e"},
+	}
+	factory := func(ctx context.Context, lease LeaseMarker, handler eventhub.Handler) (PartitionPump, error) {
+		pump := &scriptedPump{done: make(chan struct{})}
+		go func() {
+			for _, data := range script[lease.GetPartitionID()] {
+				event := eventhub.NewEventFromString(data)
+				event.ID = lease.GetPartitionID() + ":" + data
+				if err := handler(context.Background(), event); err != nil {
+					return
+				}
+			}
+		}()
+		return pump, nil
+	}
+
+	host := &EventProcessorHost{
+		name:         "scripted",
+		partitionIDs: []string{"0", "1"},
+		handlers:     make(map[string]eventhub.Handler),
+		noBanner:     true,
+	}
+	leaser := newMemoryLeaserCheckpointer(DefaultLeaseDuration, new(sharedStore))
+	host.leaser = leaser
+	host.checkpointer = leaser
+	require.NoError(t, WithPumpFactory(factory)(host))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(5)
+	received := make(map[string][]string)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := host.RegisterHandler(ctx, func(ctx context.Context, event *eventhub.Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		parts := strings.SplitN(event.ID, ":", 2)
+		received[parts[0]] = append(received[parts[0]], string(event.Data))
+		wg.Done()
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, host.StartNonBlocking(ctx))
+	waitUntil(t, &wg, 10*time.Second)
+	require.NoError(t, host.Close(ctx))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, script, received, "each partition's events should be handled in order")
+}
+
+func (p *scriptedPump) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *scriptedPump) Close(ctx context.Context) error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	return nil
+}
@@ -26,6 +26,7 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
@@ -104,6 +105,7 @@ func (s *scheduler) scan(ctx context.Context) {
 	cancel()
 	if err != nil {
 		log.For(ctx).Error(err)
+		s.recoverStore(ctx, err)
 		return
 	}
 
@@ -119,6 +121,7 @@ func (s *scheduler) scan(ctx context.Context) {
 	s.dlog(ctx, fmt.Sprintf("acquired: %v, not acquired: %v", acquired, notAcquired))
 	if err != nil {
 		log.For(ctx).Error(err)
+		s.recoverStore(ctx, err)
 		return
 	}
 
@@ -136,24 +139,22 @@ func (s *scheduler) scan(ctx context.Context) {
 		return
 	}
 
-	// calculate the number of leases we own including the newly acquired partitions
+	// gather the leases we own including the newly acquired partitions
 	byOwner := leasesByOwner(notAcquired)
-	var countOwnedByMe int
-	if val, ok := byOwner[s.processor.name]; ok {
-		countOwnedByMe = len(val)
-	}
-	countOwnedByMe += len(acquired)
+	var leasesOwnedByMe []LeaseMarker
+	leasesOwnedByMe = append(leasesOwnedByMe, byOwner[s.processor.GetOwnerIdentity()]...)
+	leasesOwnedByMe = append(leasesOwnedByMe, acquired...)
 
 	// gather all of the leases owned by others
 	var leasesOwnedByOthers []LeaseMarker
 	for key, value := range byOwner {
-		if key != s.processor.name {
+		if key != s.processor.GetOwnerIdentity() {
 			leasesOwnedByOthers = append(leasesOwnedByOthers, value...)
 		}
 	}
 
 	// try to steal work away from others if work has become imbalanced
-	if candidate, ok := s.leaseToSteal(ctx, leasesOwnedByOthers, countOwnedByMe); ok {
+	if candidate, ok := s.leaseToSteal(ctx, leasesOwnedByOthers, leasesOwnedByMe); ok && s.stillHeldByOwner(ctx, candidate) {
 		s.dlog(ctx, fmt.Sprintf("attempting to steal: %v", candidate))
 		acquireCtx, cancel := context.WithTimeout(ctx, timeout)
 		stolen, ok, err := s.processor.leaser.AcquireLease(acquireCtx, candidate.GetPartitionID())
@@ -161,12 +162,13 @@ func (s *scheduler) scan(ctx context.Context) {
 		switch {
 		case err != nil:
 			log.For(ctx).Error(err)
+			s.recoverStore(ctx, err)
 			break
 		case !ok:
 			s.dlog(ctx, fmt.Sprintf("failed to steal: %v", candidate))
 			break
 		default:
-			s.dlog(ctx, fmt.Sprintf("stole: %v", stolen))
+			s.dlog(ctx, fmt.Sprintf("stole (%v): %v", acquisitionKind(stolen), stolen))
 			if err := s.startReceiver(ctx, stolen); err != nil {
 				_, _ = s.processor.leaser.ReleaseLease(acquireCtx, candidate.GetPartitionID())
 				log.For(ctx).Error(err)
@@ -176,7 +178,9 @@ func (s *scheduler) scan(ctx context.Context) {
 	}
 }
 
-func (s *scheduler) Stop(ctx context.Context) error {
+// Stop closes all receivers and releases their leases. The final checkpoint of each partition, read after its receiver
+// has closed and before its lease is released, is returned in partition ID order.
+func (s *scheduler) Stop(ctx context.Context) ([]FinalCheckpoint, error) {
 	s.receiverMu.Lock()
 	defer s.receiverMu.Unlock()
 
@@ -189,14 +193,27 @@ func (s *scheduler) Stop(ctx context.Context) error {
 
 	// close all receivers even if errors occur reporting only the last error, but logging all
 	var lastErr error
+	finals := make([]FinalCheckpoint, 0, len(s.receivers))
 	for _, lr := range s.receivers {
 		if err := lr.Close(ctx); err != nil {
 			lastErr = err
 		}
-		_, _ = s.processor.leaser.ReleaseLease(ctx, lr.lease.GetPartitionID())
+
+		final := FinalCheckpoint{
+			PartitionID: lr.lease.GetPartitionID(),
+			Epoch:       lr.lease.GetEpoch(),
+		}
+		if s.processor.checkpointer != nil {
+			final.Checkpoint, _ = s.processor.checkpointer.GetCheckpoint(ctx, final.PartitionID)
+		}
+		_, final.Err = s.processor.leaser.ReleaseLease(ctx, final.PartitionID)
+		finals = append(finals, final)
 	}
 
-	return lastErr
+	sort.Slice(finals, func(i, j int) bool {
+		return finals[i].PartitionID < finals[j].PartitionID
+	})
+	return finals, lastErr
 }
 
 func (s *scheduler) getPartitionIDsBeingProcessed() []string {
@@ -271,6 +288,9 @@ func (s *scheduler) acquireExpiredLeases(ctx context.Context, leases []LeaseMark
 			acquireCtx, cancel := context.WithTimeout(ctx, timeout)
 			if acquiredLease, ok, err := s.processor.leaser.AcquireLease(acquireCtx, lease.GetPartitionID()); ok {
 				cancel()
+				if acquisitionKind(acquiredLease) == KindChanged {
+					s.dlog(ctx, fmt.Sprintf("changed expired lease away from %q: %v", lease.GetOwner(), acquiredLease))
+				}
 				acquired = append(acquired, acquiredLease)
 			} else {
 				cancel()
@@ -287,19 +307,51 @@ func (s *scheduler) acquireExpiredLeases(ctx context.Context, leases []LeaseMark
 	return acquired, notAcquired, nil
 }
 
+// recoverStore ensures the lease store exists again if err shows it was not found, such as after the container was
+// deleted while the host was running, so the next scan can succeed
+func (s *scheduler) recoverStore(ctx context.Context, err error) {
+	if err != ErrStoreNotFound {
+		return
+	}
+
+	s.dlog(ctx, "lease store not found; ensuring it exists")
+	ensureCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := s.processor.leaser.EnsureStore(ensureCtx); err != nil {
+		log.For(ctx).Error(err)
+	}
+}
+
 func (s *scheduler) dlog(ctx context.Context, msg string) {
 	name := s.processor.name
 	log.For(ctx).Debug(fmt.Sprintf("eph %q: "+msg, name))
 }
 
-func (s *scheduler) leaseToSteal(ctx context.Context, candidates []LeaseMarker, myLeaseCount int) (LeaseMarker, bool) {
+// stillHeldByOwner checks the lease to steal hasn't changed hands since the leases were listed. If it has, back off
+// until the next scan rather than stealing based on stale ownership.
+func (s *scheduler) stillHeldByOwner(ctx context.Context, candidate LeaseMarker) bool {
+	checker, ok := candidate.(LeaseHolderChecker)
+	if !ok || checker.IsHeldBy(ctx, candidate.GetOwner()) {
+		return true
+	}
+	s.dlog(ctx, fmt.Sprintf("not stealing lease which is no longer held by %q: %v", candidate.GetOwner(), candidate))
+	return false
+}
+
+func (s *scheduler) leaseToSteal(ctx context.Context, candidates []LeaseMarker, myLeases []LeaseMarker) (LeaseMarker, bool) {
 	span, ctx := s.startConsumerSpanFromContext(ctx, "eph.scheduler.leaseToSteal")
 	defer span.Finish()
 
+	if tb := s.processor.throughput; tb != nil {
+		tb.sample(ctx, s.processor.client, s.processor.GetPartitionIDs())
+		return tb.leaseToSteal(candidates, myLeases)
+	}
+
+	myLeaseCount := len(myLeases)
 	biggestOwner := ownerWithMostLeases(candidates)
-	if biggestOwner != nil && s.processor.GetName() != biggestOwner.Owner {
+	if biggestOwner != nil && s.processor.GetOwnerIdentity() != biggestOwner.Owner {
 		leasesByOwner := leasesByOwner(candidates)
-		log.For(ctx).Debug(fmt.Sprintf("i am %v, the biggest owner is %v and leases by owner: %v", s.processor.GetName(), biggestOwner.Owner, leasesByOwner))
+		log.For(ctx).Debug(fmt.Sprintf("i am %v, the biggest owner is %v and leases by owner: %v", s.processor.GetOwnerIdentity(), biggestOwner.Owner, leasesByOwner))
 		if leasesByOwner[biggestOwner.Owner] != nil &&
 			(len(biggestOwner.Leases)-myLeaseCount) >= 2 && len(leasesByOwner[biggestOwner.Owner]) >= 1 {
 			selection := rand.Intn(len(leasesByOwner[biggestOwner.Owner]))
@@ -309,6 +361,13 @@ func (s *scheduler) leaseToSteal(ctx context.Context, candidates []LeaseMarker,
 	return nil, false
 }
 
+func acquisitionKind(lease LeaseMarker) AcquisitionKind {
+	if getter, ok := lease.(AcquisitionKindGetter); ok {
+		return getter.GetAcquisitionKind()
+	}
+	return KindAcquired
+}
+
 func ownerWithMostLeases(candidates []LeaseMarker) *ownerCount {
 	var largest *ownerCount
 	for key, value := range leasesByOwner(candidates) {
@@ -0,0 +1,112 @@
+package eph
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/persist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedulerStopReportsFinalCheckpoints(t *testing.T) {
+	host := &EventProcessorHost{name: "me"}
+	leaser := newMemoryLeaserCheckpointer(DefaultLeaseDuration, new(sharedStore))
+	host.leaser = leaser
+	host.checkpointer = leaser
+	leaser.SetEventHostProcessor(host)
+	s := newScheduler(host)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, leaser.EnsureStore(ctx))
+
+	checkpoints := map[string]persist.Checkpoint{
+		"1": persist.NewCheckpoint("2048", 20, time.Now()),
+		"0": persist.NewCheckpoint("1024", 10, time.Now()),
+	}
+	for partitionID, checkpoint := range checkpoints {
+		_, err := leaser.EnsureLease(ctx, partitionID)
+		require.NoError(t, err)
+		lease, ok, err := leaser.AcquireLease(ctx, partitionID)
+		require.NoError(t, err)
+		require.True(t, ok, "should have acquired")
+		require.NoError(t, leaser.UpdateCheckpoint(ctx, partitionID, checkpoint))
+		s.receivers[partitionID] = newLeasedReceiver(host, lease)
+	}
+
+	finals, err := s.Stop(ctx)
+	require.NoError(t, err)
+	require.Len(t, finals, 2)
+	for idx, partitionID := range []string{"0", "1"} {
+		final := finals[idx]
+		assert.Equal(t, partitionID, final.PartitionID, "should be ordered by partition ID")
+		assert.Equal(t, checkpoints[partitionID].SequenceNumber, final.Checkpoint.SequenceNumber)
+		assert.Equal(t, int64(1), final.Epoch)
+		assert.NoError(t, final.Err, "the lease should have been released")
+
+		stored := leaser.store.getLease(partitionID)
+		require.NotNil(t, stored.Checkpoint)
+		assert.Equal(t, final.Checkpoint.SequenceNumber, stored.Checkpoint.SequenceNumber, "the reported checkpoint should be the persisted one")
+	}
+	assert.Empty(t, leaser.leases)
+}
+
+// missingStoreLeaser reports its store as missing until EnsureStore is called
+type missingStoreLeaser struct {
+	*memoryLeaserCheckpointer
+	ensured int32
+}
+
+func (m *missingStoreLeaser) EnsureStore(ctx context.Context) error {
+	atomic.AddInt32(&m.ensured, 1)
+	return m.memoryLeaserCheckpointer.EnsureStore(ctx)
+}
+
+func (m *missingStoreLeaser) GetLeases(ctx context.Context) ([]LeaseMarker, error) {
+	if atomic.LoadInt32(&m.ensured) == 0 {
+		return nil, ErrStoreNotFound
+	}
+	return m.memoryLeaserCheckpointer.GetLeases(ctx)
+}
+
+func TestSchedulerScanEnsuresMissingStore(t *testing.T) {
+	host := &EventProcessorHost{name: "me"}
+	leaser := &missingStoreLeaser{memoryLeaserCheckpointer: newMemoryLeaserCheckpointer(DefaultLeaseDuration, new(sharedStore))}
+	host.leaser = leaser
+	host.checkpointer = leaser
+	leaser.SetEventHostProcessor(host)
+	s := newScheduler(host)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.scan(ctx)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&leaser.ensured), "the scheduler should ensure the store after it was not found")
+
+	s.scan(ctx)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&leaser.ensured), "the store should only be ensured when it is missing")
+}
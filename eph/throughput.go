@@ -0,0 +1,163 @@
+package eph
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/log"
+	"github.com/Azure/azure-event-hubs-go"
+)
+
+type (
+	// ThroughputSource provides the partition runtime information used to estimate the throughput of each partition
+	ThroughputSource interface {
+		GetPartitionInformation(ctx context.Context, partitionID string) (*eventhub.HubPartitionRuntimeInformation, error)
+	}
+
+	throughputBalancer struct {
+		source  ThroughputSource
+		samples map[string]throughputSample
+		rates   map[string]float64
+		mu      sync.Mutex
+	}
+
+	throughputSample struct {
+		sequenceNumber int64
+		sampledAt      time.Time
+	}
+)
+
+// WithThroughputAwareBalancing configures the EventProcessorHost to balance partitions by their recent throughput
+// rather than only by count, so a single host doesn't end up with all of the heavy partitions.
+//
+// Throughput is estimated from the change in the last enqueued sequence number of each partition between scans. If
+// source is nil, the EventProcessorHost's own Event Hub client is used.
+func WithThroughputAwareBalancing(source ThroughputSource) EventProcessorHostOption {
+	return func(host *EventProcessorHost) error {
+		host.throughput = newThroughputBalancer(source)
+		return nil
+	}
+}
+
+func newThroughputBalancer(source ThroughputSource) *throughputBalancer {
+	return &throughputBalancer{
+		source:  source,
+		samples: make(map[string]throughputSample),
+		rates:   make(map[string]float64),
+	}
+}
+
+// sample fetches the last enqueued sequence number of each partition and updates the estimated rate of events
+func (tb *throughputBalancer) sample(ctx context.Context, source ThroughputSource, partitionIDs []string) {
+	if tb.source != nil {
+		source = tb.source
+	}
+
+	for _, partitionID := range partitionIDs {
+		infoCtx, cancel := context.WithTimeout(ctx, timeout)
+		info, err := source.GetPartitionInformation(infoCtx, partitionID)
+		cancel()
+		if err != nil {
+			log.For(ctx).Error(err)
+			continue
+		}
+		tb.record(partitionID, info.LastSequenceNumber, time.Now())
+	}
+}
+
+func (tb *throughputBalancer) record(partitionID string, sequenceNumber int64, sampledAt time.Time) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	if last, ok := tb.samples[partitionID]; ok {
+		elapsed := sampledAt.Sub(last.sampledAt).Seconds()
+		if elapsed > 0 && sequenceNumber >= last.sequenceNumber {
+			tb.rates[partitionID] = float64(sequenceNumber-last.sequenceNumber) / elapsed
+		}
+	}
+	tb.samples[partitionID] = throughputSample{
+		sequenceNumber: sequenceNumber,
+		sampledAt:      sampledAt,
+	}
+}
+
+// weights returns the throughput of each lease relative to the mean throughput of all the leases. If every partition
+// has the same throughput, or none has been sampled yet, each lease weighs 1 and balancing degrades to balancing by count.
+func (tb *throughputBalancer) weights(leases []LeaseMarker) map[string]float64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	var total float64
+	for _, lease := range leases {
+		total += tb.rates[lease.GetPartitionID()]
+	}
+
+	weights := make(map[string]float64, len(leases))
+	for _, lease := range leases {
+		weight := 1.0
+		if total > 0 {
+			weight = tb.rates[lease.GetPartitionID()] * float64(len(leases)) / total
+		}
+		weights[lease.GetPartitionID()] = weight
+	}
+	return weights
+}
+
+// leaseToSteal picks the heaviest lease of the most loaded owner which can be moved to this host without leaving this
+// host more loaded than the owner it was taken from
+func (tb *throughputBalancer) leaseToSteal(candidates []LeaseMarker, myLeases []LeaseMarker) (LeaseMarker, bool) {
+	all := make([]LeaseMarker, 0, len(candidates)+len(myLeases))
+	all = append(all, candidates...)
+	all = append(all, myLeases...)
+	weights := tb.weights(all)
+
+	var myLoad float64
+	for _, lease := range myLeases {
+		myLoad += weights[lease.GetPartitionID()]
+	}
+
+	var biggest []LeaseMarker
+	biggestLoad := -1.0
+	for _, leases := range leasesByOwner(candidates) {
+		var load float64
+		for _, lease := range leases {
+			load += weights[lease.GetPartitionID()]
+		}
+		if load > biggestLoad {
+			biggest = leases
+			biggestLoad = load
+		}
+	}
+
+	var selected LeaseMarker
+	for _, lease := range biggest {
+		weight := weights[lease.GetPartitionID()]
+		if myLoad+weight <= biggestLoad-weight && (selected == nil || weight > weights[selected.GetPartitionID()]) {
+			selected = lease
+		}
+	}
+	return selected, selected != nil
+}
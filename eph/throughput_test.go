@@ -0,0 +1,78 @@
+package eph
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThroughputBalancerSpreadsHeavyPartitions(t *testing.T) {
+	tb := newThroughputBalancer(nil)
+	recordRate(tb, "0", 100)
+	recordRate(tb, "1", 100)
+	recordRate(tb, "2", 0)
+	recordRate(tb, "3", 0)
+
+	// the other host owns both heavy partitions, so even though the count is balanced one of them should move
+	others := []LeaseMarker{ownedLease("0", "other"), ownedLease("1", "other")}
+	mine := []LeaseMarker{ownedLease("2", "me"), ownedLease("3", "me")}
+	stolen, ok := tb.leaseToSteal(others, mine)
+	require.True(t, ok, "should steal a heavy partition")
+	assert.Contains(t, []string{"0", "1"}, stolen.GetPartitionID())
+
+	// once the heavy partitions are split across the hosts, the load is balanced and nothing should move
+	others = []LeaseMarker{ownedLease("1", "other")}
+	mine = []LeaseMarker{ownedLease("0", "me"), ownedLease("2", "me"), ownedLease("3", "me")}
+	_, ok = tb.leaseToSteal(others, mine)
+	assert.False(t, ok, "shouldn't steal when heavy partitions are already spread")
+}
+
+func TestThroughputBalancerFallsBackToCount(t *testing.T) {
+	tb := newThroughputBalancer(nil)
+
+	others := []LeaseMarker{ownedLease("0", "other"), ownedLease("1", "other"), ownedLease("2", "other")}
+	mine := []LeaseMarker{ownedLease("3", "me")}
+	_, ok := tb.leaseToSteal(others, mine)
+	assert.True(t, ok, "should steal when counts are imbalanced and there is no throughput data")
+
+	others = []LeaseMarker{ownedLease("0", "other"), ownedLease("1", "other")}
+	mine = []LeaseMarker{ownedLease("2", "me"), ownedLease("3", "me")}
+	_, ok = tb.leaseToSteal(others, mine)
+	assert.False(t, ok, "shouldn't steal when counts are balanced")
+}
+
+func recordRate(tb *throughputBalancer, partitionID string, perSecond int64) {
+	start := time.Now()
+	tb.record(partitionID, 0, start)
+	tb.record(partitionID, perSecond*10, start.Add(10*time.Second))
+}
+
+func ownedLease(partitionID, owner string) LeaseMarker {
+	lease := newMemoryLease(partitionID)
+	lease.Owner = owner
+	return lease
+}
@@ -23,6 +23,9 @@ package eventhub
 //	SOFTWARE
 
 import (
+	"errors"
+	"math"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-amqp-common-go/persist"
@@ -34,6 +37,10 @@ const (
 	partitionKeyAnnotationName string = "x-opt-partition-key"
 	sequenceNumberName         string = "x-opt-sequence-number"
 	enqueueTimeName            string = "x-opt-enqueued-time"
+
+	// maxPooledBatchBuffer is the largest encoded batch kept for reuse, so a single oversized batch doesn't pin its
+	// buffer for the life of the process
+	maxPooledBatchBuffer = 1024 * 1024
 )
 
 type (
@@ -53,6 +60,21 @@ type (
 		Properties   map[string]interface{}
 		ID           string
 	}
+
+	// batchBuffer holds the encoded events of an EventBatch. The events are encoded into one shared buffer, which is
+	// reused along with the slice referencing each event once the send using them has settled.
+	batchBuffer struct {
+		data    [][]byte
+		encoded []byte
+	}
+)
+
+var (
+	batchBuffers = sync.Pool{
+		New: func() interface{} {
+			return new(batchBuffer)
+		},
+	}
 )
 
 // NewEventFromString builds an Event from a string message
@@ -74,24 +96,13 @@ func NewEventBatch(events []*Event) *EventBatch {
 	}
 }
 
-// GetCheckpoint returns the checkpoint information on the Event
+// GetCheckpoint returns the checkpoint information on the Event. An Event which was not received from Event Hubs has no
+// system properties, so its checkpoint is empty.
 func (e *Event) GetCheckpoint() persist.Checkpoint {
-	var offset string
-	var enqueueTime time.Time
-	var sequenceNumber int64
-	if val, ok := e.message.Annotations[offsetAnnotationName]; ok {
-		offset = val.(string)
+	if e.message == nil {
+		return persist.Checkpoint{}
 	}
-
-	if val, ok := e.message.Annotations[enqueueTimeName]; ok {
-		enqueueTime = val.(time.Time)
-	}
-
-	if val, ok := e.message.Annotations[sequenceNumberName]; ok {
-		sequenceNumber = val.(int64)
-	}
-
-	return persist.NewCheckpoint(offset, sequenceNumber, enqueueTime)
+	return checkpointFromMsg(e.message)
 }
 
 // Set implements opentracing.TextMapWriter and sets properties on the event to be propagated to the message broker
@@ -139,27 +150,101 @@ func (e *Event) toMsg() *amqp.Message {
 	return msg
 }
 
-func (b *EventBatch) toEvent() (*Event, error) {
-	msg := &amqp.Message{
-		Data: make([][]byte, len(b.Events)),
-		Properties: &amqp.MessageProperties{
-			MessageID: b.ID,
-		},
-		Format: batchMessageFormat,
+// toEvent encodes the events of the batch into buf, which the returned Event references until it is released
+func (b *EventBatch) toEvent(buf *batchBuffer) (*Event, error) {
+	size := 0
+	for _, event := range b.Events {
+		size += dataSectionSize(len(event.Data))
+	}
+	// sizing the buffer up front means appending never reallocates it, so the slices taken from it stay valid
+	if cap(buf.encoded) < size {
+		buf.encoded = make([]byte, 0, size)
+	}
+	if cap(buf.data) < len(b.Events) {
+		buf.data = make([][]byte, len(b.Events))
 	}
+	buf.data = buf.data[:len(b.Events)]
 
+	encoded := buf.encoded[:0]
 	for idx, event := range b.Events {
-		innerMsg := amqp.NewMessage(event.Data)
-		bin, err := innerMsg.MarshalBinary()
+		start := len(encoded)
+		var err error
+		encoded, err = appendDataSection(encoded, event.Data)
 		if err != nil {
 			return nil, err
 		}
-		msg.Data[idx] = bin
+		buf.data[idx] = encoded[start:len(encoded):len(encoded)]
 	}
+	buf.encoded = encoded
 
+	msg := &amqp.Message{
+		Data: buf.data,
+		Properties: &amqp.MessageProperties{
+			MessageID: b.ID,
+		},
+		Format: batchMessageFormat,
+	}
 	return eventFromMsg(msg), nil
 }
 
+// release returns the buffer to the pool. It must only be called once nothing references the encoded events.
+func (buf *batchBuffer) release() {
+	if cap(buf.encoded) > maxPooledBatchBuffer {
+		return
+	}
+	for idx := range buf.data {
+		buf.data[idx] = nil
+	}
+	buf.data = buf.data[:0]
+	buf.encoded = buf.encoded[:0]
+	batchBuffers.Put(buf)
+}
+
+// dataSectionSize returns the size of an AMQP message holding only a data section of n bytes
+func dataSectionSize(n int) int {
+	if n <= math.MaxUint8 {
+		return 5 + n
+	}
+	return 8 + n
+}
+
+// appendDataSection appends data encoded as an AMQP message holding only a data section, which is how
+// amqp.NewMessage(data).MarshalBinary() encodes it, without allocating a buffer per message
+func appendDataSection(dst, data []byte) ([]byte, error) {
+	// the described type code of an application data section
+	dst = append(dst, 0x00, 0x53, 0x75)
+
+	n := len(data)
+	switch {
+	case n <= math.MaxUint8:
+		dst = append(dst, 0xa0, byte(n))
+	case uint64(n) <= math.MaxUint32:
+		dst = append(dst, 0xb0, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	default:
+		return nil, errors.New("event data is too large to encode")
+	}
+	return append(dst, data...), nil
+}
+
+func checkpointFromMsg(msg *amqp.Message) persist.Checkpoint {
+	var offset string
+	var enqueueTime time.Time
+	var sequenceNumber int64
+	if val, ok := msg.Annotations[offsetAnnotationName]; ok {
+		offset = val.(string)
+	}
+
+	if val, ok := msg.Annotations[enqueueTimeName]; ok {
+		enqueueTime = val.(time.Time)
+	}
+
+	if val, ok := msg.Annotations[sequenceNumberName]; ok {
+		sequenceNumber = val.(int64)
+	}
+
+	return persist.NewCheckpoint(offset, sequenceNumber, enqueueTime)
+}
+
 func eventFromMsg(msg *amqp.Message) *Event {
 	return newEvent(msg.Data[0], msg)
 }
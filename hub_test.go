@@ -38,6 +38,7 @@ import (
 
 	"github.com/Azure/azure-amqp-common-go/aad"
 	"github.com/Azure/azure-amqp-common-go/auth"
+	"github.com/Azure/azure-amqp-common-go/persist"
 	"github.com/Azure/azure-amqp-common-go/sas"
 	"github.com/Azure/azure-amqp-common-go/uuid"
 	"github.com/Azure/azure-event-hubs-go/internal/test"
@@ -45,6 +46,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"pack.ag/amqp"
 )
 
 type (
@@ -571,6 +573,51 @@ func TestEnvironmentalCreation(t *testing.T) {
 	os.Unsetenv("EVENTHUB_NAME")
 }
 
+func (suite *eventHubSuite) TestGetPartitionRuntimeInfo() {
+	hub, cleanup := suite.RandomHub()
+	defer cleanup()
+	partitionID := (*hub.PartitionIds)[0]
+	client, closer := suite.newClient(suite.T(), *hub.Name, HubWithPartitionedSender(partitionID))
+	defer closer()
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	suite.Require().NoError(client.Send(ctx, NewEventFromString("Hello!")))
+	info, err := suite.getPartitionRuntimeInfo(ctx, *hub.Name, partitionID)
+	suite.Require().NoError(err)
+	suite.Equal(int64(0), info.LastSequenceNumber, "the send should have advanced the partition's tail")
+	suite.NotEmpty(info.LastEnqueuedOffset)
+
+	_, err = suite.getPartitionRuntimeInfo(ctx, *hub.Name, "nope")
+	suite.EqualError(err, fmt.Sprintf("partition %q does not exist in hub %q", "nope", *hub.Name))
+}
+
+// getPartitionRuntimeInfo fetches the last enqueued sequence number, offset and time of a partition, so tests can
+// assert that sends advanced the partition's tail. It isn't on test.BaseSuite, since that package can't import this one.
+func (suite *eventHubSuite) getPartitionRuntimeInfo(ctx context.Context, hubName, partitionID string) (*HubPartitionRuntimeInformation, error) {
+	connStr, err := suite.NamespaceConnectionString(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewHubFromConnectionString(connStr + ";EntityPath=" + hubName)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close(ctx)
+
+	hubInfo, err := client.GetRuntimeInformation(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range hubInfo.PartitionIDs {
+		if id == partitionID {
+			return client.GetPartitionInformation(ctx, partitionID)
+		}
+	}
+	return nil, fmt.Errorf("partition %q does not exist in hub %q", partitionID, hubName)
+}
+
 func (suite *eventHubSuite) newClient(t *testing.T, hubName string, opts ...HubOption) (*Hub, func()) {
 	provider, err := aad.NewJWTProvider(aad.JWTProviderWithEnvironmentVars(), aad.JWTProviderWithAzureEnvironment(&suite.Env))
 	if !suite.NoError(err) {
@@ -608,6 +655,200 @@ func waitUntil(t *testing.T, wg *sync.WaitGroup, d time.Duration) bool {
 	}
 }
 
+func TestListenerHandleEstimatedFlowState(t *testing.T) {
+	r := &receiver{
+		hub:           &Hub{name: "hub", namespace: &namespace{name: "ns"}},
+		consumerGroup: DefaultConsumerGroup,
+		partitionID:   "0",
+		prefetchCount: 10,
+	}
+	r.resetFlow()
+	handle := &ListenerHandle{r: r}
+
+	credit, unsettled := handle.EstimatedFlowState()
+	assert.Equal(t, uint32(10), credit)
+	assert.Equal(t, 0, unsettled)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages := make(chan delivery)
+	release := make(chan struct{})
+	go r.handleMessages(ctx, messages, func(context.Context, *amqp.Message) {
+		<-release
+	})
+
+	// receive three messages from the link, as listenForMessages does
+	deliveries := make([]delivery, 3)
+	for i := range deliveries {
+		deliveries[i] = delivery{msg: amqp.NewMessage([]byte("hello world")), generation: r.trackReceived()}
+	}
+	credit, unsettled = handle.EstimatedFlowState()
+	assert.Equal(t, uint32(7), credit)
+	assert.Equal(t, 3, unsettled)
+
+	// handing over the next message waits for the previous one to be settled
+	messages <- deliveries[0]
+	release <- struct{}{}
+	messages <- deliveries[1]
+	credit, unsettled = handle.EstimatedFlowState()
+	assert.Equal(t, uint32(8), credit)
+	assert.Equal(t, 2, unsettled)
+
+	// a new link starts with its full credit, and messages received on the old link aren't counted when they settle
+	r.resetFlow()
+	release <- struct{}{}
+	messages <- deliveries[2]
+	credit, unsettled = handle.EstimatedFlowState()
+	assert.Equal(t, uint32(10), credit)
+	assert.Equal(t, 0, unsettled)
+
+	r.trackReceived()
+	credit, unsettled = handle.EstimatedFlowState()
+	assert.Equal(t, uint32(9), credit)
+	assert.Equal(t, 1, unsettled)
+	release <- struct{}{}
+}
+
+func TestReceiverOffsetExpression(t *testing.T) {
+	hub := &Hub{
+		name:            "hub",
+		namespace:       &namespace{name: "ns"},
+		offsetPersister: persist.NewMemoryPersister(),
+	}
+	r := &receiver{hub: hub, consumerGroup: DefaultConsumerGroup, partitionID: "0"}
+
+	expr, err := r.getOffsetExpression()
+	require.NoError(t, err)
+	assert.Equal(t, "amqp.annotation.x-opt-offset >= '-1'", expr, "a partition without a checkpoint starts from the start of the stream")
+
+	require.NoError(t, hub.offsetPersister.Write("ns", "hub", DefaultConsumerGroup, "0", persist.NewCheckpoint("1024", 10, time.Now())))
+	expr, err = r.getOffsetExpression()
+	require.NoError(t, err)
+	assert.Equal(t, "amqp.annotation.x-opt-offset > '1024'", expr)
+
+	enqueued := time.Date(2018, 6, 1, 9, 0, 0, 0, time.UTC)
+	require.NoError(t, hub.offsetPersister.Write("ns", "hub", DefaultConsumerGroup, "0", persist.Checkpoint{EnqueueTime: enqueued}))
+	expr, err = r.getOffsetExpression()
+	require.NoError(t, err)
+	assert.Equal(t, "amqp.annotation.x-opt-enqueued-time > '1527843600000'", expr, "a checkpoint without an offset is positioned by enqueue time")
+}
+
+func TestBatchEncodingMatchesMarshalBinary(t *testing.T) {
+	var events []*Event
+	for _, size := range []int{0, 11, 255, 256, 70000} {
+		events = append(events, NewEvent([]byte(strings.Repeat("x", size))))
+	}
+	batch := NewEventBatch(events)
+
+	// encoding twice with the same buffer checks a reused buffer encodes the same as a new one
+	buf := new(batchBuffer)
+	for i := 0; i < 2; i++ {
+		event, err := batch.toEvent(buf)
+		require.NoError(t, err)
+		require.Len(t, event.message.Data, len(events))
+		for idx, e := range events {
+			expected, err := amqp.NewMessage(e.Data).MarshalBinary()
+			require.NoError(t, err)
+			assert.Equal(t, expected, event.message.Data[idx], "event %d should be encoded as amqp encodes it", idx)
+		}
+		assert.Equal(t, batchMessageFormat, event.message.Format)
+	}
+}
+
+func BenchmarkSendBatchBuffers(b *testing.B) {
+	events := make([]*Event, 100)
+	for idx := range events {
+		events[idx] = NewEventFromString("hello world")
+	}
+	batch := NewEventBatch(events)
+
+	b.Run("Pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf := batchBuffers.Get().(*batchBuffer)
+			if _, err := batch.toEvent(buf); err != nil {
+				b.Fatal(err)
+			}
+			buf.release()
+		}
+	})
+
+	// the encoding SendBatch used before the buffers were pooled, marshaling a new message for each event
+	b.Run("MarshalBinary", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			msg := &amqp.Message{
+				Data:       make([][]byte, len(batch.Events)),
+				Properties: &amqp.MessageProperties{MessageID: batch.ID},
+				Format:     batchMessageFormat,
+			}
+			for idx, event := range batch.Events {
+				bin, err := amqp.NewMessage(event.Data).MarshalBinary()
+				if err != nil {
+					b.Fatal(err)
+				}
+				msg.Data[idx] = bin
+			}
+			_ = eventFromMsg(msg)
+		}
+	})
+}
+
+// BenchmarkHandleMessage and BenchmarkHandleRawMessage compare the receive paths of Listen and ListenRaw for a
+// handler which accepts every message, using the global tracer. Only settling on the link is left out.
+func BenchmarkHandleMessage(b *testing.B) {
+	r := newBenchmarkReceiver()
+	msg := newBenchmarkMessage()
+	handler := func(context.Context, *Event) error { return nil }
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.handleMessage(ctx, msg, handler)
+	}
+}
+
+func BenchmarkHandleRawMessage(b *testing.B) {
+	r := newBenchmarkReceiver()
+	msg := newBenchmarkMessage()
+	handler := func(context.Context, *amqp.Message) error { return nil }
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.handleRawMessage(ctx, msg, handler)
+	}
+}
+
+func newBenchmarkReceiver() *receiver {
+	return &receiver{
+		hub: &Hub{
+			name:            "hub",
+			namespace:       &namespace{name: "ns"},
+			offsetPersister: persist.NewMemoryPersister(),
+		},
+		consumerGroup: DefaultConsumerGroup,
+		partitionID:   "0",
+		settle:        func(*amqp.Message, bool) {},
+	}
+}
+
+func newBenchmarkMessage() *amqp.Message {
+	msg := amqp.NewMessage([]byte("hello world"))
+	msg.Properties = &amqp.MessageProperties{
+		MessageID: "some-id",
+	}
+	msg.ApplicationProperties = map[string]interface{}{
+		"foo": "bar",
+	}
+	msg.Annotations = amqp.Annotations{
+		offsetAnnotationName: "4096",
+		sequenceNumberName:   int64(42),
+		enqueueTimeName:      time.Now(),
+	}
+	return msg
+}
+
 func fmtDuration(d time.Duration) string {
 	d = d.Round(time.Second) / time.Second
 	return fmt.Sprintf("%d seconds", d)
@@ -24,20 +24,27 @@ package test
 
 import (
 	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-amqp-common-go"
 	mgmt "github.com/Azure/azure-sdk-for-go/services/eventhub/mgmt/2017-04-01/eventhub"
 	rm "github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2017-05-10/resources"
+	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/azure"
 	azauth "github.com/Azure/go-autorest/autorest/azure/auth"
-	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/opentracing/opentracing-go"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/suite"
 	"github.com/uber/jaeger-client-go"
@@ -46,19 +53,27 @@ import (
 )
 
 var (
-	letterRunes = []rune("abcdefghijklmnopqrstuvwxyz123456789")
-	debug       = flag.Bool("debug", false, "output debug level logging")
+	letterRunes    = []rune("abcdefghijklmnopqrstuvwxyz123456789")
+	debug          = flag.Bool("debug", false, "output debug level logging")
+	listRetryDelay = 1 * time.Second
 )
 
 const (
+	// defaultTimeout bounds management operations unless overridden by the TEST_TIMEOUT environment variable, which is
+	// parsed by time.ParseDuration (e.g. "90s" or "5m")
 	defaultTimeout = 1 * time.Minute
+
+	// hubNamePrefix starts the name of every hub created by the test suite
+	hubNamePrefix = "goehtest"
 )
 
 const (
-	// Location is the Azure geographic location the test suite will use for provisioning
+	// Location is the default Azure geographic location the test suite will use for provisioning. It can be overridden
+	// with the AZURE_LOCATION environment variable.
 	Location = "eastus"
 
-	// ResourceGroupName is the name of the resource group the test suite will use for provisioning
+	// ResourceGroupName is the default name of the resource group the test suite will use for provisioning. It can be
+	// overridden with the AZURE_RESOURCE_GROUP environment variable so concurrent runs don't share a resource group.
 	ResourceGroupName = "ehtest"
 )
 
@@ -68,9 +83,27 @@ type (
 		suite.Suite
 		SubscriptionID string
 		Namespace      string
+		Location       string
+		ResourceGroup  string
+		SkuTier        mgmt.SkuTier
+		Timeout        time.Duration
+		NamespaceOpts  []NamespaceMgmtOption
 		Env            azure.Environment
 		TagID          string
 		closer         io.Closer
+
+		consumerGroupsMu sync.Mutex
+		consumerGroups   map[string][]string
+
+		connStrMu sync.Mutex
+		connStr   string
+	}
+
+	// ServicePrincipal holds an explicit client secret credential for authenticating management operations
+	ServicePrincipal struct {
+		ClientID     string
+		ClientSecret string
+		TenantID     string
 	}
 
 	// HubMgmtOption represents an option for configuring an Event Hub.
@@ -80,7 +113,13 @@ type (
 )
 
 func init() {
-	rand.Seed(time.Now().Unix())
+	// seed from crypto/rand so processes launched in the same instant don't generate the same resource names
+	var seed [8]byte
+	if _, err := cryptorand.Read(seed[:]); err != nil {
+		rand.Seed(time.Now().UnixNano() ^ int64(os.Getpid()))
+		return
+	}
+	rand.Seed(int64(binary.LittleEndian.Uint64(seed[:])))
 }
 
 // SetupSuite constructs the test suite from the environment and
@@ -95,6 +134,25 @@ func (suite *BaseSuite) SetupSuite() {
 	envName := os.Getenv("AZURE_ENVIRONMENT")
 	suite.TagID = RandomString("tag", 5)
 
+	suite.Location = os.Getenv("AZURE_LOCATION")
+	if suite.Location == "" {
+		suite.Location = Location
+	}
+
+	suite.Timeout = defaultTimeout
+	if timeout := os.Getenv("TEST_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if !suite.NoError(err) || d <= 0 {
+			suite.FailNow("TEST_TIMEOUT must be a positive duration such as \"90s\" or \"5m\"")
+		}
+		suite.Timeout = d
+	}
+
+	suite.ResourceGroup = os.Getenv("AZURE_RESOURCE_GROUP")
+	if suite.ResourceGroup == "" {
+		suite.ResourceGroup = ResourceGroupName
+	}
+
 	if envName == "" {
 		suite.Env = azure.PublicCloud
 	} else {
@@ -106,7 +164,15 @@ func (suite *BaseSuite) SetupSuite() {
 		suite.Env = env
 	}
 
-	if !suite.NoError(suite.ensureProvisioned(mgmt.SkuTierStandard)) {
+	if suite.SkuTier == "" {
+		suite.SkuTier = mgmt.SkuTierStandard
+	}
+
+	if os.Getenv("SKIP_PROVISIONING") == "true" {
+		if !suite.NoError(suite.verifyNamespaceExists()) {
+			suite.FailNow("SKIP_PROVISIONING is set, but the namespace could not be found")
+		}
+	} else if !suite.NoError(suite.ensureProvisioned(suite.SkuTier, suite.NamespaceOpts...)) {
 		suite.FailNow("failed provisioning")
 	}
 
@@ -118,7 +184,7 @@ func (suite *BaseSuite) SetupSuite() {
 // TearDownSuite might one day destroy all of the resources in the suite, but I'm not sure we want to do that just yet...
 func (suite *BaseSuite) TearDownSuite() {
 	// maybe tear down all existing resource??
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), suite.Timeout)
 	defer cancel()
 	suite.deleteAllTaggedEventHubs(ctx)
 	if suite.closer != nil {
@@ -126,16 +192,21 @@ func (suite *BaseSuite) TearDownSuite() {
 	}
 }
 
-// RandomHub creates a hub with a random'ish name
+// RandomHub creates a 4 partition hub with a random'ish name
 func (suite *BaseSuite) RandomHub(opts ...HubMgmtOption) (*mgmt.Model, func()) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout*2)
+	return suite.RandomHubWithPartitionCount(4, opts...)
+}
+
+// RandomHubWithPartitionCount creates a hub with a random'ish name and n partitions
+func (suite *BaseSuite) RandomHubWithPartitionCount(n int, opts ...HubMgmtOption) (*mgmt.Model, func()) {
+	ctx, cancel := context.WithTimeout(context.Background(), suite.Timeout*2)
 	defer cancel()
 
-	name := suite.RandomName("goehtest", 6)
-	model, err := suite.ensureEventHub(ctx, name, opts...)
+	name := suite.RandomName(hubNamePrefix, 6)
+	model, err := suite.ensureEventHub(ctx, name, append([]HubMgmtOption{HubWithPartitionCount(n)}, opts...)...)
 	suite.Require().NoError(err)
 	suite.Require().NotNil(model.PartitionIds)
-	suite.Require().Len(*model.PartitionIds, 4)
+	suite.Require().Len(*model.PartitionIds, n)
 	return model, func() {
 		if model != nil {
 			err := suite.DeleteEventHub(*model.Name)
@@ -148,8 +219,12 @@ func (suite *BaseSuite) RandomHub(opts ...HubMgmtOption) (*mgmt.Model, func()) {
 
 // EnsureEventHub creates an Event Hub if it doesn't exist
 func (suite *BaseSuite) ensureEventHub(ctx context.Context, name string, opts ...HubMgmtOption) (*mgmt.Model, error) {
-	client := suite.getEventHubMgmtClient()
-	hub, err := client.Get(ctx, ResourceGroupName, suite.Namespace, name)
+	client, err := suite.getEventHubMgmtClient()
+	if err != nil {
+		return nil, err
+	}
+
+	hub, err := client.Get(ctx, suite.ResourceGroup, suite.Namespace, name)
 
 	if err != nil {
 		newHub := &mgmt.Model{
@@ -166,6 +241,10 @@ func (suite *BaseSuite) ensureEventHub(ctx context.Context, name string, opts ..
 			}
 		}
 
+		if err := suite.validateHub(newHub); err != nil {
+			return nil, err
+		}
+
 		var lastErr error
 		deadline, _ := ctx.Deadline()
 		for time.Now().Before(deadline) {
@@ -180,16 +259,107 @@ func (suite *BaseSuite) ensureEventHub(ctx context.Context, name string, opts ..
 		if lastErr != nil {
 			return nil, lastErr
 		}
+
+		if err := suite.WaitForHubActive(ctx, name); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, group := range suite.takeConsumerGroups(name) {
+		if err := suite.EnsureConsumerGroup(ctx, name, group); err != nil {
+			return nil, err
+		}
 	}
 	return &hub, nil
 }
 
+// EnsureConsumerGroup creates a consumer group on the Event Hub if it does not already exist. Consumer groups are
+// removed along with their hub, so deleting the hub is all the teardown needed.
+func (suite *BaseSuite) EnsureConsumerGroup(ctx context.Context, hubName, groupName string) error {
+	client, err := suite.getConsumerGroupMgmtClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.CreateOrUpdate(ctx, suite.ResourceGroup, suite.Namespace, hubName, groupName, mgmt.ConsumerGroup{})
+	return err
+}
+
+// HubWithConsumerGroup creates the named consumer group once the Event Hub has been created
+func (suite *BaseSuite) HubWithConsumerGroup(groupName string) HubMgmtOption {
+	return func(model *mgmt.Model) error {
+		if model.Name == nil {
+			return errors.New("hub must be named before a consumer group can be added")
+		}
+
+		suite.consumerGroupsMu.Lock()
+		defer suite.consumerGroupsMu.Unlock()
+		if suite.consumerGroups == nil {
+			suite.consumerGroups = make(map[string][]string)
+		}
+		suite.consumerGroups[*model.Name] = append(suite.consumerGroups[*model.Name], groupName)
+		return nil
+	}
+}
+
+func (suite *BaseSuite) takeConsumerGroups(hubName string) []string {
+	suite.consumerGroupsMu.Lock()
+	defer suite.consumerGroupsMu.Unlock()
+	groups := suite.consumerGroups[hubName]
+	delete(suite.consumerGroups, hubName)
+	return groups
+}
+
+// WaitForHubActive polls the Event Hub with a bounded backoff until it reports an Active status or the context is
+// done. Newly created hubs are not always ready to accept AMQP connections as soon as creation returns.
+func (suite *BaseSuite) WaitForHubActive(ctx context.Context, name string) error {
+	client, err := suite.getEventHubMgmtClient()
+	if err != nil {
+		return err
+	}
+
+	delay := 500 * time.Millisecond
+	const maxDelay = 5 * time.Second
+	for {
+		hub, err := client.Get(ctx, suite.ResourceGroup, suite.Namespace, name)
+		if err == nil && hub.Properties != nil && hub.Status == mgmt.Active {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if err != nil {
+				return fmt.Errorf("hub %q did not become active: %v", name, err)
+			}
+			return fmt.Errorf("hub %q did not become active: %v", name, ctx.Err())
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}
+
+// validateHub fails early for hub configurations the provisioned namespace tier cannot support
+func (suite *BaseSuite) validateHub(hub *mgmt.Model) error {
+	if hub.Properties == nil || suite.SkuTier != mgmt.SkuTierBasic {
+		return nil
+	}
+
+	if hub.CaptureDescription != nil && hub.CaptureDescription.Enabled != nil && *hub.CaptureDescription.Enabled {
+		return fmt.Errorf("hub %q requests Capture, which is not available on a %s tier namespace; set SkuTier to %s", *hub.Name, suite.SkuTier, mgmt.SkuTierStandard)
+	}
+	return nil
+}
+
 func (suite *BaseSuite) tryHubCreate(ctx context.Context, client *mgmt.EventHubsClient, name string, hub *mgmt.Model) (mgmt.Model, error) {
 	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
 	defer cancel()
 
 	//suite.T().Logf("trying to create hub named %q", name)
-	createdHub, err := client.CreateOrUpdate(ctx, ResourceGroupName, suite.Namespace, name, *hub)
+	createdHub, err := client.CreateOrUpdate(ctx, suite.ResourceGroup, suite.Namespace, name, *hub)
 	if err != nil {
 		//suite.T().Logf("failed to create hub named %q", name)
 		return mgmt.Model{}, err
@@ -200,54 +370,170 @@ func (suite *BaseSuite) tryHubCreate(ctx context.Context, client *mgmt.EventHubs
 
 // DeleteEventHub deletes an Event Hub within the given Namespace
 func (suite *BaseSuite) DeleteEventHub(name string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), suite.Timeout)
 	defer cancel()
-	client := suite.getEventHubMgmtClient()
-	_, err := client.Delete(ctx, ResourceGroupName, suite.Namespace, name)
+	client, err := suite.getEventHubMgmtClient()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Delete(ctx, suite.ResourceGroup, suite.Namespace, name)
 	return err
 }
 
+type (
+	// hubPager is the subset of mgmt.ListResultPage used to enumerate hubs, allowing pagination to be tested offline
+	hubPager interface {
+		NotDone() bool
+		Values() []mgmt.Model
+		Next() error
+	}
+)
+
 func (suite *BaseSuite) deleteAllTaggedEventHubs(ctx context.Context) {
-	client := suite.getEventHubMgmtClient()
-	res, err := client.ListByNamespace(ctx, ResourceGroupName, suite.Namespace, to.Int32Ptr(0), to.Int32Ptr(20))
+	client, err := suite.getEventHubMgmtClient()
+	if err != nil {
+		suite.T().Log("error building the event hub management client")
+		suite.T().Error(err)
+		return
+	}
+
+	res, err := client.ListByNamespace(ctx, suite.ResourceGroup, suite.Namespace, nil, nil)
 	if err != nil {
-		suite.T().Log("error listing namespaces")
+		suite.T().Log("error listing event hubs")
 		suite.T().Error(err)
+		return
 	}
 
-	for res.NotDone() {
-		for _, val := range res.Values() {
-			if strings.Contains(*val.Name, suite.TagID) {
-				for i := 0; i < 5; i++ {
-					if _, err := client.Delete(ctx, ResourceGroupName, suite.Namespace, *val.Name); err != nil {
-						suite.T().Logf("error deleting %q", *val.Name)
-						suite.T().Error(err)
-						time.Sleep(3 * time.Second)
-					} else {
-						break
-					}
-				}
+	// collect every tagged hub before deleting any, so deletions can't shift the pages still to be listed
+	names, err := taggedHubNames(&res, suite.TagID)
+	if err != nil {
+		suite.T().Log("error listing event hubs; deleting the tagged hubs found so far")
+		suite.T().Error(err)
+	}
+
+	for _, name := range names {
+		for i := 0; i < 5; i++ {
+			if _, err := client.Delete(ctx, suite.ResourceGroup, suite.Namespace, name); err != nil {
+				suite.T().Logf("error deleting %q", name)
+				suite.T().Error(err)
+				time.Sleep(3 * time.Second)
 			} else {
-				suite.T().Logf("%q does not contain %q", *val.Name, suite.TagID)
+				break
+			}
+		}
+	}
+}
+
+// CleanupStaleResources deletes every hub in the namespace created by the test suite more than olderThan ago, whatever
+// run it was tagged with. This sweeps up hubs leaked by runs that died before tearing down. Since it deletes hubs
+// belonging to other runs, it refuses to run unless CLEANUP_STALE_RESOURCES=true is set.
+func (suite *BaseSuite) CleanupStaleResources(ctx context.Context, olderThan time.Duration) ([]string, error) {
+	if os.Getenv("CLEANUP_STALE_RESOURCES") != "true" {
+		return nil, errors.New("refusing to clean up stale resources unless CLEANUP_STALE_RESOURCES=true")
+	}
+
+	client, err := suite.getEventHubMgmtClient()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.ListByNamespace(ctx, suite.ResourceGroup, suite.Namespace, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := staleHubNames(&res, time.Now().Add(-olderThan))
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, name := range names {
+		if _, err := client.Delete(ctx, suite.ResourceGroup, suite.Namespace, name); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, name)
+	}
+	return deleted, nil
+}
+
+// taggedHubNames walks every page of hubs and returns the names of those tagged with tagID
+func taggedHubNames(pager hubPager, tagID string) ([]string, error) {
+	return hubNames(pager, func(hub mgmt.Model) bool {
+		return strings.Contains(*hub.Name, tagID)
+	})
+}
+
+// staleHubNames walks every page of hubs and returns the names of test hubs created before the cutoff
+func staleHubNames(pager hubPager, cutoff time.Time) ([]string, error) {
+	return hubNames(pager, func(hub mgmt.Model) bool {
+		return strings.HasPrefix(*hub.Name, hubNamePrefix) &&
+			hub.Properties != nil && hub.CreatedAt != nil && hub.CreatedAt.Before(cutoff)
+	})
+}
+
+// hubNames walks every page of hubs and returns the names of those matching. A failed page fetch is retried a few
+// times before giving up and returning the names collected so far.
+func hubNames(pager hubPager, match func(mgmt.Model) bool) ([]string, error) {
+	var names []string
+	for pager.NotDone() {
+		for _, val := range pager.Values() {
+			if val.Name != nil && match(val) {
+				names = append(names, *val.Name)
+			}
+		}
+
+		var err error
+		for i := 0; i < 3; i++ {
+			if err = pager.Next(); err == nil {
+				break
 			}
+			time.Sleep(time.Duration(i+1) * listRetryDelay)
+		}
+
+		if err != nil {
+			return names, err
 		}
-		res.Next()
 	}
+	return names, nil
 }
 
-func (suite *BaseSuite) ensureProvisioned(tier mgmt.SkuTier) error {
-	_, err := ensureResourceGroup(context.Background(), suite.SubscriptionID, ResourceGroupName, Location, suite.Env)
+func (suite *BaseSuite) ensureProvisioned(tier mgmt.SkuTier, opts ...NamespaceMgmtOption) error {
+	_, err := ensureResourceGroup(context.Background(), suite.SubscriptionID, suite.ResourceGroup, suite.Location, suite.Env)
 	if err != nil {
 		return err
 	}
 
-	_, err = suite.ensureNamespace()
-	return err
+	ns, err := suite.ensureNamespace(append([]NamespaceMgmtOption{NamespaceWithSkuTier(tier)}, opts...)...)
+	if err != nil {
+		return err
+	}
+
+	if ns.Sku != nil && ns.Sku.Tier != "" {
+		// the namespace may have already existed with a different tier than requested
+		suite.SkuTier = ns.Sku.Tier
+	}
+	return nil
+}
+
+// verifyNamespaceExists checks the namespace resolves without making any management plane calls, so a suite skipping
+// provisioning fails fast rather than timing out in the first test
+func (suite *BaseSuite) verifyNamespaceExists() error {
+	host := suite.Namespace + "." + suite.Env.ServiceBusEndpointSuffix
+	if _, err := net.LookupHost(host); err != nil {
+		return fmt.Errorf("namespace %q does not exist or is unreachable at %s: %v", suite.Namespace, host, err)
+	}
+	return nil
 }
 
 // ensureResourceGroup creates a Azure Resource Group if it does not already exist
 func ensureResourceGroup(ctx context.Context, subscriptionID, name, location string, env azure.Environment) (*rm.Group, error) {
-	groupClient := getRmGroupClientWithToken(subscriptionID, env)
+	groupClient, err := getRmGroupClientWithToken(subscriptionID, env)
+	if err != nil {
+		return nil, err
+	}
+
 	group, err := groupClient.Get(ctx, name)
 	if group.Response.Response == nil {
 		// tcp dial error or something else where the response was not populated
@@ -273,7 +559,11 @@ func ensureNamespace(ctx context.Context, subscriptionID, rg, name, location str
 		return nil, err
 	}
 
-	client := getNamespaceMgmtClientWithToken(subscriptionID, env)
+	client, err := getNamespaceMgmtClientWithToken(subscriptionID, env)
+	if err != nil {
+		return nil, err
+	}
+
 	namespace, err := client.Get(ctx, rg, name)
 	if err != nil {
 		return nil, err
@@ -301,6 +591,11 @@ func ensureNamespace(ctx context.Context, subscriptionID, rg, name, location str
 			}
 		}
 
+		props := newNamespace.EHNamespaceProperties
+		if props.IsAutoInflateEnabled != nil && *props.IsAutoInflateEnabled && newNamespace.Sku.Tier == mgmt.SkuTierBasic {
+			return nil, errors.New("auto-inflate is not available on a Basic tier namespace; use WithStandardTier")
+		}
+
 		nsFuture, err := client.CreateOrUpdate(ctx, rg, name, *newNamespace)
 		if err != nil {
 			return nil, err
@@ -317,18 +612,134 @@ func ensureNamespace(ctx context.Context, subscriptionID, rg, name, location str
 	return &namespace, nil
 }
 
-func (suite *BaseSuite) getEventHubMgmtClient() *mgmt.EventHubsClient {
+// NamespaceWithSkuTier configures the SKU tier of a Namespace when it is created. Only the Basic and Standard tiers
+// are available through the management API used by the test suite.
+func NamespaceWithSkuTier(tier mgmt.SkuTier) NamespaceMgmtOption {
+	return func(ns *mgmt.EHNamespace) error {
+		switch tier {
+		case mgmt.SkuTierBasic:
+			ns.Sku = &mgmt.Sku{Name: mgmt.Basic, Tier: mgmt.SkuTierBasic, Capacity: common.PtrInt32(1)}
+		case mgmt.SkuTierStandard:
+			ns.Sku = &mgmt.Sku{Name: mgmt.Standard, Tier: mgmt.SkuTierStandard, Capacity: common.PtrInt32(1)}
+		default:
+			return fmt.Errorf("unsupported namespace sku tier %q", tier)
+		}
+		return nil
+	}
+}
+
+// WithStandardTier configures a Namespace to be created in the Standard tier
+func WithStandardTier() NamespaceMgmtOption {
+	return NamespaceWithSkuTier(mgmt.SkuTierStandard)
+}
+
+// WithAutoInflate enables auto-inflate on a Namespace, allowing it to scale up to maxTU throughput units. Auto-inflate
+// requires the Standard tier.
+func WithAutoInflate(maxTU int32) NamespaceMgmtOption {
+	return func(ns *mgmt.EHNamespace) error {
+		if maxTU < 1 || maxTU > 20 {
+			return fmt.Errorf("maximum throughput units must be between 1 and 20; got %d", maxTU)
+		}
+		ns.IsAutoInflateEnabled = common.PtrBool(true)
+		ns.MaximumThroughputUnits = common.PtrInt32(maxTU)
+		return nil
+	}
+}
+
+// HubWithPartitionCount configures the number of partitions of an Event Hub when it is created
+func HubWithPartitionCount(count int) HubMgmtOption {
+	return func(model *mgmt.Model) error {
+		if count < 1 {
+			return errors.New("partition count must be at least 1")
+		}
+		model.PartitionCount = common.PtrInt64(int64(count))
+		return nil
+	}
+}
+
+// HubWithCapture enables Capture on an Event Hub, archiving events as Avro to the given container of the destination
+// storage account every 5 minutes or 300MB, whichever comes first. destStorageAccount is the ARM resource ID of the
+// storage account; see StorageAccountResourceID. The container must already exist and is left in place when the
+// suite tears down, since only the hub is owned by the suite.
+func HubWithCapture(destStorageAccount, container string) HubMgmtOption {
+	return func(model *mgmt.Model) error {
+		if destStorageAccount == "" || container == "" {
+			return errors.New("capture requires a destination storage account and container")
+		}
+
+		model.CaptureDescription = &mgmt.CaptureDescription{
+			Enabled:           common.PtrBool(true),
+			Encoding:          mgmt.Avro,
+			IntervalInSeconds: common.PtrInt32(300),
+			SizeLimitInBytes:  common.PtrInt32(300 * 1024 * 1024),
+			Destination: &mgmt.Destination{
+				Name: common.PtrString("EventHubArchive.AzureBlockBlob"),
+				DestinationProperties: &mgmt.DestinationProperties{
+					StorageAccountResourceID: common.PtrString(destStorageAccount),
+					BlobContainer:            common.PtrString(container),
+					ArchiveNameFormat:        common.PtrString("{Namespace}/{EventHub}/{PartitionId}/{Year}/{Month}/{Day}/{Hour}/{Minute}/{Second}"),
+				},
+			},
+		}
+		return nil
+	}
+}
+
+// StorageAccountResourceID builds the ARM resource ID of a storage account in the suite's resource group
+func (suite *BaseSuite) StorageAccountResourceID(accountName string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Storage/storageAccounts/%s", suite.SubscriptionID, suite.ResourceGroup, accountName)
+}
+
+func (suite *BaseSuite) getEventHubMgmtClient() (*mgmt.EventHubsClient, error) {
 	client := mgmt.NewEventHubsClientWithBaseURI(suite.Env.ResourceManagerEndpoint, suite.SubscriptionID)
-	a, err := azauth.NewAuthorizerFromEnvironment()
+	a, err := newAuthorizer(suite.Env)
+	if err != nil {
+		return nil, err
+	}
+	client.Authorizer = a
+	return &client, nil
+}
+
+// NamespaceConnectionString returns the primary connection string of the namespace's RootManageSharedAccessKey rule.
+// The connection string is fetched once and cached on the suite. It contains a secret, so don't log it.
+func (suite *BaseSuite) NamespaceConnectionString(ctx context.Context) (string, error) {
+	suite.connStrMu.Lock()
+	defer suite.connStrMu.Unlock()
+
+	if suite.connStr != "" {
+		return suite.connStr, nil
+	}
+
+	client, err := getNamespaceMgmtClientWithToken(suite.SubscriptionID, suite.Env)
+	if err != nil {
+		return "", err
+	}
+
+	keys, err := client.ListKeys(ctx, suite.ResourceGroup, suite.Namespace, "RootManageSharedAccessKey")
 	if err != nil {
-		log.Fatal(err)
+		return "", err
+	}
+
+	if keys.PrimaryConnectionString == nil {
+		return "", fmt.Errorf("no primary connection string found for namespace %q", suite.Namespace)
+	}
+
+	suite.connStr = *keys.PrimaryConnectionString
+	return suite.connStr, nil
+}
+
+func (suite *BaseSuite) getConsumerGroupMgmtClient() (*mgmt.ConsumerGroupsClient, error) {
+	client := mgmt.NewConsumerGroupsClientWithBaseURI(suite.Env.ResourceManagerEndpoint, suite.SubscriptionID)
+	a, err := newAuthorizer(suite.Env)
+	if err != nil {
+		return nil, err
 	}
 	client.Authorizer = a
-	return &client
+	return &client, nil
 }
 
-func (suite *BaseSuite) ensureNamespace() (*mgmt.EHNamespace, error) {
-	ns, err := ensureNamespace(context.Background(), suite.SubscriptionID, ResourceGroupName, suite.Namespace, Location, suite.Env)
+func (suite *BaseSuite) ensureNamespace(opts ...NamespaceMgmtOption) (*mgmt.EHNamespace, error) {
+	ns, err := ensureNamespace(context.Background(), suite.SubscriptionID, suite.ResourceGroup, suite.Namespace, suite.Location, suite.Env, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -337,16 +748,21 @@ func (suite *BaseSuite) ensureNamespace() (*mgmt.EHNamespace, error) {
 
 func (suite *BaseSuite) setupTracing() error {
 	if os.Getenv("TRACING") == "true" {
-		// Sample configuration for testing. Use constant sampling to sample every trace
-		// and enable LogSpan to log every span via configured Logger.
-		cfg := config.Configuration{
-			Sampler: &config.SamplerConfig{
-				Type:  jaeger.SamplerTypeConst,
-				Param: 1,
-			},
-			Reporter: &config.ReporterConfig{
-				LocalAgentHostPort: "0.0.0.0:6831",
-			},
+		// Start from the standard JAEGER_* environment variables (JAEGER_AGENT_HOST, JAEGER_AGENT_PORT,
+		// JAEGER_SAMPLER_TYPE, JAEGER_SAMPLER_PARAM, ...) so the agent and sampling can be configured for containerized
+		// runs. Without them, sample every trace and report to a local agent.
+		cfg, err := config.FromEnv()
+		if err != nil {
+			return err
+		}
+
+		if cfg.Sampler.Type == "" {
+			cfg.Sampler.Type = jaeger.SamplerTypeConst
+			cfg.Sampler.Param = 1
+		}
+
+		if os.Getenv("JAEGER_AGENT_HOST") == "" && os.Getenv("JAEGER_AGENT_PORT") == "" {
+			cfg.Reporter.LocalAgentHostPort = "0.0.0.0:6831"
 		}
 
 		// Example logger and metrics factory. Use github.com/uber/jaeger-client-go/log
@@ -368,24 +784,77 @@ func (suite *BaseSuite) setupTracing() error {
 	return nil
 }
 
-func getNamespaceMgmtClientWithToken(subscriptionID string, env azure.Environment) *mgmt.NamespacesClient {
+// StartTestSpan starts a root span for a test method so traces emitted by the code under test share a per-test
+// parent. Call it at the top of each test and pass the returned context to the code under test:
+//
+//	span, ctx := suite.StartTestSpan("")
+//	defer span.Finish()
+//
+// An empty name uses the name of the running test.
+func (suite *BaseSuite) StartTestSpan(name string) (opentracing.Span, context.Context) {
+	if name == "" {
+		name = suite.T().Name()
+	}
+	span, ctx := opentracing.StartSpanFromContext(context.Background(), name)
+	span.SetTag("test.name", suite.T().Name())
+	span.SetTag("test.tag_id", suite.TagID)
+	return span, ctx
+}
+
+// NewAuthorizer builds a management plane authorizer for the environment from the service principal. If sp is nil, the
+// authorizer is built from the standard AZURE_* environment variables.
+func NewAuthorizer(env azure.Environment, sp *ServicePrincipal) (autorest.Authorizer, error) {
+	if sp == nil {
+		return azauth.NewAuthorizerFromEnvironment()
+	}
+
+	if sp.ClientID == "" || sp.ClientSecret == "" || sp.TenantID == "" {
+		return nil, errors.New("a service principal requires a client ID, client secret and tenant ID")
+	}
+
+	cfg := azauth.NewClientCredentialsConfig(sp.ClientID, sp.ClientSecret, sp.TenantID)
+	cfg.AADEndpoint = env.ActiveDirectoryEndpoint
+	cfg.Resource = env.ResourceManagerEndpoint
+	return cfg.Authorizer()
+}
+
+// ServicePrincipalFromEnv reads a service principal from the EVENTHUB_TEST_CLIENT_ID, EVENTHUB_TEST_CLIENT_SECRET and
+// EVENTHUB_TEST_TENANT_ID environment variables, returning nil if none of them are set
+func ServicePrincipalFromEnv() *ServicePrincipal {
+	sp := &ServicePrincipal{
+		ClientID:     os.Getenv("EVENTHUB_TEST_CLIENT_ID"),
+		ClientSecret: os.Getenv("EVENTHUB_TEST_CLIENT_SECRET"),
+		TenantID:     os.Getenv("EVENTHUB_TEST_TENANT_ID"),
+	}
+
+	if sp.ClientID == "" && sp.ClientSecret == "" && sp.TenantID == "" {
+		return nil
+	}
+	return sp
+}
+
+func newAuthorizer(env azure.Environment) (autorest.Authorizer, error) {
+	return NewAuthorizer(env, ServicePrincipalFromEnv())
+}
+
+func getNamespaceMgmtClientWithToken(subscriptionID string, env azure.Environment) (*mgmt.NamespacesClient, error) {
 	client := mgmt.NewNamespacesClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
-	a, err := azauth.NewAuthorizerFromEnvironment()
+	a, err := newAuthorizer(env)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	client.Authorizer = a
-	return &client
+	return &client, nil
 }
 
-func getRmGroupClientWithToken(subscriptionID string, env azure.Environment) *rm.GroupsClient {
+func getRmGroupClientWithToken(subscriptionID string, env azure.Environment) (*rm.GroupsClient, error) {
 	groupsClient := rm.NewGroupsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
-	a, err := azauth.NewAuthorizerFromEnvironment()
+	a, err := newAuthorizer(env)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	groupsClient.Authorizer = a
-	return &groupsClient
+	return &groupsClient, nil
 }
 
 func mustGetEnv(key string) string {
@@ -0,0 +1,129 @@
+package test
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go"
+	mgmt "github.com/Azure/azure-sdk-for-go/services/eventhub/mgmt/2017-04-01/eventhub"
+	"github.com/Azure/go-autorest/autorest/date"
+	"github.com/stretchr/testify/assert"
+)
+
+type (
+	fakeHubPager struct {
+		pages    [][]mgmt.Model
+		current  int
+		failures int
+	}
+)
+
+func (p *fakeHubPager) NotDone() bool {
+	return p.current < len(p.pages)
+}
+
+func (p *fakeHubPager) Values() []mgmt.Model {
+	return p.pages[p.current]
+}
+
+func (p *fakeHubPager) Next() error {
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("transient failure")
+	}
+	p.current++
+	return nil
+}
+
+func newFakeHubPager(tagID string, tagged, untagged, pageSize int) *fakeHubPager {
+	var all []mgmt.Model
+	for i := 0; i < tagged; i++ {
+		name := fmt.Sprintf("goehtest%d-%s", i, tagID)
+		all = append(all, mgmt.Model{Name: &name})
+	}
+	for i := 0; i < untagged; i++ {
+		name := fmt.Sprintf("other%d", i)
+		all = append(all, mgmt.Model{Name: &name})
+	}
+
+	pager := new(fakeHubPager)
+	for len(all) > 0 {
+		n := pageSize
+		if n > len(all) {
+			n = len(all)
+		}
+		pager.pages = append(pager.pages, all[:n])
+		all = all[n:]
+	}
+	return pager
+}
+
+func init() {
+	listRetryDelay = 0
+}
+
+func TestTaggedHubNamesVisitsEveryPage(t *testing.T) {
+	pager := newFakeHubPager("tagabc", 50, 7, 20)
+	pager.failures = 1
+
+	names, err := taggedHubNames(pager, "tagabc")
+	assert.NoError(t, err)
+	assert.Len(t, names, 50)
+	for i, name := range names {
+		assert.Equal(t, fmt.Sprintf("goehtest%d-tagabc", i), name)
+	}
+}
+
+func TestTaggedHubNamesReturnsPartialResultsOnFailure(t *testing.T) {
+	pager := newFakeHubPager("tagabc", 50, 0, 20)
+	pager.failures = 10
+
+	names, err := taggedHubNames(pager, "tagabc")
+	assert.Error(t, err)
+	assert.Len(t, names, 20)
+}
+
+func TestStaleHubNamesSkipsRecentAndForeignHubs(t *testing.T) {
+	now := time.Now()
+	hub := func(name string, age time.Duration) mgmt.Model {
+		return mgmt.Model{
+			Name:       &name,
+			Properties: &mgmt.Properties{CreatedAt: &date.Time{Time: now.Add(-age)}},
+		}
+	}
+	pager := &fakeHubPager{
+		pages: [][]mgmt.Model{
+			{hub("goehtestabc-tag1", 48*time.Hour), hub("goehtestdef-tag2", time.Minute)},
+			{hub("production", 48*time.Hour), {Name: common.PtrString("goehtestnodate")}},
+			{hub("goehtestghi-tag3", 25*time.Hour)},
+		},
+	}
+
+	names, err := staleHubNames(pager, now.Add(-24*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"goehtestabc-tag1", "goehtestghi-tag3"}, names)
+}
@@ -25,6 +25,8 @@ package eventhub
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-amqp-common-go"
@@ -60,6 +62,25 @@ type (
 		done          func()
 		epoch         *int64
 		lastError     error
+		flow          flowCount
+		// settle replaces settling handled messages on the link when set, since messages received elsewhere, such as
+		// in benchmarks, can't be settled
+		settle func(msg *amqp.Message, accepted bool)
+	}
+
+	// flowCount counts the messages received and settled on the current link. The generation changes with each new
+	// link, so a message received on an earlier link isn't counted when it's settled.
+	flowCount struct {
+		mu         sync.Mutex
+		generation uint64
+		received   int
+		settled    int
+	}
+
+	// delivery is a message received from the link, along with the generation of the link it was received on
+	delivery struct {
+		msg        *amqp.Message
+		generation uint64
 	}
 
 	// ReceiveOption provides a structure for configuring receivers
@@ -158,15 +179,28 @@ func (r *receiver) Recover(ctx context.Context) error {
 
 // Listen start a listener for messages sent to the entity path
 func (r *receiver) Listen(handler Handler) *ListenerHandle {
+	return r.listen(func(ctx context.Context, msg *amqp.Message) {
+		r.handleMessage(ctx, msg, handler)
+	})
+}
+
+// ListenRaw start a listener for messages sent to the entity path which hands the raw AMQP messages to the handler
+func (r *receiver) ListenRaw(handler RawHandler) *ListenerHandle {
+	return r.listen(func(ctx context.Context, msg *amqp.Message) {
+		r.handleRawMessage(ctx, msg, handler)
+	})
+}
+
+func (r *receiver) listen(handle func(context.Context, *amqp.Message)) *ListenerHandle {
 	ctx, done := context.WithCancel(context.Background())
 	r.done = done
 
 	span, ctx := r.startConsumerSpanFromContext(ctx, "eh.receiver.Listen")
 	defer span.Finish()
 
-	messages := make(chan *amqp.Message)
+	messages := make(chan delivery)
 	go r.listenForMessages(ctx, messages)
-	go r.handleMessages(ctx, messages, handler)
+	go r.handleMessages(ctx, messages, handle)
 
 	return &ListenerHandle{
 		r:   r,
@@ -174,15 +208,16 @@ func (r *receiver) Listen(handler Handler) *ListenerHandle {
 	}
 }
 
-func (r *receiver) handleMessages(ctx context.Context, messages chan *amqp.Message, handler Handler) {
+func (r *receiver) handleMessages(ctx context.Context, messages chan delivery, handle func(context.Context, *amqp.Message)) {
 	span, ctx := r.startConsumerSpanFromContext(ctx, "eh.receiver.handleMessages")
 	defer span.Finish()
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case msg := <-messages:
-			r.handleMessage(ctx, msg, handler)
+		case d := <-messages:
+			handle(ctx, d.msg)
+			r.trackSettled(d.generation)
 		}
 	}
 }
@@ -203,22 +238,50 @@ func (r *receiver) handleMessage(ctx context.Context, msg *amqp.Message, handler
 
 	err = handler(ctx, event)
 	if err != nil {
-		msg.Modify(true, false, nil)
+		r.settleMessage(msg, false)
 		log.For(ctx).Error(fmt.Errorf("message modified(true, false, nil): id: %v", id))
 		return
 	}
-	msg.Accept()
+	r.settleMessage(msg, true)
 	r.storeLastReceivedOffset(event.GetCheckpoint())
 }
 
-func (r *receiver) listenForMessages(ctx context.Context, msgChan chan *amqp.Message) {
+func (r *receiver) handleRawMessage(ctx context.Context, msg *amqp.Message, handler RawHandler) {
+	span, ctx := r.startConsumerSpanFromContext(ctx, "eh.receiver.handleRawMessage")
+	defer span.Finish()
+
+	id := messageID(msg)
+	span.SetTag("eh.message-id", id)
+
+	if err := handler(ctx, msg); err != nil {
+		r.settleMessage(msg, false)
+		log.For(ctx).Error(fmt.Errorf("message modified(true, false, nil): id: %v", id))
+		return
+	}
+	r.settleMessage(msg, true)
+	r.storeLastReceivedOffset(checkpointFromMsg(msg))
+}
+
+// settleMessage accepts a message which was handled, or modifies it for redelivery otherwise
+func (r *receiver) settleMessage(msg *amqp.Message, accepted bool) {
+	switch {
+	case r.settle != nil:
+		r.settle(msg, accepted)
+	case accepted:
+		msg.Accept()
+	default:
+		msg.Modify(true, false, nil)
+	}
+}
+
+func (r *receiver) listenForMessages(ctx context.Context, msgChan chan delivery) {
 	span, ctx := r.startConsumerSpanFromContext(ctx, "eh.receiver.listenForMessages")
 	defer span.Finish()
 
 	for {
 		msg, err := r.listenForMessage(ctx)
 		if err == nil {
-			msgChan <- msg
+			msgChan <- delivery{msg: msg, generation: r.trackReceived()}
 			continue
 		}
 
@@ -331,12 +394,47 @@ func (r *receiver) newSessionAndLink(ctx context.Context) error {
 	}
 
 	r.receiver = amqpReceiver
+	r.resetFlow()
 	return nil
 }
 
-func (r *receiver) getLastReceivedOffset() (string, error) {
-	checkpoint, err := r.offsetPersister().Read(r.namespaceName(), r.hubName(), r.consumerGroup, r.partitionID)
-	return checkpoint.Offset, err
+// trackReceived counts a message received on the current link, returning the link's generation
+func (r *receiver) trackReceived() uint64 {
+	r.flow.mu.Lock()
+	defer r.flow.mu.Unlock()
+	r.flow.received++
+	return r.flow.generation
+}
+
+// trackSettled counts a settled message, unless it was received on an earlier link
+func (r *receiver) trackSettled(generation uint64) {
+	r.flow.mu.Lock()
+	defer r.flow.mu.Unlock()
+	if generation == r.flow.generation {
+		r.flow.settled++
+	}
+}
+
+// resetFlow clears the flow accounting when a new link is established, since messages which were unsettled on the
+// previous link will be redelivered on the new one
+func (r *receiver) resetFlow() {
+	r.flow.mu.Lock()
+	defer r.flow.mu.Unlock()
+	r.flow.generation++
+	r.flow.received = 0
+	r.flow.settled = 0
+}
+
+func (r *receiver) estimateFlow() (uint32, int) {
+	r.flow.mu.Lock()
+	unsettled := r.flow.received - r.flow.settled
+	r.flow.mu.Unlock()
+
+	var credit uint32
+	if int64(r.prefetchCount) > int64(unsettled) {
+		credit = r.prefetchCount - uint32(unsettled)
+	}
+	return credit, unsettled
 }
 
 func (r *receiver) storeLastReceivedOffset(checkpoint persist.Checkpoint) error {
@@ -344,12 +442,17 @@ func (r *receiver) storeLastReceivedOffset(checkpoint persist.Checkpoint) error
 }
 
 func (r *receiver) getOffsetExpression() (string, error) {
-	offset, err := r.getLastReceivedOffset()
+	checkpoint, err := r.offsetPersister().Read(r.namespaceName(), r.hubName(), r.consumerGroup, r.partitionID)
 	if err != nil {
 		// assume err read is due to not having an offset -- probably want to change this as it's ambiguous
 		return fmt.Sprintf(amqpAnnotationFormat, offsetAnnotationName, "=", persist.StartOfStream), nil
 	}
-	return fmt.Sprintf(amqpAnnotationFormat, offsetAnnotationName, "", offset), nil
+	if checkpoint.Offset == "" && !checkpoint.EnqueueTime.IsZero() {
+		// a checkpoint without an offset is positioned by enqueue time, in milliseconds since the epoch
+		millis := checkpoint.EnqueueTime.UnixNano() / int64(time.Millisecond)
+		return fmt.Sprintf(amqpAnnotationFormat, enqueueTimeName, "", strconv.FormatInt(millis, 10)), nil
+	}
+	return fmt.Sprintf(amqpAnnotationFormat, offsetAnnotationName, "", checkpoint.Offset), nil
 }
 
 func (r *receiver) getAddress() string {
@@ -397,6 +500,16 @@ func (lc *ListenerHandle) Done() <-chan struct{} {
 	return lc.ctx.Done()
 }
 
+// EstimatedFlowState returns an estimate of the link credit available to the receiver, along with the number of
+// messages which have been delivered to the receiver but not yet settled. This is useful for telling whether the
+// prefetch count is limiting throughput.
+//
+// The AMQP library doesn't expose the link's credit, so rather than being read from the link, the credit is estimated
+// as the prefetch count less the unsettled messages. The counts start over when the link is recovered.
+func (lc *ListenerHandle) EstimatedFlowState() (credit uint32, unsettled int) {
+	return lc.r.estimateFlow()
+}
+
 // Err will return the last error encountered
 func (lc *ListenerHandle) Err() error {
 	if lc.r.lastError != nil {
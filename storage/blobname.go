@@ -0,0 +1,106 @@
+package storage
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const (
+	upperHex = "0123456789ABCDEF"
+
+	// checkpointBlobSuffix is appended to the lease blob name to name the checkpoint blob of a partition. Encoded
+	// partition IDs never contain a ".", so a checkpoint blob can't be mistaken for a lease blob.
+	checkpointBlobSuffix = ".checkpoint"
+)
+
+// leaseBlobName returns the name of the blob holding the lease of the partition. Event Hubs partition IDs are numeric,
+// so they are used as is, but any other character, including the "/" which would place the blob under a virtual
+// directory, is percent-encoded so every partition ID maps to a single valid blob name. partitionIDFromBlobName
+// reverses the encoding.
+func leaseBlobName(partitionID string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(partitionID); i++ {
+		c := partitionID[i]
+		if isUnreservedBlobNameByte(c) {
+			buf.WriteByte(c)
+			continue
+		}
+		buf.WriteByte('%')
+		buf.WriteByte(upperHex[c>>4])
+		buf.WriteByte(upperHex[c&0x0F])
+	}
+	return buf.String()
+}
+
+// checkpointBlobName returns the name of the blob holding the checkpoint of the partition when checkpoints are stored
+// separately from the leases
+func checkpointBlobName(partitionID string) string {
+	return leaseBlobName(partitionID) + checkpointBlobSuffix
+}
+
+// partitionIDFromBlobName returns the partition ID of a lease blob named by leaseBlobName. An error is returned for
+// names leaseBlobName could not have produced, such as blobs written by other applications.
+func partitionIDFromBlobName(blobName string) (string, error) {
+	var buf bytes.Buffer
+	for i := 0; i < len(blobName); i++ {
+		c := blobName[i]
+		if c != '%' {
+			if !isUnreservedBlobNameByte(c) {
+				return "", fmt.Errorf("blob name %q is not an encoded partition ID", blobName)
+			}
+			buf.WriteByte(c)
+			continue
+		}
+
+		if i+2 >= len(blobName) {
+			return "", fmt.Errorf("blob name %q has a truncated escape", blobName)
+		}
+		hi, okHi := fromHex(blobName[i+1])
+		lo, okLo := fromHex(blobName[i+2])
+		if !okHi || !okLo {
+			return "", fmt.Errorf("blob name %q has an invalid escape", blobName)
+		}
+		buf.WriteByte(hi<<4 | lo)
+		i += 2
+	}
+	return buf.String(), nil
+}
+
+// isUnreservedBlobNameByte returns true for the bytes which are left as is in lease blob names
+func isUnreservedBlobNameByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '~'
+}
+
+func fromHex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	}
+	return 0, false
+}
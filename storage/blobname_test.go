@@ -0,0 +1,76 @@
+package storage
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeaseBlobNameRoundTrip(t *testing.T) {
+	partitionIDs := map[string]string{
+		"0":            "0",
+		"31":           "31",
+		"my partition": "my%20partition",
+		"tenant/0":     "tenant%2F0",
+		"100%":         "100%25",
+		"données":      "donn%C3%A9es",
+		"パーティション":      "%E3%83%91%E3%83%BC%E3%83%86%E3%82%A3%E3%82%B7%E3%83%A7%E3%83%B3",
+	}
+	for partitionID, expected := range partitionIDs {
+		blobName := leaseBlobName(partitionID)
+		assert.Equal(t, expected, blobName)
+
+		decoded, err := partitionIDFromBlobName(blobName)
+		require.NoError(t, err)
+		assert.Equal(t, partitionID, decoded)
+	}
+}
+
+func TestPartitionIDFromBlobNameRejectsForeignNames(t *testing.T) {
+	for _, blobName := range []string{"notes.txt", "a b", "bad%2", "bad%zz"} {
+		_, err := partitionIDFromBlobName(blobName)
+		assert.Error(t, err, "blob name %q should not decode", blobName)
+	}
+}
+
+func TestLeaseRequestedFromSanitizedBlobName(t *testing.T) {
+	paths := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.EscapedPath()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	_, err := leaser.getLease(ctx, "tenant/my partition")
+	require.Error(t, err)
+	assert.Equal(t, "/somecontainer/tenant%252Fmy%2520partition", <-paths, "the partition ID should be a single, encoded path segment")
+}
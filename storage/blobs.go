@@ -0,0 +1,213 @@
+package storage
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+
+	"github.com/Azure/azure-storage-blob-go/2016-05-31/azblob"
+)
+
+type (
+	// blobProperties are the properties of a blob returned by the blob operations the LeaserCheckpointer uses
+	blobProperties struct {
+		StatusCode      int
+		ETag            azblob.ETag
+		LeaseState      azblob.LeaseStateType
+		ContentEncoding string
+	}
+
+	// blobItem is a blob listed in the container
+	blobItem struct {
+		Name       string
+		LeaseState azblob.LeaseStateType
+	}
+
+	// blobClient is the subset of Azure Storage operations the LeaserCheckpointer performs on its container and the
+	// blobs within it, addressed by blob name. Failures are returned as azblob.StorageError, so they can be classified
+	// by service code. It lets the leasing and checkpointing logic be tested against an in-memory container rather
+	// than a storage account.
+	//
+	// Only listing the containers in the account, for StoreExists, and the probes made by VerifyPermissions, which
+	// exercise the credential itself, go through the container URL directly.
+	blobClient interface {
+		// PutBlob writes the blob and returns its new ETag
+		PutBlob(ctx context.Context, blobName string, body []byte, headers azblob.BlobHTTPHeaders, metadata azblob.Metadata, ac azblob.BlobAccessConditions) (blobProperties, error)
+		// GetBlob reads the whole blob along with its properties
+		GetBlob(ctx context.Context, blobName string) ([]byte, blobProperties, error)
+		GetPropertiesAndMetadata(ctx context.Context, blobName string) (blobProperties, error)
+		AcquireLease(ctx context.Context, blobName, proposedID string, duration int32) (blobProperties, error)
+		RenewLease(ctx context.Context, blobName, leaseID string) (blobProperties, error)
+		ReleaseLease(ctx context.Context, blobName, leaseID string) (blobProperties, error)
+		ChangeLease(ctx context.Context, blobName, leaseID, proposedID string) (blobProperties, error)
+		BreakLease(ctx context.Context, blobName string, breakPeriod int32) (blobProperties, error)
+		Delete(ctx context.Context, blobName string, ac azblob.BlobAccessConditions) error
+		// ListBlobs lists every blob in the container, following the continuation markers
+		ListBlobs(ctx context.Context) ([]blobItem, error)
+		// Create creates the container
+		Create(ctx context.Context, metadata azblob.Metadata) error
+		// GetContainerProperties fetches the container's properties, failing with a 404 if it doesn't exist
+		GetContainerProperties(ctx context.Context) error
+		// SetContainerMetadata replaces the container's metadata
+		SetContainerMetadata(ctx context.Context, metadata azblob.Metadata) error
+		// DeleteContainer deletes the container and every blob within it
+		DeleteContainer(ctx context.Context) error
+	}
+
+	// containerBlobClient performs the blob operations against Azure Storage through a container URL
+	containerBlobClient struct {
+		containerURL *azblob.ContainerURL
+	}
+)
+
+// blobs returns the client for the blobs of the container, which is the container URL unless a client was injected
+func (sl *LeaserCheckpointer) blobs() blobClient {
+	if sl.blobClient != nil {
+		return sl.blobClient
+	}
+	return containerBlobClient{containerURL: sl.containerURL}
+}
+
+func (c containerBlobClient) PutBlob(ctx context.Context, blobName string, body []byte, headers azblob.BlobHTTPHeaders, metadata azblob.Metadata, ac azblob.BlobAccessConditions) (blobProperties, error) {
+	res, err := c.containerURL.NewBlobURL(blobName).ToBlockBlobURL().PutBlob(ctx, bytes.NewReader(body), headers, metadata, ac)
+	if err != nil {
+		return blobProperties{}, err
+	}
+	return blobProperties{StatusCode: res.StatusCode(), ETag: res.ETag()}, nil
+}
+
+func (c containerBlobClient) GetBlob(ctx context.Context, blobName string) ([]byte, blobProperties, error) {
+	res, err := c.containerURL.NewBlobURL(blobName).GetBlob(ctx, azblob.BlobRange{}, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return nil, blobProperties{}, err
+	}
+	body := res.Response().Body
+	defer body.Close()
+
+	bits, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, blobProperties{}, err
+	}
+	return bits, blobProperties{
+		StatusCode:      res.StatusCode(),
+		ETag:            res.ETag(),
+		LeaseState:      res.LeaseState(),
+		ContentEncoding: res.ContentEncoding(),
+	}, nil
+}
+
+func (c containerBlobClient) GetPropertiesAndMetadata(ctx context.Context, blobName string) (blobProperties, error) {
+	res, err := c.containerURL.NewBlobURL(blobName).GetPropertiesAndMetadata(ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		return blobProperties{}, err
+	}
+	return blobProperties{
+		StatusCode:      res.StatusCode(),
+		ETag:            res.ETag(),
+		LeaseState:      res.LeaseState(),
+		ContentEncoding: res.ContentEncoding(),
+	}, nil
+}
+
+func (c containerBlobClient) AcquireLease(ctx context.Context, blobName, proposedID string, duration int32) (blobProperties, error) {
+	res, err := c.containerURL.NewBlobURL(blobName).AcquireLease(ctx, proposedID, duration, azblob.HTTPAccessConditions{})
+	if err != nil {
+		return blobProperties{}, err
+	}
+	return blobProperties{StatusCode: res.StatusCode(), ETag: res.ETag()}, nil
+}
+
+func (c containerBlobClient) RenewLease(ctx context.Context, blobName, leaseID string) (blobProperties, error) {
+	res, err := c.containerURL.NewBlobURL(blobName).RenewLease(ctx, leaseID, azblob.HTTPAccessConditions{})
+	if err != nil {
+		return blobProperties{}, err
+	}
+	return blobProperties{StatusCode: res.StatusCode(), ETag: res.ETag()}, nil
+}
+
+func (c containerBlobClient) ReleaseLease(ctx context.Context, blobName, leaseID string) (blobProperties, error) {
+	res, err := c.containerURL.NewBlobURL(blobName).ReleaseLease(ctx, leaseID, azblob.HTTPAccessConditions{})
+	if err != nil {
+		return blobProperties{}, err
+	}
+	return blobProperties{StatusCode: res.StatusCode(), ETag: res.ETag()}, nil
+}
+
+func (c containerBlobClient) ChangeLease(ctx context.Context, blobName, leaseID, proposedID string) (blobProperties, error) {
+	res, err := c.containerURL.NewBlobURL(blobName).ChangeLease(ctx, leaseID, proposedID, azblob.HTTPAccessConditions{})
+	if err != nil {
+		return blobProperties{}, err
+	}
+	return blobProperties{StatusCode: res.StatusCode(), ETag: res.ETag()}, nil
+}
+
+func (c containerBlobClient) BreakLease(ctx context.Context, blobName string, breakPeriod int32) (blobProperties, error) {
+	res, err := c.containerURL.NewBlobURL(blobName).BreakLease(ctx, breakPeriod, azblob.HTTPAccessConditions{})
+	if err != nil {
+		return blobProperties{}, err
+	}
+	return blobProperties{StatusCode: res.StatusCode(), ETag: res.ETag()}, nil
+}
+
+func (c containerBlobClient) Delete(ctx context.Context, blobName string, ac azblob.BlobAccessConditions) error {
+	_, err := c.containerURL.NewBlobURL(blobName).Delete(ctx, azblob.DeleteSnapshotsOptionInclude, ac)
+	return err
+}
+
+func (c containerBlobClient) Create(ctx context.Context, metadata azblob.Metadata) error {
+	_, err := c.containerURL.Create(ctx, metadata, azblob.PublicAccessNone)
+	return err
+}
+
+func (c containerBlobClient) ListBlobs(ctx context.Context) ([]blobItem, error) {
+	var items []blobItem
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		res, err := c.containerURL.ListBlobs(ctx, marker, azblob.ListBlobsOptions{})
+		if err != nil {
+			return nil, err
+		}
+		marker = res.NextMarker
+
+		for _, blob := range res.Blobs.Blob {
+			items = append(items, blobItem{Name: blob.Name, LeaseState: blob.Properties.LeaseState})
+		}
+	}
+	return items, nil
+}
+
+func (c containerBlobClient) GetContainerProperties(ctx context.Context) error {
+	_, err := c.containerURL.GetPropertiesAndMetadata(ctx, azblob.LeaseAccessConditions{})
+	return err
+}
+
+func (c containerBlobClient) SetContainerMetadata(ctx context.Context, metadata azblob.Metadata) error {
+	_, err := c.containerURL.SetMetadata(ctx, metadata, azblob.ContainerAccessConditions{})
+	return err
+}
+
+func (c containerBlobClient) DeleteContainer(ctx context.Context) error {
+	_, err := c.containerURL.Delete(ctx, azblob.ContainerAccessConditions{})
+	return err
+}
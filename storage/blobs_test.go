@@ -0,0 +1,936 @@
+package storage
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/persist"
+	"github.com/Azure/azure-event-hubs-go"
+	"github.com/Azure/azure-event-hubs-go/eph"
+	"github.com/Azure/azure-storage-blob-go/2016-05-31/azblob"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	// fakeBlobs is an in-memory blobClient which enforces blob leases, ETags and create-only writes the way Azure
+	// Storage does, so leasing behavior can be tested without a storage account
+	fakeBlobs struct {
+		blobs     map[string]*fakeBlob
+		created   bool
+		metadata  azblob.Metadata
+		etagCount int
+		mu        sync.Mutex
+	}
+
+	fakeBlob struct {
+		body            []byte
+		contentEncoding string
+		etag            azblob.ETag
+		leaseID         string
+		leaseState      azblob.LeaseStateType
+	}
+
+	// fakeStorageError reports a failure with a service code and status. The embedded StorageError is never set; it
+	// only satisfies the rest of the interface.
+	fakeStorageError struct {
+		azblob.StorageError
+		code   azblob.ServiceCodeType
+		status int
+	}
+)
+
+func newFakeBlobs() *fakeBlobs {
+	return &fakeBlobs{blobs: make(map[string]*fakeBlob)}
+}
+
+func (e *fakeStorageError) ServiceCode() azblob.ServiceCodeType {
+	return e.code
+}
+
+func (e *fakeStorageError) Response() *http.Response {
+	return &http.Response{StatusCode: e.status, Header: make(http.Header)}
+}
+
+func (e *fakeStorageError) Error() string {
+	return fmt.Sprintf("%d %s", e.status, e.code)
+}
+
+func newFakeStorageError(code azblob.ServiceCodeType, status int) error {
+	return &fakeStorageError{code: code, status: status}
+}
+
+func (f *fakeBlobs) nextETag() azblob.ETag {
+	f.etagCount++
+	return azblob.ETag(fmt.Sprintf("\"0x%d\"", f.etagCount))
+}
+
+func (f *fakeBlobs) props(status int, blob *fakeBlob) blobProperties {
+	return blobProperties{
+		StatusCode:      status,
+		ETag:            blob.etag,
+		LeaseState:      blob.leaseState,
+		ContentEncoding: blob.contentEncoding,
+	}
+}
+
+// checkBlobLease returns the error Azure Storage reports when writing to or deleting a blob with the leaseID
+func checkBlobLease(blob *fakeBlob, leaseID string) error {
+	switch {
+	case blob.leaseState != azblob.LeaseStateLeased && leaseID != "":
+		return newFakeStorageError(azblob.ServiceCodeLeaseNotPresentWithBlobOperation, http.StatusPreconditionFailed)
+	case blob.leaseState == azblob.LeaseStateLeased && leaseID == "":
+		return newFakeStorageError(azblob.ServiceCodeLeaseIDMissing, http.StatusPreconditionFailed)
+	case blob.leaseState == azblob.LeaseStateLeased && leaseID != blob.leaseID:
+		return newFakeStorageError(azblob.ServiceCodeLeaseIDMismatchWithBlobOperation, http.StatusPreconditionFailed)
+	}
+	return nil
+}
+
+// leasedBlob returns the blob if it's leased with the leaseID, or the error Azure Storage reports for a lease operation
+func (f *fakeBlobs) leasedBlob(blobName, leaseID string) (*fakeBlob, error) {
+	blob, ok := f.blobs[blobName]
+	switch {
+	case !ok:
+		return nil, newFakeStorageError(azblob.ServiceCodeBlobNotFound, http.StatusNotFound)
+	case blob.leaseState != azblob.LeaseStateLeased:
+		return nil, newFakeStorageError(azblob.ServiceCodeLeaseNotPresentWithLeaseOperation, http.StatusConflict)
+	case blob.leaseID != leaseID:
+		return nil, newFakeStorageError(azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation, http.StatusConflict)
+	}
+	return blob, nil
+}
+
+func (f *fakeBlobs) PutBlob(ctx context.Context, blobName string, body []byte, headers azblob.BlobHTTPHeaders, metadata azblob.Metadata, ac azblob.BlobAccessConditions) (blobProperties, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	blob, ok := f.blobs[blobName]
+	if ok && ac.HTTPAccessConditions.IfNoneMatch == "*" {
+		return blobProperties{}, newFakeStorageError(azblob.ServiceCodeBlobAlreadyExists, http.StatusConflict)
+	}
+	if ifMatch := ac.HTTPAccessConditions.IfMatch; ifMatch != "" && (!ok || blob.etag != ifMatch) {
+		return blobProperties{}, newFakeStorageError(azblob.ServiceCodeConditionNotMet, http.StatusPreconditionFailed)
+	}
+	if !ok {
+		blob = &fakeBlob{leaseState: azblob.LeaseStateAvailable}
+	}
+	if err := checkBlobLease(blob, ac.LeaseAccessConditions.LeaseID); err != nil {
+		return blobProperties{}, err
+	}
+
+	blob.body = append([]byte(nil), body...)
+	blob.contentEncoding = headers.ContentEncoding
+	blob.etag = f.nextETag()
+	f.blobs[blobName] = blob
+	return f.props(http.StatusCreated, blob), nil
+}
+
+func (f *fakeBlobs) GetBlob(ctx context.Context, blobName string) ([]byte, blobProperties, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	blob, ok := f.blobs[blobName]
+	if !ok {
+		return nil, blobProperties{}, newFakeStorageError(azblob.ServiceCodeBlobNotFound, http.StatusNotFound)
+	}
+	return append([]byte(nil), blob.body...), f.props(http.StatusOK, blob), nil
+}
+
+func (f *fakeBlobs) GetPropertiesAndMetadata(ctx context.Context, blobName string) (blobProperties, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	blob, ok := f.blobs[blobName]
+	if !ok {
+		return blobProperties{}, newFakeStorageError(azblob.ServiceCodeBlobNotFound, http.StatusNotFound)
+	}
+	return f.props(http.StatusOK, blob), nil
+}
+
+func (f *fakeBlobs) AcquireLease(ctx context.Context, blobName, proposedID string, duration int32) (blobProperties, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	blob, ok := f.blobs[blobName]
+	if !ok {
+		return blobProperties{}, newFakeStorageError(azblob.ServiceCodeBlobNotFound, http.StatusNotFound)
+	}
+	if blob.leaseState == azblob.LeaseStateLeased && blob.leaseID != proposedID {
+		return blobProperties{}, newFakeStorageError(azblob.ServiceCodeLeaseAlreadyPresent, http.StatusConflict)
+	}
+	blob.leaseID = proposedID
+	blob.leaseState = azblob.LeaseStateLeased
+	return f.props(http.StatusCreated, blob), nil
+}
+
+func (f *fakeBlobs) RenewLease(ctx context.Context, blobName, leaseID string) (blobProperties, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	blob, err := f.leasedBlob(blobName, leaseID)
+	if err != nil {
+		return blobProperties{}, err
+	}
+	return f.props(http.StatusOK, blob), nil
+}
+
+func (f *fakeBlobs) ReleaseLease(ctx context.Context, blobName, leaseID string) (blobProperties, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	blob, err := f.leasedBlob(blobName, leaseID)
+	if err != nil {
+		return blobProperties{}, err
+	}
+	blob.leaseID = ""
+	blob.leaseState = azblob.LeaseStateAvailable
+	return f.props(http.StatusOK, blob), nil
+}
+
+func (f *fakeBlobs) ChangeLease(ctx context.Context, blobName, leaseID, proposedID string) (blobProperties, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	blob, err := f.leasedBlob(blobName, leaseID)
+	if err != nil {
+		return blobProperties{}, err
+	}
+	blob.leaseID = proposedID
+	return f.props(http.StatusOK, blob), nil
+}
+
+func (f *fakeBlobs) BreakLease(ctx context.Context, blobName string, breakPeriod int32) (blobProperties, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	blob, ok := f.blobs[blobName]
+	switch {
+	case !ok:
+		return blobProperties{}, newFakeStorageError(azblob.ServiceCodeBlobNotFound, http.StatusNotFound)
+	case blob.leaseState != azblob.LeaseStateLeased:
+		return blobProperties{}, newFakeStorageError(azblob.ServiceCodeLeaseNotPresentWithLeaseOperation, http.StatusConflict)
+	}
+	// the break period is ignored; the lease is always broken immediately
+	blob.leaseID = ""
+	blob.leaseState = azblob.LeaseStateBroken
+	return f.props(http.StatusAccepted, blob), nil
+}
+
+func (f *fakeBlobs) Delete(ctx context.Context, blobName string, ac azblob.BlobAccessConditions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	blob, ok := f.blobs[blobName]
+	if !ok {
+		return newFakeStorageError(azblob.ServiceCodeBlobNotFound, http.StatusNotFound)
+	}
+	if ifMatch := ac.HTTPAccessConditions.IfMatch; ifMatch != "" && blob.etag != ifMatch {
+		return newFakeStorageError(azblob.ServiceCodeConditionNotMet, http.StatusPreconditionFailed)
+	}
+	if err := checkBlobLease(blob, ac.LeaseAccessConditions.LeaseID); err != nil {
+		return err
+	}
+	delete(f.blobs, blobName)
+	return nil
+}
+
+func (f *fakeBlobs) Create(ctx context.Context, metadata azblob.Metadata) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.created {
+		return newFakeStorageError(azblob.ServiceCodeContainerAlreadyExists, http.StatusConflict)
+	}
+	f.created = true
+	f.metadata = metadata
+	return nil
+}
+
+func (f *fakeBlobs) ListBlobs(ctx context.Context) ([]blobItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	items := make([]blobItem, 0, len(f.blobs))
+	for name, blob := range f.blobs {
+		items = append(items, blobItem{Name: name, LeaseState: blob.leaseState})
+	}
+	// Azure Storage lists blobs in lexicographical order
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Name < items[j].Name
+	})
+	return items, nil
+}
+
+func (f *fakeBlobs) GetContainerProperties(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.created {
+		return newFakeStorageError(azblob.ServiceCodeContainerNotFound, http.StatusNotFound)
+	}
+	return nil
+}
+
+func (f *fakeBlobs) SetContainerMetadata(ctx context.Context, metadata azblob.Metadata) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.created {
+		return newFakeStorageError(azblob.ServiceCodeContainerNotFound, http.StatusNotFound)
+	}
+	f.metadata = metadata
+	return nil
+}
+
+func (f *fakeBlobs) DeleteContainer(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.created {
+		return newFakeStorageError(azblob.ServiceCodeContainerNotFound, http.StatusNotFound)
+	}
+	f.created = false
+	f.metadata = nil
+	f.blobs = make(map[string]*fakeBlob)
+	return nil
+}
+
+// lease returns the lease ID and state of the named blob
+func (f *fakeBlobs) lease(blobName string) (string, azblob.LeaseStateType) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	blob, ok := f.blobs[blobName]
+	if !ok {
+		return "", azblob.LeaseStateNone
+	}
+	return blob.leaseID, blob.leaseState
+}
+
+// touch rewrites the named blob with its current body, as another host would, changing its ETag
+func (f *fakeBlobs) touch(blobName string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.blobs[blobName].etag = f.nextETag()
+}
+
+func newFakeBlobLeaser(t *testing.T, opts ...LeaserCheckpointerOption) (*LeaserCheckpointer, *fakeBlobs) {
+	cred := azblob.NewSharedKeyCredential("foo", "Zm9vCg==")
+	leaser, err := NewStorageLeaserCheckpointer(cred, "foo", "somecontainer", azure.PublicCloud, opts...)
+	require.NoError(t, err)
+	blobs := newFakeBlobs()
+	leaser.blobClient = blobs
+	leaser.processor = new(eph.EventProcessorHost)
+	require.NoError(t, eph.WithOwnerIdentity("me")(leaser.processor))
+	return leaser, blobs
+}
+
+func TestFakeBlobsLeaseLifecycle(t *testing.T) {
+	leaser, blobs := newFakeBlobLeaser(t)
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	_, err := leaser.EnsureLease(ctx, "0")
+	require.NoError(t, err)
+
+	lease, ok, err := leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, "me", lease.(*storageLease).Owner)
+	token, state := blobs.lease(leaseBlobName("0"))
+	assert.Equal(t, azblob.LeaseStateLeased, state)
+	assert.Equal(t, lease.(*storageLease).Token, token)
+
+	_, ok, err = leaser.RenewLease(ctx, "0")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+	released, err := leaser.ReleaseLease(ctx, "0")
+	require.NoError(t, err)
+	assert.True(t, released)
+
+	_, state = blobs.lease(leaseBlobName("0"))
+	assert.Equal(t, azblob.LeaseStateAvailable, state)
+	stored, err := leaser.getLease(ctx, "0")
+	require.NoError(t, err)
+	require.NotNil(t, stored.checkpoint())
+	assert.Equal(t, int64(10), stored.checkpoint().SequenceNumber)
+	assert.Equal(t, "me", stored.Owner)
+}
+
+func TestFakeBlobsEnsureLeaseKeepsExistingLease(t *testing.T) {
+	leaser, _ := newFakeBlobLeaser(t)
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	_, err := leaser.EnsureLeaseWithCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now()))
+	require.NoError(t, err)
+
+	lease, err := leaser.EnsureLeaseWithCheckpoint(ctx, "0", persist.NewCheckpoint("200", 20, time.Now()))
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), lease.(*storageLease).checkpoint().SequenceNumber)
+}
+
+func TestFakeBlobsAcquireChangesLeaseHeldByRecordedOwner(t *testing.T) {
+	other, blobs := newFakeBlobLeaser(t)
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	_, err := other.EnsureLease(ctx, "0")
+	require.NoError(t, err)
+	_, ok, err := other.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	leaser, _ := newFakeBlobLeaser(t)
+	leaser.blobClient = blobs
+	lease, ok, err := leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, eph.KindChanged, lease.(*storageLease).AcquisitionKind)
+
+	_, ok, err = other.RenewLease(ctx, "0")
+	assert.False(t, ok)
+	assert.True(t, isLeaseLost(err))
+}
+
+func TestFakeBlobsUploadRetriesAfterETagChange(t *testing.T) {
+	leaser, blobs := newFakeBlobLeaser(t, WithSynchronousCheckpoints())
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	_, err := leaser.EnsureLease(ctx, "0")
+	require.NoError(t, err)
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	blobs.touch(leaseBlobName("0"))
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+
+	stored, err := leaser.getLease(ctx, "0")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), stored.checkpoint().SequenceNumber)
+}
+
+func TestEnsureCheckpointAtUploadsWithSynchronousCheckpoints(t *testing.T) {
+	leaser, _ := newFakeBlobLeaser(t, WithSynchronousCheckpoints())
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	_, err := leaser.EnsureLease(ctx, "0")
+	require.NoError(t, err)
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	_, err = leaser.EnsureCheckpointAt(ctx, "0", persist.NewCheckpoint("100", 10, time.Now()))
+	require.NoError(t, err)
+	assert.Empty(t, leaser.dirtySnapshot(), "synchronous checkpoints shouldn't be left for the persistence loop")
+
+	stored, err := leaser.getLease(ctx, "0")
+	require.NoError(t, err)
+	require.NotNil(t, stored.checkpoint())
+	assert.Equal(t, int64(10), stored.checkpoint().SequenceNumber, "the seeded checkpoint should be uploaded before returning")
+}
+
+func TestFakeBlobsDeleteLeaseHeldByAnotherHostFails(t *testing.T) {
+	other, blobs := newFakeBlobLeaser(t)
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	_, err := other.EnsureLease(ctx, "0")
+	require.NoError(t, err)
+	_, ok, err := other.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	leaser, _ := newFakeBlobLeaser(t)
+	leaser.blobClient = blobs
+	assert.Error(t, leaser.DeleteLease(ctx, "0"))
+	_, state := blobs.lease(leaseBlobName("0"))
+	assert.Equal(t, azblob.LeaseStateLeased, state)
+}
+
+func TestDroppedCheckpointReappliedAfterLeaseRegained(t *testing.T) {
+	metrics := new(recordingMetrics)
+	leaser, blobs := newFakeBlobLeaser(t, WithDroppedCheckpointBuffer(4), WithMetricsRecorder(metrics))
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	_, err := leaser.EnsureLease(ctx, "0")
+	require.NoError(t, err)
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+
+	// another host takes the lease before the dirty checkpoint is persisted, then hands it back
+	other, _ := newFakeBlobLeaser(t)
+	other.blobClient = blobs
+	_, ok, err = other.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Error(t, leaser.persistDirtyPartitions(ctx))
+	_, err = other.ReleaseLease(ctx, "0")
+	require.NoError(t, err)
+
+	_, ok, err = leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	stored, err := leaser.getLease(ctx, "0")
+	require.NoError(t, err)
+	require.NotNil(t, stored.checkpoint())
+	assert.Equal(t, int64(10), stored.checkpoint().SequenceNumber)
+	assert.Equal(t, []string{"0"}, metrics.reapplied)
+	assert.Empty(t, leaser.dropped)
+}
+
+func TestDroppedCheckpointBufferedWhenLeaseTakenAfterRenew(t *testing.T) {
+	leaser, blobs := newFakeBlobLeaser(t, WithDroppedCheckpointBuffer(4))
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	_, err := leaser.EnsureLease(ctx, "0")
+	require.NoError(t, err)
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+
+	leaser.blobClient = &stolenAfterRenewBlobs{fakeBlobs: blobs}
+	err = leaser.persistDirtyPartitions(ctx)
+	require.Error(t, err)
+	require.Contains(t, leaser.dropped, "0", "the checkpoint rejected by the new owner's lease should be buffered")
+	assert.Equal(t, int64(10), leaser.dropped["0"].SequenceNumber)
+}
+
+func TestDroppedCheckpointBufferedWithSeparateCheckpointBlobs(t *testing.T) {
+	leaser, blobs := newFakeBlobLeaser(t, WithDroppedCheckpointBuffer(4), WithSeparateCheckpointBlobs())
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	_, err := leaser.EnsureLease(ctx, "0")
+	require.NoError(t, err)
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+
+	other, _ := newFakeBlobLeaser(t, WithSeparateCheckpointBlobs())
+	other.blobClient = blobs
+	_, ok, err = other.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	assert.Error(t, leaser.persistDirtyPartitions(ctx))
+	assert.Contains(t, leaser.dropped, "0", "the checkpoint dropped when renewing failed should be buffered")
+}
+
+// stolenAfterRenewBlobs hands each lease to another host just after it's renewed, so the write which follows the
+// renewal is rejected
+type stolenAfterRenewBlobs struct {
+	*fakeBlobs
+}
+
+func (b *stolenAfterRenewBlobs) RenewLease(ctx context.Context, blobName, leaseID string) (blobProperties, error) {
+	props, err := b.fakeBlobs.RenewLease(ctx, blobName, leaseID)
+	if err != nil {
+		return props, err
+	}
+	_, err = b.fakeBlobs.ChangeLease(ctx, blobName, leaseID, "another-host")
+	return props, err
+}
+
+func TestDroppedCheckpointDiscardedWhenAnotherHostProgressed(t *testing.T) {
+	metrics := new(recordingMetrics)
+	leaser, blobs := newFakeBlobLeaser(t, WithDroppedCheckpointBuffer(4), WithMetricsRecorder(metrics))
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	_, err := leaser.EnsureLease(ctx, "0")
+	require.NoError(t, err)
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+
+	other, _ := newFakeBlobLeaser(t, WithSynchronousCheckpoints())
+	other.blobClient = blobs
+	_, ok, err = other.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Error(t, leaser.persistDirtyPartitions(ctx))
+	require.NoError(t, other.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("200", 20, time.Now())))
+	_, err = other.ReleaseLease(ctx, "0")
+	require.NoError(t, err)
+
+	_, ok, err = leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	stored, err := leaser.getLease(ctx, "0")
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), stored.checkpoint().SequenceNumber)
+	assert.Empty(t, metrics.reapplied)
+}
+
+func TestDroppedCheckpointBufferIsBounded(t *testing.T) {
+	leaser, _ := newFakeBlobLeaser(t, WithDroppedCheckpointBuffer(1))
+	ctx := context.Background()
+	for _, id := range []string{"0", "1"} {
+		checkpoint := persist.NewCheckpoint("100", 10, time.Now())
+		leaser.setLease(&storageLease{Lease: &eph.Lease{PartitionID: id}, leaser: leaser, Checkpoint: &checkpoint})
+		leaser.bufferDroppedCheckpoint(ctx, id)
+	}
+
+	assert.Len(t, leaser.dropped, 1)
+	assert.Contains(t, leaser.dropped, "0")
+}
+
+func TestWithDroppedCheckpointBufferRejectsNonPositiveSize(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	assert.Error(t, WithDroppedCheckpointBuffer(0)(leaser))
+}
+
+// checkpointBlobSequence returns the sequence number of the checkpoint in the partition's checkpoint blob
+func (f *fakeBlobs) checkpointBlobSequence(t *testing.T, partitionID string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	blob, ok := f.blobs[checkpointBlobName(partitionID)]
+	require.True(t, ok, "the checkpoint blob should exist")
+	var checkpoint persist.Checkpoint
+	require.NoError(t, json.Unmarshal(blob.body, &checkpoint))
+	return checkpoint.SequenceNumber
+}
+
+// newSeparateCheckpointOwners returns a host which acquired partition "0" and persisted a checkpoint at sequence number
+// 10, and a second host sharing its blobs which has since taken the lease over
+func newSeparateCheckpointOwners(t *testing.T, opts ...LeaserCheckpointerOption) (*LeaserCheckpointer, *LeaserCheckpointer, *fakeBlobs) {
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	stale, blobs := newFakeBlobLeaser(t, append(opts, WithSeparateCheckpointBlobs())...)
+	_, err := stale.EnsureLease(ctx, "0")
+	require.NoError(t, err)
+	_, ok, err := stale.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, stale.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+	if !stale.synchronous {
+		require.NoError(t, stale.persistDirtyPartitions(ctx))
+	}
+
+	owner, _ := newFakeBlobLeaser(t, WithSeparateCheckpointBlobs(), WithSynchronousCheckpoints())
+	owner.blobClient = blobs
+	_, ok, err = owner.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	return stale, owner, blobs
+}
+
+func TestSeparateCheckpointStaleOwnerCannotPersist(t *testing.T) {
+	stale, _, blobs := newSeparateCheckpointOwners(t)
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	require.NoError(t, stale.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("300", 30, time.Now())))
+	assert.Error(t, stale.persistDirtyPartitions(ctx), "renewing the lost lease should fail")
+	assert.Equal(t, int64(10), blobs.checkpointBlobSequence(t, "0"))
+}
+
+func TestSeparateCheckpointWriteConditionedOnETag(t *testing.T) {
+	stale, owner, blobs := newSeparateCheckpointOwners(t, WithSynchronousCheckpoints())
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	require.NoError(t, owner.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("200", 20, time.Now())))
+	err := stale.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("300", 30, time.Now()))
+	require.Error(t, err)
+	assert.True(t, isConditionNotMet(err), "the checkpoint blob was written by the new owner")
+	assert.Equal(t, int64(20), blobs.checkpointBlobSequence(t, "0"))
+
+	_, err = stale.ReleaseLease(ctx, "0")
+	assert.Error(t, err)
+	assert.Equal(t, int64(20), blobs.checkpointBlobSequence(t, "0"), "releasing the lost lease shouldn't write the checkpoint")
+}
+
+func TestSeparateCheckpointsExportedAndCopiedFromCheckpointBlob(t *testing.T) {
+	leaser, _ := newFakeBlobLeaser(t, WithSeparateCheckpointBlobs(), WithSynchronousCheckpoints())
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	_, err := leaser.EnsureLease(ctx, "0")
+	require.NoError(t, err)
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+
+	data, err := leaser.ExportCheckpoints(ctx, []string{"0"})
+	require.NoError(t, err)
+	var export checkpointExport
+	require.NoError(t, json.Unmarshal(data, &export))
+	assert.Equal(t, int64(10), export.Checkpoints["0"].SequenceNumber, "the lease blob's copy of the checkpoint is stale")
+
+	target, _ := newFakeBlobLeaser(t)
+	require.NoError(t, target.CopyCheckpoint(ctx, "0", "1", leaser))
+	copied, err := target.getLease(ctx, "1")
+	require.NoError(t, err)
+	require.NotNil(t, copied.checkpoint())
+	assert.Equal(t, int64(10), copied.checkpoint().SequenceNumber)
+}
+
+func TestFakeBlobsEnsureStoreCreatesContainer(t *testing.T) {
+	metadata := azblob.Metadata{"app": "orders"}
+	leaser, blobs := newFakeBlobLeaser(t, WithContainerMetadata(metadata))
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	hcErr, ok := leaser.HealthCheck(ctx).(*HealthCheckError)
+	require.True(t, ok, "should be a health check error")
+	assert.Equal(t, ErrStorageContainerNotFound, hcErr.Reason)
+
+	require.NoError(t, leaser.EnsureStore(ctx))
+	assert.True(t, blobs.created)
+	assert.Equal(t, metadata, blobs.metadata)
+	require.NoError(t, leaser.EnsureStore(ctx), "an existing container should be left as is")
+	assert.NoError(t, leaser.HealthCheck(ctx))
+
+	require.NoError(t, leaser.DeleteStore(ctx))
+	assert.False(t, blobs.created)
+}
+
+func TestSeparateCheckpointsReportedInOwnershipAndWarmStart(t *testing.T) {
+	leaser, blobs := newFakeBlobLeaser(t, WithSeparateCheckpointBlobs(), WithSynchronousCheckpoints())
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	_, err := leaser.EnsureLease(ctx, "0")
+	require.NoError(t, err)
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+
+	ownership, err := leaser.GetOwnershipByConsumerGroup(ctx)
+	require.NoError(t, err)
+	require.Len(t, ownership[eventhub.DefaultConsumerGroup], 1, "the checkpoint blob should not be reported as a partition")
+	info := ownership[eventhub.DefaultConsumerGroup]["0"]
+	assert.Equal(t, "me", info.Owner)
+	require.NotNil(t, info.Checkpoint)
+	assert.Equal(t, int64(10), info.Checkpoint.SequenceNumber)
+
+	restarted, _ := newFakeBlobLeaser(t, WithSeparateCheckpointBlobs())
+	restarted.blobClient = blobs
+	require.NoError(t, restarted.loadHeldLeases(ctx))
+	assert.Equal(t, []string{"0"}, restarted.OwnedPartitions())
+	checkpoint, ok := restarted.GetCheckpoint(ctx, "0")
+	require.True(t, ok)
+	assert.Equal(t, int64(10), checkpoint.SequenceNumber)
+}
+
+func TestPruneLeasesDeletesCheckpointBlobs(t *testing.T) {
+	leaser, blobs := newFakeBlobLeaser(t, WithSeparateCheckpointBlobs(), WithSynchronousCheckpoints())
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	for _, partitionID := range []string{"0", "1", "2"} {
+		_, err := leaser.EnsureLease(ctx, partitionID)
+		require.NoError(t, err)
+		_, ok, err := leaser.AcquireLease(ctx, partitionID)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.NoError(t, leaser.UpdateCheckpoint(ctx, partitionID, persist.NewCheckpoint("100", 10, time.Now())))
+	}
+	_, err := leaser.ReleaseLease(ctx, "1")
+	require.NoError(t, err)
+
+	removed, err := leaser.PruneLeases(ctx, []string{"0"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1"}, removed, "only the unleased blob of a removed partition should be pruned")
+
+	_, err = blobs.GetPropertiesAndMetadata(ctx, checkpointBlobName("1"))
+	assert.Error(t, err, "the checkpoint blob of a pruned partition should be deleted")
+	_, err = blobs.GetPropertiesAndMetadata(ctx, checkpointBlobName("2"))
+	assert.NoError(t, err, "the checkpoint blob of a leased partition should be kept")
+}
+
+func TestFakeBlobsBreakLease(t *testing.T) {
+	leaser, blobs := newFakeBlobLeaser(t)
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	_, err := leaser.EnsureLease(ctx, "0")
+	require.NoError(t, err)
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	require.NoError(t, leaser.BreakLease(ctx, "0"))
+	_, state := blobs.lease(leaseBlobName("0"))
+	assert.Equal(t, azblob.LeaseStateBroken, state)
+	assert.Error(t, leaser.BreakLease(ctx, "0"), "a lease which isn't held can't be broken")
+}
+
+func TestEnsureLeasesReturnsEnsuredLeasesWithPartitionErrors(t *testing.T) {
+	leaser, blobs := newFakeBlobLeaser(t)
+	denied := newFakeStorageError(azblob.ServiceCodeType("AuthorizationPermissionMismatch"), http.StatusForbidden)
+	leaser.blobClient = &failingPutBlobs{fakeBlobs: blobs, fail: map[string]error{leaseBlobName("1"): denied}}
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	leases, err := leaser.EnsureLeases(ctx, []string{"0", "1", "2"})
+	require.Error(t, err)
+	partitionErrs, ok := err.(PartitionErrors)
+	require.True(t, ok, "should be PartitionErrors")
+	require.Len(t, partitionErrs, 1)
+	assert.Equal(t, denied, partitionErrs["1"])
+
+	require.Len(t, leases, 2, "the leases which were ensured should still be returned")
+	assert.Equal(t, "0", leases[0].GetPartitionID())
+	assert.Equal(t, "2", leases[1].GetPartitionID())
+}
+
+func TestEnsureLeasesReturnsEnsuredLeasesWhenContextIsDone(t *testing.T) {
+	leaser, blobs := newFakeBlobLeaser(t)
+	leaser.blobClient = &blockingPutBlobs{fakeBlobs: blobs, block: leaseBlobName("1")}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the other leases are ensured well before the context is canceled
+	time.AfterFunc(100*time.Millisecond, cancel)
+	leases, err := leaser.EnsureLeases(ctx, []string{"0", "1", "2"})
+	assert.Equal(t, context.Canceled, err)
+	require.Len(t, leases, 2, "the leases ensured before the context was done should be returned")
+	assert.Equal(t, "0", leases[0].GetPartitionID())
+	assert.Equal(t, "2", leases[1].GetPartitionID())
+}
+
+func TestDrainAndCloseDoesNotReportReleasedLeasesAsFailed(t *testing.T) {
+	leaser, blobs := newFakeBlobLeaser(t)
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	for _, partitionID := range []string{"0", "1"} {
+		_, err := leaser.EnsureLease(ctx, partitionID)
+		require.NoError(t, err)
+		_, ok, err := leaser.AcquireLease(ctx, partitionID)
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+
+	denied := newFakeStorageError(azblob.ServiceCodeType("AuthorizationPermissionMismatch"), http.StatusForbidden)
+	leaser.blobClient = &failingPutBlobs{fakeBlobs: blobs, fail: map[string]error{leaseBlobName("0"): denied}}
+	assert.NoError(t, leaser.DrainAndClose(ctx), "a lease released without its final checkpoint isn't a failed release")
+
+	for _, partitionID := range []string{"0", "1"} {
+		_, state := blobs.lease(leaseBlobName(partitionID))
+		assert.Equal(t, azblob.LeaseStateAvailable, state)
+	}
+}
+
+// failingPutBlobs fails writes to the blobs in fail with their error
+type failingPutBlobs struct {
+	*fakeBlobs
+	fail map[string]error
+}
+
+func (b *failingPutBlobs) PutBlob(ctx context.Context, blobName string, body []byte, headers azblob.BlobHTTPHeaders, metadata azblob.Metadata, ac azblob.BlobAccessConditions) (blobProperties, error) {
+	if err, ok := b.fail[blobName]; ok {
+		return blobProperties{}, err
+	}
+	return b.fakeBlobs.PutBlob(ctx, blobName, body, headers, metadata, ac)
+}
+
+// blockingPutBlobs holds writes to the block blob until the context is done
+type blockingPutBlobs struct {
+	*fakeBlobs
+	block string
+}
+
+func (b *blockingPutBlobs) PutBlob(ctx context.Context, blobName string, body []byte, headers azblob.BlobHTTPHeaders, metadata azblob.Metadata, ac azblob.BlobAccessConditions) (blobProperties, error) {
+	if blobName == b.block {
+		<-ctx.Done()
+		return blobProperties{}, ctx.Err()
+	}
+	return b.fakeBlobs.PutBlob(ctx, blobName, body, headers, metadata, ac)
+}
+
+// intrudedBlobs reports another owner in every lease blob read after the first, as if another host wrote over the lease
+// just after it was acquired
+type intrudedBlobs struct {
+	*fakeBlobs
+	reads int
+}
+
+func (b *intrudedBlobs) GetBlob(ctx context.Context, blobName string) ([]byte, blobProperties, error) {
+	body, props, err := b.fakeBlobs.GetBlob(ctx, blobName)
+	b.reads++
+	if err != nil || b.reads == 1 {
+		return body, props, err
+	}
+
+	var lease map[string]interface{}
+	if err := json.Unmarshal(body, &lease); err != nil {
+		return nil, blobProperties{}, err
+	}
+	lease["owner"] = "intruder"
+	body, err = json.Marshal(lease)
+	return body, props, err
+}
+
+func TestOwnershipViolationReleasesAcquiredLease(t *testing.T) {
+	var violations []*OwnershipViolationError
+	leaser, blobs := newFakeBlobLeaser(t, WithOwnershipVerification(func(violation *OwnershipViolationError) {
+		violations = append(violations, violation)
+	}))
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	_, err := leaser.EnsureLease(ctx, "0")
+	require.NoError(t, err)
+	leaser.blobClient = &intrudedBlobs{fakeBlobs: blobs}
+
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	assert.False(t, ok)
+	_, isViolation := err.(*OwnershipViolationError)
+	assert.True(t, isViolation, "should be an ownership violation")
+	assert.Len(t, violations, 1)
+
+	_, state := blobs.lease(leaseBlobName("0"))
+	assert.Equal(t, azblob.LeaseStateAvailable, state, "the blob lease should be released rather than left to expire")
+	_, owned := leaser.ownedLease("0")
+	assert.False(t, owned)
+}
@@ -0,0 +1,340 @@
+package storage
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/persist"
+	"github.com/Azure/azure-event-hubs-go/eph"
+	"github.com/Azure/azure-storage-blob-go/2016-05-31/azblob"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type (
+	fakeClock struct {
+		now     time.Time
+		waiters []fakeWaiter
+		mu      sync.Mutex
+	}
+
+	fakeWaiter struct {
+		deadline time.Time
+		ch       chan time.Time
+	}
+)
+
+func TestIsExpiredWhenRenewalLapses(t *testing.T) {
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&gets, 1)
+		w.Header().Set("x-ms-lease-state", string(azblob.LeaseStateLeased))
+		w.Write([]byte(`{"partitionID":"0","epoch":1,"owner":"me","token":"my-token"}`))
+	}))
+	defer server.Close()
+
+	clock := newFakeClock()
+	leaser := newServerLeaser(t, server)
+	leaser.clock = clock
+	lease := newClockLease(leaser)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	assert.False(t, lease.IsExpired(ctx), "the blob is still leased")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&gets))
+
+	clock.Advance(leaser.leaseDuration)
+	assert.True(t, lease.IsExpired(ctx), "the lease was not renewed within the lease duration")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&gets), "a lapsed renewal shouldn't need to check the blob")
+}
+
+func TestRemainingLeaseTimeFollowsClock(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	clock := newFakeClock()
+	leaser := newServerLeaser(t, server, WithLeaseDuration(30*time.Second))
+	leaser.clock = clock
+	leaser.leases["0"] = &storageLease{Lease: &eph.Lease{PartitionID: "0"}, leaser: leaser, Token: "my-token", renewedAt: clock.Now()}
+
+	remaining, ok := leaser.RemainingLeaseTime("0")
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, remaining)
+
+	clock.Advance(20 * time.Second)
+	remaining, _ = leaser.RemainingLeaseTime("0")
+	assert.Equal(t, 10*time.Second, remaining)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	_, ok, err := leaser.RenewLease(ctx, "0")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	remaining, _ = leaser.RemainingLeaseTime("0")
+	assert.Equal(t, 30*time.Second, remaining, "renewing should restart the lease duration")
+
+	clock.Advance(45 * time.Second)
+	remaining, _ = leaser.RemainingLeaseTime("0")
+	assert.Equal(t, time.Duration(0), remaining, "a lapsed lease has no time remaining")
+
+	_, ok = leaser.RemainingLeaseTime("1")
+	assert.False(t, ok, "the partition isn't owned")
+}
+
+func TestIsHeldBy(t *testing.T) {
+	cases := []struct {
+		name  string
+		state azblob.LeaseStateType
+		body  string
+		held  bool
+	}{
+		{
+			name:  "unleased",
+			state: azblob.LeaseStateAvailable,
+			body:  `{"partitionID":"0","epoch":1,"owner":"me","token":"my-token"}`,
+		},
+		{
+			name:  "held by self",
+			state: azblob.LeaseStateLeased,
+			body:  `{"partitionID":"0","epoch":1,"owner":"me","token":"my-token"}`,
+			held:  true,
+		},
+		{
+			name:  "held by other",
+			state: azblob.LeaseStateLeased,
+			body:  `{"partitionID":"0","epoch":2,"owner":"other","token":"other-token"}`,
+		},
+		{
+			name:  "held by another instance with my name",
+			state: azblob.LeaseStateLeased,
+			body:  `{"partitionID":"0","epoch":2,"owner":"me","token":"other-token"}`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("x-ms-lease-state", string(c.state))
+				w.Write([]byte(c.body))
+			}))
+			defer server.Close()
+
+			leaser := newServerLeaser(t, server)
+			leaser.clock = newFakeClock()
+			lease := newClockLease(leaser)
+
+			ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+			defer cancel()
+			assert.Equal(t, c.held, lease.IsHeldBy(ctx, "me"))
+		})
+	}
+}
+
+func TestPersistCadenceFollowsClock(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Method == http.MethodPut && r.URL.Query().Get("comp") == "" {
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	clock := newFakeClock()
+	leaser := newServerLeaser(t, server)
+	leaser.clock = clock
+	newClockLease(leaser)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+	go leaser.persistLeases(ctx)
+
+	clock.waitForWaiter(t)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests), "nothing should be persisted during the initial delay")
+
+	// the dirty lease is renewed and uploaded once the initial delay passes
+	clock.Advance(5 * time.Second)
+	clock.waitForWaiter(t)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("200", 20, time.Now())))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests), "the next persist should wait for the clock")
+
+	clock.Advance(time.Second)
+	clock.waitForWaiter(t)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+}
+
+func TestLivenessFollowsPersistLoop(t *testing.T) {
+	clock := newFakeClock()
+	leaser := newOfflineLeaser(t)
+	leaser.clock = clock
+	assert.Error(t, leaser.Liveness(), "the persistence loop hasn't started")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	leaser.startPersistLeases(ctx)
+	assert.NoError(t, leaser.Liveness(), "the loop should be live as soon as it's started")
+	clock.waitForWaiter(t)
+	assert.NoError(t, leaser.Liveness(), "the initial delay shouldn't count against the loop")
+
+	clock.Advance(5 * time.Second)
+	clock.waitForWaiter(t)
+	assert.NoError(t, leaser.Liveness())
+
+	// the loop ticks, then stalls waiting for the lease lock
+	leaser.leasesMu.Lock()
+	clock.Advance(time.Second)
+	waitForPersistTick(t, leaser, clock.Now())
+	clock.Advance(persistTimeout)
+	assert.NoError(t, leaser.Liveness(), "waiting out a persist for the full timeout shouldn't fail the loop")
+	clock.Advance(DefaultLivenessThreshold - persistTimeout + time.Second)
+	assert.Error(t, leaser.Liveness(), "the loop hasn't ticked within the liveness threshold")
+
+	leaser.leasesMu.Unlock()
+	clock.waitForWaiter(t)
+	clock.Advance(time.Second)
+	waitForPersistTick(t, leaser, clock.Now())
+	assert.NoError(t, leaser.Liveness(), "the loop recovered")
+
+	cancel()
+	clock.waitForWaiter(t)
+	clock.Advance(time.Second)
+	waitForPersistTick(t, leaser, time.Unix(0, 0))
+	assert.Error(t, leaser.Liveness(), "the persistence loop stopped")
+}
+
+func TestWithLivenessThreshold(t *testing.T) {
+	clock := newFakeClock()
+	leaser := newOfflineLeaser(t, WithLivenessThreshold(5*time.Second))
+	leaser.clock = clock
+
+	atomic.StoreInt64(&leaser.persistTick, clock.Now().UnixNano())
+	clock.Advance(5 * time.Second)
+	assert.NoError(t, leaser.Liveness())
+	clock.Advance(time.Second)
+	assert.Error(t, leaser.Liveness(), "the loop hasn't ticked within the configured threshold")
+
+	assert.Error(t, WithLivenessThreshold(persistInterval)(leaser), "a threshold the loop can't tick within should be rejected")
+}
+
+func TestLivenessWithSynchronousCheckpoints(t *testing.T) {
+	leaser := newOfflineLeaser(t, WithSynchronousCheckpoints())
+	assert.NoError(t, leaser.Liveness(), "there is no persistence loop to check")
+}
+
+// waitForPersistTick waits for the persistence loop to record a tick at the time. The Unix epoch waits for the loop to
+// stop.
+func waitForPersistTick(t *testing.T, leaser *LeaserCheckpointer, at time.Time) {
+	want := at.UnixNano()
+	deadline := time.Now().Add(shortTimeout)
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt64(&leaser.persistTick) == want {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("the persistence loop didn't tick at %v", at)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now: time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- fc.now
+		return ch
+	}
+	fc.waiters = append(fc.waiters, fakeWaiter{deadline: fc.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the clock forward, firing any timers which are due
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	fc.now = fc.now.Add(d)
+	var pending []fakeWaiter
+	for _, w := range fc.waiters {
+		if w.deadline.After(fc.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- fc.now
+	}
+	fc.waiters = pending
+}
+
+// waitForWaiter blocks until something is waiting on the clock
+func (fc *fakeClock) waitForWaiter(t *testing.T) {
+	deadline := time.Now().Add(shortTimeout)
+	for time.Now().Before(deadline) {
+		fc.mu.Lock()
+		waiting := len(fc.waiters)
+		fc.mu.Unlock()
+		if waiting > 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("nothing waited on the clock")
+}
+
+// newClockLease adds a lease for partition "0" to the leaser which was just renewed according to the leaser's clock
+func newClockLease(leaser *LeaserCheckpointer) *storageLease {
+	lease := &storageLease{
+		Lease: &eph.Lease{
+			PartitionID: "0",
+			Owner:       "me",
+		},
+		leaser:    leaser,
+		Token:     "my-token",
+		renewedAt: leaser.clock.Now(),
+	}
+	leaser.leases["0"] = lease
+	return lease
+}
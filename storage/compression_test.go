@@ -0,0 +1,127 @@
+package storage
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-amqp-common-go/persist"
+	"github.com/Azure/azure-event-hubs-go/eph"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// encodedBlobServer stores a single blob along with the Content-Encoding it was written with
+type encodedBlobServer struct {
+	mu       sync.Mutex
+	body     []byte
+	encoding string
+}
+
+func (s *encodedBlobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+		if s.encoding != "" {
+			w.Header().Set("Content-Encoding", s.encoding)
+		}
+		w.Write(s.body)
+	case http.MethodPut:
+		s.body, _ = ioutil.ReadAll(r.Body)
+		s.encoding = r.Header.Get("x-ms-blob-content-encoding")
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func TestCompressedLeaseRoundTrip(t *testing.T) {
+	blob := new(encodedBlobServer)
+	server := httptest.NewServer(blob)
+	defer server.Close()
+	leaser := newServerLeaser(t, server, WithCompression(CompressionGzip))
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	lease := &storageLease{Lease: &eph.Lease{PartitionID: "0", Owner: "me"}, Token: "my-token", leaser: leaser}
+	lease.setCheckpoint(&persist.Checkpoint{Offset: "100", SequenceNumber: 10})
+	require.NoError(t, leaser.uploadLease(ctx, lease))
+
+	assert.Equal(t, gzipContentEncoding, blob.encoding)
+	require.True(t, len(blob.body) > 2)
+	assert.Equal(t, []byte{0x1f, 0x8b}, blob.body[:2], "the blob should be stored gzip compressed")
+
+	read, err := leaser.getLease(ctx, "0")
+	require.NoError(t, err)
+	assert.Equal(t, "me", read.Owner)
+	assert.Equal(t, int64(10), read.checkpoint().SequenceNumber)
+}
+
+func TestCompressionReadsUncompressedLegacyBlob(t *testing.T) {
+	legacy := &storageLease{Lease: &eph.Lease{PartitionID: "0", Owner: "me"}}
+	legacy.setCheckpoint(&persist.Checkpoint{Offset: "100", SequenceNumber: 10})
+	body, err := legacy.marshal()
+	require.NoError(t, err)
+	blob := &encodedBlobServer{body: body}
+	server := httptest.NewServer(blob)
+	defer server.Close()
+	leaser := newServerLeaser(t, server, WithCompression(CompressionGzip))
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	read, err := leaser.getLease(ctx, "0")
+	require.NoError(t, err)
+	assert.Equal(t, "me", read.Owner)
+	assert.Equal(t, int64(10), read.checkpoint().SequenceNumber)
+
+	// the next write converts the blob to the compressed encoding
+	require.NoError(t, leaser.uploadLease(ctx, read))
+	assert.Equal(t, gzipContentEncoding, blob.encoding)
+}
+
+func TestUncompressedLeaseHasNoContentEncoding(t *testing.T) {
+	blob := new(encodedBlobServer)
+	server := httptest.NewServer(blob)
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	lease := &storageLease{Lease: &eph.Lease{PartitionID: "0"}, leaser: leaser}
+	require.NoError(t, leaser.uploadLease(ctx, lease))
+	assert.Empty(t, blob.encoding)
+	assert.Equal(t, byte('{'), blob.body[0])
+}
+
+func TestWithCompressionRejectsUnknown(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	assert.Error(t, WithCompression(Compression(42))(leaser))
+}
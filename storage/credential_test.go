@@ -25,7 +25,6 @@ package storage
 import (
 	"context"
 	"errors"
-	"log"
 	"net/url"
 	"strings"
 	"testing"
@@ -35,7 +34,6 @@ import (
 	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2017-10-01/storage"
 	"github.com/Azure/azure-storage-blob-go/2016-05-31/azblob"
 	"github.com/Azure/go-autorest/autorest/azure"
-	azauth "github.com/Azure/go-autorest/autorest/azure/auth"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -70,7 +68,7 @@ func (ts *testSuite) TestCredential() {
 	containerName := "foo"
 	blobName := "bar"
 	message := "Hello World!!"
-	tokenProvider, err := NewAADSASCredential(ts.SubscriptionID, test.ResourceGroupName, ts.AccountName, containerName, AADSASCredentialWithEnvironmentVars())
+	tokenProvider, err := NewAADSASCredential(ts.SubscriptionID, ts.ResourceGroup, ts.AccountName, containerName, AADSASCredentialWithEnvironmentVars())
 	if err != nil {
 		ts.T().Fatal(err)
 	}
@@ -101,8 +99,12 @@ func (ts *testSuite) deleteStorageAccount() error {
 	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
 	defer cancel()
 
-	client := getStorageAccountMgmtClient(ts.SubscriptionID, ts.Env)
-	_, err := client.Delete(ctx, test.ResourceGroupName, ts.AccountName)
+	client, err := getStorageAccountMgmtClient(ts.SubscriptionID, ts.Env)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Delete(ctx, ts.ResourceGroup, ts.AccountName)
 	return err
 }
 
@@ -110,8 +112,12 @@ func (ts *testSuite) ensureStorageAccount() error {
 	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
 	defer cancel()
 
-	client := getStorageAccountMgmtClient(ts.SubscriptionID, ts.Env)
-	accounts, err := client.ListByResourceGroup(ctx, test.ResourceGroupName)
+	client, err := getStorageAccountMgmtClient(ts.SubscriptionID, ts.Env)
+	if err != nil {
+		return err
+	}
+
+	accounts, err := client.ListByResourceGroup(ctx, ts.ResourceGroup)
 	if err != nil {
 		return err
 	}
@@ -131,13 +137,13 @@ func (ts *testSuite) ensureStorageAccount() error {
 		}
 	}
 
-	_, err = client.Create(ctx, test.ResourceGroupName, ts.AccountName, storage.AccountCreateParameters{
+	_, err = client.Create(ctx, ts.ResourceGroup, ts.AccountName, storage.AccountCreateParameters{
 		Sku: &storage.Sku{
 			Name: storage.StandardLRS,
 			Tier: storage.Standard,
 		},
 		Kind:     storage.BlobStorage,
-		Location: common.PtrString(test.Location),
+		Location: common.PtrString(ts.Location),
 		AccountPropertiesCreateParameters: &storage.AccountPropertiesCreateParameters{
 			AccessTier: storage.Hot,
 		},
@@ -146,12 +152,12 @@ func (ts *testSuite) ensureStorageAccount() error {
 	return err
 }
 
-func getStorageAccountMgmtClient(subscriptionID string, env azure.Environment) *storage.AccountsClient {
+func getStorageAccountMgmtClient(subscriptionID string, env azure.Environment) (*storage.AccountsClient, error) {
 	client := storage.NewAccountsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
-	a, err := azauth.NewAuthorizerFromEnvironment()
+	a, err := test.NewAuthorizer(env, test.ServicePrincipalFromEnv())
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	client.Authorizer = a
-	return &client
+	return &client, nil
 }
@@ -0,0 +1,132 @@
+package storage
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/Azure/azure-amqp-common-go/persist"
+)
+
+// checkpointExportVersion is the version of the document written by ExportCheckpoints
+const checkpointExportVersion = 1
+
+// checkpointExport is the document written by ExportCheckpoints and read by ImportCheckpoints
+type checkpointExport struct {
+	Version     int                           `json:"version"`
+	Checkpoints map[string]persist.Checkpoint `json:"checkpoints"`
+}
+
+// ExportCheckpoints reads the checkpoint of each of the partitionIDs from its lease blob, or from its checkpoint blob
+// when checkpoints are stored separately, whichever host owns it, and returns them as a versioned JSON document keyed
+// by partition ID, for backup or for moving to another container with ImportCheckpoints. Partitions which have never
+// been checkpointed are left out. If any lease can't be read, a PartitionErrors holding the error for each such
+// partition is returned.
+func (sl *LeaserCheckpointer) ExportCheckpoints(ctx context.Context, partitionIDs []string) ([]byte, error) {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.ExportCheckpoints")
+	defer span.Finish()
+
+	type exportResult struct {
+		PartitionID string
+		leaseGetResult
+	}
+
+	resCh := make(chan exportResult, len(partitionIDs))
+	for _, partitionID := range partitionIDs {
+		go func(id string) {
+			lease, err := sl.getLeaseWithCheckpoint(ctx, id)
+			resCh <- exportResult{
+				PartitionID: id,
+				leaseGetResult: leaseGetResult{
+					Lease: lease,
+					Err:   err,
+				},
+			}
+		}(partitionID)
+	}
+
+	export := checkpointExport{
+		Version:     checkpointExportVersion,
+		Checkpoints: make(map[string]persist.Checkpoint, len(partitionIDs)),
+	}
+	errs := make(PartitionErrors)
+	for i := 0; i < len(partitionIDs); i++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case res := <-resCh:
+			if res.Err != nil {
+				sl.logger.Error(ctx, "failed to export checkpoint", "partitionID", res.PartitionID, "error", res.Err)
+				errs[res.PartitionID] = res.Err
+				continue
+			}
+			if checkpoint := res.Lease.checkpoint(); checkpoint != nil {
+				export.Checkpoints[res.PartitionID] = *checkpoint
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return json.Marshal(export)
+}
+
+// ImportCheckpoints writes the checkpoints of a document returned by ExportCheckpoints to the lease blobs of their
+// partitions, creating the blobs if needed. Each lease is acquired for the write and released afterwards, unless this
+// host already holds it; partitions leased by other hosts are not changed. As with UpdateCheckpoint, a checkpoint behind
+// the one already stored for a partition is rejected unless WithAllowRewind is set. If any checkpoint can't be written,
+// a PartitionErrors holding the error for each such partition is returned.
+//
+// The EventProcessorHost must be set, since it provides the owner identity recorded on the leases.
+func (sl *LeaserCheckpointer) ImportCheckpoints(ctx context.Context, data []byte) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.ImportCheckpoints")
+	defer span.Finish()
+
+	var export checkpointExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return err
+	}
+	if export.Version < 1 || export.Version > checkpointExportVersion {
+		return fmt.Errorf("checkpoint export version %d is not supported; the supported version is %d", export.Version, checkpointExportVersion)
+	}
+	if sl.processor == nil {
+		return errors.New("the EventProcessorHost must be set to acquire the leases")
+	}
+
+	errs := make(PartitionErrors)
+	for partitionID, checkpoint := range export.Checkpoints {
+		if err := sl.writeCheckpoint(ctx, partitionID, checkpoint); err != nil {
+			sl.logger.Error(ctx, "failed to import checkpoint", "partitionID", partitionID, "error", err)
+			errs[partitionID] = err
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package storage
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/persist"
+	"github.com/Azure/azure-event-hubs-go/eph"
+	"github.com/Azure/azure-storage-blob-go/2016-05-31/azblob"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// leaseBlobs serves lease blobs from memory, keyed by partition ID
+type leaseBlobs map[string][]byte
+
+func (b leaseBlobs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, ok := b[strings.TrimPrefix(r.URL.Path, "/somecontainer/")]
+	if !ok {
+		w.Header().Set("x-ms-error-code", string(azblob.ServiceCodeBlobNotFound))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Write(body)
+}
+
+func leaseBlob(t *testing.T, partitionID string, checkpoint *persist.Checkpoint) []byte {
+	lease := &storageLease{Lease: &eph.Lease{PartitionID: partitionID, Owner: "someone"}}
+	lease.setCheckpoint(checkpoint)
+	body, err := lease.marshal()
+	require.NoError(t, err)
+	return body
+}
+
+func TestExportCheckpoints(t *testing.T) {
+	enqueued := time.Date(2018, 6, 1, 12, 30, 15, 123456789, time.UTC)
+	checkpoint := persist.NewCheckpoint("4096", 40, enqueued)
+	server := httptest.NewServer(leaseBlobs{
+		"0": leaseBlob(t, "0", &checkpoint),
+		"1": leaseBlob(t, "1", nil),
+	})
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	data, err := leaser.ExportCheckpoints(ctx, []string{"0", "1"})
+	require.NoError(t, err)
+
+	var export checkpointExport
+	require.NoError(t, json.Unmarshal(data, &export))
+	assert.Equal(t, checkpointExportVersion, export.Version)
+	require.Len(t, export.Checkpoints, 1, "partitions without a checkpoint should be left out")
+	exported := export.Checkpoints["0"]
+	assert.Equal(t, checkpoint.Offset, exported.Offset)
+	assert.Equal(t, checkpoint.SequenceNumber, exported.SequenceNumber)
+	assert.True(t, enqueued.Equal(exported.EnqueueTime), "the enqueue time should keep its full precision")
+
+	again, err := leaser.ExportCheckpoints(ctx, []string{"1", "0"})
+	require.NoError(t, err)
+	assert.Equal(t, string(data), string(again), "the document should be stable")
+}
+
+func TestExportCheckpointsReportsPartitionErrors(t *testing.T) {
+	checkpoint := persist.NewCheckpoint("4096", 40, time.Now())
+	server := httptest.NewServer(leaseBlobs{"0": leaseBlob(t, "0", &checkpoint)})
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+	leaser.containerURL = noRetryContainerURL(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	_, err := leaser.ExportCheckpoints(ctx, []string{"0", "5"})
+	require.Error(t, err)
+	partitionErrs, ok := err.(PartitionErrors)
+	require.True(t, ok, "should be partition errors")
+	assert.Len(t, partitionErrs, 1)
+	assert.Contains(t, partitionErrs, "5")
+}
+
+func TestImportCheckpointsRejectsUnsupportedDocuments(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	ctx := context.Background()
+	assert.Error(t, leaser.ImportCheckpoints(ctx, []byte("not json")))
+	assert.Error(t, leaser.ImportCheckpoints(ctx, []byte(`{"version":2,"checkpoints":{}}`)))
+	assert.Error(t, leaser.ImportCheckpoints(ctx, []byte(`{"checkpoints":{}}`)), "a document without a version isn't an export")
+	assert.Error(t, leaser.ImportCheckpoints(ctx, []byte(`{"version":1,"checkpoints":{}}`)), "the EventProcessorHost is needed to acquire leases")
+}
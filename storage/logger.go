@@ -0,0 +1,83 @@
+package storage
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Azure/azure-amqp-common-go/log"
+)
+
+type (
+	// Logger receives the LeaserCheckpointer's log entries as a message with alternating key and value fields, so they
+	// can be routed to a structured logger. The context carries the span of the operation being logged.
+	Logger interface {
+		Debug(ctx context.Context, msg string, keyvals ...interface{})
+		Info(ctx context.Context, msg string, keyvals ...interface{})
+		Error(ctx context.Context, msg string, keyvals ...interface{})
+	}
+
+	// spanLogger logs through github.com/Azure/azure-amqp-common-go/log, which records entries on the context's span
+	spanLogger struct{}
+)
+
+// WithLogger routes all of the LeaserCheckpointer's logging through the logger. By default, entries are logged through
+// github.com/Azure/azure-amqp-common-go/log.
+func WithLogger(logger Logger) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if logger == nil {
+			return errors.New("logger must not be nil")
+		}
+		sl.logger = logger
+		return nil
+	}
+}
+
+func (spanLogger) Debug(ctx context.Context, msg string, keyvals ...interface{}) {
+	log.For(ctx).Debug(formatLogEntry(msg, keyvals))
+}
+
+func (spanLogger) Info(ctx context.Context, msg string, keyvals ...interface{}) {
+	log.For(ctx).Info(formatLogEntry(msg, keyvals))
+}
+
+func (spanLogger) Error(ctx context.Context, msg string, keyvals ...interface{}) {
+	log.For(ctx).Error(errors.New(formatLogEntry(msg, keyvals)))
+}
+
+// formatLogEntry appends the fields to the message as key=value pairs
+func formatLogEntry(msg string, keyvals []interface{}) string {
+	var buf bytes.Buffer
+	buf.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var value interface{} = "(missing)"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		fmt.Fprintf(&buf, " %v=%v", keyvals[i], value)
+	}
+	return buf.String()
+}
@@ -0,0 +1,73 @@
+package storage
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"errors"
+	"time"
+)
+
+type (
+	// MetricsRecorder receives measurements of the leases and checkpoints managed by a LeaserCheckpointer, so they can
+	// be exported to a monitoring system. It is called synchronously with leasing and checkpointing, so it must not
+	// block.
+	MetricsRecorder interface {
+		// LeaseAcquired is called each time this host acquires or steals the lease on a partition
+		LeaseAcquired(partitionID string)
+		// LeaseLost is called each time renewing or updating the lease on a partition shows it was taken by another host
+		LeaseLost(partitionID string)
+		// CheckpointPersisted is called each time the lease of a partition is uploaded to persist its checkpoint, with
+		// how long the upload took and the error it failed with, if any
+		CheckpointPersisted(partitionID string, duration time.Duration, err error)
+		// OwnedPartitions is called with the number of partitions this host holds leases for each time it changes
+		OwnedPartitions(count int)
+		// CheckpointReapplied is called each time a checkpoint dropped when the lease on a partition was lost is applied
+		// after the partition is acquired again; see WithDroppedCheckpointBuffer
+		CheckpointReapplied(partitionID string)
+	}
+
+	// noopMetrics discards all measurements
+	noopMetrics struct{}
+)
+
+// WithMetricsRecorder reports measurements of the leases and checkpoints to the recorder. By default, no measurements
+// are recorded. See the storage/prometheus package for a recorder exporting them as Prometheus metrics.
+func WithMetricsRecorder(recorder MetricsRecorder) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if recorder == nil {
+			return errors.New("metrics recorder must not be nil")
+		}
+		sl.metrics = recorder
+		return nil
+	}
+}
+
+func (noopMetrics) LeaseAcquired(partitionID string) {}
+
+func (noopMetrics) LeaseLost(partitionID string) {}
+
+func (noopMetrics) CheckpointPersisted(partitionID string, duration time.Duration, err error) {}
+
+func (noopMetrics) OwnedPartitions(count int) {}
+
+func (noopMetrics) CheckpointReapplied(partitionID string) {}
@@ -0,0 +1,196 @@
+package storage
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/Azure/azure-amqp-common-go/uuid"
+	"github.com/Azure/azure-storage-blob-go/2016-05-31/azblob"
+)
+
+const (
+	// CapabilityWrite is the permission to create and overwrite lease blobs
+	CapabilityWrite Capability = "write"
+	// CapabilityRead is the permission to read lease blobs
+	CapabilityRead Capability = "read"
+	// CapabilityLease is the permission to acquire and release blob leases
+	CapabilityLease Capability = "lease"
+	// CapabilityDelete is the permission to delete lease blobs
+	CapabilityDelete Capability = "delete"
+
+	permissionProbePrefix = "permission-probe-"
+
+	// probeCleanupTimeout bounds removing the probe blob, which is done even if the caller's context is done
+	probeCleanupTimeout = 10 * time.Second
+)
+
+type (
+	// Capability names a blob operation the LeaserCheckpointer needs permission to perform
+	Capability string
+
+	// PermissionResult is the outcome of probing a single Capability
+	PermissionResult struct {
+		Allowed    bool
+		StatusCode int
+		Err        error
+	}
+
+	// PermissionReport maps each Capability the LeaserCheckpointer needs to the result of probing it
+	PermissionReport map[Capability]PermissionResult
+)
+
+// Allowed returns true if every probed Capability was allowed
+func (r PermissionReport) Allowed() bool {
+	for _, result := range r {
+		if !result.Allowed {
+			return false
+		}
+	}
+	return len(r) > 0
+}
+
+// Denied returns the capabilities which were not allowed
+func (r PermissionReport) Denied() []Capability {
+	var denied []Capability
+	for _, c := range []Capability{CapabilityWrite, CapabilityRead, CapabilityLease, CapabilityDelete} {
+		if result, ok := r[c]; ok && !result.Allowed {
+			denied = append(denied, c)
+		}
+	}
+	return denied
+}
+
+// VerifyPermissions probes each operation the LeaserCheckpointer needs against a throwaway blob in the container,
+// without touching any partition's lease. Each capability is reported as allowed or denied along with the status code
+// returned by Azure Storage. Capabilities which depend on the probe blob existing are not probed if it can't be
+// written. An error is returned only if the probes couldn't reach Azure Storage at all. The probe blob is removed
+// however probing ends, breaking its lease first if it couldn't be released.
+func (sl *LeaserCheckpointer) VerifyPermissions(ctx context.Context) (PermissionReport, error) {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.VerifyPermissions")
+	defer span.Finish()
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	report := make(PermissionReport)
+	blobURL := sl.containerURL.NewBlobURL(permissionProbePrefix + id.String())
+
+	putRes, err := blobURL.ToBlockBlobURL().PutBlob(ctx, bytes.NewReader([]byte("{}")), sl.blobHTTPHeaders, azblob.Metadata{}, azblob.BlobAccessConditions{})
+	if err != nil {
+		// nothing else can be probed without the blob
+		return report, report.deny(CapabilityWrite, err)
+	}
+	report[CapabilityWrite] = allowed(putRes.StatusCode())
+
+	var leased, deleted bool
+	defer func() {
+		if !deleted {
+			sl.removeProbeBlob(ctx, blobURL, leased)
+		}
+	}()
+
+	getRes, err := blobURL.GetBlob(ctx, azblob.BlobRange{}, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		if err := report.deny(CapabilityRead, err); err != nil {
+			return report, err
+		}
+	} else {
+		_ = getRes.Body().Close()
+		report[CapabilityRead] = allowed(getRes.StatusCode())
+	}
+
+	token, err := sl.newToken()
+	if err != nil {
+		return report, err
+	}
+
+	leaseRes, err := blobURL.AcquireLease(ctx, token, 15, azblob.HTTPAccessConditions{})
+	if err != nil {
+		if err := report.deny(CapabilityLease, err); err != nil {
+			return report, err
+		}
+	} else {
+		report[CapabilityLease] = allowed(leaseRes.StatusCode())
+		leased = true
+		if _, err := blobURL.ReleaseLease(ctx, token, azblob.HTTPAccessConditions{}); err != nil {
+			sl.logger.Error(ctx, "failed to release the permission probe lease", "error", err)
+			if err := report.deny(CapabilityLease, err); err != nil {
+				return report, err
+			}
+		} else {
+			leased = false
+		}
+	}
+
+	deleteRes, err := blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+	if err != nil {
+		if err := report.deny(CapabilityDelete, err); err != nil {
+			return report, err
+		}
+	} else {
+		report[CapabilityDelete] = allowed(deleteRes.StatusCode())
+		deleted = true
+	}
+
+	if !report.Allowed() {
+		sl.logger.Info(ctx, "storage permission probe denied", "denied", report.Denied())
+	}
+	return report, nil
+}
+
+// removeProbeBlob deletes the probe blob left behind by VerifyPermissions, breaking its lease first if it's still
+// leased. Failures are only logged, since the probes have already been reported.
+func (sl *LeaserCheckpointer) removeProbeBlob(ctx context.Context, blobURL azblob.BlobURL, leased bool) {
+	// the caller's context may be why probing ended, so the cleanup isn't bound by it
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), probeCleanupTimeout)
+	defer cancel()
+
+	if leased {
+		if _, err := blobURL.BreakLease(cleanupCtx, 0, azblob.HTTPAccessConditions{}); err != nil {
+			sl.logger.Error(ctx, "failed to break the permission probe lease", "error", err)
+		}
+	}
+	if _, err := blobURL.Delete(cleanupCtx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{}); err != nil {
+		sl.logger.Error(ctx, "failed to remove the permission probe blob", "error", err)
+	}
+}
+
+// deny records a denied probe in the report, returning the error instead if the probe didn't get a response from
+// Azure Storage
+func (r PermissionReport) deny(c Capability, err error) error {
+	storageErr, ok := err.(azblob.StorageError)
+	if !ok || storageErr.Response() == nil {
+		return err
+	}
+	r[c] = PermissionResult{StatusCode: storageErr.Response().StatusCode, Err: err}
+	return nil
+}
+
+func allowed(statusCode int) PermissionResult {
+	return PermissionResult{Allowed: true, StatusCode: statusCode}
+}
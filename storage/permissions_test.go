@@ -0,0 +1,143 @@
+package storage
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyPermissionsReportsDeniedCapabilities(t *testing.T) {
+	var probed string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probed = r.URL.Path
+		switch {
+		case r.Method == http.MethodPut && r.URL.Query().Get("comp") == "lease":
+			w.Header().Set("x-ms-error-code", "AuthorizationPermissionMismatch")
+			w.WriteHeader(http.StatusForbidden)
+		case r.Method == http.MethodPut:
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+	leaser.containerURL = noRetryContainerURL(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	report, err := leaser.VerifyPermissions(ctx)
+	require.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(probed, "/somecontainer/"+permissionProbePrefix), "should only probe a throwaway blob")
+	assert.False(t, report.Allowed())
+	assert.Equal(t, []Capability{CapabilityLease}, report.Denied())
+	assert.Equal(t, http.StatusForbidden, report[CapabilityLease].StatusCode)
+	assert.Equal(t, PermissionResult{Allowed: true, StatusCode: http.StatusCreated}, report[CapabilityWrite])
+	assert.Equal(t, PermissionResult{Allowed: true, StatusCode: http.StatusOK}, report[CapabilityRead])
+	assert.Equal(t, PermissionResult{Allowed: true, StatusCode: http.StatusAccepted}, report[CapabilityDelete])
+}
+
+func TestVerifyPermissionsStopsWhenWriteIsDenied(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+	leaser.containerURL = noRetryContainerURL(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	report, err := leaser.VerifyPermissions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, []Capability{CapabilityWrite}, report.Denied())
+	assert.Len(t, report, 1)
+}
+
+func TestVerifyPermissionsRemovesProbeBlobLeftLeased(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		leased  bool
+		actions []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case r.Method == http.MethodPut && r.URL.Query().Get("comp") == "lease":
+			action := r.Header.Get("x-ms-lease-action")
+			actions = append(actions, action)
+			switch action {
+			case "acquire":
+				leased = true
+				w.WriteHeader(http.StatusCreated)
+			case "break":
+				leased = false
+				w.WriteHeader(http.StatusAccepted)
+			default:
+				w.Header().Set("x-ms-error-code", "AuthorizationPermissionMismatch")
+				w.WriteHeader(http.StatusForbidden)
+			}
+		case r.Method == http.MethodPut:
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodDelete:
+			actions = append(actions, "delete")
+			if leased {
+				w.Header().Set("x-ms-error-code", "LeaseIdMissing")
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.Write([]byte("{}"))
+		}
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+	leaser.containerURL = noRetryContainerURL(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	report, err := leaser.VerifyPermissions(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Capability{CapabilityLease, CapabilityDelete}, report.Denied())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"acquire", "release", "delete", "break", "delete"}, actions, "the probe blob's lease should be broken so it can be deleted")
+	assert.False(t, leased)
+}
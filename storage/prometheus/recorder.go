@@ -0,0 +1,124 @@
+package prometheus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"time"
+
+	"github.com/Azure/azure-event-hubs-go/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	partitionIDLabel = "partition_id"
+	resultLabel      = "result"
+)
+
+type (
+	// PrometheusRecorder is a storage.MetricsRecorder which exports the measurements of a LeaserCheckpointer as
+	// Prometheus metrics:
+	//
+	//	eventhub_lease_acquired_total                    counter of leases acquired or stolen, by partition_id
+	//	eventhub_lease_lost_total                        counter of leases taken by other hosts, by partition_id
+	//	eventhub_checkpoint_persist_duration_seconds     histogram of checkpoint uploads, by partition_id and result
+	//	eventhub_owned_partitions                        gauge of the partitions this host holds leases for
+	//	eventhub_checkpoint_reapplied_total              counter of dropped checkpoints reapplied, by partition_id
+	//
+	// Partition IDs are bounded by the partition count of the Event Hub, so they are safe to use as labels.
+	PrometheusRecorder struct {
+		acquired        *prometheus.CounterVec
+		lost            *prometheus.CounterVec
+		persistDuration *prometheus.HistogramVec
+		owned           prometheus.Gauge
+		reapplied       *prometheus.CounterVec
+	}
+)
+
+var _ storage.MetricsRecorder = (*PrometheusRecorder)(nil)
+
+// NewPrometheusRecorder creates the metrics and registers them with the registerer, such as prometheus.DefaultRegisterer
+// or an application's own registry. The metric names are fixed, so each registerer can only hold the metrics of one
+// LeaserCheckpointer; wrap the registerer with distinguishing labels, such as the Event Hub and consumer group, to
+// export the metrics of several.
+func NewPrometheusRecorder(registerer prometheus.Registerer) (*PrometheusRecorder, error) {
+	r := &PrometheusRecorder{
+		acquired: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "eventhub_lease_acquired_total",
+			Help: "Number of partition leases acquired or stolen by this host.",
+		}, []string{partitionIDLabel}),
+		lost: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "eventhub_lease_lost_total",
+			Help: "Number of partition leases held by this host which were taken by another host.",
+		}, []string{partitionIDLabel}),
+		persistDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "eventhub_checkpoint_persist_duration_seconds",
+			Help:    "Time taken to upload the lease of a partition to persist its checkpoint.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{partitionIDLabel, resultLabel}),
+		owned: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "eventhub_owned_partitions",
+			Help: "Number of partitions this host holds leases for.",
+		}),
+		reapplied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "eventhub_checkpoint_reapplied_total",
+			Help: "Number of checkpoints dropped when a lease was lost which were reapplied after the partition was acquired again.",
+		}, []string{partitionIDLabel}),
+	}
+
+	for _, collector := range []prometheus.Collector{r.acquired, r.lost, r.persistDuration, r.owned, r.reapplied} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// LeaseAcquired increments eventhub_lease_acquired_total for the partition
+func (r *PrometheusRecorder) LeaseAcquired(partitionID string) {
+	r.acquired.WithLabelValues(partitionID).Inc()
+}
+
+// LeaseLost increments eventhub_lease_lost_total for the partition
+func (r *PrometheusRecorder) LeaseLost(partitionID string) {
+	r.lost.WithLabelValues(partitionID).Inc()
+}
+
+// CheckpointPersisted observes the duration in eventhub_checkpoint_persist_duration_seconds for the partition, with a
+// result of "success" or "failure"
+func (r *PrometheusRecorder) CheckpointPersisted(partitionID string, duration time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	r.persistDuration.WithLabelValues(partitionID, result).Observe(duration.Seconds())
+}
+
+// OwnedPartitions sets eventhub_owned_partitions to the count
+func (r *PrometheusRecorder) OwnedPartitions(count int) {
+	r.owned.Set(float64(count))
+}
+
+// CheckpointReapplied increments eventhub_checkpoint_reapplied_total for the partition
+func (r *PrometheusRecorder) CheckpointReapplied(partitionID string) {
+	r.reapplied.WithLabelValues(partitionID).Inc()
+}
@@ -0,0 +1,81 @@
+package prometheus
+
+//	MIT License
+//
+//	Copyright (c) Microsoft Corporation. All rights reserved.
+//
+//	Permission is hereby granted, free of charge, to any person obtaining a copy
+//	of this software and associated documentation files (the "Software"), to deal
+//	in the Software without restriction, including without limitation the rights
+//	to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+//	copies of the Software, and to permit persons to whom the Software is
+//	furnished to do so, subject to the following conditions:
+//
+//	The above copyright notice and this permission notice shall be included in all
+//	copies or substantial portions of the Software.
+//
+//	THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+//	IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+//	FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+//	AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+//	LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+//	OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+//	SOFTWARE
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusRecorderExportsMeasurements(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	recorder, err := NewPrometheusRecorder(registry)
+	require.NoError(t, err)
+
+	recorder.LeaseAcquired("0")
+	recorder.LeaseAcquired("0")
+	recorder.LeaseAcquired("1")
+	recorder.LeaseLost("1")
+	recorder.OwnedPartitions(1)
+	recorder.CheckpointReapplied("0")
+	recorder.CheckpointPersisted("0", 20*time.Millisecond, nil)
+	recorder.CheckpointPersisted("0", time.Second, errors.New("boom"))
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(recorder.acquired.WithLabelValues("0")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(recorder.acquired.WithLabelValues("1")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(recorder.lost.WithLabelValues("1")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(recorder.owned))
+	assert.Equal(t, float64(1), testutil.ToFloat64(recorder.reapplied.WithLabelValues("0")))
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	persists := make(map[string]uint64)
+	for _, family := range families {
+		if family.GetName() != "eventhub_checkpoint_persist_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == resultLabel {
+					persists[label.GetValue()] = metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	assert.Equal(t, map[string]uint64{"success": 1, "failure": 1}, persists)
+}
+
+func TestNewPrometheusRecorderFailsOnDuplicateRegistration(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	_, err := NewPrometheusRecorder(registry)
+	require.NoError(t, err)
+
+	_, err = NewPrometheusRecorder(registry)
+	assert.Error(t, err, "the metric names should already be registered")
+}
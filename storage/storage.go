@@ -30,11 +30,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
 	"net/url"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/Azure/azure-amqp-common-go/log"
 	"github.com/Azure/azure-amqp-common-go/persist"
 	"github.com/Azure/azure-amqp-common-go/uuid"
 	"github.com/Azure/azure-event-hubs-go"
@@ -46,30 +51,182 @@ import (
 	"github.com/Azure/go-autorest/autorest/azure"
 )
 
+const (
+	leaseContentType = "application/json"
+	partitionIDTag   = "eh.eventprocessorhost.partitionID"
+	instanceIDTag    = "eh.eventprocessorhost.instanceID"
+	blobNameTag      = "eh.eventprocessorhost.blobName"
+
+	leaseChangeBuffer  = 64
+	persistErrorBuffer = 64
+
+	// warmStartTimeout bounds loading the leases held by this host when the EventProcessorHost is set
+	warmStartTimeout = 30 * time.Second
+
+	// persistInitialDelay is how long the persistence loop waits before first persisting dirty leases
+	persistInitialDelay = 5 * time.Second
+	// persistInterval is how long the persistence loop waits between persisting dirty leases
+	persistInterval = time.Second
+	// persistTimeout bounds persisting a single dirty lease
+	persistTimeout = 20 * time.Second
+
+	// DefaultLivenessThreshold is the default time since the persistence loop last ticked after which Liveness fails. It
+	// is two persist intervals plus the persist timeout rather than just two intervals, since a tick waits for its
+	// persists and a slow but healthy call to Azure Storage would otherwise fail the probe and restart the host.
+	DefaultLivenessThreshold = persistTimeout + 2*persistInterval
+
+	// DefaultEnsureStoreAttempts is the default number of times EnsureStore tries to create the container
+	DefaultEnsureStoreAttempts = 3
+
+	// DefaultEnsureStoreRetryDelay is the default delay before EnsureStore retries creating the container, which grows
+	// with each attempt
+	DefaultEnsureStoreRetryDelay = time.Second
+
+	// DefaultMaxConcurrentPersists is the default number of partitions persisted to Azure Storage at once
+	DefaultMaxConcurrentPersists = 16
+
+	// leaseSchemaVersion is the version of the lease blob format written by this package. Version 0 blobs were
+	// written before the version was recorded and share the version 1 format.
+	leaseSchemaVersion = 1
+
+	// MinLeaseDuration is the shortest fixed duration Azure Storage allows for a blob lease
+	MinLeaseDuration = 15 * time.Second
+
+	// MaxLeaseDuration is the longest fixed duration Azure Storage allows for a blob lease
+	MaxLeaseDuration = 60 * time.Second
+
+	// InfiniteLeaseDuration configures blob leases which never expire; see WithLeaseDuration
+	InfiniteLeaseDuration time.Duration = -1
+
+	// maxLeaseUploadAttempts bounds how many times a lease upload is tried when the blob keeps changing underneath it
+	maxLeaseUploadAttempts = 3
+)
+
+var (
+	// ErrStorageUnauthorized indicates the credential isn't authorized to access the container
+	ErrStorageUnauthorized = errors.New("storage: the credential is not authorized to access the container")
+
+	// ErrStorageContainerNotFound indicates the container doesn't exist
+	ErrStorageContainerNotFound = errors.New("storage: the container does not exist")
+
+	// ErrStorageThrottled indicates Azure Storage is throttling requests to the account
+	ErrStorageThrottled = errors.New("storage: requests to the account are being throttled")
+
+	// ErrEventNotReceived indicates an event can't be checkpointed because it lacks the offset and sequence number
+	// system properties set by Event Hubs, such as an event constructed client-side
+	ErrEventNotReceived = errors.New("storage: the event has no system properties to checkpoint; was it received from Event Hubs?")
+
+	// ErrStoreNotFound is returned by GetLeases and AcquireLease when the container doesn't exist, such as when
+	// EnsureStore was never called or the container was deleted while the host was running. It is the same error as
+	// eph.ErrStoreNotFound, so the EventProcessorHost recreates the container and retries.
+	ErrStoreNotFound = eph.ErrStoreNotFound
+
+	// ErrPartitionNotOwned is returned when checkpointing a partition whose lease isn't held by this host. The
+	// checkpoint is not recorded.
+	ErrPartitionNotOwned = errors.New("storage: lease for partition isn't owned by this EventProcessorHost")
+)
+
 type (
 	// LeaserCheckpointer implements the eph.LeaserCheckpointer interface for Azure Storage
 	LeaserCheckpointer struct {
+		// persistTick is the time, in Unix nanoseconds, the persistence loop last ticked, or 0 if it isn't running. It is
+		// accessed atomically, so it is kept first in the struct for 64-bit alignment.
+		persistTick     int64
 		leases          map[string]*storageLease
 		processor       *eph.EventProcessorHost
 		leaseDuration   time.Duration
 		credential      Credential
 		containerURL    *azblob.ContainerURL
+		blobClient      blobClient
 		serviceURL      *azblob.ServiceURL
 		containerName   string
 		accountName     string
 		env             azure.Environment
-		dirtyPartitions map[string]uuid.UUID
+		dirtyPartitions map[string]string
 		leasesMu        sync.Mutex
+		leasesMapMu     sync.RWMutex
 		dirtyMu         sync.Mutex
 		done            func()
+
+		containerMetadata   azblob.Metadata
+		forceMetadataUpdate bool
+		dirtySince          map[string]time.Time
+		backlogThreshold    time.Duration
+		backlogAlert        func(count int)
+		allowRewind         bool
+		evictOnDelete       bool
+		lenientCheckpoint   bool
+		compression         Compression
+		onLeaseLost         func(partitionID string)
+		maxPersists         int
+		livenessThreshold   time.Duration
+		synchronous         bool
+		warmStart           bool
+		separateCheckpoints bool
+		droppedLimit        int
+		dropped             map[string]*persist.Checkpoint
+		droppedMu           sync.Mutex
+		instanceID          string
+		operationTimeout    time.Duration
+		createAttempts      int
+		createRetryDelay    time.Duration
+		blobHTTPHeaders     azblob.BlobHTTPHeaders
+		leaseMetadata       azblob.Metadata
+		watchers            []chan LeaseChange
+		watchMu             sync.Mutex
+		watchClosed         chan struct{}
+		minPersistInterval  time.Duration
+		lastPersisted       map[string]time.Time
+		verifyOwnership     bool
+		onViolation         func(*OwnershipViolationError)
+		mirror              eph.Checkpointer
+		clock               clock
+		secondaryURL        *azblob.ContainerURL
+		endpointOverride    func(accountName string) (*url.URL, error)
+		logger              Logger
+		metrics             MetricsRecorder
+		spanDecorator       func(opentracing.Span)
+		newToken            func() (string, error)
+		persistErrs         chan error
+		persistErrsMu       sync.Mutex
+		persistErrsClosed   bool
+	}
+
+	// PartitionRuntime is the runtime information of a partition, as returned by eventhub.Hub.GetPartitionInformation
+	PartitionRuntime = eventhub.HubPartitionRuntimeInformation
+
+	// LeaseChange describes a change in the ownership of a partition's lease as seen by this host
+	LeaseChange struct {
+		PartitionID string
+		OldOwner    string
+		NewOwner    string
+		Timestamp   time.Time
 	}
 
+	// LeaserCheckpointerOption provides configuration options for a LeaserCheckpointer
+	LeaserCheckpointerOption func(*LeaserCheckpointer) error
+
 	storageLease struct {
 		*eph.Lease
 		leaser     *LeaserCheckpointer
 		Checkpoint *persist.Checkpoint   `json:"checkpoint"`
 		State      azblob.LeaseStateType `json:"state"`
 		Token      string                `json:"token"`
+		// InstanceID identifies the running instance of the host which last claimed the lease; see DetectSplitBrain
+		InstanceID string `json:"instanceID,omitempty"`
+		// SchemaVersion is the version of the lease blob format; see leaseSchemaVersion
+		SchemaVersion int `json:"schemaVersion,omitempty"`
+		renewedAt     time.Time
+		// etag is the ETag of the lease blob as of this host's last read or write of it. It is only used by operations
+		// holding the leaser's leasesMu.
+		etag azblob.ETag
+		// checkpointETag is the ETag of the checkpoint blob as of this host's last read or write of it, or empty if the
+		// blob didn't exist, when checkpoints are stored separately; see putCheckpointBlob. Like etag, it is only used by
+		// operations holding the leaser's leasesMu.
+		checkpointETag azblob.ETag
+
+		// checkpointMu guards Checkpoint, which is updated without holding the leaser's leasesMu
+		checkpointMu sync.Mutex
 	}
 
 	// Credential is a wrapper for the Azure Storage azblob.Credential
@@ -86,540 +243,3329 @@ type (
 		PartitionID string
 		Err         error
 	}
-)
 
-// NewStorageLeaserCheckpointer builds an Azure Storage Leaser Checkpointer which handles leasing and checkpointing for
-// the EventProcessorHost
-func NewStorageLeaserCheckpointer(credential Credential, accountName, containerName string, env azure.Environment) (*LeaserCheckpointer, error) {
-	storageURL, err := url.Parse("https://" + accountName + ".blob." + env.StorageEndpointSuffix)
-	if err != nil {
-		return nil, err
+	leaseStateResult struct {
+		PartitionID string
+		State       azblob.LeaseStateType
+		Err         error
 	}
 
-	svURL := azblob.NewServiceURL(*storageURL, azblob.NewPipeline(credential, azblob.PipelineOptions{}))
-	containerURL := svURL.NewContainerURL(containerName)
-
-	return &LeaserCheckpointer{
-		credential:      credential,
-		containerName:   containerName,
-		accountName:     accountName,
-		leaseDuration:   eph.DefaultLeaseDuration,
-		env:             env,
-		serviceURL:      &svURL,
-		containerURL:    &containerURL,
-		leases:          make(map[string]*storageLease),
-		dirtyPartitions: make(map[string]uuid.UUID),
-	}, nil
-}
-
-// SetEventHostProcessor sets the EventHostProcessor on the instance of the LeaserCheckpointer
-func (sl *LeaserCheckpointer) SetEventHostProcessor(eph *eph.EventProcessorHost) {
-	sl.processor = eph
-	ctx, cancel := context.WithCancel(context.Background())
-	go sl.persistLeases(ctx)
-	sl.done = cancel
-}
-
-// StoreExists returns true if the storage container exists
-func (sl *LeaserCheckpointer) StoreExists(ctx context.Context) (bool, error) {
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.StoreExists")
-	defer span.Finish()
+	// OwnershipInfo describes the ownership and checkpoint recorded in a partition's lease blob
+	OwnershipInfo struct {
+		Owner      string
+		Epoch      int64
+		State      azblob.LeaseStateType
+		Checkpoint *persist.Checkpoint
+	}
 
-	opts := azblob.ListContainersOptions{
-		Prefix: sl.containerName,
+	ownershipResult struct {
+		BlobName string
+		Lease    *storageLease
+		Err      error
 	}
-	res, err := sl.serviceURL.ListContainers(ctx, azblob.Marker{}, opts)
-	if err != nil {
-		return false, err
+
+	// ErrUnsupportedLeaseVersion is returned when reading a lease blob written in a newer format than this version of the
+	// package understands, such as during a rolling upgrade
+	ErrUnsupportedLeaseVersion struct {
+		PartitionID      string
+		Version          int
+		SupportedVersion int
 	}
 
-	for _, container := range res.Containers {
-		if container.Name == sl.containerName {
-			return true, nil
-		}
+	// ErrCheckpointRegression is returned by UpdateCheckpoint when the checkpoint would move the sequence number of the
+	// partition backwards and WithAllowRewind is not set
+	ErrCheckpointRegression struct {
+		PartitionID       string
+		StoredSequence    int64
+		AttemptedSequence int64
 	}
-	return false, nil
-}
 
-// EnsureStore creates the container if it does not exist
-func (sl *LeaserCheckpointer) EnsureStore(ctx context.Context) error {
-	sl.leasesMu.Lock()
-	defer sl.leasesMu.Unlock()
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.EnsureStore")
-	defer span.Finish()
+	// HealthCheckError is returned by HealthCheck when the container can't be reached. Reason is one of the
+	// ErrStorage errors when the failure is recognized, and Err is the error returned by Azure Storage.
+	HealthCheckError struct {
+		Reason error
+		Err    error
+	}
 
-	ok, err := sl.StoreExists(ctx)
-	if err != nil {
-		return err
+	// StorageOperationError wraps an error returned by Azure Storage with the details Azure support needs to trace the
+	// failing request, such as the x-ms-request-id of the operation
+	StorageOperationError struct {
+		Operation   string
+		PartitionID string
+		RequestID   string
+		StatusCode  int
+		ServiceCode azblob.ServiceCodeType
+		Err         error
 	}
 
-	if !ok {
-		containerURL := sl.serviceURL.NewContainerURL(sl.containerName)
-		_, err := containerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone)
-		if err != nil {
-			return err
-		}
-		sl.containerURL = &containerURL
+	// FinalCheckpointError is returned by ReleaseLease when the lease was released, but the latest checkpoint could not
+	// be uploaded beforehand, so the next owner may reprocess events
+	FinalCheckpointError struct {
+		PartitionID string
+		Err         error
 	}
-	return nil
-}
 
-// DeleteStore deletes the Azure Storage container
-func (sl *LeaserCheckpointer) DeleteStore(ctx context.Context) error {
-	sl.leasesMu.Lock()
-	defer sl.leasesMu.Unlock()
+	// PersistError is sent on the channel returned by Errors when the background loop fails to persist the lease and
+	// checkpoint of a partition
+	PersistError struct {
+		PartitionID string
+		Err         error
+	}
 
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.DeleteStore")
-	defer span.Finish()
+	// OwnershipViolationError is returned when re-reading a lease which this host has just acquired shows that it is
+	// held by another owner or token, meaning more than one host believes it owns the partition
+	OwnershipViolationError struct {
+		PartitionID   string
+		ExpectedOwner string
+		ExpectedToken string
+		ActualOwner   string
+		ActualToken   string
+		State         azblob.LeaseStateType
+	}
 
-	_, err := sl.containerURL.Delete(ctx, azblob.ContainerAccessConditions{})
-	return err
-}
+	// PartitionErrors holds the errors encountered for each partition in an operation spanning several partitions
+	PartitionErrors map[string]error
 
-// GetLeases gets all of the partition leases
-func (sl *LeaserCheckpointer) GetLeases(ctx context.Context) ([]eph.LeaseMarker, error) {
-	sl.leasesMu.Lock()
-	defer sl.leasesMu.Unlock()
+	// LeaseConflictError is returned when a lease can't be taken because the blob lease is in the middle of a
+	// transition, such as being broken or changed by another host
+	LeaseConflictError struct {
+		PartitionID string
+		State       azblob.LeaseStateType
+		Err         error
+	}
+)
 
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.GetLeases")
-	defer span.Finish()
+// NewStorageLeaserCheckpointer builds an Azure Storage Leaser Checkpointer which handles leasing and checkpointing for
+// the EventProcessorHost
+func NewStorageLeaserCheckpointer(credential Credential, accountName, containerName string, env azure.Environment, opts ...LeaserCheckpointerOption) (*LeaserCheckpointer, error) {
+	sl := newLeaserCheckpointer(nil, accountName, containerName, env)
+	sl.credential = credential
+	if err := sl.setAccountURLs(); err != nil {
+		return nil, err
+	}
 
-	partitionIDs := sl.processor.GetPartitionIDs()
-	leaseCh := make(chan leaseGetResult)
-	for idx, partitionID := range partitionIDs {
-		go func(i int, pID string) {
-			lease, err := sl.getLease(ctx, pID)
-			leaseCh <- leaseGetResult{
-				Lease: lease,
-				Err:   err,
-			}
-		}(idx, partitionID)
+	sl, err := sl.withOptions(opts...)
+	if err != nil {
+		return nil, err
 	}
 
-	leases := make([]eph.LeaseMarker, len(partitionIDs))
-	for i := 0; i < len(partitionIDs); i++ {
-		select {
-		case <-ctx.Done():
-			return leases, ctx.Err()
-		case result := <-leaseCh:
-			if result.Err != nil {
-				return nil, result.Err
-			}
-			leases[i] = result.Lease
+	if sl.endpointOverride != nil {
+		// the options may have been applied before the override, so the endpoints are built again with it
+		if err := sl.setAccountURLs(); err != nil {
+			return nil, err
 		}
 	}
-	return leases, nil
+	return sl, nil
 }
 
-// EnsureLease creates a lease in the container if it doesn't exist
-func (sl *LeaserCheckpointer) EnsureLease(ctx context.Context, partitionID string) (eph.LeaseMarker, error) {
-	sl.leasesMu.Lock()
-	defer sl.leasesMu.Unlock()
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.EnsureLease")
-	defer span.Finish()
+// setAccountURLs builds the service and container URLs of the primary endpoint, and of the secondary endpoint if one
+// is configured, from the account name
+func (sl *LeaserCheckpointer) setAccountURLs() error {
+	storageURL, err := sl.accountURL(sl.accountName)
+	if err != nil {
+		return err
+	}
+	svURL := azblob.NewServiceURL(*storageURL, azblob.NewPipeline(sl.credential, azblob.PipelineOptions{}))
+	containerURL := svURL.NewContainerURL(sl.containerName)
+	sl.serviceURL = &svURL
+	sl.containerURL = &containerURL
 
-	return sl.createOrGetLease(ctx, partitionID)
+	if sl.secondaryURL != nil {
+		return sl.setSecondaryURL()
+	}
+	return nil
 }
 
-// DeleteLease deletes a lease in the storage container
-func (sl *LeaserCheckpointer) DeleteLease(ctx context.Context, partitionID string) error {
-	sl.leasesMu.Lock()
-	defer sl.leasesMu.Unlock()
+// setSecondaryURL builds the container URL of the read-only secondary endpoint of the account
+func (sl *LeaserCheckpointer) setSecondaryURL() error {
+	storageURL, err := sl.accountURL(sl.accountName + "-secondary")
+	if err != nil {
+		return err
+	}
+	svURL := azblob.NewServiceURL(*storageURL, azblob.NewPipeline(sl.credential, azblob.PipelineOptions{}))
+	containerURL := svURL.NewContainerURL(sl.containerName)
+	sl.secondaryURL = &containerURL
+	return nil
+}
 
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.DeleteLease")
-	defer span.Finish()
+// accountURL returns the blob endpoint of the storage account, as returned by the endpoint override if one is
+// configured, or https://{account}.blob.{StorageEndpointSuffix} otherwise
+func (sl *LeaserCheckpointer) accountURL(accountName string) (*url.URL, error) {
+	if sl.endpointOverride == nil {
+		return url.Parse("https://" + accountName + ".blob." + sl.env.StorageEndpointSuffix)
+	}
 
-	_, err := sl.containerURL.NewBlobURL(partitionID).Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
-	delete(sl.leases, partitionID)
-	return err
+	u, err := sl.endpointOverride(accountName)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("the endpoint override for account %q must return an absolute http or https URL, but returned %v", accountName, u)
+	}
+	return u, nil
 }
 
-// AcquireLease acquires the lease to the Azure blob in the container
-func (sl *LeaserCheckpointer) AcquireLease(ctx context.Context, partitionID string) (eph.LeaseMarker, bool, error) {
-	sl.leasesMu.Lock()
-	defer sl.leasesMu.Unlock()
-
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.AcquireLease")
-	defer span.Finish()
+// NewStorageLeaserCheckpointerFromContainerURL builds an Azure Storage Leaser Checkpointer which uses an existing
+// container URL, along with its pipeline and credential, for every call to Azure Storage. The account and container
+// names are derived from the URL, which may be either https://{account}.blob.{suffix}/{container} or, as used by the
+// storage emulator, {endpoint}/{account}/{container}.
+//
+// Since the leaser only has access to the container, StoreExists checks for the container by fetching its properties
+// rather than listing the containers in the account, and WithSecondaryReadEndpoint is not supported.
+func NewStorageLeaserCheckpointerFromContainerURL(containerURL *azblob.ContainerURL, env azure.Environment, opts ...LeaserCheckpointerOption) (*LeaserCheckpointer, error) {
+	if containerURL == nil {
+		return nil, errors.New("container URL must not be nil")
+	}
 
-	blobURL := sl.containerURL.NewBlobURL(partitionID)
-	lease, err := sl.getLease(ctx, partitionID)
+	accountName, containerName, err := parseContainerURL(containerURL.URL())
 	if err != nil {
-		log.For(ctx).Error(err)
-		return nil, false, nil
+		return nil, err
 	}
 
-	res, err := blobURL.GetPropertiesAndMetadata(ctx, azblob.BlobAccessConditions{})
+	sl := newLeaserCheckpointer(containerURL, accountName, containerName, env)
+	sl, err = sl.withOptions(opts...)
 	if err != nil {
-		log.For(ctx).Error(err)
-		return nil, false, err
+		return nil, err
 	}
 
-	uuidToken, err := uuid.NewV4()
-	if err != nil {
-		log.For(ctx).Error(err)
-		return nil, false, err
+	if sl.endpointOverride != nil {
+		return nil, errors.New("the endpoint override requires a leaser built with a credential, rather than a container URL")
 	}
+	return sl, nil
+}
 
-	newToken := uuidToken.String()
-	if res.LeaseState() == azblob.LeaseStateLeased {
-		// is leased by someone else due to a race to acquire
-		_, err := blobURL.ChangeLease(ctx, lease.Token, newToken, azblob.HTTPAccessConditions{})
-		if err != nil {
-			log.For(ctx).Error(err)
-			return nil, false, err
-		}
-	} else {
-		_, err = blobURL.AcquireLease(ctx, newToken, int32(sl.leaseDuration.Round(time.Second).Seconds()), azblob.HTTPAccessConditions{})
-		if err != nil {
-			log.For(ctx).Error(err)
-			return nil, false, err
+// parseContainerURL returns the account and container names of a container URL
+func parseContainerURL(u url.URL) (string, string, error) {
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch {
+	case len(segments) == 1 && segments[0] != "":
+		host := u.Hostname()
+		if idx := strings.Index(host, "."); idx > 0 {
+			return host[:idx], segments[0], nil
 		}
+	case len(segments) == 2 && segments[0] != "" && segments[1] != "":
+		return segments[0], segments[1], nil
 	}
+	return "", "", fmt.Errorf("could not determine the account and container from the container URL %q", u.String())
+}
 
-	lease.Token = newToken
-	lease.Owner = sl.processor.GetName()
-	lease.IncrementEpoch()
-	err = sl.uploadLease(ctx, lease)
-	if err != nil {
-		return nil, false, err
+func newLeaserCheckpointer(containerURL *azblob.ContainerURL, accountName, containerName string, env azure.Environment) *LeaserCheckpointer {
+	return &LeaserCheckpointer{
+		containerName:   containerName,
+		accountName:     accountName,
+		leaseDuration:   eph.DefaultLeaseDuration,
+		env:             env,
+		containerURL:    containerURL,
+		leases:          make(map[string]*storageLease),
+		dirtyPartitions: make(map[string]string),
+		dirtySince:      make(map[string]time.Time),
+		logger:          spanLogger{},
+		newToken:        newUUIDToken,
+		metrics:         noopMetrics{},
+		blobHTTPHeaders: azblob.BlobHTTPHeaders{
+			ContentType: leaseContentType,
+		},
+		watchClosed:       make(chan struct{}),
+		lastPersisted:     make(map[string]time.Time),
+		dropped:           make(map[string]*persist.Checkpoint),
+		clock:             realClock{},
+		persistErrs:       make(chan error, persistErrorBuffer),
+		maxPersists:       DefaultMaxConcurrentPersists,
+		livenessThreshold: DefaultLivenessThreshold,
+		createAttempts:    DefaultEnsureStoreAttempts,
+		createRetryDelay:  DefaultEnsureStoreRetryDelay,
 	}
-	sl.leases[partitionID] = lease
-	return lease, true, nil
 }
 
-// RenewLease renews the lease to the Azure blob
-func (sl *LeaserCheckpointer) RenewLease(ctx context.Context, partitionID string) (eph.LeaseMarker, bool, error) {
-	sl.leasesMu.Lock()
-	defer sl.leasesMu.Unlock()
+func (sl *LeaserCheckpointer) withOptions(opts ...LeaserCheckpointerOption) (*LeaserCheckpointer, error) {
+	for _, opt := range opts {
+		if err := opt(sl); err != nil {
+			return nil, err
+		}
+	}
 
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.RenewLease")
-	defer span.Finish()
+	return sl, nil
+}
 
-	blobURL := sl.containerURL.NewBlobURL(partitionID)
-	lease, ok := sl.leases[partitionID]
-	if !ok {
-		return nil, false, errors.New("lease was not found")
+// WithContainerMetadata configures the metadata the container is created with by EnsureStore. If the container
+// already exists, its metadata is left untouched unless WithForceMetadataUpdate is also specified.
+func WithContainerMetadata(metadata azblob.Metadata) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		sl.containerMetadata = metadata
+		return nil
 	}
+}
 
-	_, err := blobURL.RenewLease(ctx, lease.Token, azblob.HTTPAccessConditions{})
-	if err != nil {
-		log.For(ctx).Error(err)
-		return nil, false, err
+// WithForceMetadataUpdate configures EnsureStore to overwrite the metadata of an existing container with the metadata
+// provided by WithContainerMetadata
+func WithForceMetadataUpdate() LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		sl.forceMetadataUpdate = true
+		return nil
 	}
-	return lease, true, nil
 }
 
-// ReleaseLease releases the lease to the blob in Azure storage
-func (sl *LeaserCheckpointer) ReleaseLease(ctx context.Context, partitionID string) (bool, error) {
-	sl.leasesMu.Lock()
-	defer sl.leasesMu.Unlock()
-
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.ReleaseLease")
-	defer span.Finish()
+// WithBacklogAlert configures a callback which is called when checkpoints have been waiting to be persisted to Azure
+// Storage for longer than the threshold, which usually means the persistence loop is stuck or falling behind. The
+// callback receives the number of partitions whose checkpoints have been pending for longer than the threshold and
+// is called each time the backlog is checked until those checkpoints are persisted.
+func WithBacklogAlert(threshold time.Duration, alert func(count int)) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if threshold <= 0 {
+			return errors.New("backlog alert threshold must be greater than 0")
+		}
+		sl.backlogThreshold = threshold
+		sl.backlogAlert = alert
+		return nil
+	}
+}
 
-	blobURL := sl.containerURL.NewBlobURL(partitionID)
-	lease, ok := sl.leases[partitionID]
-	if !ok {
-		return false, errors.New("lease was not found")
+// WithMonotonicCheckpoints configures UpdateCheckpoint to reject a checkpoint with a lower sequence number than the one
+// already stored for the partition with an *ErrCheckpointRegression.
+//
+// Deprecated: rejecting rewinds is the default, so the option only undoes an earlier WithAllowRewind. Leave out
+// WithAllowRewind instead.
+func WithMonotonicCheckpoints() LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		sl.allowRewind = false
+		return nil
 	}
+}
 
-	_, err := blobURL.ReleaseLease(ctx, lease.Token, azblob.HTTPAccessConditions{})
-	if err != nil {
-		log.For(ctx).Error(err)
-		return false, err
+// WithAllowRewind configures UpdateCheckpoint to store a checkpoint with a lower sequence number than the one already
+// stored for the partition, rather than rejecting it with an *ErrCheckpointRegression. The rewind is logged at info
+// level. Use this when handlers intentionally move a partition back to reprocess events.
+func WithAllowRewind() LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		sl.allowRewind = true
+		return nil
 	}
-	delete(sl.leases, partitionID)
-	delete(sl.dirtyPartitions, partitionID)
-	return true, nil
 }
 
-// UpdateLease renews and uploads the latest lease to the blob store
-func (sl *LeaserCheckpointer) UpdateLease(ctx context.Context, partitionID string) (eph.LeaseMarker, bool, error) {
-	sl.leasesMu.Lock()
-	defer sl.leasesMu.Unlock()
+// WithLenientCheckpoint configures UpdateCheckpoint to log and skip a checkpoint for a partition this host doesn't own,
+// rather than returning ErrPartitionNotOwned. During a rebalance, the goroutine handling
+// a partition's events may still be draining them after the lease has been lost to another host; its checkpoints can
+// safely be dropped since the new owner resumes from the last persisted checkpoint.
+func WithLenientCheckpoint() LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		sl.lenientCheckpoint = true
+		return nil
+	}
+}
 
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.UpdateLease")
-	defer span.Finish()
+// WithCheckpointEvictionOnDelete configures DeleteCheckpoint to remove the checkpoint from the lease rather than
+// resetting it to the start of the stream, so the next owner of the partition starts from the EventProcessorHost's
+// default start position.
+func WithCheckpointEvictionOnDelete() LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		sl.evictOnDelete = true
+		return nil
+	}
+}
 
-	return sl.updateLease(ctx, partitionID)
+// WithBlobHTTPHeaders configures the HTTP headers, such as Cache-Control or Content-Disposition, which are set on the
+// lease blobs each time they are written. If no content type is specified, the lease blobs are stored as
+// application/json.
+func WithBlobHTTPHeaders(headers azblob.BlobHTTPHeaders) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if headers.ContentType == "" {
+			headers.ContentType = leaseContentType
+		}
+		sl.blobHTTPHeaders = headers
+		return nil
+	}
 }
 
-func (sl *LeaserCheckpointer) updateLease(ctx context.Context, partitionID string) (eph.LeaseMarker, bool, error) {
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.updateLease")
-	defer span.Finish()
+// WithLeaseDuration configures the duration of the blob leases taken on partitions, which must be between
+// MinLeaseDuration and MaxLeaseDuration once rounded to the second. The default is eph.DefaultLeaseDuration. A lease
+// which isn't renewed within the duration expires, letting other hosts take the partition.
+//
+// InfiniteLeaseDuration configures leases which never expire, so a partition held by a host which dies without
+// releasing it stays unavailable until its lease is broken, such as with BreakLease.
+func WithLeaseDuration(d time.Duration) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if d == InfiniteLeaseDuration {
+			sl.leaseDuration = d
+			return nil
+		}
 
-	blobURL := sl.containerURL.NewBlobURL(partitionID)
-	lease, ok := sl.leases[partitionID]
-	if !ok {
-		return nil, false, errors.New("lease was not found")
+		rounded := d.Round(time.Second)
+		if rounded < MinLeaseDuration || rounded > MaxLeaseDuration {
+			return fmt.Errorf("lease duration %v is outside the %v to %v range allowed for blob leases", d, MinLeaseDuration, MaxLeaseDuration)
+		}
+		sl.leaseDuration = rounded
+		return nil
 	}
+}
 
-	_, err := blobURL.RenewLease(ctx, lease.Token, azblob.HTTPAccessConditions{})
-	if err != nil {
-		log.For(ctx).Error(err)
-		return nil, false, err
+// WithSeparateCheckpointBlobs stores the checkpoint of each partition in a "<partition ID>.checkpoint" blob, holding
+// only the JSON encoded checkpoint, rather than in the partition's lease blob. Persisting a checkpoint then renews the
+// lease and writes the small checkpoint blob, conditioned on its ETag so a host which lost the lease can't write over
+// the new owner's checkpoint, and the checkpoint can be read without decoding the lease. The lease blob still records
+// the checkpoint when the lease is acquired or released, so hosts which don't store checkpoints separately keep working
+// during a rolling upgrade.
+//
+// Existing lease blobs are migrated as they are used: a partition without a checkpoint blob starts from the checkpoint
+// in its lease blob, and the checkpoint blob is created when its next checkpoint is persisted.
+func WithSeparateCheckpointBlobs() LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		sl.separateCheckpoints = true
+		return nil
 	}
+}
 
-	if !ok {
-		return nil, false, errors.New("could not renew lease when updating lease")
+// WithDroppedCheckpointBuffer keeps the checkpoints of up to size partitions which couldn't be persisted because the
+// lease was lost, and applies them when this host acquires the partition again. A lease which bounces to another host
+// and back, such as when a renewal was delayed past the lease duration, then keeps the progress checkpointed while it
+// was held rather than dropping it. A buffered checkpoint is only applied if it is further along than the checkpoint in
+// the lease blob, so the progress of a host which held the partition in between is never written over. Once size
+// partitions are buffered, checkpoints dropped for further partitions are discarded as they are without the buffer.
+//
+// A checkpoint is buffered when renewing the lease before persisting it fails, or when the write is rejected because
+// another host took the lease after it was renewed. With WithSeparateCheckpointBlobs the lease is still renewed before
+// each checkpoint blob is written, so checkpoints dropped there are buffered too.
+func WithDroppedCheckpointBuffer(size int) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if size <= 0 {
+			return errors.New("dropped checkpoint buffer size must be greater than 0")
+		}
+		sl.droppedLimit = size
+		return nil
+	}
+}
+
+// WithSpanDecorator calls decorate with each span the LeaserCheckpointer starts, after its default tags are set, so
+// callers can attach their own tags or baggage, such as a tenant or correlation ID, to correlate the leaser's spans
+// with their request traces. It is called last, so it may also override the default tags.
+func WithSpanDecorator(decorate func(opentracing.Span)) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if decorate == nil {
+			return errors.New("span decorator must not be nil")
+		}
+		sl.spanDecorator = decorate
+		return nil
+	}
+}
+
+// WithOperationTimeout bounds each call made to Azure Storage to read, acquire, change, renew or upload a lease by d,
+// so a single hung connection fails fast rather than stalling an operation spanning many partitions, such as GetLeases,
+// until the caller's context is done. The timeout of each call is derived from the caller's context, so cancelling the
+// context still cancels the call. By default, calls are only bounded by the caller's context.
+func WithOperationTimeout(d time.Duration) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if d <= 0 {
+			return fmt.Errorf("operation timeout must be positive, but was %v", d)
+		}
+		sl.operationTimeout = d
+		return nil
+	}
+}
+
+// WithWarmStart loads the leases this host holds into memory when the EventProcessorHost is set, so checkpoints of
+// partitions it still holds from before a restart are read from their lease blobs rather than falling back to the start
+// of the stream. Only blobs which are leased and name this host as their owner are loaded; no lease is acquired or
+// written. If the leases can't be loaded, such as when the container doesn't exist yet, the error is logged and the
+// host starts cold.
+func WithWarmStart() LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		sl.warmStart = true
+		return nil
+	}
+}
+
+// WithTokenGenerator configures the function generating the lease IDs used to acquire blob leases and the IDs marking
+// checkpoints to be persisted, so tests can predict the lease IDs or fail their generation. Each call must return a
+// new, unique token, and lease IDs must be in a GUID format accepted by Azure Storage. By default, random UUIDs are
+// generated.
+func WithTokenGenerator(generator func() (string, error)) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if generator == nil {
+			return errors.New("token generator must not be nil")
+		}
+		sl.newToken = generator
+		return nil
+	}
+}
+
+// WithLeaseMetadata configures metadata, such as a tenant identifier for cost attribution, which is set on the lease
+// blobs each time they are written, so it is kept as leases are updated and can be read by listing the blobs
+func WithLeaseMetadata(metadata map[string]string) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		leaseMetadata := make(azblob.Metadata, len(metadata))
+		for key, value := range metadata {
+			if key == "" {
+				return errors.New("lease metadata keys must not be empty")
+			}
+			leaseMetadata[key] = value
+		}
+		sl.leaseMetadata = leaseMetadata
+		return nil
+	}
+}
+
+// WithMinCheckpointInterval configures the minimum amount of time between writes of a partition's checkpoint to Azure
+// Storage. If a partition's checkpoint was persisted more recently than the interval, it stays dirty until the interval
+// has passed and then the newest checkpoint is written. This caps the storage transactions spent on partitions which
+// checkpoint at a high rate, at the cost of reprocessing up to the interval's worth of events after a failure.
+func WithMinCheckpointInterval(d time.Duration) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if d < 0 {
+			return errors.New("minimum checkpoint interval must not be negative")
+		}
+		sl.minPersistInterval = d
+		return nil
+	}
+}
+
+// WithSynchronousCheckpoints configures UpdateCheckpoint to upload the lease to Azure Storage before returning, rather
+// than recording the checkpoint in memory for the background loop to persist, which is then not started. A checkpoint
+// is durable once UpdateCheckpoint returns without error, so no events are reprocessed past it after a failure. The
+// cost is a storage write, taken while holding the leaser's operation lock, for each checkpoint: expect the latency of
+// UpdateCheckpoint to be that of a blob upload, and checkpoint throughput to be limited by the storage account.
+func WithSynchronousCheckpoints() LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		sl.synchronous = true
+		return nil
+	}
+}
+
+// WithEnsureStoreRetry configures how many times EnsureStore tries to create the container when Azure Storage fails
+// with a transient error, and the delay before the first retry, which grows linearly with each attempt
+func WithEnsureStoreRetry(attempts int, delay time.Duration) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if attempts < 1 {
+			return errors.New("ensure store attempts must be at least 1")
+		}
+		if delay < 0 {
+			return errors.New("ensure store retry delay must not be negative")
+		}
+		sl.createAttempts = attempts
+		sl.createRetryDelay = delay
+		return nil
+	}
+}
+
+// WithMaxConcurrentPersists configures how many dirty partitions are written to Azure Storage at once by the background
+// persistence loop. The default is DefaultMaxConcurrentPersists. Writing every partition of a host at once can exceed
+// the request rate of the storage account, and throttled writes risk renewals failing and leases being lost.
+func WithMaxConcurrentPersists(n int) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if n < 1 {
+			return errors.New("max concurrent persists must be at least 1")
+		}
+		sl.maxPersists = n
+		return nil
+	}
+}
+
+// WithLivenessThreshold configures how long after the persistence loop last ticked Liveness reports the loop as stuck.
+// The default is DefaultLivenessThreshold. A tick waits for the persists of every dirty partition, so hosts owning many
+// more partitions than WithMaxConcurrentPersists allows at once may need a longer threshold.
+func WithLivenessThreshold(threshold time.Duration) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if threshold <= persistInterval {
+			return fmt.Errorf("liveness threshold must be longer than the persist interval of %v", persistInterval)
+		}
+		sl.livenessThreshold = threshold
+		return nil
+	}
+}
+
+// WithOwnershipVerification configures the LeaserCheckpointer to re-read each lease after acquiring or stealing it and
+// confirm this host is the only owner. If another owner or token is found, the blob lease just acquired is released, an
+// *OwnershipViolationError is returned and onViolation, if not nil, is called. This costs an extra read per acquire in
+// return for detecting double ownership of a partition.
+func WithOwnershipVerification(onViolation func(*OwnershipViolationError)) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		sl.verifyOwnership = true
+		sl.onViolation = onViolation
+		return nil
+	}
+}
+
+// WithLeaseLostHandler configures a handler which is called with the partition ID when renewing a lease shows this host
+// has lost it, such as after the lease expired and was taken by another host or was broken. The handler runs in its
+// own goroutine so it can't stall the renewal of other leases; use it to flush buffered work or record the loss.
+func WithLeaseLostHandler(handler func(partitionID string)) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if handler == nil {
+			return errors.New("lease lost handler must not be nil")
+		}
+		sl.onLeaseLost = handler
+		return nil
+	}
+}
+
+// WithMirrorCheckpointer configures a secondary Checkpointer, such as one backed by another storage account, which
+// receives a best-effort copy of every checkpoint update. Reads prefer the checkpoint in the lease blob and fall back to
+// the secondary when the lease has no checkpoint, so a partition keeps its position if the primary account loses it.
+//
+// Failures writing to the secondary are logged, but do not fail the checkpoint update. The secondary's store must
+// already be provisioned; it is given the EventProcessorHost and closed along with the LeaserCheckpointer.
+func WithMirrorCheckpointer(secondary eph.Checkpointer) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if secondary == nil {
+			return errors.New("mirror checkpointer must not be nil")
+		}
+		sl.mirror = secondary
+		return nil
+	}
+}
+
+// WithEndpointOverride configures the function returning the blob endpoint of a storage account, such as
+// https://{account}.blob.local.azurestack.external for Azure Stack Hub, or a private endpoint whose DNS name doesn't
+// follow the https://{account}.blob.{StorageEndpointSuffix} convention of the Azure environment. The function is called
+// with the account name, and with the account name suffixed with "-secondary" when WithSecondaryReadEndpoint is also
+// configured. It must return an absolute http or https URL.
+//
+// The override is only supported by leasers built with NewStorageLeaserCheckpointer, since the container URL given to
+// NewStorageLeaserCheckpointerFromContainerURL already holds the endpoint.
+func WithEndpointOverride(override func(accountName string) (*url.URL, error)) LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if override == nil {
+			return errors.New("endpoint override must not be nil")
+		}
+		sl.endpointOverride = override
+		return nil
+	}
+}
+
+// WithSecondaryReadEndpoint configures GetCheckpointFromStorage to read from the read-only secondary endpoint of a
+// geo-redundant storage account when the primary endpoint is throttled or unavailable. Acquiring, renewing and uploading
+// leases always use the primary endpoint, as does any read used to decide the state of a lease, since the secondary may
+// lag behind the primary.
+func WithSecondaryReadEndpoint() LeaserCheckpointerOption {
+	return func(sl *LeaserCheckpointer) error {
+		if sl.credential == nil {
+			return errors.New("the secondary read endpoint requires a leaser built with a credential")
+		}
+
+		return sl.setSecondaryURL()
+	}
+}
+
+// SetEventHostProcessor sets the EventHostProcessor on the instance of the LeaserCheckpointer
+func (sl *LeaserCheckpointer) SetEventHostProcessor(eph *eph.EventProcessorHost) {
+	sl.processor = eph
+	if instanceID, err := uuid.NewV4(); err == nil {
+		sl.instanceID = instanceID.String()
+	} else {
+		sl.logger.Error(context.Background(), "failed to generate the instance ID", "error", err)
+	}
+	if sl.mirror != nil {
+		sl.mirror.SetEventHostProcessor(eph)
+	}
+	if sl.warmStart {
+		ctx, cancel := context.WithTimeout(context.Background(), warmStartTimeout)
+		if err := sl.loadHeldLeases(ctx); err != nil {
+			sl.logger.Error(ctx, "failed to warm start leases", "error", err)
+		}
+		cancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if !sl.synchronous {
+		sl.startPersistLeases(ctx)
+	}
+	if sl.backlogAlert != nil {
+		go sl.watchBacklog(ctx)
+	}
+	sl.done = cancel
+}
+
+// loadHeldLeases reads the lease blobs which are leased and owned by this host's name into memory, without acquiring or
+// writing them
+func (sl *LeaserCheckpointer) loadHeldLeases(ctx context.Context) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.loadHeldLeases")
+	defer span.Finish()
+
+	blobs, err := sl.blobs().ListBlobs(ctx)
+	if err != nil {
+		return err
+	}
+
+	var leased []string
+	for _, blob := range blobs {
+		if strings.Contains(blob.Name, "/") || blob.LeaseState != azblob.LeaseStateLeased {
+			continue
+		}
+		if partitionID, err := partitionIDFromBlobName(blob.Name); err == nil {
+			leased = append(leased, partitionID)
+		}
+	}
+
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	owner := sl.processor.GetOwnerIdentity()
+	for _, partitionID := range leased {
+		lease, err := sl.getLease(ctx, partitionID)
+		if err != nil {
+			return err
+		}
+		if lease.Owner != owner {
+			continue
+		}
+		if _, ok := sl.ownedLease(partitionID); !ok {
+			if err := sl.loadCheckpointBlob(ctx, lease); err != nil {
+				return err
+			}
+			sl.setLease(lease)
+			sl.dlog(ctx, "warm started lease", "partitionID", partitionID, "epoch", lease.GetEpoch())
+		}
+	}
+	return nil
+}
+
+// StoreExists returns true if the storage container exists
+func (sl *LeaserCheckpointer) StoreExists(ctx context.Context) (bool, error) {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.StoreExists")
+	defer span.Finish()
+
+	if sl.serviceURL == nil {
+		return sl.containerExists(ctx)
+	}
+
+	opts := azblob.ListContainersOptions{
+		Prefix: sl.containerName,
+	}
+	res, err := sl.serviceURL.ListContainers(ctx, azblob.Marker{}, opts)
+	if err != nil {
+		return false, err
+	}
+
+	for _, container := range res.Containers {
+		if container.Name == sl.containerName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// containerExists checks for the container by fetching its properties, which unlike listing containers only needs
+// access to the container itself
+func (sl *LeaserCheckpointer) containerExists(ctx context.Context) (bool, error) {
+	err := sl.blobs().GetContainerProperties(ctx)
+	if err == nil {
+		return true, nil
+	}
+	if storageErr, ok := err.(azblob.StorageError); ok && storageErr.Response() != nil && storageErr.Response().StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return false, err
+}
+
+// HealthCheck verifies the container can be reached with the configured credential by fetching the container's
+// properties. It is cheap enough to be used as a readiness probe and, unlike StoreExists, doesn't require permission
+// to list the containers in the account.
+//
+// If the check fails, a *HealthCheckError is returned describing the reason.
+func (sl *LeaserCheckpointer) HealthCheck(ctx context.Context) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.HealthCheck")
+	defer span.Finish()
+
+	err := sl.blobs().GetContainerProperties(ctx)
+	if err == nil {
+		return nil
+	}
+
+	sl.logger.Error(ctx, "storage health check failed", "error", err)
+	hcErr := &HealthCheckError{Err: err}
+	if storageErr, ok := err.(azblob.StorageError); ok && storageErr.Response() != nil {
+		switch storageErr.Response().StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			hcErr.Reason = ErrStorageUnauthorized
+		case http.StatusNotFound:
+			hcErr.Reason = ErrStorageContainerNotFound
+		}
+	}
+	if isThrottled(err) {
+		hcErr.Reason = ErrStorageThrottled
+	}
+	return hcErr
+}
+
+// Readiness returns an error if this host can't serve as a member of the EventProcessorHost cluster, for use as a
+// readiness probe: the container must be reachable with the configured credential, as checked by HealthCheck. Owning
+// partitions isn't required, since a host may be ready while there are more hosts than partitions.
+func (sl *LeaserCheckpointer) Readiness(ctx context.Context) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.Readiness")
+	defer span.Finish()
+
+	return sl.HealthCheck(ctx)
+}
+
+// Liveness returns an error if the loop persisting dirty checkpoints in the background is not running or has not
+// ticked within the liveness threshold, such as when it is stuck on a hung call to Azure Storage, for use as a liveness
+// probe. The threshold is DefaultLivenessThreshold unless set with WithLivenessThreshold. Storage being unreachable
+// doesn't fail Liveness; see Readiness. With WithSynchronousCheckpoints there is no background loop, so Liveness always
+// succeeds.
+func (sl *LeaserCheckpointer) Liveness() error {
+	if sl.synchronous {
+		return nil
+	}
+
+	tick := atomic.LoadInt64(&sl.persistTick)
+	if tick == 0 {
+		return errors.New("checkpoint persistence loop is not running")
+	}
+	if since := sl.clock.Now().Sub(time.Unix(0, tick)); since > sl.livenessThreshold {
+		return fmt.Errorf("checkpoint persistence loop last ticked %v ago, longer than %v", since, sl.livenessThreshold)
+	}
+	return nil
+}
+
+// EnsureStore creates the container if it does not exist. The container is checked for by fetching its properties
+// rather than listing the account's containers, so a SAS scoped to the container is enough. A container created by
+// another host since it was found missing, as when several hosts start together, is not an error. Transient failures
+// creating the container are retried; see WithEnsureStoreRetry.
+func (sl *LeaserCheckpointer) EnsureStore(ctx context.Context) error {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.EnsureStore")
+	defer span.Finish()
+
+	ok, err := sl.containerExists(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		metadata := sl.containerMetadata
+		if metadata == nil {
+			metadata = azblob.Metadata{}
+		}
+
+		return sl.createContainer(ctx, metadata)
+	}
+
+	if sl.forceMetadataUpdate && sl.containerMetadata != nil {
+		if err := sl.blobs().SetContainerMetadata(ctx, sl.containerMetadata); err != nil {
+			sl.logger.Error(ctx, "failed to set the container metadata", "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (sl *LeaserCheckpointer) createContainer(ctx context.Context, metadata azblob.Metadata) error {
+	for attempt := 1; ; attempt++ {
+		err := sl.blobs().Create(ctx, metadata)
+		switch {
+		case err == nil:
+			return nil
+		case isContainerAlreadyExists(err):
+			sl.dlog(ctx, "container was created by another host")
+			return nil
+		case !isTransient(err) || attempt >= sl.createAttempts:
+			sl.logger.Error(ctx, "failed to create the container", "attempt", attempt, "error", err)
+			return err
+		}
+
+		sl.logger.Info(ctx, "failed to create container; retrying", "attempt", attempt, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-sl.clock.After(sl.createRetryDelay * time.Duration(attempt)):
+		}
+	}
+}
+
+// DeleteStore deletes the Azure Storage container
+func (sl *LeaserCheckpointer) DeleteStore(ctx context.Context) error {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.DeleteStore")
+	defer span.Finish()
+
+	return sl.blobs().DeleteContainer(ctx)
+}
+
+// GetLeases gets all of the partition leases
+func (sl *LeaserCheckpointer) GetLeases(ctx context.Context) ([]eph.LeaseMarker, error) {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.GetLeases")
+	defer span.Finish()
+
+	partitionIDs := sl.processor.GetPartitionIDs()
+	leaseCh := make(chan leaseGetResult)
+	for idx, partitionID := range partitionIDs {
+		go func(i int, pID string) {
+			lease, err := sl.getLease(ctx, pID)
+			leaseCh <- leaseGetResult{
+				Lease: lease,
+				Err:   err,
+			}
+		}(idx, partitionID)
+	}
+
+	leases := make([]eph.LeaseMarker, len(partitionIDs))
+	for i := 0; i < len(partitionIDs); i++ {
+		select {
+		case <-ctx.Done():
+			return leases, ctx.Err()
+		case result := <-leaseCh:
+			if isContainerNotFound(result.Err) {
+				return nil, ErrStoreNotFound
+			}
+			if result.Err != nil {
+				return nil, result.Err
+			}
+			leases[i] = result.Lease
+		}
+	}
+	return leases, nil
+}
+
+// EnsureLease creates a lease in the container if it doesn't exist
+func (sl *LeaserCheckpointer) EnsureLease(ctx context.Context, partitionID string) (eph.LeaseMarker, error) {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.EnsureLease")
+	defer span.Finish()
+
+	return sl.createOrGetLease(ctx, partitionID, nil)
+}
+
+// EnsureLeaseWithCheckpoint creates a lease in the container seeded with the checkpoint if it doesn't exist. This is
+// useful for importing positions from another system when provisioning. If the lease already exists, it is returned
+// unchanged and the checkpoint is not applied.
+func (sl *LeaserCheckpointer) EnsureLeaseWithCheckpoint(ctx context.Context, partitionID string, checkpoint persist.Checkpoint) (eph.LeaseMarker, error) {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.EnsureLeaseWithCheckpoint")
+	defer span.Finish()
+
+	return sl.createOrGetLease(ctx, partitionID, &checkpoint)
+}
+
+// EnsureLeases creates the leases for the partitionIDs in the container if they don't exist. The leases are created
+// concurrently, which is considerably faster than calling EnsureLease for each partition when starting against a hub
+// with many partitions.
+//
+// If some of the leases can't be ensured, the leases which were ensured are returned along with PartitionErrors
+// describing the failures. Likewise, if the context is done first, the leases ensured so far are returned along with
+// the context's error.
+func (sl *LeaserCheckpointer) EnsureLeases(ctx context.Context, partitionIDs []string) ([]eph.LeaseMarker, error) {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.EnsureLeases")
+	defer span.Finish()
+
+	type ensureResult struct {
+		Index int
+		leaseGetResult
+	}
+
+	resultCh := make(chan ensureResult, len(partitionIDs))
+	for idx, partitionID := range partitionIDs {
+		go func(i int, pID string) {
+			lease, err := sl.createOrGetLease(ctx, pID, nil)
+			resultCh <- ensureResult{
+				Index: i,
+				leaseGetResult: leaseGetResult{
+					Lease: lease,
+					Err:   err,
+				},
+			}
+		}(idx, partitionID)
+	}
+
+	results := make([]*storageLease, len(partitionIDs))
+	errs := make(PartitionErrors)
+	var ctxErr error
+	for i := 0; i < len(partitionIDs) && ctxErr == nil; i++ {
+		select {
+		case <-ctx.Done():
+			ctxErr = ctx.Err()
+		case result := <-resultCh:
+			if result.Err != nil {
+				sl.logger.Error(ctx, "failed to ensure lease", "partitionID", partitionIDs[result.Index], "error", result.Err)
+				errs[partitionIDs[result.Index]] = result.Err
+				continue
+			}
+			results[result.Index] = result.Lease
+		}
+	}
+
+	leases := make([]eph.LeaseMarker, 0, len(partitionIDs))
+	for _, lease := range results {
+		if lease == nil {
+			continue
+		}
+		// prefer the lease we already own, since it holds the token for the blob lease
+		if owned, ok := sl.ownedLease(lease.PartitionID); ok {
+			leases = append(leases, owned)
+			continue
+		}
+		leases = append(leases, lease)
+	}
+
+	if ctxErr != nil {
+		return leases, ctxErr
+	}
+	if len(errs) > 0 {
+		return leases, errs
+	}
+	return leases, nil
+}
+
+// Bootstrap ensures the container exists and then that the lease blob of each of the partitionIDs exists, as
+// EnsureStore followed by EnsureLeases would. The existing lease blobs are listed first, so when everything already
+// exists Bootstrap returns after a single listing, and only the missing lease blobs are created, concurrently.
+//
+// Bootstrap is idempotent and safe to call from several hosts at once: a container or lease blob created by another
+// host in the meantime is treated as ensured, and existing lease blobs are never overwritten. If some lease blobs
+// can't be created, a PartitionErrors holding the error for each such partition is returned.
+func (sl *LeaserCheckpointer) Bootstrap(ctx context.Context, partitionIDs []string) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.Bootstrap")
+	defer span.Finish()
+
+	if err := sl.EnsureStore(ctx); err != nil {
+		return err
+	}
+
+	blobs, err := sl.blobs().ListBlobs(ctx)
+	if err != nil {
+		sl.logger.Error(ctx, "failed to list the lease blobs", "error", err)
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for _, blob := range blobs {
+		if partitionID, err := partitionIDFromBlobName(blob.Name); err == nil {
+			existing[partitionID] = true
+		}
+	}
+
+	var missing []string
+	for _, partitionID := range partitionIDs {
+		if !existing[partitionID] {
+			missing = append(missing, partitionID)
+		}
+	}
+	if len(missing) == 0 {
+		sl.dlog(ctx, "store and leases already exist")
+		return nil
+	}
+
+	_, err = sl.EnsureLeases(ctx, missing)
+	return err
+}
+
+// GetOwnershipByConsumerGroup reads every lease blob in the container and returns the ownership and checkpoint of each
+// partition keyed by consumer group and then by partition ID.
+//
+// Lease blobs named "<consumer group>/<partition ID>" are grouped by their prefix. Lease blobs at the root of the
+// container, which is where this LeaserCheckpointer stores its leases, are reported under the default consumer group.
+// A partition with a checkpoint blob, written by WithSeparateCheckpointBlobs, is reported with the checkpoint from that
+// blob.
+func (sl *LeaserCheckpointer) GetOwnershipByConsumerGroup(ctx context.Context) (map[string]map[string]OwnershipInfo, error) {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.GetOwnershipByConsumerGroup")
+	defer span.Finish()
+
+	blobs, err := sl.blobs().ListBlobs(ctx)
+	if err != nil {
+		sl.logger.Error(ctx, "failed to list the lease blobs", "error", err)
+		return nil, err
+	}
+
+	var blobNames []string
+	checkpointBlobs := make(map[string]bool)
+	for _, blob := range blobs {
+		if strings.HasSuffix(blob.Name, checkpointBlobSuffix) {
+			checkpointBlobs[blob.Name] = true
+			continue
+		}
+		blobNames = append(blobNames, blob.Name)
+	}
+
+	resCh := make(chan ownershipResult, len(blobNames))
+	for _, blobName := range blobNames {
+		go func(name string) {
+			lease, err := sl.readLeaseBlob(ctx, sl.blobs(), name)
+			if err == nil && checkpointBlobs[name+checkpointBlobSuffix] {
+				// the lease blob's copy of the checkpoint is stale when checkpoints are stored separately
+				var checkpoint *persist.Checkpoint
+				checkpoint, _, err = sl.readCheckpointBlob(ctx, sl.blobs(), name, name+checkpointBlobSuffix)
+				if checkpoint != nil {
+					lease.Checkpoint = checkpoint
+				}
+			}
+			resCh <- ownershipResult{
+				BlobName: name,
+				Lease:    lease,
+				Err:      err,
+			}
+		}(blobName)
+	}
+
+	ownership := make(map[string]map[string]OwnershipInfo)
+	for i := 0; i < len(blobNames); i++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case res := <-resCh:
+			if res.Err != nil {
+				sl.logger.Error(ctx, "failed to read lease blob", "error", res.Err)
+				return nil, res.Err
+			}
+
+			consumerGroup, encodedID := eventhub.DefaultConsumerGroup, res.BlobName
+			if idx := strings.LastIndex(res.BlobName, "/"); idx >= 0 {
+				consumerGroup, encodedID = res.BlobName[:idx], res.BlobName[idx+1:]
+			}
+			partitionID, err := partitionIDFromBlobName(encodedID)
+			if err != nil {
+				sl.logger.Error(ctx, "failed to parse lease blob name", "blobName", encodedID, "error", err)
+				return nil, err
+			}
+
+			if _, ok := ownership[consumerGroup]; !ok {
+				ownership[consumerGroup] = make(map[string]OwnershipInfo)
+			}
+			ownership[consumerGroup][partitionID] = OwnershipInfo{
+				Owner:      res.Lease.Owner,
+				Epoch:      res.Lease.Epoch,
+				State:      res.Lease.State,
+				Checkpoint: res.Lease.Checkpoint,
+			}
+		}
+	}
+	return ownership, nil
+}
+
+// PruneLeases deletes the lease blobs of partitions which are not in validPartitionIDs, such as those left behind after
+// an Event Hub is re-created with fewer partitions. Blobs which are leased are skipped so active ownership is never
+// removed, as are blobs under a consumer group prefix. The IDs of the pruned partitions are returned.
+func (sl *LeaserCheckpointer) PruneLeases(ctx context.Context, validPartitionIDs []string) ([]string, error) {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.PruneLeases")
+	defer span.Finish()
+
+	valid := make(map[string]bool, len(validPartitionIDs))
+	for _, partitionID := range validPartitionIDs {
+		valid[partitionID] = true
+	}
+
+	blobs, err := sl.blobs().ListBlobs(ctx)
+	if err != nil {
+		sl.logger.Error(ctx, "failed to list the lease blobs", "error", err)
+		return nil, err
+	}
+
+	var stale []string
+	for _, blob := range blobs {
+		if strings.Contains(blob.Name, "/") {
+			continue
+		}
+		partitionID, err := partitionIDFromBlobName(blob.Name)
+		if err != nil || valid[partitionID] {
+			// blobs which aren't named after a partition were not written by a LeaserCheckpointer
+			continue
+		}
+
+		switch blob.LeaseState {
+		case azblob.LeaseStateLeased, azblob.LeaseStateBreaking:
+			sl.dlog(ctx, "not pruning leased blob", "blobName", blob.Name)
+			continue
+		}
+		stale = append(stale, partitionID)
+	}
+
+	var removed []string
+	for _, partitionID := range stale {
+		// deleting a blob without its lease ID fails, so a blob leased since it was listed is not removed
+		err := sl.blobs().Delete(ctx, leaseBlobName(partitionID), azblob.BlobAccessConditions{})
+		if err != nil {
+			sl.logger.Error(ctx, "failed to prune lease blob", "partitionID", partitionID, "error", err)
+			continue
+		}
+		if err := sl.deleteCheckpointBlob(ctx, partitionID, ""); err != nil {
+			sl.logger.Error(ctx, "failed to prune checkpoint blob", "partitionID", partitionID, "error", err)
+		}
+		removed = append(removed, partitionID)
+	}
+	return removed, nil
+}
+
+// DeleteLease deletes a lease in the storage container
+func (sl *LeaserCheckpointer) DeleteLease(ctx context.Context, partitionID string) error {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.DeleteLease")
+	defer span.Finish()
+
+	err := sl.blobs().Delete(ctx, leaseBlobName(partitionID), azblob.BlobAccessConditions{})
+	sl.removeLease(partitionID)
+	if err != nil {
+		return err
+	}
+	return sl.deleteCheckpointBlob(ctx, partitionID, "")
+}
+
+// DeleteLeases deletes the lease blobs of the partitionIDs concurrently, such as when decommissioning a consumer group,
+// and forgets any of the leases and unpersisted checkpoints held by this host for them. Blobs which don't exist are
+// treated as deleted. Blobs leased by other hosts can't be deleted until their lease expires or is broken. If any
+// blob fails to be deleted, a PartitionErrors holding the error for each such partition is returned.
+func (sl *LeaserCheckpointer) DeleteLeases(ctx context.Context, partitionIDs []string) error {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.DeleteLeases")
+	defer span.Finish()
+
+	resCh := make(chan dirtyResult, len(partitionIDs))
+	for _, partitionID := range partitionIDs {
+		var conditions azblob.BlobAccessConditions
+		if lease, ok := sl.ownedLease(partitionID); ok {
+			conditions.LeaseAccessConditions.LeaseID = lease.Token
+		}
+
+		go func(id string, ac azblob.BlobAccessConditions) {
+			err := sl.blobs().Delete(ctx, leaseBlobName(id), ac)
+			if isBlobNotFound(err) {
+				err = nil
+			}
+			if err == nil {
+				err = sl.deleteCheckpointBlob(ctx, id, "")
+			}
+			resCh <- dirtyResult{
+				Err:         err,
+				PartitionID: id,
+			}
+		}(partitionID, conditions)
+	}
+
+	errs := make(PartitionErrors)
+	for i := 0; i < len(partitionIDs); i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case res := <-resCh:
+			if res.Err != nil {
+				sl.logger.Error(ctx, "failed to delete lease", "partitionID", res.PartitionID, "error", res.Err)
+				errs[res.PartitionID] = res.Err
+				continue
+			}
+			sl.removeLease(res.PartitionID)
+			sl.untrackDirty(res.PartitionID)
+			delete(sl.lastPersisted, res.PartitionID)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// AcquireLease acquires the lease to the Azure blob in the container
+func (sl *LeaserCheckpointer) AcquireLease(ctx context.Context, partitionID string) (eph.LeaseMarker, bool, error) {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.AcquireLease")
+	defer span.Finish()
+	span.SetTag(instanceIDTag, sl.instanceID)
+
+	lease, err := sl.getLease(ctx, partitionID)
+	if err != nil {
+		sl.logger.Error(ctx, "failed to read lease", "partitionID", partitionID, "error", err)
+		if isContainerNotFound(err) {
+			return nil, false, ErrStoreNotFound
+		}
+		return nil, false, nil
+	}
+
+	if lease.GetEpoch() >= eph.MaxEpoch {
+		sl.logger.Error(ctx, "failed to acquire lease", "partitionID", partitionID, "error", eph.ErrEpochExhausted)
+		return nil, false, eph.ErrEpochExhausted
+	}
+
+	propsCtx, cancel := sl.operationContext(ctx)
+	props, err := sl.blobs().GetPropertiesAndMetadata(propsCtx, leaseBlobName(partitionID))
+	cancel()
+	if err != nil {
+		sl.logger.Error(ctx, "failed to read lease properties", "partitionID", partitionID, "error", err)
+		return nil, false, err
+	}
+
+	newToken, err := sl.newToken()
+	if err != nil {
+		sl.logger.Error(ctx, "failed to generate lease token", "partitionID", partitionID, "error", err)
+		return nil, false, err
+	}
+
+	kind := eph.KindAcquired
+	if props.LeaseState == azblob.LeaseStateLeased {
+		// is leased by someone else due to a race to acquire
+		if err := sl.changeBlobLease(ctx, partitionID, lease.Token, newToken); err != nil {
+			sl.logger.Error(ctx, "failed to change lease", "partitionID", partitionID, "owner", lease.Owner, "error", err)
+			return nil, false, err
+		}
+		kind = eph.KindChanged
+	} else {
+		if err := sl.acquireBlobLease(ctx, partitionID, newToken); err != nil {
+			sl.logger.Error(ctx, "failed to acquire lease", "partitionID", partitionID, "error", err)
+			return nil, false, err
+		}
+	}
+
+	if err := sl.claimLease(ctx, lease, newToken, kind); err != nil {
+		return nil, false, err
+	}
+	sl.dlog(ctx, "acquired lease", "partitionID", partitionID, "kind", kind, "epoch", lease.GetEpoch())
+	return lease, true, nil
+}
+
+// AcquireAnyAvailable acquires the leases of up to max of the partitionIDs which no host currently holds, returning the
+// leases won. The lease state of each partition is read first, which is far cheaper than an acquisition, so partitions
+// leased by other hosts are skipped rather than contended for; this keeps a host starting into an already balanced
+// cluster from disturbing it. Partitions are tried in the order given, and those already owned by this host are
+// skipped.
+//
+// Losing the race for a partition to another host is not an error. If the state of a partition can't be read, or
+// acquiring it fails otherwise, the leases won are returned along with a PartitionErrors holding the error for each
+// such partition.
+func (sl *LeaserCheckpointer) AcquireAnyAvailable(ctx context.Context, partitionIDs []string, max int) ([]eph.LeaseMarker, error) {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.AcquireAnyAvailable")
+	defer span.Finish()
+
+	if max < 1 {
+		return nil, fmt.Errorf("max must be at least 1, but was %d", max)
+	}
+
+	resCh := make(chan leaseStateResult, len(partitionIDs))
+	for _, partitionID := range partitionIDs {
+		go func(id string) {
+			state, err := sl.LeaseState(ctx, id)
+			resCh <- leaseStateResult{
+				PartitionID: id,
+				State:       state,
+				Err:         err,
+			}
+		}(partitionID)
+	}
+
+	errs := make(PartitionErrors)
+	states := make(map[string]azblob.LeaseStateType, len(partitionIDs))
+	for i := 0; i < len(partitionIDs); i++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case res := <-resCh:
+			if isContainerNotFound(res.Err) {
+				return nil, ErrStoreNotFound
+			}
+			if res.Err != nil {
+				errs[res.PartitionID] = res.Err
+				continue
+			}
+			states[res.PartitionID] = res.State
+		}
+	}
+
+	var acquired []eph.LeaseMarker
+	for _, partitionID := range partitionIDs {
+		if len(acquired) >= max {
+			break
+		}
+
+		state, ok := states[partitionID]
+		if !ok {
+			continue
+		}
+		switch state {
+		case azblob.LeaseStateLeased, azblob.LeaseStateBreaking:
+			sl.dlog(ctx, "skipping leased partition", "partitionID", partitionID)
+			continue
+		}
+		if _, owned := sl.ownedLease(partitionID); owned {
+			continue
+		}
+
+		lease, ok, err := sl.AcquireLease(ctx, partitionID)
+		switch {
+		case err == ErrStoreNotFound:
+			return acquired, err
+		case isLeaseAlreadyPresent(err) || isLeaseConflict(err):
+			sl.dlog(ctx, "lost the race to acquire lease", "partitionID", partitionID)
+		case err != nil:
+			errs[partitionID] = err
+		case ok:
+			acquired = append(acquired, lease)
+		}
+	}
+
+	if len(errs) > 0 {
+		return acquired, errs
+	}
+	return acquired, nil
+}
+
+// StealLease forcibly takes the lease for the partitionID for this host, regardless of which host currently owns it or
+// whether the lease has expired. This is intended for manual rebalancing, such as moving a partition onto a specific
+// host while debugging or draining another host.
+//
+// A *LeaseConflictError is returned if the blob lease is in the middle of a transition, such as being broken or having
+// been changed by another host since it was read.
+func (sl *LeaserCheckpointer) StealLease(ctx context.Context, partitionID string) (eph.LeaseMarker, bool, error) {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.StealLease")
+	defer span.Finish()
+	span.SetTag(instanceIDTag, sl.instanceID)
+
+	lease, err := sl.getLease(ctx, partitionID)
+	if err != nil {
+		sl.logger.Error(ctx, "failed to read lease", "partitionID", partitionID, "error", err)
+		return nil, false, err
+	}
+
+	if lease.GetEpoch() >= eph.MaxEpoch {
+		sl.logger.Error(ctx, "failed to steal lease", "partitionID", partitionID, "error", eph.ErrEpochExhausted)
+		return nil, false, eph.ErrEpochExhausted
+	}
+
+	newToken, err := sl.newToken()
+	if err != nil {
+		sl.logger.Error(ctx, "failed to generate lease token", "partitionID", partitionID, "error", err)
+		return nil, false, err
+	}
+
+	kind := eph.KindAcquired
+	switch lease.State {
+	case azblob.LeaseStateLeased:
+		err = sl.changeBlobLease(ctx, partitionID, lease.Token, newToken)
+		kind = eph.KindChanged
+	case azblob.LeaseStateBreaking:
+		return nil, false, &LeaseConflictError{PartitionID: partitionID, State: lease.State}
+	default:
+		err = sl.acquireBlobLease(ctx, partitionID, newToken)
+	}
+
+	if err != nil {
+		sl.logger.Error(ctx, "failed to steal lease", "partitionID", partitionID, "owner", lease.Owner, "error", err)
+		if isLeaseConflict(err) {
+			return nil, false, &LeaseConflictError{PartitionID: partitionID, State: lease.State, Err: err}
+		}
+		return nil, false, err
+	}
+
+	if err := sl.claimLease(ctx, lease, newToken, kind); err != nil {
+		return nil, false, err
+	}
+	return lease, true, nil
+}
+
+// acquireBlobLease acquires the blob lease for the partitionID with newToken
+func (sl *LeaserCheckpointer) acquireBlobLease(ctx context.Context, partitionID, newToken string) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.acquireBlobLease")
+	defer span.Finish()
+	span.SetTag(partitionIDTag, partitionID)
+	ctx, cancel := sl.operationContext(ctx)
+	defer cancel()
+
+	props, err := sl.blobs().AcquireLease(ctx, leaseBlobName(partitionID), newToken, sl.leaseDurationSeconds())
+	if err != nil {
+		return newStorageOperationError(span, "AcquireLease", partitionID, err)
+	}
+	tag.HTTPStatusCode.Set(span, uint16(props.StatusCode))
+	return nil
+}
+
+// operationContext returns the context for a single call to Azure Storage, bounded by the operation timeout if one is
+// configured
+func (sl *LeaserCheckpointer) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if sl.operationTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, sl.operationTimeout)
+}
+
+// newUUIDToken generates a random UUID token
+func newUUIDToken() (string, error) {
+	token, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	return token.String(), nil
+}
+
+// blobMetadata returns the metadata to write the lease blobs with
+func (sl *LeaserCheckpointer) blobMetadata() azblob.Metadata {
+	if sl.leaseMetadata == nil {
+		return azblob.Metadata{}
+	}
+	return sl.leaseMetadata
+}
+
+// SuggestedRenewalDelay returns how long to wait before renewing the lease on the partition. Leases acquired in a burst
+// would otherwise all come due for renewal together, so the delay is spread between half and three quarters of the
+// lease duration by a hash of the partition ID. The delay is the same for a partition each time it is asked for,
+// leaving a quarter of the lease duration to retry a failed renewal before the lease expires.
+//
+// A scheduler renewing leases on a timer per partition, rather than on a single interval for all partitions, would
+// wait SuggestedRenewalDelay after each acquisition or renewal before calling RenewLease. Infinite leases never expire,
+// so their delay is computed from eph.DefaultLeaseDuration to keep checking that they are still held.
+func (sl *LeaserCheckpointer) SuggestedRenewalDelay(partitionID string) time.Duration {
+	leaseDuration := sl.leaseDuration
+	if leaseDuration == InfiniteLeaseDuration {
+		leaseDuration = eph.DefaultLeaseDuration
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(partitionID))
+	// partition IDs are usually short and differ only in their last characters, which the low bits of the hash spread
+	// far better than the high bits
+	const buckets = 1000
+	jitter := leaseDuration / 4 / buckets * time.Duration(hash.Sum32()%buckets)
+	return leaseDuration/2 + jitter
+}
+
+// leaseDurationSeconds returns the lease duration as passed to Azure Storage, where -1 is an infinite lease
+func (sl *LeaserCheckpointer) leaseDurationSeconds() int32 {
+	if sl.leaseDuration == InfiniteLeaseDuration {
+		return -1
+	}
+	return int32(sl.leaseDuration.Round(time.Second).Seconds())
+}
+
+// changeBlobLease changes the blob lease for the partitionID from currentToken to newToken
+func (sl *LeaserCheckpointer) changeBlobLease(ctx context.Context, partitionID, currentToken, newToken string) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.changeBlobLease")
+	defer span.Finish()
+	span.SetTag(partitionIDTag, partitionID)
+	ctx, cancel := sl.operationContext(ctx)
+	defer cancel()
+
+	props, err := sl.blobs().ChangeLease(ctx, leaseBlobName(partitionID), currentToken, newToken)
+	if err != nil {
+		return newStorageOperationError(span, "ChangeLease", partitionID, err)
+	}
+	tag.HTTPStatusCode.Set(span, uint16(props.StatusCode))
+	return nil
+}
+
+// claimLease records this host as the owner of a blob lease which has just been acquired or changed to newToken
+func (sl *LeaserCheckpointer) claimLease(ctx context.Context, lease *storageLease, newToken string, kind eph.AcquisitionKind) error {
+	oldOwner := lease.Owner
+	lease.Token = newToken
+	lease.Owner = sl.processor.GetOwnerIdentity()
+	lease.AcquisitionKind = kind
+	lease.InstanceID = sl.instanceID
+	lease.IncrementEpoch()
+	lease.renewedAt = sl.clock.Now()
+	if err := sl.loadCheckpointBlob(ctx, lease); err != nil {
+		return err
+	}
+	reapplied := sl.reapplyDroppedCheckpoint(ctx, lease)
+	if err := sl.uploadLease(ctx, lease); err != nil {
+		return err
+	}
+
+	if sl.verifyOwnership {
+		if err := sl.verifyLeaseOwnership(ctx, lease); err != nil {
+			// the blob lease is held with newToken, so release it rather than block the partition until it expires
+			if _, releaseErr := sl.blobs().ReleaseLease(ctx, leaseBlobName(lease.PartitionID), newToken); releaseErr != nil {
+				sl.logger.Error(ctx, "failed to release lease after ownership violation", "partitionID", lease.PartitionID, "error", releaseErr)
+			}
+			return err
+		}
+	}
+
+	sl.setLease(lease)
+	sl.forgetDroppedCheckpoint(lease.PartitionID)
+	if reapplied {
+		sl.metrics.CheckpointReapplied(lease.PartitionID)
+	}
+	sl.metrics.LeaseAcquired(lease.PartitionID)
+	sl.notifyLeaseChange(lease.PartitionID, oldOwner, lease.Owner)
+	return nil
+}
+
+// DetectSplitBrain reads the lease blob for the partitionID and returns true if it is owned by this host's name, but was
+// claimed by a different running instance, such as an earlier incarnation of this host which was restarted while
+// holding the lease. Two instances with the same name can otherwise each appear to own the partition, leading to
+// duplicate processing. Leases written before instance IDs were recorded are never reported.
+func (sl *LeaserCheckpointer) DetectSplitBrain(ctx context.Context, partitionID string) (bool, error) {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.DetectSplitBrain")
+	defer span.Finish()
+	span.SetTag(partitionIDTag, partitionID)
+	span.SetTag(instanceIDTag, sl.instanceID)
+
+	if sl.processor == nil {
+		return false, errors.New("the EventProcessorHost must be set to detect a split brain")
+	}
+
+	lease, err := sl.getLease(ctx, partitionID)
+	if err != nil {
+		sl.logger.Error(ctx, "failed to read lease", "partitionID", partitionID, "error", err)
+		return false, err
+	}
+
+	splitBrain := lease.Owner == sl.processor.GetOwnerIdentity() && lease.InstanceID != "" && lease.InstanceID != sl.instanceID
+	if splitBrain {
+		span.SetTag("eh.eventprocessorhost.blob_instanceID", lease.InstanceID)
+		sl.logger.Error(ctx, "lease is owned by another instance of this host", "partitionID", partitionID, "instanceID", sl.instanceID, "blobInstanceID", lease.InstanceID)
+	}
+	return splitBrain, nil
+}
+
+// verifyLeaseOwnership re-reads the lease blob to confirm it is leased by this host with this host's token
+func (sl *LeaserCheckpointer) verifyLeaseOwnership(ctx context.Context, lease *storageLease) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.verifyLeaseOwnership")
+	defer span.Finish()
+
+	current, err := sl.getLease(ctx, lease.PartitionID)
+	if err != nil {
+		sl.logger.Error(ctx, "failed to read lease", "partitionID", lease.PartitionID, "error", err)
+		return err
+	}
+
+	if current.Owner == lease.Owner && current.Token == lease.Token && current.State == azblob.LeaseStateLeased {
+		return nil
+	}
+
+	violation := &OwnershipViolationError{
+		PartitionID:   lease.PartitionID,
+		ExpectedOwner: lease.Owner,
+		ExpectedToken: lease.Token,
+		ActualOwner:   current.Owner,
+		ActualToken:   current.Token,
+		State:         current.State,
+	}
+	sl.logger.Error(ctx, "lease ownership violated", "partitionID", lease.PartitionID, "expectedToken", violation.ExpectedToken, "actualToken", violation.ActualToken, "state", violation.State)
+	if sl.onViolation != nil {
+		sl.onViolation(violation)
+	}
+	return violation
+}
+
+// RenewLease renews the lease to the Azure blob
+func (sl *LeaserCheckpointer) RenewLease(ctx context.Context, partitionID string) (eph.LeaseMarker, bool, error) {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.RenewLease")
+	defer span.Finish()
+	span.SetTag(instanceIDTag, sl.instanceID)
+
+	lease, ok := sl.leases[partitionID]
+	if !ok {
+		return nil, false, errors.New("lease was not found")
+	}
+
+	renewCtx, cancel := sl.operationContext(ctx)
+	_, err := sl.blobs().RenewLease(renewCtx, leaseBlobName(partitionID), lease.Token)
+	cancel()
+	if err != nil {
+		err = newStorageOperationError(span, "RenewLease", partitionID, err)
+		sl.logger.Error(ctx, "failed to renew lease", "partitionID", partitionID, "error", err)
+		sl.notifyLeaseLost(partitionID, err)
+		return nil, false, err
+	}
+	lease.renewedAt = sl.clock.Now()
+	return lease, true, nil
+}
+
+// ReleaseLease releases the lease to the blob in Azure storage. The latest in-memory lease, including its checkpoint, is
+// uploaded before the lease is released so the next owner continues from where this host left off. If that upload
+// fails, the lease is still released and a *FinalCheckpointError is returned along with true.
+func (sl *LeaserCheckpointer) ReleaseLease(ctx context.Context, partitionID string) (bool, error) {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.ReleaseLease")
+	defer span.Finish()
+	span.SetTag(instanceIDTag, sl.instanceID)
+
+	lease, ok := sl.leases[partitionID]
+	if !ok {
+		return false, errors.New("lease was not found")
+	}
+
+	// the lease blob is written under the blob lease first, so a host which lost the lease doesn't go on to write the
+	// unleased checkpoint blob
+	var warning error
+	if err := sl.uploadLease(ctx, lease); err != nil {
+		sl.logger.Error(ctx, "failed to upload final checkpoint", "partitionID", partitionID, "error", err)
+		warning = &FinalCheckpointError{PartitionID: partitionID, Err: err}
+	} else if sl.separateCheckpoints {
+		if err := sl.putCheckpointBlob(ctx, lease); err != nil {
+			sl.logger.Error(ctx, "failed to upload final checkpoint", "partitionID", partitionID, "error", err)
+			warning = &FinalCheckpointError{PartitionID: partitionID, Err: err}
+		}
+	}
+
+	_, err := sl.blobs().ReleaseLease(ctx, leaseBlobName(partitionID), lease.Token)
+	if err != nil {
+		sl.logger.Error(ctx, "failed to release lease", "partitionID", partitionID, "error", err)
+		return false, err
+	}
+	sl.removeLease(partitionID)
+	delete(sl.lastPersisted, partitionID)
+	sl.untrackDirty(partitionID)
+	sl.notifyLeaseChange(partitionID, lease.Owner, "")
+	return true, warning
+}
+
+// BreakLease immediately breaks the blob lease for the partitionID, whichever host holds it, so the partition can be
+// picked up without waiting for the lease to expire. It is intended for manual recovery after confirming the owning
+// host is dead; breaking the lease of a live host leaves two hosts processing the partition until the old owner fails
+// to renew. The leases held by this host are not changed.
+func (sl *LeaserCheckpointer) BreakLease(ctx context.Context, partitionID string) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.BreakLease")
+	defer span.Finish()
+	span.SetTag(partitionIDTag, partitionID)
+
+	res, err := sl.blobs().BreakLease(ctx, leaseBlobName(partitionID), 0)
+	if err != nil {
+		err = newStorageOperationError(span, "BreakLease", partitionID, err)
+		sl.logger.Error(ctx, "failed to break lease", "partitionID", partitionID, "error", err)
+		return err
+	}
+	tag.HTTPStatusCode.Set(span, uint16(res.StatusCode))
+	sl.logger.Info(ctx, "broke lease", "partitionID", partitionID)
+	return nil
+}
+
+// LeaseState returns the state of the blob lease for the partitionID, as reported by Azure Storage, for diagnostics
+// which need more detail than IsExpired. It only reads the blob's properties, so neither the lease nor the leases held
+// by this host are changed.
+func (sl *LeaserCheckpointer) LeaseState(ctx context.Context, partitionID string) (azblob.LeaseStateType, error) {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.LeaseState")
+	defer span.Finish()
+	span.SetTag(partitionIDTag, partitionID)
+
+	props, err := sl.blobs().GetPropertiesAndMetadata(ctx, leaseBlobName(partitionID))
+	if err != nil {
+		return azblob.LeaseStateNone, newStorageOperationError(span, "GetProperties", partitionID, err)
+	}
+	tag.HTTPStatusCode.Set(span, uint16(props.StatusCode))
+	return props.LeaseState, nil
+}
+
+// UpdateLease renews and uploads the latest lease to the blob store
+func (sl *LeaserCheckpointer) UpdateLease(ctx context.Context, partitionID string) (eph.LeaseMarker, bool, error) {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.UpdateLease")
+	defer span.Finish()
+
+	return sl.updateLease(ctx, partitionID)
+}
+
+func (sl *LeaserCheckpointer) updateLease(ctx context.Context, partitionID string) (eph.LeaseMarker, bool, error) {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.updateLease")
+	defer span.Finish()
+
+	lease, ok := sl.leases[partitionID]
+	if !ok {
+		return nil, false, errors.New("lease was not found")
+	}
+
+	renewCtx, cancel := sl.operationContext(ctx)
+	_, err := sl.blobs().RenewLease(renewCtx, leaseBlobName(partitionID), lease.Token)
+	cancel()
+	if err != nil {
+		err = newStorageOperationError(span, "RenewLease", partitionID, err)
+		sl.logger.Error(ctx, "failed to renew lease", "partitionID", partitionID, "error", err)
+		sl.notifyLeaseLost(partitionID, err)
+		return nil, false, err
+	}
+	lease.renewedAt = sl.clock.Now()
+
+	if !ok {
+		return nil, false, errors.New("could not renew lease when updating lease")
+	}
+
+	err = sl.persistLeaseCheckpoint(ctx, lease)
+	if err != nil {
+		sl.logger.Error(ctx, "failed to persist lease", "partitionID", partitionID, "error", err)
+		return nil, false, err
+	}
+
+	return lease, true, nil
+}
+
+// GetCheckpoint returns the latest checkpoint for the partitionID.
+func (sl *LeaserCheckpointer) GetCheckpoint(ctx context.Context, partitionID string) (persist.Checkpoint, bool) {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.GetCheckpoint")
+	defer span.Finish()
+
+	lease, ok := sl.leases[partitionID]
+	if ok {
+		if checkpoint := lease.checkpoint(); checkpoint != nil {
+			return *checkpoint, ok
+		}
+	}
+	if checkpoint, mirrored := sl.mirroredCheckpoint(ctx, partitionID); mirrored {
+		return checkpoint, ok
+	}
+	return sl.defaultCheckpoint(), ok
+}
+
+// GetCheckpoints returns the latest checkpoint of every partition owned by this host, keyed by partition ID. The leases
+// are read under a single lock, so the checkpoints are a consistent snapshot of the partitions owned at that moment.
+// Like GetCheckpoint, partitions without a checkpoint fall back to the mirror checkpointer, if configured, and then to
+// the EventProcessorHost's default start position.
+func (sl *LeaserCheckpointer) GetCheckpoints(ctx context.Context) map[string]persist.Checkpoint {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.GetCheckpoints")
+	defer span.Finish()
+
+	sl.leasesMapMu.RLock()
+	checkpoints := make(map[string]persist.Checkpoint, len(sl.leases))
+	var missing []string
+	for partitionID, lease := range sl.leases {
+		if checkpoint := lease.checkpoint(); checkpoint != nil {
+			checkpoints[partitionID] = *checkpoint
+			continue
+		}
+		missing = append(missing, partitionID)
+	}
+	sl.leasesMapMu.RUnlock()
+
+	// the mirror may call out to storage, so it is only consulted once the leases are no longer locked
+	for _, partitionID := range missing {
+		if checkpoint, mirrored := sl.mirroredCheckpoint(ctx, partitionID); mirrored {
+			checkpoints[partitionID] = checkpoint
+			continue
+		}
+		checkpoints[partitionID] = sl.defaultCheckpoint()
+	}
+	return checkpoints
+}
+
+// OwnedPartitions returns the sorted IDs of the partitions this host currently holds leases for. It is a snapshot; the
+// partitions owned can change as soon as it returns when leases are acquired, stolen or released.
+func (sl *LeaserCheckpointer) OwnedPartitions() []string {
+	sl.leasesMapMu.RLock()
+	defer sl.leasesMapMu.RUnlock()
+
+	partitionIDs := make([]string, 0, len(sl.leases))
+	for partitionID := range sl.leases {
+		partitionIDs = append(partitionIDs, partitionID)
+	}
+	sort.Strings(partitionIDs)
+	return partitionIDs
+}
+
+// RemainingLeaseTime returns how long remains before the lease this host holds on the partition expires, measured from
+// when this host last acquired or renewed it, so a scheduler can renew the lease just before it expires rather than on
+// a fixed interval. Once the lease duration has passed without a renewal, zero is returned. A lease loaded by
+// WithWarmStart, which this host hasn't renewed since, also returns zero since its expiry isn't known. An infinite lease
+// returns the largest time.Duration. False is returned if this host doesn't hold the partition's lease.
+func (sl *LeaserCheckpointer) RemainingLeaseTime(partitionID string) (time.Duration, bool) {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	lease, ok := sl.ownedLease(partitionID)
+	if !ok {
+		return 0, false
+	}
+	if sl.leaseDuration == InfiniteLeaseDuration {
+		return time.Duration(math.MaxInt64), true
+	}
+	if lease.renewedAt.IsZero() {
+		return 0, true
+	}
+
+	remaining := sl.leaseDuration - sl.clock.Now().Sub(lease.renewedAt)
+	if remaining < 0 {
+		return 0, true
+	}
+	return remaining, true
+}
+
+// GetCheckpointAndEpoch returns the latest checkpoint for the partitionID along with the epoch of the lease this host
+// holds for the partition. See LeaseEpoch for how the epoch can be used to fence writes from a previous owner.
+func (sl *LeaserCheckpointer) GetCheckpointAndEpoch(ctx context.Context, partitionID string) (persist.Checkpoint, int64, bool) {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.GetCheckpointAndEpoch")
+	defer span.Finish()
+
+	lease, ok := sl.leases[partitionID]
+	if !ok {
+		return sl.defaultCheckpoint(), 0, false
+	}
+
+	checkpoint := lease.checkpoint()
+	if checkpoint == nil {
+		return sl.defaultCheckpoint(), lease.GetEpoch(), true
+	}
+	return *checkpoint, lease.GetEpoch(), true
+}
+
+// CheckpointLag returns how many events each partition owned by this host is behind the tail of the partition, given
+// the runtime information of the partitions keyed by partition ID. Partitions which are caught up have a lag of zero.
+// Partitions this host doesn't own, or which have no runtime information, are left out. So are partitions whose
+// checkpoint is positioned by enqueue time, such as one written by SeedCheckpointsFromTime, since their lag is unknown
+// until an event is checkpointed.
+func (sl *LeaserCheckpointer) CheckpointLag(ctx context.Context, runtimeInfo map[string]PartitionRuntime) (map[string]int64, error) {
+	span, _ := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.CheckpointLag")
+	defer span.Finish()
+
+	sl.leasesMapMu.RLock()
+	defer sl.leasesMapMu.RUnlock()
+
+	lags := make(map[string]int64, len(sl.leases))
+	for partitionID, lease := range sl.leases {
+		info, ok := runtimeInfo[partitionID]
+		if !ok {
+			continue
+		}
+
+		checkpoint := lease.checkpoint()
+		if checkpoint == nil {
+			defaultCheckpoint := sl.defaultCheckpoint()
+			checkpoint = &defaultCheckpoint
+		}
+		if checkpoint.Offset == "" && !checkpoint.EnqueueTime.IsZero() {
+			// the checkpoint has no sequence number to measure the lag from
+			continue
+		}
+
+		lag := info.LastSequenceNumber - checkpoint.SequenceNumber
+		if lag < 0 {
+			lag = 0
+		}
+		lags[partitionID] = lag
+	}
+	return lags, nil
+}
+
+// LeaseEpoch returns the epoch of the lease this host currently holds for the partitionID. The bool is false if the
+// partition is not owned by this host.
+//
+// The epoch is incremented each time the lease changes hands, so it can be used as a fencing token for writes to an
+// external sink: store the epoch alongside each write and have the sink reject any write carrying an epoch lower than
+// the highest it has seen for the partition. A host which has lost its lease, but has not yet noticed, will then be
+// unable to overwrite data written by the new owner.
+func (sl *LeaserCheckpointer) LeaseEpoch(partitionID string) (int64, bool) {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	lease, ok := sl.leases[partitionID]
+	if !ok {
+		return 0, false
+	}
+	return lease.GetEpoch(), true
+}
+
+// EnsureCheckpoint ensures a checkpoint exists for the lease
+func (sl *LeaserCheckpointer) EnsureCheckpoint(ctx context.Context, partitionID string) (persist.Checkpoint, error) {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.EnsureCheckpoint")
+	defer span.Finish()
+
+	lease, ok := sl.leases[partitionID]
+	if ok {
+		if checkpoint := lease.checkpoint(); checkpoint != nil {
+			return *checkpoint, nil
+		}
+
+		checkpoint, mirrored := sl.mirroredCheckpoint(ctx, partitionID)
+		if !mirrored {
+			checkpoint = sl.defaultCheckpoint()
+		}
+		checkpoint, _ = lease.setCheckpointIfEmpty(checkpoint)
+		return checkpoint, nil
+	}
+	if checkpoint, mirrored := sl.mirroredCheckpoint(ctx, partitionID); mirrored {
+		return checkpoint, nil
+	}
+	return sl.defaultCheckpoint(), nil
+}
+
+// EnsureCheckpointAt sets the checkpoint of a partition owned by this host to checkpoint if the partition doesn't
+// have one yet, and returns the partition's checkpoint. An existing checkpoint is left untouched, so this can be used
+// to seed positions when migrating from another checkpoint store without reprocessing history. With
+// WithSynchronousCheckpoints the seeded checkpoint is uploaded before returning. To seed partitions before any host
+// owns them, use EnsureLeaseWithCheckpoint.
+func (sl *LeaserCheckpointer) EnsureCheckpointAt(ctx context.Context, partitionID string, checkpoint persist.Checkpoint) (persist.Checkpoint, error) {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.EnsureCheckpointAt")
+	defer span.Finish()
+
+	lease, ok := sl.leases[partitionID]
+	if !ok {
+		return persist.Checkpoint{}, ErrPartitionNotOwned
+	}
+
+	current, set := lease.setCheckpointIfEmpty(checkpoint)
+	if !set {
+		return current, nil
+	}
+
+	if sl.synchronous {
+		if err := sl.persistLeaseCheckpointWithMetrics(ctx, lease); err != nil {
+			return persist.Checkpoint{}, err
+		}
+	} else if err := sl.markDirty(partitionID); err != nil {
+		return persist.Checkpoint{}, err
+	}
+	return checkpoint, nil
+}
+
+// CheckpointEvent checkpoints the partition at the event, using the offset, sequence number and enqueued time Event
+// Hubs set on the event when it was received
+func (sl *LeaserCheckpointer) CheckpointEvent(ctx context.Context, partitionID string, event *eventhub.Event) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.CheckpointEvent")
+	defer span.Finish()
+
+	if event == nil {
+		return ErrEventNotReceived
+	}
+
+	checkpoint := event.GetCheckpoint()
+	if checkpoint.Offset == "" {
+		return ErrEventNotReceived
+	}
+	return sl.UpdateCheckpoint(ctx, partitionID, checkpoint)
+}
+
+// UpdateCheckpoint will attempt to write the checkpoint to Azure Storage. Checkpoints are recorded in memory under a
+// lock for the partition alone and persisted in the background, so updates don't wait on other partitions or on
+// calls to Azure Storage.
+func (sl *LeaserCheckpointer) UpdateCheckpoint(ctx context.Context, partitionID string, checkpoint persist.Checkpoint) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.UpdateCheckpoint")
+	defer span.Finish()
+
+	lease, ok := sl.ownedLease(partitionID)
+	if !ok {
+		if sl.lenientCheckpoint {
+			sl.logger.Info(ctx, "skipping checkpoint for partition not owned by this host", "partitionID", partitionID, "sequenceNumber", checkpoint.SequenceNumber)
+			return nil
+		}
+		return ErrPartitionNotOwned
+	}
+
+	if err := sl.advanceCheckpoint(ctx, lease, checkpoint); err != nil {
+		return err
+	}
+
+	if sl.synchronous {
+		if err := sl.persistCheckpoint(ctx, partitionID); err != nil {
+			return err
+		}
+	} else if err := sl.markDirty(partitionID); err != nil {
+		return err
+	}
+
+	if sl.mirror != nil {
+		if err := sl.mirror.UpdateCheckpoint(ctx, partitionID, checkpoint); err != nil {
+			sl.logger.Error(ctx, "failed to mirror checkpoint", "partitionID", partitionID, "error", err)
+		}
+	}
+	return nil
+}
+
+// persistCheckpoint uploads the lease held for the partition, for WithSynchronousCheckpoints
+func (sl *LeaserCheckpointer) persistCheckpoint(ctx context.Context, partitionID string) error {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	lease, ok := sl.ownedLease(partitionID)
+	if !ok {
+		return ErrPartitionNotOwned
+	}
+	return sl.persistLeaseCheckpointWithMetrics(ctx, lease)
+}
+
+// persistLeaseCheckpointWithMetrics uploads the lease's checkpoint and records how long it took; must be called with
+// leasesMu held
+func (sl *LeaserCheckpointer) persistLeaseCheckpointWithMetrics(ctx context.Context, lease *storageLease) error {
+	start := sl.clock.Now()
+	err := sl.persistLeaseCheckpoint(ctx, lease)
+	sl.metrics.CheckpointPersisted(lease.PartitionID, sl.clock.Now().Sub(start), err)
+	if err != nil {
+		sl.logger.Error(ctx, "failed to persist checkpoint", "partitionID", lease.PartitionID, "error", err)
+		return err
+	}
+	return nil
+}
+
+// SeedCheckpointsFromTime replaces the checkpoints of the partitionIDs with ones positioned at the enqueue time t, and
+// uploads them, so receivers started for the partitions afterwards begin with the first event enqueued after t. This
+// replays or skips events without having to look up their offsets. Every partition must be owned by this host, or no
+// checkpoint is changed, and t must not be in the future.
+//
+// Seeding is an intentional rewind, so the seeded checkpoints replace the stored ones even without WithAllowRewind. They
+// have no offset or sequence number, so CheckpointLag leaves the partitions out until they're checkpointed again.
+//
+// Receivers already running for the partitions are not repositioned, and their next checkpoints replace the seeded
+// ones, so seed partitions before their receivers start or while they are not checkpointing.
+func (sl *LeaserCheckpointer) SeedCheckpointsFromTime(ctx context.Context, partitionIDs []string, t time.Time) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.SeedCheckpointsFromTime")
+	defer span.Finish()
+
+	if t.IsZero() {
+		return errors.New("the time to seed checkpoints from must be set")
+	}
+	if now := sl.clock.Now(); t.After(now) {
+		return fmt.Errorf("the time to seed checkpoints from, %v, is in the future", t)
+	}
+
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	leases := make([]*storageLease, 0, len(partitionIDs))
+	for _, partitionID := range partitionIDs {
+		lease, ok := sl.ownedLease(partitionID)
+		if !ok {
+			return PartitionErrors{partitionID: ErrPartitionNotOwned}
+		}
+		leases = append(leases, lease)
+	}
+
+	errs := make(PartitionErrors)
+	for _, lease := range leases {
+		// a checkpoint without an offset is positioned by its enqueue time
+		lease.setCheckpoint(&persist.Checkpoint{EnqueueTime: t})
+		sl.untrackDirty(lease.PartitionID)
+		if err := sl.persistLeaseCheckpoint(ctx, lease); err != nil {
+			sl.logger.Error(ctx, "failed to persist seeded checkpoint", "partitionID", lease.PartitionID, "error", err)
+			errs[lease.PartitionID] = err
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// advanceCheckpoint sets the lease's checkpoint, rejecting a rewind unless WithAllowRewind is set
+func (sl *LeaserCheckpointer) advanceCheckpoint(ctx context.Context, lease *storageLease, checkpoint persist.Checkpoint) error {
+	lease.checkpointMu.Lock()
+	defer lease.checkpointMu.Unlock()
+
+	if lease.Checkpoint != nil && checkpoint.SequenceNumber < lease.Checkpoint.SequenceNumber {
+		regression := &ErrCheckpointRegression{
+			PartitionID:       lease.PartitionID,
+			StoredSequence:    lease.Checkpoint.SequenceNumber,
+			AttemptedSequence: checkpoint.SequenceNumber,
+		}
+		if !sl.allowRewind {
+			sl.logger.Error(ctx, "rejected checkpoint regression", "partitionID", lease.PartitionID, "storedSequence", regression.StoredSequence, "attemptedSequence", regression.AttemptedSequence)
+			return regression
+		}
+		sl.logger.Info(ctx, "rewinding checkpoint", "partitionID", lease.PartitionID, "storedSequence", regression.StoredSequence, "attemptedSequence", regression.AttemptedSequence)
+	}
+
+	lease.Checkpoint = &checkpoint
+	return nil
+}
+
+// DeleteCheckpoint will attempt to delete the checkpoint from Azure Storage
+func (sl *LeaserCheckpointer) DeleteCheckpoint(ctx context.Context, partitionID string) error {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.DeleteCheckpoint")
+	defer span.Finish()
+
+	lease, ok := sl.leases[partitionID]
+	if !ok {
+		return ErrPartitionNotOwned
+	}
+
+	if sl.evictOnDelete {
+		lease.setCheckpoint(nil)
+	} else {
+		checkpoint := persist.NewCheckpointFromStartOfStream()
+		lease.setCheckpoint(&checkpoint)
+	}
+	updatedLease, ok, err := sl.updateLease(ctx, lease.PartitionID)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errors.New("checkpoint update was not successful")
+	}
+	sl.setLease(updatedLease.(*storageLease))
+	return nil
+
+}
+
+// DrainAndClose releases every lease this host owns, uploading each partition's final checkpoint first, so other hosts
+// can pick up the partitions immediately rather than waiting for the leases to expire. The LeaserCheckpointer is closed
+// afterwards. Partitions which could not be released before the context is done are returned as PartitionErrors. A
+// partition whose lease was released but whose final checkpoint couldn't be uploaded isn't returned, since the lease
+// was given up; ReleaseLease has logged the failed upload.
+func (sl *LeaserCheckpointer) DrainAndClose(ctx context.Context) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.DrainAndClose")
+	defer span.Finish()
+
+	sl.leasesMu.Lock()
+	partitionIDs := make([]string, 0, len(sl.leases))
+	for partitionID := range sl.leases {
+		partitionIDs = append(partitionIDs, partitionID)
+	}
+	sl.leasesMu.Unlock()
+
+	errs := make(PartitionErrors)
+	for _, partitionID := range partitionIDs {
+		if err := ctx.Err(); err != nil {
+			errs[partitionID] = err
+			continue
+		}
+
+		released, err := sl.ReleaseLease(ctx, partitionID)
+		if err != nil && !released {
+			sl.logger.Error(ctx, "failed to release lease", "partitionID", partitionID, "error", err)
+			errs[partitionID] = err
+		}
+	}
+
+	if err := sl.Close(); err != nil {
+		return err
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// GetCheckpointFromStorage reads the checkpoint for the partitionID from its lease blob rather than from this host's
+// in-memory leases, so it reflects what was last persisted by whichever host owns the partition. With
+// WithSecondaryReadEndpoint, the read falls back to the secondary endpoint if the primary is throttled or unavailable,
+// in which case the checkpoint may be behind the primary's.
+func (sl *LeaserCheckpointer) GetCheckpointFromStorage(ctx context.Context, partitionID string) (persist.Checkpoint, error) {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.GetCheckpointFromStorage")
+	defer span.Finish()
+
+	if sl.separateCheckpoints {
+		checkpoint, ok, err := sl.getCheckpointBlobFrom(ctx, sl.blobs(), partitionID)
+		if err != nil && sl.secondaryURL != nil && isThrottled(err) {
+			sl.logger.Error(ctx, "checkpoint read throttled, reading from the secondary", "partitionID", partitionID, "error", err)
+			span.SetTag("azure.storage.secondary_read", true)
+			checkpoint, ok, err = sl.getCheckpointBlobFrom(ctx, containerBlobClient{containerURL: sl.secondaryURL}, partitionID)
+		}
+		if err != nil {
+			sl.logger.Error(ctx, "failed to read checkpoint", "partitionID", partitionID, "error", err)
+			return persist.Checkpoint{}, err
+		}
+		if ok {
+			return *checkpoint, nil
+		}
+		// not yet migrated, so the checkpoint is still in the lease blob
+	}
+
+	lease, err := sl.getLease(ctx, partitionID)
+	if err != nil && sl.secondaryURL != nil && isThrottled(err) {
+		sl.logger.Error(ctx, "lease read throttled, reading from the secondary", "partitionID", partitionID, "error", err)
+		span.SetTag("azure.storage.secondary_read", true)
+		lease, err = sl.getLeaseFrom(ctx, containerBlobClient{containerURL: sl.secondaryURL}, partitionID)
 	}
 
-	err = sl.uploadLease(ctx, lease)
 	if err != nil {
-		log.For(ctx).Error(err)
-		return nil, false, err
+		sl.logger.Error(ctx, "failed to read checkpoint", "partitionID", partitionID, "error", err)
+		return persist.Checkpoint{}, err
 	}
 
-	return lease, true, nil
+	if lease.Checkpoint == nil {
+		return sl.defaultCheckpoint(), nil
+	}
+	return *lease.Checkpoint, nil
 }
 
-// GetCheckpoint returns the latest checkpoint for the partitionID.
-func (sl *LeaserCheckpointer) GetCheckpoint(ctx context.Context, partitionID string) (persist.Checkpoint, bool) {
+// CopyCheckpoint copies the persisted checkpoint of fromPartitionID in src's container to toPartitionID in this
+// leaser's container, such as when migrating consumers to another hub with the same partition layout without
+// reprocessing events. The target lease is acquired for the copy and released afterwards, unless this host already
+// holds it; a target leased by another host is not taken. Like UpdateCheckpoint, an *ErrCheckpointRegression is
+// returned if the target already has a more advanced checkpoint, unless WithAllowRewind is set.
+//
+// The EventProcessorHost must be set on this leaser, since it provides the owner identity recorded on the lease.
+func (sl *LeaserCheckpointer) CopyCheckpoint(ctx context.Context, fromPartitionID, toPartitionID string, src *LeaserCheckpointer) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.CopyCheckpoint")
+	defer span.Finish()
+	span.SetTag(partitionIDTag, toPartitionID)
+
+	if src == nil {
+		return errors.New("source leaser checkpointer must not be nil")
+	}
+	if sl.processor == nil {
+		return errors.New("the EventProcessorHost must be set to acquire the target lease")
+	}
+
+	source, err := src.getLeaseWithCheckpoint(ctx, fromPartitionID)
+	if err != nil {
+		sl.logger.Error(ctx, "failed to read source checkpoint", "partitionID", fromPartitionID, "error", err)
+		return err
+	}
+	checkpoint := source.checkpoint()
+	if checkpoint == nil {
+		return fmt.Errorf("partition %q has no checkpoint to copy", fromPartitionID)
+	}
+	return sl.writeCheckpoint(ctx, toPartitionID, *checkpoint)
+}
+
+// writeCheckpoint uploads the checkpoint to the lease blob of the partition. The lease is acquired for the write and
+// released afterwards, unless this host already holds it. A lease held by another host is not taken.
+func (sl *LeaserCheckpointer) writeCheckpoint(ctx context.Context, partitionID string, checkpoint persist.Checkpoint) error {
+	if _, owned := sl.ownedLease(partitionID); owned {
+		if err := sl.setOwnedCheckpoint(ctx, partitionID, checkpoint); err != nil {
+			return err
+		}
+		_, _, err := sl.UpdateLease(ctx, partitionID)
+		return err
+	}
+
+	if _, err := sl.EnsureLease(ctx, partitionID); err != nil {
+		sl.logger.Error(ctx, "failed to ensure lease", "partitionID", partitionID, "error", err)
+		return err
+	}
+	target, err := sl.getLease(ctx, partitionID)
+	if err != nil {
+		sl.logger.Error(ctx, "failed to read lease", "partitionID", partitionID, "error", err)
+		return err
+	}
+	if target.State == azblob.LeaseStateLeased {
+		return fmt.Errorf("partition %q is leased by %q; it must be released before its checkpoint can be replaced", partitionID, target.Owner)
+	}
+
+	_, ok, err := sl.AcquireLease(ctx, partitionID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("could not acquire the lease for partition %q", partitionID)
+	}
+
+	setErr := sl.setOwnedCheckpoint(ctx, partitionID, checkpoint)
+	// releasing the lease uploads the checkpoint
+	if _, err := sl.ReleaseLease(ctx, partitionID); err != nil {
+		return err
+	}
+	return setErr
+}
+
+// setOwnedCheckpoint sets the checkpoint on the in-memory lease held by this host for the partition
+func (sl *LeaserCheckpointer) setOwnedCheckpoint(ctx context.Context, partitionID string, checkpoint persist.Checkpoint) error {
+	lease, ok := sl.ownedLease(partitionID)
+	if !ok {
+		return ErrPartitionNotOwned
+	}
+	return sl.advanceCheckpoint(ctx, lease, checkpoint)
+}
+
+// mirroredCheckpoint reads the checkpoint for the partitionID from the mirror checkpointer, if one is configured
+func (sl *LeaserCheckpointer) mirroredCheckpoint(ctx context.Context, partitionID string) (persist.Checkpoint, bool) {
+	if sl.mirror == nil {
+		return persist.Checkpoint{}, false
+	}
+	return sl.mirror.GetCheckpoint(ctx, partitionID)
+}
+
+// defaultCheckpoint returns the checkpoint to use for a partition which doesn't have one
+func (sl *LeaserCheckpointer) defaultCheckpoint() persist.Checkpoint {
+	if sl.processor != nil {
+		return sl.processor.GetDefaultStartPosition()
+	}
+	return persist.NewCheckpointFromStartOfStream()
+}
+
+// Close will stop the leaser / checkpointer from persisting dirty leases & checkpoints to storage
+func (sl *LeaserCheckpointer) Close() error {
+	if sl.done != nil {
+		sl.done()
+	}
+	sl.closeWatchers()
+	sl.closePersistErrors()
+	if sl.mirror != nil {
+		return sl.mirror.Close()
+	}
+	return nil
+}
+
+// Reset makes the LeaserCheckpointer forget the leases it holds, as if the host had crashed, without closing it. The
+// lease blobs are left untouched, so the blob leases expire once they are no longer renewed and other hosts take the
+// partitions over. This is intended for failover testing.
+//
+// Checkpoints which have not been persisted are discarded, just as they would be lost in a crash, and watchers are
+// not told of the forgotten leases.
+func (sl *LeaserCheckpointer) Reset() {
 	sl.leasesMu.Lock()
 	defer sl.leasesMu.Unlock()
 
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.GetCheckpoint")
+	sl.leasesMapMu.Lock()
+	sl.leases = make(map[string]*storageLease)
+	sl.leasesMapMu.Unlock()
+	sl.metrics.OwnedPartitions(0)
+
+	sl.dirtyMu.Lock()
+	sl.dirtyPartitions = make(map[string]string)
+	sl.dirtySince = make(map[string]time.Time)
+	sl.dirtyMu.Unlock()
+
+	sl.droppedMu.Lock()
+	sl.dropped = make(map[string]*persist.Checkpoint)
+	sl.droppedMu.Unlock()
+
+	sl.lastPersisted = make(map[string]time.Time)
+}
+
+// WatchLeases returns a channel which receives a LeaseChange each time this host acquires, steals or releases a lease.
+// Changes made by other hosts are not observed, so this reflects only this host's view of the partitions it owns.
+//
+// The channel is closed when the context is done or the LeaserCheckpointer is closed. If the receiver falls behind,
+// changes are dropped rather than blocking the leasing of partitions.
+func (sl *LeaserCheckpointer) WatchLeases(ctx context.Context) (<-chan LeaseChange, error) {
+	sl.watchMu.Lock()
+	defer sl.watchMu.Unlock()
+
+	select {
+	case <-sl.watchClosed:
+		return nil, errors.New("leaser checkpointer is closed")
+	default:
+	}
+
+	ch := make(chan LeaseChange, leaseChangeBuffer)
+	sl.watchers = append(sl.watchers, ch)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			sl.removeWatcher(ch)
+		case <-sl.watchClosed:
+		}
+	}()
+	return ch, nil
+}
+
+func (sl *LeaserCheckpointer) notifyLeaseChange(partitionID, oldOwner, newOwner string) {
+	sl.watchMu.Lock()
+	defer sl.watchMu.Unlock()
+
+	change := LeaseChange{
+		PartitionID: partitionID,
+		OldOwner:    oldOwner,
+		NewOwner:    newOwner,
+		Timestamp:   sl.clock.Now(),
+	}
+	for _, ch := range sl.watchers {
+		select {
+		case ch <- change:
+		default:
+			// drop the change rather than block the lease path on a slow watcher
+		}
+	}
+}
+
+// notifyLeaseLost records the loss and calls the lease lost handler if the error from renewing the partition's lease
+// shows it was lost
+func (sl *LeaserCheckpointer) notifyLeaseLost(partitionID string, err error) {
+	if !isLeaseLost(err) {
+		return
+	}
+	sl.metrics.LeaseLost(partitionID)
+	if sl.onLeaseLost == nil {
+		return
+	}
+	go sl.onLeaseLost(partitionID)
+}
+
+func (sl *LeaserCheckpointer) removeWatcher(ch chan LeaseChange) {
+	sl.watchMu.Lock()
+	defer sl.watchMu.Unlock()
+
+	for idx, watcher := range sl.watchers {
+		if watcher == ch {
+			sl.watchers = append(sl.watchers[:idx], sl.watchers[idx+1:]...)
+			close(ch)
+			return
+		}
+	}
+}
+
+func (sl *LeaserCheckpointer) closeWatchers() {
+	sl.watchMu.Lock()
+	defer sl.watchMu.Unlock()
+
+	select {
+	case <-sl.watchClosed:
+		return
+	default:
+		close(sl.watchClosed)
+	}
+
+	for _, ch := range sl.watchers {
+		close(ch)
+	}
+	sl.watchers = nil
+}
+
+// Errors returns a channel which receives a *PersistError each time the background loop fails to persist a partition's
+// lease and checkpoint, such as when Azure Storage is unavailable. The same channel is returned on every call.
+//
+// The channel is closed when the LeaserCheckpointer is closed. If the receiver falls behind, errors are dropped rather
+// than stalling the persistence of checkpoints.
+func (sl *LeaserCheckpointer) Errors() <-chan error {
+	return sl.persistErrs
+}
+
+func (sl *LeaserCheckpointer) notifyPersistError(partitionID string, err error) {
+	sl.persistErrsMu.Lock()
+	defer sl.persistErrsMu.Unlock()
+
+	if sl.persistErrsClosed {
+		return
+	}
+
+	select {
+	case sl.persistErrs <- &PersistError{PartitionID: partitionID, Err: err}:
+	default:
+		// drop the error rather than block the persistence loop on a slow receiver
+	}
+}
+
+func (sl *LeaserCheckpointer) closePersistErrors() {
+	sl.persistErrsMu.Lock()
+	defer sl.persistErrsMu.Unlock()
+
+	if sl.persistErrsClosed {
+		return
+	}
+	sl.persistErrsClosed = true
+	close(sl.persistErrs)
+}
+
+// startPersistLeases starts the persistence loop. The loop is recorded as ticking before it's started, so Liveness
+// doesn't report it as not running before the goroutine is scheduled.
+func (sl *LeaserCheckpointer) startPersistLeases(ctx context.Context) {
+	// the initial delay is treated as one long interval, so the loop isn't reported dead before its first tick
+	atomic.StoreInt64(&sl.persistTick, sl.clock.Now().Add(persistInitialDelay-persistInterval).UnixNano())
+	go sl.persistLeases(ctx)
+}
+
+func (sl *LeaserCheckpointer) persistLeases(ctx context.Context) {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.persistLeases")
 	defer span.Finish()
+	defer atomic.StoreInt64(&sl.persistTick, 0)
 
-	lease, ok := sl.leases[partitionID]
-	if ok {
-		return *lease.Checkpoint, ok
+	<-sl.clock.After(persistInitialDelay)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			atomic.StoreInt64(&sl.persistTick, sl.clock.Now().UnixNano())
+			err := sl.persistDirtyPartitions(ctx)
+			if err != nil {
+				sl.logger.Error(ctx, "failed to persist checkpoints", "error", err)
+			}
+			<-sl.clock.After(persistInterval)
+		}
 	}
-	return persist.NewCheckpointFromStartOfStream(), ok
 }
 
-// EnsureCheckpoint ensures a checkpoint exists for the lease
-func (sl *LeaserCheckpointer) EnsureCheckpoint(ctx context.Context, partitionID string) (persist.Checkpoint, error) {
+func (sl *LeaserCheckpointer) persistDirtyPartitions(ctx context.Context) error {
 	sl.leasesMu.Lock()
 	defer sl.leasesMu.Unlock()
 
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.EnsureCheckpoint")
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.persistDirtyPartitions")
 	defer span.Finish()
 
-	lease, ok := sl.leases[partitionID]
-	if ok {
-		if lease.Checkpoint == nil {
-			checkpoint := persist.NewCheckpointFromStartOfStream()
-			lease.Checkpoint = &checkpoint
+	now := sl.clock.Now()
+	eligible := make(map[string]string)
+	for partitionID, dirtyID := range sl.dirtySnapshot() {
+		// partitions persisted too recently stay dirty until a later tick, when their newest checkpoint is written
+		if last, ok := sl.lastPersisted[partitionID]; ok && now.Sub(last) < sl.minPersistInterval {
+			continue
+		}
+		eligible[partitionID] = dirtyID
+	}
+
+	work := make(chan string, len(eligible))
+	for partitionID := range eligible {
+		work <- partitionID
+	}
+	close(work)
+
+	workers := sl.maxPersists
+	if workers > len(eligible) {
+		workers = len(eligible)
+	}
+
+	resCh := make(chan dirtyResult, len(eligible))
+	for i := 0; i < workers; i++ {
+		go func() {
+			for id := range work {
+				if ctx.Err() != nil {
+					return
+				}
+				err := sl.persistLease(ctx, id)
+				resCh <- dirtyResult{
+					Err:         err,
+					PartitionID: id,
+				}
+			}
+		}()
+	}
+
+	var lastErr error
+	for i := 0; i < len(eligible); i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case res := <-resCh:
+			if res.Err != nil {
+				lastErr = res.Err
+				sl.notifyPersistError(res.PartitionID, res.Err)
+			} else {
+				sl.lastPersisted[res.PartitionID] = now
+			}
+			// a checkpoint updated while the partition was being persisted keeps it dirty for the next tick
+			sl.clearDirty(res.PartitionID, eligible[res.PartitionID])
 		}
-		return *lease.Checkpoint, nil
 	}
-	return persist.NewCheckpointFromStartOfStream(), nil
+	return lastErr
 }
 
-// UpdateCheckpoint will attempt to write the checkpoint to Azure Storage
-func (sl *LeaserCheckpointer) UpdateCheckpoint(ctx context.Context, partitionID string, checkpoint persist.Checkpoint) error {
-	sl.leasesMu.Lock()
-	defer sl.leasesMu.Unlock()
+// trackDirty records when the partition became dirty. The dirty times are guarded by dirtyMu rather than leasesMu so
+// the backlog can still be checked while the persistence loop is stuck holding leasesMu.
+func (sl *LeaserCheckpointer) trackDirty(partitionID string) {
+	sl.dirtyMu.Lock()
+	defer sl.dirtyMu.Unlock()
+
+	if _, ok := sl.dirtySince[partitionID]; !ok {
+		sl.dirtySince[partitionID] = sl.clock.Now()
+	}
+}
+
+func (sl *LeaserCheckpointer) untrackDirty(partitionID string) {
+	sl.dirtyMu.Lock()
+	defer sl.dirtyMu.Unlock()
+
+	delete(sl.dirtyPartitions, partitionID)
+	delete(sl.dirtySince, partitionID)
+}
+
+// markDirty records the partition's checkpoint needs to be persisted. Each update gets a new dirty ID, so a persist
+// which raced with a newer update can tell the partition is still dirty.
+func (sl *LeaserCheckpointer) markDirty(partitionID string) error {
+	dirtyID, err := sl.newToken()
+	if err != nil {
+		return err
+	}
+
+	sl.dirtyMu.Lock()
+	sl.dirtyPartitions[partitionID] = dirtyID
+	sl.dirtyMu.Unlock()
+	sl.trackDirty(partitionID)
+	return nil
+}
+
+// clearDirty marks the partition clean if it hasn't been dirtied again since dirtyID was recorded
+func (sl *LeaserCheckpointer) clearDirty(partitionID, dirtyID string) {
+	sl.dirtyMu.Lock()
+	defer sl.dirtyMu.Unlock()
+
+	if current, ok := sl.dirtyPartitions[partitionID]; ok && current == dirtyID {
+		delete(sl.dirtyPartitions, partitionID)
+		delete(sl.dirtySince, partitionID)
+	}
+}
+
+func (sl *LeaserCheckpointer) dirtySnapshot() map[string]string {
+	sl.dirtyMu.Lock()
+	defer sl.dirtyMu.Unlock()
 
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.UpdateCheckpoint")
+	snapshot := make(map[string]string, len(sl.dirtyPartitions))
+	for partitionID, dirtyID := range sl.dirtyPartitions {
+		snapshot[partitionID] = dirtyID
+	}
+	return snapshot
+}
+
+// staleDirtyCount returns the number of partitions which have been dirty for longer than the backlog threshold
+func (sl *LeaserCheckpointer) staleDirtyCount(now time.Time) int {
+	sl.dirtyMu.Lock()
+	defer sl.dirtyMu.Unlock()
+
+	count := 0
+	for _, since := range sl.dirtySince {
+		if now.Sub(since) > sl.backlogThreshold {
+			count++
+		}
+	}
+	return count
+}
+
+func (sl *LeaserCheckpointer) watchBacklog(ctx context.Context) {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.watchBacklog")
 	defer span.Finish()
 
-	lease, ok := sl.leases[partitionID]
+	interval := sl.backlogThreshold / 2
+	if interval <= 0 {
+		interval = sl.backlogThreshold
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if count := sl.staleDirtyCount(sl.clock.Now()); count > 0 {
+				sl.logger.Error(ctx, "checkpoints have not been persisted within the backlog threshold", "count", count, "threshold", sl.backlogThreshold)
+				sl.backlogAlert(count)
+			}
+		}
+	}
+}
+
+func (sl *LeaserCheckpointer) persistLease(ctx context.Context, partitionID string) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.persistLease")
+	defer span.Finish()
+
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	start := sl.clock.Now()
+	// the lease is renewed before the checkpoint is written, even to an unleased checkpoint blob, so a host which lost
+	// the lease doesn't write over the new owner's checkpoint
+	_, ok, err := sl.updateLease(ctx, partitionID)
+	if isLeaseLost(err) || isLeaseLostOnWrite(err) {
+		sl.bufferDroppedCheckpoint(ctx, partitionID)
+	}
+	sl.metrics.CheckpointPersisted(partitionID, sl.clock.Now().Sub(start), err)
+
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errors.New("unable to update dirty lease -- this may mean there will be reprocessing")
+	}
+	return nil
+}
+
+// bufferDroppedCheckpoint keeps the unpersisted checkpoint of a partition whose lease was lost, so it can be applied if
+// the partition is acquired again; see WithDroppedCheckpointBuffer
+func (sl *LeaserCheckpointer) bufferDroppedCheckpoint(ctx context.Context, partitionID string) {
+	if sl.droppedLimit <= 0 {
+		return
+	}
+
+	lease, ok := sl.ownedLease(partitionID)
+	if !ok {
+		return
+	}
+	checkpoint := lease.checkpoint()
+	if checkpoint == nil {
+		return
+	}
+	buffered := *checkpoint
+
+	sl.droppedMu.Lock()
+	defer sl.droppedMu.Unlock()
+
+	if current, ok := sl.dropped[partitionID]; ok {
+		if buffered.SequenceNumber > current.SequenceNumber {
+			sl.dropped[partitionID] = &buffered
+		}
+		return
+	}
+	if len(sl.dropped) >= sl.droppedLimit {
+		sl.logger.Error(ctx, "discarding checkpoint dropped by lost lease; the buffer is full", "partitionID", partitionID, "sequenceNumber", buffered.SequenceNumber)
+		return
+	}
+	sl.dropped[partitionID] = &buffered
+	sl.logger.Info(ctx, "buffered checkpoint dropped by lost lease", "partitionID", partitionID, "sequenceNumber", buffered.SequenceNumber)
+}
+
+// reapplyDroppedCheckpoint gives a lease being claimed the checkpoint buffered when this host lost it, if it is further
+// along than the lease's checkpoint, returning true if it was applied. The buffer is left untouched until the claim
+// succeeds.
+func (sl *LeaserCheckpointer) reapplyDroppedCheckpoint(ctx context.Context, lease *storageLease) bool {
+	sl.droppedMu.Lock()
+	buffered, ok := sl.dropped[lease.PartitionID]
+	sl.droppedMu.Unlock()
 	if !ok {
-		return errors.New("lease for partition isn't owned by this EventProcessorHost")
+		return false
+	}
+
+	if stored := lease.checkpoint(); stored != nil && stored.SequenceNumber >= buffered.SequenceNumber {
+		sl.logger.Info(ctx, "discarding buffered checkpoint; the partition progressed past it on another host", "partitionID", lease.PartitionID, "sequenceNumber", buffered.SequenceNumber)
+		return false
+	}
+	checkpoint := *buffered
+	lease.setCheckpoint(&checkpoint)
+	sl.logger.Info(ctx, "reapplying checkpoint dropped by lost lease", "partitionID", lease.PartitionID, "sequenceNumber", checkpoint.SequenceNumber)
+	return true
+}
+
+func (sl *LeaserCheckpointer) forgetDroppedCheckpoint(partitionID string) {
+	sl.droppedMu.Lock()
+	defer sl.droppedMu.Unlock()
+
+	delete(sl.dropped, partitionID)
+}
+
+// persistLeaseCheckpoint persists the checkpoint of the lease, to its checkpoint blob when checkpoints are stored
+// separately or by uploading the whole lease otherwise. The caller must hold leasesMu.
+func (sl *LeaserCheckpointer) persistLeaseCheckpoint(ctx context.Context, lease *storageLease) error {
+	if sl.separateCheckpoints {
+		return sl.putCheckpointBlob(ctx, lease)
+	}
+	return sl.uploadLease(ctx, lease)
+}
+
+// putCheckpointBlob writes the checkpoint of the lease to the partition's checkpoint blob, or deletes the blob if the
+// lease has no checkpoint. The blob isn't leased, so the write is conditioned on the blob's ETag as of this host's last
+// read or write of it instead; if another host has written the blob since, such as a new owner of the partition, the
+// write fails rather than rolling the checkpoint back.
+func (sl *LeaserCheckpointer) putCheckpointBlob(ctx context.Context, lease *storageLease) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.putCheckpointBlob")
+	defer span.Finish()
+	span.SetTag(partitionIDTag, lease.PartitionID)
+	ctx, cancel := sl.operationContext(ctx)
+	defer cancel()
+
+	checkpoint := lease.checkpoint()
+	if checkpoint == nil {
+		if err := sl.deleteCheckpointBlob(ctx, lease.PartitionID, lease.checkpointETag); err != nil {
+			return err
+		}
+		lease.checkpointETag = ""
+		return nil
 	}
 
-	lease.Checkpoint = &checkpoint
-	dirtyPartitionID, err := uuid.NewV4()
+	body, err := json.Marshal(checkpoint)
 	if err != nil {
 		return err
 	}
-	sl.dirtyPartitions[partitionID] = dirtyPartitionID
+	conditions := azblob.HTTPAccessConditions{IfMatch: lease.checkpointETag}
+	if lease.checkpointETag == "" {
+		// the blob didn't exist when this host last looked, so it must not have been created since
+		conditions = azblob.HTTPAccessConditions{IfNoneMatch: "*"}
+	}
+	props, err := sl.blobs().PutBlob(ctx, checkpointBlobName(lease.PartitionID), body, sl.blobHTTPHeaders, sl.blobMetadata(), azblob.BlobAccessConditions{
+		HTTPAccessConditions: conditions,
+	})
+	if err != nil {
+		return newStorageOperationError(span, "PutBlob", lease.PartitionID, err)
+	}
+	tag.HTTPStatusCode.Set(span, uint16(props.StatusCode))
+	lease.checkpointETag = props.ETag
 	return nil
 }
 
-// DeleteCheckpoint will attempt to delete the checkpoint from Azure Storage
-func (sl *LeaserCheckpointer) DeleteCheckpoint(ctx context.Context, partitionID string) error {
-	sl.leasesMu.Lock()
-	defer sl.leasesMu.Unlock()
+// deleteCheckpointBlob deletes the partition's checkpoint blob when checkpoints are stored separately, only if its ETag
+// still matches etag unless etag is empty. A checkpoint blob which doesn't exist is treated as deleted.
+func (sl *LeaserCheckpointer) deleteCheckpointBlob(ctx context.Context, partitionID string, etag azblob.ETag) error {
+	if !sl.separateCheckpoints {
+		return nil
+	}
 
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.DeleteCheckpoint")
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.deleteCheckpointBlob")
 	defer span.Finish()
+	span.SetTag(partitionIDTag, partitionID)
+	ctx, cancel := sl.operationContext(ctx)
+	defer cancel()
 
-	lease, ok := sl.leases[partitionID]
-	if !ok {
-		return errors.New("lease for partition isn't owned by this EventProcessorHost")
+	err := sl.blobs().Delete(ctx, checkpointBlobName(partitionID), azblob.BlobAccessConditions{
+		HTTPAccessConditions: azblob.HTTPAccessConditions{IfMatch: etag},
+	})
+	if err != nil && !isBlobNotFound(err) {
+		return newStorageOperationError(span, "DeleteBlob", partitionID, err)
 	}
+	return nil
+}
 
-	checkpoint := persist.NewCheckpointFromStartOfStream()
-	lease.Checkpoint = &checkpoint
-	updatedLease, ok, err := sl.updateLease(ctx, lease.PartitionID)
+// loadCheckpointBlob replaces the checkpoint of the lease with the one in the partition's checkpoint blob when
+// checkpoints are stored separately. If the blob doesn't exist yet, the lease keeps the checkpoint from its lease blob.
+func (sl *LeaserCheckpointer) loadCheckpointBlob(ctx context.Context, lease *storageLease) error {
+	if !sl.separateCheckpoints {
+		return nil
+	}
+
+	checkpoint, etag, err := sl.readCheckpointBlob(ctx, sl.blobs(), lease.PartitionID, checkpointBlobName(lease.PartitionID))
 	if err != nil {
 		return err
 	}
-
-	if !ok {
-		return errors.New("checkpoint update was not successful")
+	lease.checkpointETag = etag
+	if checkpoint != nil {
+		lease.setCheckpoint(checkpoint)
 	}
-	sl.leases[partitionID] = updatedLease.(*storageLease)
 	return nil
-
 }
 
-// Close will stop the leaser / checkpointer from persisting dirty leases & checkpoints to storage
-func (sl *LeaserCheckpointer) Close() error {
-	if sl.done != nil {
-		sl.done()
-	}
-	return nil
+// getCheckpointBlobFrom reads the partition's checkpoint blob. False is returned if the blob doesn't exist, such as
+// for a partition whose checkpoint is still only in a lease blob written before checkpoints were stored separately.
+func (sl *LeaserCheckpointer) getCheckpointBlobFrom(ctx context.Context, blobs blobClient, partitionID string) (*persist.Checkpoint, bool, error) {
+	checkpoint, _, err := sl.readCheckpointBlob(ctx, blobs, partitionID, checkpointBlobName(partitionID))
+	return checkpoint, checkpoint != nil, err
 }
 
-func (sl *LeaserCheckpointer) persistLeases(ctx context.Context) {
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.persistLeases")
+// readCheckpointBlob reads the named checkpoint blob of the partition, which may be under a consumer group prefix, along
+// with its ETag. If the blob doesn't exist, a nil checkpoint and an empty ETag are returned.
+func (sl *LeaserCheckpointer) readCheckpointBlob(ctx context.Context, blobs blobClient, partitionID, blobName string) (*persist.Checkpoint, azblob.ETag, error) {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.getCheckpointBlob")
 	defer span.Finish()
-	<-time.After(5 * time.Second) // initial delay
+	span.SetTag(partitionIDTag, partitionID)
+	ctx, cancel := sl.operationContext(ctx)
+	defer cancel()
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			err := sl.persistDirtyPartitions(ctx)
-			if err != nil {
-				log.For(ctx).Error(err)
-			}
-			<-time.After(1 * time.Second)
+	body, props, err := blobs.GetBlob(ctx, blobName)
+	if err != nil {
+		if isBlobNotFound(err) {
+			return nil, "", nil
 		}
+		return nil, "", newStorageOperationError(span, "GetBlob", partitionID, err)
 	}
-}
+	tag.HTTPStatusCode.Set(span, uint16(props.StatusCode))
 
-func (sl *LeaserCheckpointer) persistDirtyPartitions(ctx context.Context) error {
-	sl.leasesMu.Lock()
-	defer sl.leasesMu.Unlock()
+	var checkpoint persist.Checkpoint
+	if err := json.Unmarshal(body, &checkpoint); err != nil {
+		return nil, "", err
+	}
+	return &checkpoint, props.ETag, nil
+}
 
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.persistDirtyPartitions")
+// uploadLease writes the lease to its blob, only if the blob hasn't changed since this host last read or wrote it. If
+// the blob was changed underneath the lease, the blob is read again and the upload retried.
+func (sl *LeaserCheckpointer) uploadLease(ctx context.Context, lease *storageLease) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.uploadLease")
 	defer span.Finish()
+	span.SetTag(partitionIDTag, lease.PartitionID)
 
-	resCh := make(chan dirtyResult)
-	for partitionID := range sl.dirtyPartitions {
-		go func(id string) {
-			err := sl.persistLease(ctx, id)
-			resCh <- dirtyResult{
-				Err:         err,
-				PartitionID: id,
-			}
-		}(partitionID)
-	}
+	for attempt := 1; ; attempt++ {
+		err := sl.putLease(ctx, lease)
+		if err == nil || !isConditionNotMet(err) || attempt >= maxLeaseUploadAttempts {
+			return err
+		}
 
-	var lastErr error
-	for i := 0; i < len(sl.dirtyPartitions); i++ {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case res := <-resCh:
-			if res.Err != nil {
-				lastErr = res.Err
-			}
-			delete(sl.dirtyPartitions, res.PartitionID)
+		sl.logger.Info(ctx, "lease blob changed since it was last read; refreshing before retrying upload", "partitionID", lease.PartitionID, "attempt", attempt)
+		if err := sl.refreshLeaseETag(ctx, lease); err != nil {
+			return err
 		}
 	}
-	return lastErr
 }
 
-func (sl *LeaserCheckpointer) persistLease(ctx context.Context, partitionID string) error {
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.persistLease")
+func (sl *LeaserCheckpointer) putLease(ctx context.Context, lease *storageLease) error {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.putLease")
 	defer span.Finish()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	ctx, cancel := sl.operationContext(ctx)
 	defer cancel()
-	_, ok, err := sl.updateLease(ctx, partitionID)
 
+	body, headers, err := sl.leaseBody(lease)
 	if err != nil {
 		return err
 	}
-
-	if !ok {
-		return errors.New("unable to update dirty lease -- this may mean there will be reprocessing")
+	props, err := sl.blobs().PutBlob(ctx, leaseBlobName(lease.PartitionID), body, headers, sl.blobMetadata(), azblob.BlobAccessConditions{
+		HTTPAccessConditions: azblob.HTTPAccessConditions{
+			IfMatch: lease.etag,
+		},
+		LeaseAccessConditions: azblob.LeaseAccessConditions{
+			LeaseID: lease.Token,
+		},
+	})
+	if err != nil {
+		return newStorageOperationError(span, "PutBlob", lease.PartitionID, err)
 	}
+	tag.HTTPStatusCode.Set(span, uint16(props.StatusCode))
+	lease.etag = props.ETag
 	return nil
 }
 
-func (sl *LeaserCheckpointer) uploadLease(ctx context.Context, lease *storageLease) error {
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.uploadLease")
-	defer span.Finish()
-
-	blobURL := sl.containerURL.NewBlobURL(lease.PartitionID)
-	jsonLease, err := json.Marshal(lease)
+// refreshLeaseETag reads the lease blob again to pick up its current ETag. If the blob holds a checkpoint further
+// along than the lease's, the lease adopts it so the retried upload doesn't write over progress.
+func (sl *LeaserCheckpointer) refreshLeaseETag(ctx context.Context, lease *storageLease) error {
+	current, err := sl.getLease(ctx, lease.PartitionID)
 	if err != nil {
 		return err
 	}
-	reader := bytes.NewReader(jsonLease)
-	_, err = blobURL.ToBlockBlobURL().PutBlob(ctx, reader, azblob.BlobHTTPHeaders{}, azblob.Metadata{}, azblob.BlobAccessConditions{
-		LeaseAccessConditions: azblob.LeaseAccessConditions{
-			LeaseID: lease.Token,
-		},
-	})
 
-	return err
+	lease.etag = current.etag
+	if stored := current.checkpoint(); stored != nil {
+		lease.checkpointMu.Lock()
+		if lease.Checkpoint == nil || stored.SequenceNumber > lease.Checkpoint.SequenceNumber {
+			lease.Checkpoint = stored
+		}
+		lease.checkpointMu.Unlock()
+	}
+	return nil
 }
 
-func (sl *LeaserCheckpointer) createOrGetLease(ctx context.Context, partitionID string) (*storageLease, error) {
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.createOrGetLease")
+func (sl *LeaserCheckpointer) createOrGetLease(ctx context.Context, partitionID string, checkpoint *persist.Checkpoint) (*storageLease, error) {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.createOrGetLease")
 	defer span.Finish()
 
 	lease := &storageLease{
 		Lease: &eph.Lease{
 			PartitionID: partitionID,
 		},
+		Checkpoint: checkpoint,
 	}
-	blobURL := sl.containerURL.NewBlobURL(partitionID)
-	jsonLease, err := json.Marshal(lease)
+	body, headers, err := sl.leaseBody(lease)
 	if err != nil {
 		return nil, err
 	}
-	reader := bytes.NewReader(jsonLease)
-	res, err := blobURL.ToBlockBlobURL().PutBlob(ctx, reader, azblob.BlobHTTPHeaders{}, azblob.Metadata{}, azblob.BlobAccessConditions{
+	props, err := sl.blobs().PutBlob(ctx, leaseBlobName(partitionID), body, headers, sl.blobMetadata(), azblob.BlobAccessConditions{
 		HTTPAccessConditions: azblob.HTTPAccessConditions{
 			IfNoneMatch: "*",
 		},
 	})
 
 	if err != nil {
+		if isBlobAlreadyExists(err) {
+			// the lease was already created, possibly by another host, so use the lease which is already there
+			return sl.getLease(ctx, partitionID)
+		}
 		return nil, err
 	}
+	lease.etag = props.ETag
+	return lease, nil
+}
 
-	if res.StatusCode() == 404 {
-		return sl.getLease(ctx, partitionID)
+// getLeaseWithCheckpoint reads the lease of the partition along with its latest checkpoint, which is read from the
+// checkpoint blob when checkpoints are stored separately
+func (sl *LeaserCheckpointer) getLeaseWithCheckpoint(ctx context.Context, partitionID string) (*storageLease, error) {
+	lease, err := sl.getLease(ctx, partitionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := sl.loadCheckpointBlob(ctx, lease); err != nil {
+		return nil, err
 	}
-	return lease, err
+	return lease, nil
 }
 
 func (sl *LeaserCheckpointer) getLease(ctx context.Context, partitionID string) (*storageLease, error) {
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.getLease")
+	return sl.getLeaseFrom(ctx, sl.blobs(), partitionID)
+}
+
+func (sl *LeaserCheckpointer) getLeaseFrom(ctx context.Context, blobs blobClient, partitionID string) (*storageLease, error) {
+	return sl.readLeaseBlob(ctx, blobs, leaseBlobName(partitionID))
+}
+
+// readLeaseBlob reads the lease from the named blob, which may be under a consumer group prefix
+func (sl *LeaserCheckpointer) readLeaseBlob(ctx context.Context, blobs blobClient, blobName string) (*storageLease, error) {
+	span, ctx := sl.startConsumerSpanFromContext(ctx, "storage.LeaserCheckpointer.getLease")
 	defer span.Finish()
+	span.SetTag(blobNameTag, blobName)
+	// only lease blobs at the root of the container are this LeaserCheckpointer's, named after their partition
+	if !strings.Contains(blobName, "/") {
+		if partitionID, err := partitionIDFromBlobName(blobName); err == nil {
+			span.SetTag(partitionIDTag, partitionID)
+		}
+	}
+	ctx, cancel := sl.operationContext(ctx)
+	defer cancel()
 
-	blobURL := sl.containerURL.NewBlobURL(partitionID)
-	res, err := blobURL.GetBlob(ctx, azblob.BlobRange{}, azblob.BlobAccessConditions{}, false)
+	body, props, err := blobs.GetBlob(ctx, blobName)
 	if err != nil {
+		if storageErr, ok := err.(azblob.StorageError); ok && storageErr.Response() != nil {
+			tag.HTTPStatusCode.Set(span, uint16(storageErr.Response().StatusCode))
+		}
+		tag.Error.Set(span, true)
 		return nil, err
 	}
-	return sl.leaseFromResponse(res)
+	tag.HTTPStatusCode.Set(span, uint16(props.StatusCode))
+	return sl.leaseFromBlob(body, props)
 }
 
-func (sl *LeaserCheckpointer) leaseFromResponse(res *azblob.GetResponse) (*storageLease, error) {
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(res.Response().Body)
+func (sl *LeaserCheckpointer) leaseFromBlob(body []byte, props blobProperties) (*storageLease, error) {
+	// a body decompressed by the HTTP transport no longer carries its Content-Encoding
+	bits, err := readLeaseBody(bytes.NewReader(body), props.ContentEncoding)
+	if err != nil {
+		return nil, err
+	}
 	var lease storageLease
-	if err := json.Unmarshal(buf.Bytes(), &lease); err != nil {
+	if err := json.Unmarshal(bits, &lease); err != nil {
+		return nil, err
+	}
+	if err := migrateLease(&lease); err != nil {
 		return nil, err
 	}
 	lease.leaser = sl
-	lease.State = res.LeaseState()
+	lease.State = props.LeaseState
+	lease.etag = props.ETag
 	return &lease, nil
 }
 
-func (sl *LeaserCheckpointer) dlog(ctx context.Context, msg string) {
-	name := sl.processor.GetName()
-	log.For(ctx).Debug(fmt.Sprintf("storage leaser eph %q: "+msg, name))
+// migrateLease upgrades a lease read from a blob to the current schema version, rejecting leases written in a newer
+// format than this package understands
+func migrateLease(lease *storageLease) error {
+	if lease.SchemaVersion > leaseSchemaVersion {
+		partitionID := ""
+		if lease.Lease != nil {
+			partitionID = lease.PartitionID
+		}
+		return &ErrUnsupportedLeaseVersion{
+			PartitionID:      partitionID,
+			Version:          lease.SchemaVersion,
+			SupportedVersion: leaseSchemaVersion,
+		}
+	}
+
+	// version 0 has the same shape as version 1, and only lacks the version itself
+	lease.SchemaVersion = leaseSchemaVersion
+	return nil
+}
+
+func (e *ErrUnsupportedLeaseVersion) Error() string {
+	return fmt.Sprintf("lease for partition %q was written with schema version %d, but only versions up to %d are supported", e.PartitionID, e.Version, e.SupportedVersion)
+}
+
+func (e *LeaseConflictError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("lease for partition %q is in transition (state %q): %v", e.PartitionID, e.State, e.Err)
+	}
+	return fmt.Sprintf("lease for partition %q is in transition (state %q)", e.PartitionID, e.State)
+}
+
+func (e *ErrCheckpointRegression) Error() string {
+	return fmt.Sprintf("checkpoint for partition %q would move backwards from sequence number %d to %d", e.PartitionID, e.StoredSequence, e.AttemptedSequence)
+}
+
+func (e *HealthCheckError) Error() string {
+	if e.Reason != nil {
+		return fmt.Sprintf("%v: %v", e.Reason, e.Err)
+	}
+	return fmt.Sprintf("storage: health check failed: %v", e.Err)
+}
+
+func (e *StorageOperationError) Error() string {
+	return fmt.Sprintf("storage %s for partition %q failed with status %d (request ID %q): %v",
+		e.Operation, e.PartitionID, e.StatusCode, e.RequestID, e.Err)
+}
+
+// Unwrap returns the underlying Azure Storage error
+func (e *StorageOperationError) Unwrap() error {
+	return e.Err
+}
+
+// newStorageOperationError wraps err with the request details from the Azure Storage response, if there is one, and
+// tags the span with them
+func newStorageOperationError(span opentracing.Span, operation, partitionID string, err error) error {
+	opErr := &StorageOperationError{
+		Operation:   operation,
+		PartitionID: partitionID,
+		Err:         err,
+	}
+
+	if storageErr, ok := err.(azblob.StorageError); ok {
+		opErr.ServiceCode = storageErr.ServiceCode()
+		if res := storageErr.Response(); res != nil {
+			opErr.StatusCode = res.StatusCode
+			opErr.RequestID = res.Header.Get("x-ms-request-id")
+		}
+	}
+
+	tag.Error.Set(span, true)
+	span.SetTag("azure.storage.operation", operation)
+	if opErr.RequestID != "" {
+		span.SetTag("azure.storage.request_id", opErr.RequestID)
+	}
+	if opErr.StatusCode != 0 {
+		tag.HTTPStatusCode.Set(span, uint16(opErr.StatusCode))
+	}
+	return opErr
+}
+
+func (e *PersistError) Error() string {
+	return fmt.Sprintf("failed to persist lease and checkpoint for partition %q: %v", e.PartitionID, e.Err)
+}
+
+// Unwrap returns the error from persisting the partition
+func (e *PersistError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FinalCheckpointError) Error() string {
+	return fmt.Sprintf("released lease for partition %q without uploading the final checkpoint: %v", e.PartitionID, e.Err)
+}
+
+// Unwrap returns the error from uploading the final checkpoint
+func (e *FinalCheckpointError) Unwrap() error {
+	return e.Err
+}
+
+func (e *OwnershipViolationError) Error() string {
+	return fmt.Sprintf("lease for partition %q should be owned by %q with token %q, but is owned by %q with token %q in state %q",
+		e.PartitionID, e.ExpectedOwner, e.ExpectedToken, e.ActualOwner, e.ActualToken, e.State)
+}
+
+func (pe PartitionErrors) Error() string {
+	partitionIDs := make([]string, 0, len(pe))
+	for partitionID := range pe {
+		partitionIDs = append(partitionIDs, partitionID)
+	}
+	sort.Strings(partitionIDs)
+
+	msgs := make([]string, len(partitionIDs))
+	for idx, partitionID := range partitionIDs {
+		msgs[idx] = fmt.Sprintf("partition %q: %v", partitionID, pe[partitionID])
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func isBlobAlreadyExists(err error) bool {
+	if storageErr, ok := err.(azblob.StorageError); ok {
+		if storageErr.ServiceCode() == azblob.ServiceCodeBlobAlreadyExists {
+			return true
+		}
+		if res := storageErr.Response(); res != nil {
+			return res.StatusCode == http.StatusConflict || res.StatusCode == http.StatusPreconditionFailed
+		}
+	}
+	return false
+}
+
+// isContainerNotFound returns true if the error is Azure Storage reporting the container doesn't exist
+func isContainerNotFound(err error) bool {
+	if opErr, ok := err.(*StorageOperationError); ok {
+		err = opErr.Err
+	}
+	if storageErr, ok := err.(azblob.StorageError); ok {
+		return storageErr.ServiceCode() == azblob.ServiceCodeContainerNotFound
+	}
+	return false
+}
+
+// isBlobNotFound returns true if the error is Azure Storage reporting the blob doesn't exist
+func isBlobNotFound(err error) bool {
+	if storageErr, ok := err.(azblob.StorageError); ok {
+		return storageErr.ServiceCode() == azblob.ServiceCodeBlobNotFound
+	}
+	return false
+}
+
+// isContainerAlreadyExists returns true if the error is Azure Storage reporting the container was already created
+func isContainerAlreadyExists(err error) bool {
+	if storageErr, ok := err.(azblob.StorageError); ok {
+		return storageErr.ServiceCode() == azblob.ServiceCodeContainerAlreadyExists
+	}
+	return false
+}
+
+// isTransient returns true if the error is Azure Storage failing in a way which may succeed when retried
+func isTransient(err error) bool {
+	if storageErr, ok := err.(azblob.StorageError); ok && storageErr.Response() != nil {
+		status := storageErr.Response().StatusCode
+		return status >= http.StatusInternalServerError || status == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// isThrottled returns true if the error is Azure Storage throttling requests or being unavailable
+func isThrottled(err error) bool {
+	if storageErr, ok := err.(azblob.StorageError); ok && storageErr.Response() != nil {
+		switch storageErr.Response().StatusCode {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return true
+		}
+	}
+	return false
+}
+
+// isConditionNotMet returns true if the error is Azure Storage rejecting a write because the blob's ETag changed
+func isConditionNotMet(err error) bool {
+	if opErr, ok := err.(*StorageOperationError); ok {
+		err = opErr.Err
+	}
+	if storageErr, ok := err.(azblob.StorageError); ok {
+		return storageErr.ServiceCode() == azblob.ServiceCodeConditionNotMet
+	}
+	return false
+}
+
+// isLeaseAlreadyPresent returns true if the error is Azure Storage refusing to acquire a blob lease another host holds
+func isLeaseAlreadyPresent(err error) bool {
+	if opErr, ok := err.(*StorageOperationError); ok {
+		err = opErr.Err
+	}
+	if storageErr, ok := err.(azblob.StorageError); ok {
+		return storageErr.ServiceCode() == azblob.ServiceCodeLeaseAlreadyPresent
+	}
+	return false
+}
+
+// isLeaseLostOnWrite returns true if a write to a blob with the lease ID failed because the lease was taken by another
+// host or expired after it was last renewed
+func isLeaseLostOnWrite(err error) bool {
+	if opErr, ok := err.(*StorageOperationError); ok {
+		err = opErr.Err
+	}
+	if storageErr, ok := err.(azblob.StorageError); ok {
+		switch storageErr.ServiceCode() {
+		case azblob.ServiceCodeLeaseIDMismatchWithBlobOperation,
+			azblob.ServiceCodeLeaseNotPresentWithBlobOperation:
+			return true
+		}
+	}
+	return false
+}
+
+// isLeaseLost returns true if the error shows the blob lease is no longer held with the token used for the operation
+func isLeaseLost(err error) bool {
+	if opErr, ok := err.(*StorageOperationError); ok {
+		err = opErr.Err
+	}
+	if storageErr, ok := err.(azblob.StorageError); ok {
+		switch storageErr.ServiceCode() {
+		case azblob.ServiceCodeLeaseLost,
+			azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation,
+			azblob.ServiceCodeLeaseNotPresentWithLeaseOperation,
+			azblob.ServiceCodeLeaseIsBrokenAndCannotBeRenewed:
+			return true
+		}
+	}
+	return false
+}
+
+func isLeaseConflict(err error) bool {
+	if opErr, ok := err.(*StorageOperationError); ok {
+		err = opErr.Err
+	}
+	if storageErr, ok := err.(azblob.StorageError); ok {
+		switch storageErr.ServiceCode() {
+		case azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation,
+			azblob.ServiceCodeLeaseIsBreakingAndCannotBeChanged,
+			azblob.ServiceCodeLeaseIsBreakingAndCannotBeAcquired:
+			return true
+		}
+	}
+	return false
+}
+
+func (sl *LeaserCheckpointer) dlog(ctx context.Context, msg string, keyvals ...interface{}) {
+	if sl.processor != nil {
+		keyvals = append([]interface{}{"eph", sl.processor.GetName()}, keyvals...)
+	}
+	sl.logger.Debug(ctx, msg, keyvals...)
 }
 
-// IsExpired checks to see if the blob is not still leased
+// IsExpired checks to see if the blob is not still leased. A lease held by this host which hasn't been renewed within
+// the lease duration is expired without needing to check the blob.
 func (s *storageLease) IsExpired(ctx context.Context) bool {
-	span, ctx := startConsumerSpanFromContext(ctx, "storage.storageLease.IsExpired")
+	span, ctx := s.leaser.startConsumerSpanFromContext(ctx, "storage.storageLease.IsExpired")
 	defer span.Finish()
 
+	if s.leaser.renewalLapsed(s) {
+		return true
+	}
+
 	lease, err := s.leaser.getLease(ctx, s.PartitionID)
 	if err != nil {
 		return false
@@ -627,8 +3573,110 @@ func (s *storageLease) IsExpired(ctx context.Context) bool {
 	return lease.State != azblob.LeaseStateLeased
 }
 
+// IsHeldBy checks to see if the blob is leased by the owner. When this host holds the lease as that owner, the token
+// stored in the blob must also match the token this host holds, so a lease reacquired by another instance using the
+// same name isn't mistaken for our own.
+func (s *storageLease) IsHeldBy(ctx context.Context, owner string) bool {
+	span, ctx := s.leaser.startConsumerSpanFromContext(ctx, "storage.storageLease.IsHeldBy")
+	defer span.Finish()
+
+	lease, err := s.leaser.getLease(ctx, s.PartitionID)
+	if err != nil {
+		return false
+	}
+
+	if lease.State != azblob.LeaseStateLeased || lease.Owner != owner {
+		return false
+	}
+
+	s.leaser.leasesMu.Lock()
+	defer s.leaser.leasesMu.Unlock()
+	if held, ok := s.leaser.leases[s.PartitionID]; ok && held.Owner == owner {
+		return held.Token == lease.Token
+	}
+	return true
+}
+
+// renewalLapsed returns true if the lease was acquired or renewed by this host, but not within the lease duration. An
+// infinite lease never lapses.
+func (sl *LeaserCheckpointer) renewalLapsed(lease *storageLease) bool {
+	sl.leasesMu.Lock()
+	defer sl.leasesMu.Unlock()
+
+	if sl.leaseDuration == InfiniteLeaseDuration {
+		return false
+	}
+	return !lease.renewedAt.IsZero() && sl.clock.Now().Sub(lease.renewedAt) >= sl.leaseDuration
+}
+
+// ownedLease returns the lease this host holds for the partition. Unlike reading leases while holding leasesMu, it
+// doesn't wait on calls to Azure Storage made for other partitions.
+func (sl *LeaserCheckpointer) ownedLease(partitionID string) (*storageLease, bool) {
+	sl.leasesMapMu.RLock()
+	defer sl.leasesMapMu.RUnlock()
+
+	lease, ok := sl.leases[partitionID]
+	return lease, ok
+}
+
+// setLease records a lease held by this host. The caller must hold leasesMu.
+func (sl *LeaserCheckpointer) setLease(lease *storageLease) {
+	sl.leasesMapMu.Lock()
+	sl.leases[lease.PartitionID] = lease
+	count := len(sl.leases)
+	sl.leasesMapMu.Unlock()
+
+	sl.metrics.OwnedPartitions(count)
+}
+
+// removeLease forgets a lease held by this host. The caller must hold leasesMu.
+func (sl *LeaserCheckpointer) removeLease(partitionID string) {
+	sl.leasesMapMu.Lock()
+	delete(sl.leases, partitionID)
+	count := len(sl.leases)
+	sl.leasesMapMu.Unlock()
+
+	sl.metrics.OwnedPartitions(count)
+}
+
+func (s *storageLease) checkpoint() *persist.Checkpoint {
+	s.checkpointMu.Lock()
+	defer s.checkpointMu.Unlock()
+
+	return s.Checkpoint
+}
+
+func (s *storageLease) setCheckpoint(checkpoint *persist.Checkpoint) {
+	s.checkpointMu.Lock()
+	defer s.checkpointMu.Unlock()
+
+	s.Checkpoint = checkpoint
+}
+
+// setCheckpointIfEmpty sets the checkpoint if the lease doesn't have one, returning the lease's checkpoint and whether
+// it was set
+func (s *storageLease) setCheckpointIfEmpty(checkpoint persist.Checkpoint) (persist.Checkpoint, bool) {
+	s.checkpointMu.Lock()
+	defer s.checkpointMu.Unlock()
+
+	if s.Checkpoint != nil {
+		return *s.Checkpoint, false
+	}
+	s.Checkpoint = &checkpoint
+	return checkpoint, true
+}
+
+// marshal serializes the lease for upload in the current schema version
+func (s *storageLease) marshal() ([]byte, error) {
+	s.checkpointMu.Lock()
+	defer s.checkpointMu.Unlock()
+
+	s.SchemaVersion = leaseSchemaVersion
+	return json.Marshal(s)
+}
+
 func (s *storageLease) String() string {
-	bits, err := json.Marshal(s)
+	bits, err := s.marshal()
 	if err != nil {
 		return ""
 	}
@@ -642,3 +3690,12 @@ func startConsumerSpanFromContext(ctx context.Context, operationName string, opt
 	span.SetTag("eh.eventprocessorhost.kind", "azure.storage")
 	return span, ctx
 }
+
+// startConsumerSpanFromContext starts a span with the default tags, then applies the span decorator, if any
+func (sl *LeaserCheckpointer) startConsumerSpanFromContext(ctx context.Context, operationName string, opts ...opentracing.StartSpanOption) (opentracing.Span, context.Context) {
+	span, ctx := startConsumerSpanFromContext(ctx, operationName, opts...)
+	if sl != nil && sl.spanDecorator != nil {
+		sl.spanDecorator(span)
+	}
+	return span, ctx
+}
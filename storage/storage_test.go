@@ -24,14 +24,34 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
 	"time"
 
 	"github.com/Azure/azure-amqp-common-go/aad"
+	"github.com/Azure/azure-amqp-common-go/persist"
+	"github.com/Azure/azure-event-hubs-go"
 	"github.com/Azure/azure-event-hubs-go/eph"
-	"github.com/Azure/azure-event-hubs-go/internal/test"
 	"github.com/Azure/azure-storage-blob-go/2016-05-31/azblob"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/opentracing/opentracing-go"
+	tag "github.com/opentracing/opentracing-go/ext"
+	"github.com/opentracing/opentracing-go/mocktracer"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const (
@@ -63,6 +83,28 @@ func (ts *testSuite) TestLeaserStoreCreation() {
 	ts.True(exists)
 }
 
+func (ts *testSuite) TestLeaserStoreMetadata() {
+	metadata := azblob.Metadata{"costcenter": "1234"}
+	leaser, del := ts.newLeaser(WithContainerMetadata(metadata))
+	defer del()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	ts.Require().NoError(leaser.EnsureStore(ctx))
+	ts.Equal(metadata, ts.containerMetadata(ctx, leaser))
+
+	updated := azblob.Metadata{"costcenter": "5678"}
+	other, err := NewStorageLeaserCheckpointer(leaser.credential, ts.AccountName, leaser.containerName, ts.Env, WithContainerMetadata(updated))
+	ts.Require().NoError(err)
+	ts.Require().NoError(other.EnsureStore(ctx))
+	ts.Equal(metadata, ts.containerMetadata(ctx, leaser), "metadata should be preserved on an existing container")
+
+	forced, err := NewStorageLeaserCheckpointer(leaser.credential, ts.AccountName, leaser.containerName, ts.Env, WithContainerMetadata(updated), WithForceMetadataUpdate())
+	ts.Require().NoError(err)
+	ts.Require().NoError(forced.EnsureStore(ctx))
+	ts.Equal(updated, ts.containerMetadata(ctx, leaser), "metadata should be overwritten when forced")
+}
+
 func (ts *testSuite) TestLeaserLeaseEnsure() {
 	leaser, del := ts.leaserWithEPH()
 	defer del()
@@ -76,6 +118,126 @@ func (ts *testSuite) TestLeaserLeaseEnsure() {
 	}
 }
 
+func (ts *testSuite) TestLeaserLeaseEnsureExisting() {
+	leaser, del := ts.leaserWithEPHAndLeases()
+	defer del()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	partitionID := leaser.processor.GetPartitionIDs()[0]
+	acquired, ok, err := leaser.AcquireLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have acquired")
+
+	lease, err := leaser.EnsureLease(ctx, partitionID)
+	ts.Require().NoError(err, "ensuring an existing lease shouldn't fail")
+	ts.Equal(partitionID, lease.GetPartitionID())
+	ts.Equal(acquired.GetOwner(), lease.GetOwner(), "should return the existing lease")
+	ts.Equal(acquired.GetEpoch(), lease.GetEpoch())
+}
+
+func (ts *testSuite) TestLeaserBlobHTTPHeaders() {
+	leaser, del := ts.leaserWithEPH()
+	defer del()
+	ts.Require().NoError(WithBlobHTTPHeaders(azblob.BlobHTTPHeaders{CacheControl: "no-cache"})(leaser))
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	partitionID := leaser.processor.GetPartitionIDs()[0]
+	_, err := leaser.EnsureLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.assertLeaseHeaders(ctx, leaser, partitionID)
+
+	// the headers should survive the lease being uploaded again
+	_, ok, err := leaser.AcquireLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have acquired")
+	ts.assertLeaseHeaders(ctx, leaser, partitionID)
+}
+
+func (ts *testSuite) assertLeaseHeaders(ctx context.Context, leaser *LeaserCheckpointer, partitionID string) {
+	res, err := leaser.containerURL.NewBlobURL(partitionID).GetPropertiesAndMetadata(ctx, azblob.BlobAccessConditions{})
+	ts.Require().NoError(err)
+	ts.Equal("application/json", res.ContentType())
+	ts.Equal("no-cache", res.CacheControl())
+}
+
+func (ts *testSuite) TestLeaserEnsureLeaseWithCheckpoint() {
+	leaser, del := ts.leaserWithEPH()
+	defer del()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	partitionID := leaser.processor.GetPartitionIDs()[0]
+	seed := persist.NewCheckpoint("2048", 42, time.Now().UTC().Truncate(time.Second))
+	_, err := leaser.EnsureLeaseWithCheckpoint(ctx, partitionID, seed)
+	ts.Require().NoError(err)
+
+	blobLease, err := leaser.getLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Require().NotNil(blobLease.Checkpoint, "the created blob should carry the seeded checkpoint")
+	ts.Equal(seed.Offset, blobLease.Checkpoint.Offset)
+	ts.Equal(seed.SequenceNumber, blobLease.Checkpoint.SequenceNumber)
+	ts.True(seed.EnqueueTime.Equal(blobLease.Checkpoint.EnqueueTime))
+
+	// once the lease is acquired, the seeded checkpoint is where receiving starts
+	_, ok, err := leaser.AcquireLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have acquired")
+	checkpoint, err := leaser.EnsureCheckpoint(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Equal(seed.Offset, checkpoint.Offset)
+}
+
+func (ts *testSuite) TestLeaserEnsureLeases() {
+	leaser, del := ts.leaserWithEPH()
+	defer del()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	partitionIDs := leaser.processor.GetPartitionIDs()
+	leases, err := leaser.EnsureLeases(ctx, partitionIDs)
+	ts.Require().NoError(err)
+	ts.Require().Len(leases, len(partitionIDs))
+	for idx, lease := range leases {
+		ts.Equal(partitionIDs[idx], lease.GetPartitionID())
+	}
+
+	// ensuring the leases again should return the existing leases
+	leases, err = leaser.EnsureLeases(ctx, partitionIDs)
+	ts.Require().NoError(err)
+	ts.Len(leases, len(partitionIDs))
+}
+
+func (ts *testSuite) TestLeaserOwnershipByConsumerGroup() {
+	leaser, del := ts.leaserWithEPH()
+	defer del()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	for _, blobName := range []string{"0", "1", "groupA/0", "groupA/1", "groupB/0"} {
+		_, err := leaser.createOrGetLease(ctx, blobName, nil)
+		ts.Require().NoError(err)
+	}
+
+	acquired, ok, err := leaser.AcquireLease(ctx, "0")
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have acquired")
+
+	ownership, err := leaser.GetOwnershipByConsumerGroup(ctx)
+	ts.Require().NoError(err)
+	ts.Len(ownership, 3)
+	ts.Len(ownership[eventhub.DefaultConsumerGroup], 2)
+	ts.Len(ownership["groupA"], 2)
+	ts.Len(ownership["groupB"], 1)
+
+	info := ownership[eventhub.DefaultConsumerGroup]["0"]
+	ts.Equal(acquired.GetOwner(), info.Owner)
+	ts.Equal(acquired.GetEpoch(), info.Epoch)
+	ts.Equal(azblob.LeaseStateLeased, info.State)
+	ts.Equal("", ownership["groupB"]["0"].Owner)
+}
+
 func (ts *testSuite) TestLeaserAcquire() {
 	leaser, del := ts.leaserWithEPHAndLeases()
 	defer del()
@@ -94,10 +256,33 @@ func (ts *testSuite) TestLeaserAcquire() {
 		assert.Equal(ts.T(), epochBefore+1, acquiredLease.GetEpoch())
 		assert.Equal(ts.T(), leaser.processor.GetName(), acquiredLease.GetOwner())
 		assert.NotNil(ts.T(), acquiredLease.(*storageLease).Token)
+		assert.Equal(ts.T(), eph.KindAcquired, acquiredLease.(*storageLease).GetAcquisitionKind())
 	}
 	assert.Equal(ts.T(), len(leaser.processor.GetPartitionIDs()), len(leaser.leases))
 }
 
+func (ts *testSuite) TestLeaserOwnerIdentity() {
+	identity := "somehost-" + ts.RandomName("owner", 6)
+	leaser, del := ts.leaserWithEPH(eph.WithOwnerIdentity(identity))
+	defer del()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	partitionID := leaser.processor.GetPartitionIDs()[0]
+	_, err := leaser.EnsureLease(ctx, partitionID)
+	ts.Require().NoError(err)
+
+	acquired, ok, err := leaser.AcquireLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have acquired")
+	ts.Equal(identity, acquired.GetOwner())
+
+	blobLease, err := leaser.getLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Equal(identity, blobLease.Owner, "the blob should record the configured owner identity")
+	ts.NotEqual(leaser.processor.GetName(), blobLease.Owner)
+}
+
 func (ts *testSuite) TestLeaserRenewLease() {
 	leaser, del := ts.leaserWithEPHAndLeases()
 	defer del()
@@ -142,61 +327,2625 @@ func (ts *testSuite) TestLeaserRelease() {
 	ts.Equal(0, len(leaser.leases))
 }
 
-func (ts *testSuite) leaserWithEPHAndLeases() (*LeaserCheckpointer, func()) {
-	leaser, del := ts.leaserWithEPH()
+func (ts *testSuite) TestLeaserReleaseUploadsFinalCheckpoint() {
+	leaser, del := ts.leaserWithEPHAndLeases()
+	defer del()
 
 	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
 	defer cancel()
-	for _, partitionID := range leaser.processor.GetPartitionIDs() {
-		lease, err := leaser.EnsureLease(ctx, partitionID)
-		ts.NoError(err)
-		ts.Equal(partitionID, lease.GetPartitionID())
-	}
+	partitionID := leaser.processor.GetPartitionIDs()[0]
+	_, ok, err := leaser.AcquireLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have acquired")
 
-	return leaser, del
+	// the checkpoint is only held in memory until the next persist tick, which a release should not wait for
+	checkpoint := persist.NewCheckpoint("2048", 20, time.Now())
+	ts.Require().NoError(leaser.UpdateCheckpoint(ctx, partitionID, checkpoint))
+	ok, err = leaser.ReleaseLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have released")
+
+	second, err := NewStorageLeaserCheckpointer(leaser.credential, leaser.accountName, leaser.containerName, leaser.env)
+	ts.Require().NoError(err)
+	second.SetEventHostProcessor(leaser.processor)
+	defer second.Close()
+
+	_, ok, err = second.AcquireLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "second instance should have acquired")
+
+	carried, ok := second.GetCheckpoint(ctx, partitionID)
+	ts.Require().True(ok, "second instance should have a checkpoint")
+	ts.Equal(checkpoint.Offset, carried.Offset)
+	ts.Equal(checkpoint.SequenceNumber, carried.SequenceNumber)
 }
 
-func (ts *testSuite) leaserWithEPH() (*LeaserCheckpointer, func()) {
-	leaser, del := ts.newLeaser()
-	hub, delHub := ts.RandomHub()
-	delAll := func() {
-		delHub()
-		del()
-	}
+func (ts *testSuite) TestLeaserCopyCheckpoint() {
+	source, del := ts.leaserWithEPHAndLeases()
+	defer del()
 
-	provider, err := aad.NewJWTProvider(aad.JWTProviderWithEnvironmentVars())
-	if !ts.NoError(err) {
-		delAll()
-		ts.FailNow("could not build a new JWT provider from env")
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	partitionID := source.processor.GetPartitionIDs()[0]
+	_, ok, err := source.AcquireLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have acquired")
+	checkpoint := persist.NewCheckpoint("2048", 20, time.Now())
+	ts.Require().NoError(source.UpdateCheckpoint(ctx, partitionID, checkpoint))
+	_, err = source.ReleaseLease(ctx, partitionID)
+	ts.Require().NoError(err)
+
+	target, delTarget := ts.newLeaser()
+	defer delTarget()
+	target.SetEventHostProcessor(source.processor)
+	defer target.Close()
+	ts.Require().NoError(target.EnsureStore(ctx))
+
+	ts.Require().NoError(target.CopyCheckpoint(ctx, partitionID, partitionID, source))
+	copied, err := target.GetCheckpointFromStorage(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Equal(checkpoint.Offset, copied.Offset)
+	ts.Equal(checkpoint.SequenceNumber, copied.SequenceNumber)
+	_, owned := target.ownedLease(partitionID)
+	ts.False(owned, "the target lease should be released after the copy")
+
+	// a target which is further along than the source is not rewound
+	_, ok, err = target.AcquireLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have acquired")
+	ts.Require().NoError(target.UpdateCheckpoint(ctx, partitionID, persist.NewCheckpoint("4096", 40, time.Now())))
+	err = target.CopyCheckpoint(ctx, partitionID, partitionID, source)
+	ts.IsType(&ErrCheckpointRegression{}, err)
+}
+
+func (ts *testSuite) TestLeaserDetectSplitBrain() {
+	leaser, del := ts.leaserWithEPHAndLeases()
+	defer del()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	partitionID := leaser.processor.GetPartitionIDs()[0]
+	_, ok, err := leaser.AcquireLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have acquired")
+
+	splitBrain, err := leaser.DetectSplitBrain(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.False(splitBrain, "the instance which claimed the lease is not split")
+
+	// a restarted instance of the same host has the same name, but a new instance ID
+	restarted, err := NewStorageLeaserCheckpointer(leaser.credential, leaser.accountName, leaser.containerName, leaser.env)
+	ts.Require().NoError(err)
+	restarted.SetEventHostProcessor(leaser.processor)
+	defer restarted.Close()
+	ts.NotEqual(leaser.instanceID, restarted.instanceID)
+
+	splitBrain, err = restarted.DetectSplitBrain(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.True(splitBrain, "the lease is held under this host's name by another instance")
+}
+
+func (ts *testSuite) TestLeaserExportImportCheckpoints() {
+	source, del := ts.leaserWithEPHAndLeases()
+	defer del()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	partitionIDs := source.processor.GetPartitionIDs()
+	for idx, partitionID := range partitionIDs {
+		_, ok, err := source.AcquireLease(ctx, partitionID)
+		ts.Require().NoError(err)
+		ts.Require().True(ok, "should have acquired")
+		checkpoint := persist.NewCheckpoint(strconv.Itoa(1024*(idx+1)), int64(10*(idx+1)), time.Now())
+		ts.Require().NoError(source.UpdateCheckpoint(ctx, partitionID, checkpoint))
 	}
+	ts.Require().NoError(source.DrainAndClose(ctx))
+
+	exported, err := source.ExportCheckpoints(ctx, partitionIDs)
+	ts.Require().NoError(err)
+
+	target, delTarget := ts.newLeaser()
+	defer delTarget()
+	target.SetEventHostProcessor(source.processor)
+	defer target.Close()
+	ts.Require().NoError(target.EnsureStore(ctx))
+	ts.Require().NoError(target.ImportCheckpoints(ctx, exported))
+
+	reexported, err := target.ExportCheckpoints(ctx, partitionIDs)
+	ts.Require().NoError(err)
+	ts.JSONEq(string(exported), string(reexported), "the checkpoints should survive the round trip unchanged")
+	ts.Empty(target.GetCheckpoints(ctx), "the leases taken for the import should be released")
+}
+
+func (ts *testSuite) TestLeaserDrainAndClose() {
+	leaser, del := ts.leaserWithEPHAndLeases()
+	defer del()
 
 	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
 	defer cancel()
-	processor, err := eph.New(ctx, ts.Namespace, *hub.Name, provider, nil, nil)
-	if !ts.NoError(err) {
-		delAll()
-		ts.FailNow("could not create a new eph")
+	partitionIDs := leaser.processor.GetPartitionIDs()
+	for _, partitionID := range partitionIDs {
+		_, ok, err := leaser.AcquireLease(ctx, partitionID)
+		ts.Require().NoError(err)
+		ts.Require().True(ok, "should have acquired")
 	}
-	leaser.SetEventHostProcessor(processor)
-	if !ts.NoError(leaser.EnsureStore(ctx)) {
-		delAll()
-		ts.FailNow("could not ensure store")
+
+	ts.Require().NoError(leaser.DrainAndClose(ctx))
+	ts.Equal(0, len(leaser.leases))
+
+	second, err := NewStorageLeaserCheckpointer(leaser.credential, leaser.accountName, leaser.containerName, leaser.env)
+	ts.Require().NoError(err)
+	second.SetEventHostProcessor(leaser.processor)
+	defer second.Close()
+
+	for _, partitionID := range partitionIDs {
+		acquired, ok, err := second.AcquireLease(ctx, partitionID)
+		ts.Require().NoError(err)
+		ts.Require().True(ok, "second instance should have acquired")
+		ts.Equal(eph.KindAcquired, acquired.(*storageLease).GetAcquisitionKind(), "the lease should have been released rather than changed")
 	}
+}
 
-	return leaser, delAll
+func (ts *testSuite) TestLeaserDeleteCheckpointEviction() {
+	endOfStream := persist.NewCheckpointFromEndOfStream()
+	leaser, del := ts.leaserWithEPHAndLeases(eph.WithDefaultStartPosition(endOfStream))
+	defer del()
+	ts.Require().NoError(WithCheckpointEvictionOnDelete()(leaser))
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	partitionID := leaser.processor.GetPartitionIDs()[0]
+	_, ok, err := leaser.AcquireLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have acquired")
+
+	ts.Require().NoError(leaser.UpdateCheckpoint(ctx, partitionID, persist.NewCheckpoint("1024", 10, time.Now())))
+	ts.Require().NoError(leaser.DeleteCheckpoint(ctx, partitionID))
+
+	blobLease, err := leaser.getLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Nil(blobLease.Checkpoint, "the checkpoint should have been removed from the lease blob")
+
+	ok, err = leaser.ReleaseLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have released")
+
+	_, ok, err = leaser.AcquireLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have reacquired")
+
+	checkpoint, err := leaser.EnsureCheckpoint(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Equal(endOfStream.Offset, checkpoint.Offset, "should start from the default start position")
 }
 
-func (ts *testSuite) newLeaser() (*LeaserCheckpointer, func()) {
-	containerName := strings.ToLower(ts.RandomName("stortest", 4))
-	cred, err := NewAADSASCredential(ts.SubscriptionID, test.ResourceGroupName, ts.AccountName, containerName, AADSASCredentialWithEnvironmentVars())
+func (ts *testSuite) TestLeaserStealLease() {
+	leaser, del := ts.leaserWithEPHAndLeases()
+	defer del()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	leases, err := leaser.GetLeases(ctx)
 	ts.Require().NoError(err)
-	leaser, err := NewStorageLeaserCheckpointer(cred, ts.AccountName, containerName, ts.Env)
+
+	lease := leases[0]
+	acquired, ok, err := leaser.AcquireLease(ctx, lease.GetPartitionID())
 	ts.Require().NoError(err)
-	return leaser, func() {
-		ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
-		defer cancel()
-		if err := leaser.DeleteStore(ctx); err != nil {
-			ts.T().Fatal(err)
-		}
+	ts.Require().True(ok, "should have acquired")
+
+	stolen, ok, err := leaser.StealLease(ctx, acquired.GetPartitionID())
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have stolen")
+	ts.Equal(acquired.GetEpoch()+1, stolen.GetEpoch())
+	ts.NotEqual(acquired.(*storageLease).Token, stolen.(*storageLease).Token)
+	ts.Equal(eph.KindChanged, stolen.(*storageLease).GetAcquisitionKind())
+
+	_, ok, err = leaser.RenewLease(ctx, stolen.GetPartitionID())
+	ts.NoError(err)
+	ts.True(ok, "should be able to renew the stolen lease")
+}
+
+func (ts *testSuite) TestLeaserWatchLeases() {
+	leaser, del := ts.leaserWithEPHAndLeases()
+	defer del()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	changes, err := leaser.WatchLeases(ctx)
+	ts.Require().NoError(err)
+
+	partitionID := leaser.processor.GetPartitionIDs()[0]
+	_, ok, err := leaser.AcquireLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have acquired")
+	ok, err = leaser.ReleaseLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have released")
+
+	acquired := <-changes
+	ts.Equal(partitionID, acquired.PartitionID)
+	ts.Equal("", acquired.OldOwner)
+	ts.Equal(leaser.processor.GetOwnerIdentity(), acquired.NewOwner)
+
+	released := <-changes
+	ts.Equal(partitionID, released.PartitionID)
+	ts.Equal(leaser.processor.GetOwnerIdentity(), released.OldOwner)
+	ts.Equal("", released.NewOwner)
+}
+
+func (ts *testSuite) TestLeaserEpochPersistsAcrossAcquireCycles() {
+	leaser, del := ts.leaserWithEPHAndLeases()
+	defer del()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	partitionID := leaser.processor.GetPartitionIDs()[0]
+	blobLease, err := leaser.getLease(ctx, partitionID)
+	ts.Require().NoError(err)
+	last := blobLease.GetEpoch()
+
+	for i := 0; i < 10; i++ {
+		acquired, ok, err := leaser.AcquireLease(ctx, partitionID)
+		ts.Require().NoError(err)
+		ts.Require().True(ok, "should have acquired")
+		ts.Equal(last+1, acquired.GetEpoch())
+
+		blobLease, err := leaser.getLease(ctx, partitionID)
+		ts.Require().NoError(err)
+		ts.Equal(acquired.GetEpoch(), blobLease.GetEpoch(), "the epoch should be persisted to the blob")
+		last = blobLease.GetEpoch()
+
+		ok, err = leaser.ReleaseLease(ctx, partitionID)
+		ts.Require().NoError(err)
+		ts.Require().True(ok, "should have released")
 	}
 }
+
+func (ts *testSuite) TestLeaserLeaseEpoch() {
+	leaser, del := ts.leaserWithEPHAndLeases()
+	defer del()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	leases, err := leaser.GetLeases(ctx)
+	ts.Require().NoError(err)
+
+	lease := leases[0]
+	_, ok := leaser.LeaseEpoch(lease.GetPartitionID())
+	ts.False(ok, "shouldn't have an epoch for an unowned partition")
+
+	acquired, ok, err := leaser.AcquireLease(ctx, lease.GetPartitionID())
+	ts.Require().NoError(err)
+	ts.Require().True(ok, "should have acquired")
+
+	epoch, ok := leaser.LeaseEpoch(acquired.GetPartitionID())
+	ts.True(ok)
+	ts.Equal(acquired.GetEpoch(), epoch)
+
+	_, checkpointEpoch, ok := leaser.GetCheckpointAndEpoch(ctx, acquired.GetPartitionID())
+	ts.True(ok)
+	ts.Equal(epoch, checkpointEpoch)
+}
+
+func TestBacklogAlertWhenPersistIsStuck(t *testing.T) {
+	alerts := make(chan int, 1)
+	cred := azblob.NewSharedKeyCredential("foo", "Zm9vCg==")
+	leaser, err := NewStorageLeaserCheckpointer(cred, "foo", "somecontainer", azure.PublicCloud, WithBacklogAlert(50*time.Millisecond, func(count int) {
+		select {
+		case alerts <- count:
+		default:
+		}
+	}))
+	require.NoError(t, err)
+
+	// holding the lease lock stops the persistence loop from making progress, just as a hung upload would
+	leaser.leasesMu.Lock()
+	defer leaser.leasesMu.Unlock()
+	leaser.trackDirty("0")
+	leaser.trackDirty("1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go leaser.watchBacklog(ctx)
+
+	select {
+	case count := <-alerts:
+		assert.Equal(t, 2, count)
+	case <-ctx.Done():
+		t.Fatal("backlog alert never fired")
+	}
+}
+
+func TestBacklogAlertQuietOncePersisted(t *testing.T) {
+	cred := azblob.NewSharedKeyCredential("foo", "Zm9vCg==")
+	leaser, err := NewStorageLeaserCheckpointer(cred, "foo", "somecontainer", azure.PublicCloud, WithBacklogAlert(50*time.Millisecond, func(int) {}))
+	require.NoError(t, err)
+
+	leaser.trackDirty("0")
+	assert.Equal(t, 1, leaser.staleDirtyCount(time.Now().Add(time.Second)))
+
+	leaser.untrackDirty("0")
+	assert.Equal(t, 0, leaser.staleDirtyCount(time.Now().Add(time.Second)))
+}
+
+func TestLeaseFromResponseClosesBody(t *testing.T) {
+	var newConns int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ms-lease-state", string(azblob.LeaseStateAvailable))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"partitionID":"0","epoch":1,"owner":"someone","token":""}`))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&newConns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	for i := 0; i < 20; i++ {
+		lease, err := leaser.getLease(ctx, "0")
+		require.NoError(t, err)
+		assert.Equal(t, "someone", lease.Owner)
+	}
+
+	// if each body is drained and closed, the connection is returned to the pool and reused for every request
+	assert.Equal(t, int32(1), atomic.LoadInt32(&newConns))
+}
+
+func TestHealthCheck(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Status int
+		Reason error
+	}{
+		{Name: "Healthy", Status: http.StatusOK},
+		{Name: "Forbidden", Status: http.StatusForbidden, Reason: ErrStorageUnauthorized},
+		{Name: "NotFound", Status: http.StatusNotFound, Reason: ErrStorageContainerNotFound},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(c.Status)
+			}))
+			defer server.Close()
+			leaser := newServerLeaser(t, server)
+
+			ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+			defer cancel()
+			err := leaser.HealthCheck(ctx)
+			if c.Reason == nil {
+				assert.NoError(t, err)
+				return
+			}
+
+			require.Error(t, err)
+			hcErr, ok := err.(*HealthCheckError)
+			require.True(t, ok, "should be a health check error")
+			assert.Equal(t, c.Reason, hcErr.Reason)
+		})
+	}
+}
+
+func TestReadinessChecksStorage(t *testing.T) {
+	status := int32(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	assert.NoError(t, leaser.Readiness(ctx), "ready without owning any partitions")
+
+	atomic.StoreInt32(&status, http.StatusForbidden)
+	err := leaser.Readiness(ctx)
+	require.Error(t, err)
+	hcErr, ok := err.(*HealthCheckError)
+	require.True(t, ok, "should be a health check error")
+	assert.Equal(t, ErrStorageUnauthorized, hcErr.Reason)
+}
+
+func TestBreakLease(t *testing.T) {
+	var action, period, path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action = r.Header.Get("x-ms-lease-action")
+		period = r.Header.Get("x-ms-lease-break-period")
+		path = r.URL.Path
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+	owned := &storageLease{Lease: &eph.Lease{PartitionID: "1"}, leaser: leaser, Token: "my-token"}
+	leaser.leases["1"] = owned
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	require.NoError(t, leaser.BreakLease(ctx, "1"))
+	assert.Equal(t, "break", action)
+	assert.Equal(t, "0", period, "the lease should be broken immediately")
+	assert.Equal(t, "/somecontainer/1", path)
+
+	lease, ok := leaser.ownedLease("1")
+	assert.True(t, ok, "breaking a lease shouldn't change the leases held by this host")
+	assert.Equal(t, owned, lease)
+}
+
+func TestDeleteLeases(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		leaseIDs = make(map[string]string)
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		partitionID := strings.TrimPrefix(r.URL.Path, "/somecontainer/")
+		mu.Lock()
+		leaseIDs[partitionID] = r.Header.Get("x-ms-lease-id")
+		mu.Unlock()
+
+		switch partitionID {
+		case "1":
+			w.Header().Set("x-ms-error-code", string(azblob.ServiceCodeBlobNotFound))
+			w.WriteHeader(http.StatusNotFound)
+		case "2":
+			w.Header().Set("x-ms-error-code", string(azblob.ServiceCodeLeaseIDMissing))
+			w.WriteHeader(http.StatusPreconditionFailed)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+	leaser.leases["0"] = &storageLease{Lease: &eph.Lease{PartitionID: "0"}, leaser: leaser, Token: "my-token"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+
+	err := leaser.DeleteLeases(ctx, []string{"0", "1", "2"})
+	require.Error(t, err)
+	partitionErrs, ok := err.(PartitionErrors)
+	require.True(t, ok, "should be partition errors")
+	assert.Len(t, partitionErrs, 1, "the missing blob should be treated as deleted")
+	assert.Contains(t, partitionErrs, "2")
+
+	assert.Equal(t, "my-token", leaseIDs["0"], "an owned lease should be deleted with its lease ID")
+	assert.Empty(t, leaseIDs["1"])
+	_, owned := leaser.ownedLease("0")
+	assert.False(t, owned)
+	assert.Empty(t, leaser.dirtySnapshot())
+}
+
+func TestLeaseState(t *testing.T) {
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		w.Header().Set("x-ms-lease-state", string(azblob.LeaseStateBreaking))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	state, err := leaser.LeaseState(ctx, "0")
+	require.NoError(t, err)
+	assert.Equal(t, azblob.LeaseStateBreaking, state)
+	assert.Equal(t, []string{http.MethodHead}, methods, "only the blob's properties should be read")
+	_, owned := leaser.ownedLease("0")
+	assert.False(t, owned)
+}
+
+func TestBreakLeaseReturnsStorageOperationError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ms-error-code", string(azblob.ServiceCodeLeaseNotPresentWithLeaseOperation))
+		w.WriteHeader(http.StatusConflict)
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	err := leaser.BreakLease(ctx, "1")
+	require.Error(t, err)
+	opErr, ok := err.(*StorageOperationError)
+	require.True(t, ok, "should be a storage operation error")
+	assert.Equal(t, "BreakLease", opErr.Operation)
+	assert.Equal(t, http.StatusConflict, opErr.StatusCode)
+}
+
+func TestParseContainerURL(t *testing.T) {
+	cases := []struct {
+		url       string
+		account   string
+		container string
+		err       bool
+	}{
+		{url: "https://myaccount.blob.core.windows.net/mycontainer", account: "myaccount", container: "mycontainer"},
+		{url: "https://myaccount.blob.core.windows.net/mycontainer/", account: "myaccount", container: "mycontainer"},
+		{url: "http://127.0.0.1:10000/devstoreaccount1/mycontainer", account: "devstoreaccount1", container: "mycontainer"},
+		{url: "https://myaccount.blob.core.windows.net", err: true},
+		{url: "https://myaccount.blob.core.windows.net/a/b/c", err: true},
+		{url: "https://localhost/mycontainer", err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.url, func(t *testing.T) {
+			u, err := url.Parse(c.url)
+			require.NoError(t, err)
+			account, container, err := parseContainerURL(*u)
+			if c.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.account, account)
+			assert.Equal(t, c.container, container)
+		})
+	}
+}
+
+func TestNewStorageLeaserCheckpointerFromContainerURL(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL + "/someaccount/somecontainer")
+	require.NoError(t, err)
+	containerURL := azblob.NewContainerURL(*serverURL, azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{}))
+	leaser, err := NewStorageLeaserCheckpointerFromContainerURL(&containerURL, azure.PublicCloud)
+	require.NoError(t, err)
+	assert.Equal(t, "someaccount", leaser.accountName)
+	assert.Equal(t, "somecontainer", leaser.containerName)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	exists, err := leaser.StoreExists(ctx)
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, []string{"/someaccount/somecontainer"}, paths, "the container should be checked through the given URL")
+
+	_, err = NewStorageLeaserCheckpointerFromContainerURL(&containerURL, azure.PublicCloud, WithSecondaryReadEndpoint())
+	assert.Error(t, err, "the secondary endpoint can't be built without a credential")
+
+	_, err = NewStorageLeaserCheckpointerFromContainerURL(nil, azure.PublicCloud)
+	assert.Error(t, err)
+}
+
+// etagServer serves a single lease blob, rejecting uploads whose If-Match doesn't match the blob's current ETag
+type etagServer struct {
+	mu      sync.Mutex
+	etag    int
+	body    []byte
+	puts    int
+	ifMatch []string
+}
+
+func (s *etagServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := fmt.Sprintf("\"%d\"", s.etag)
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("ETag", current)
+		w.Write(s.body)
+	case http.MethodPut:
+		s.puts++
+		ifMatch := r.Header.Get("If-Match")
+		s.ifMatch = append(s.ifMatch, ifMatch)
+		if ifMatch != "" && ifMatch != current {
+			w.Header().Set("x-ms-error-code", string(azblob.ServiceCodeConditionNotMet))
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		s.body, _ = ioutil.ReadAll(r.Body)
+		s.etag++
+		w.Header().Set("ETag", fmt.Sprintf("\"%d\"", s.etag))
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// write changes the blob as another writer would, moving its ETag on
+func (s *etagServer) write(t *testing.T, lease *storageLease) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	body, err := lease.marshal()
+	require.NoError(t, err)
+	s.body = body
+	s.etag++
+}
+
+func TestUploadLeaseRetriesWhenETagChanges(t *testing.T) {
+	blob := new(etagServer)
+	server := httptest.NewServer(blob)
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	mine := &storageLease{Lease: &eph.Lease{PartitionID: "0", Owner: "me"}, Token: "my-token", leaser: leaser}
+	mine.setCheckpoint(&persist.Checkpoint{Offset: "120", SequenceNumber: 12})
+	require.NoError(t, leaser.uploadLease(ctx, mine))
+	assert.Equal(t, azblob.ETag(`"1"`), mine.etag)
+
+	// another write path updates the blob, so the lease's ETag is now stale
+	other := &storageLease{Lease: &eph.Lease{PartitionID: "0", Owner: "me"}, Token: "my-token"}
+	other.setCheckpoint(&persist.Checkpoint{Offset: "100", SequenceNumber: 10})
+	blob.write(t, other)
+
+	require.NoError(t, leaser.uploadLease(ctx, mine))
+	assert.Equal(t, 3, blob.puts, "the stale upload should be retried once")
+	assert.Equal(t, []string{"", `"1"`, `"2"`}, blob.ifMatch)
+	assert.Equal(t, azblob.ETag(`"3"`), mine.etag)
+
+	stored, err := leaser.getLease(ctx, "0")
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), stored.checkpoint().SequenceNumber, "the retried upload should keep the newer checkpoint")
+}
+
+func TestUploadLeaseAdoptsNewerCheckpointAfterETagChange(t *testing.T) {
+	blob := new(etagServer)
+	server := httptest.NewServer(blob)
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	mine := &storageLease{Lease: &eph.Lease{PartitionID: "0", Owner: "me"}, Token: "my-token", leaser: leaser, etag: `"0"`}
+	mine.setCheckpoint(&persist.Checkpoint{Offset: "50", SequenceNumber: 5})
+
+	newer := &storageLease{Lease: &eph.Lease{PartitionID: "0", Owner: "me"}, Token: "my-token"}
+	newer.setCheckpoint(&persist.Checkpoint{Offset: "100", SequenceNumber: 10})
+	blob.write(t, newer)
+
+	require.NoError(t, leaser.uploadLease(ctx, mine))
+	assert.Equal(t, int64(10), mine.checkpoint().SequenceNumber, "the lease should not write over the newer checkpoint")
+}
+
+func TestUploadLeaseGivesUpWhenETagKeepsChanging(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("ETag", `"moving"`)
+			w.Write([]byte(`{"partitionID":"0"}`))
+			return
+		}
+		w.Header().Set("x-ms-error-code", string(azblob.ServiceCodeConditionNotMet))
+		w.WriteHeader(http.StatusPreconditionFailed)
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	lease := &storageLease{Lease: &eph.Lease{PartitionID: "0"}, Token: "my-token", leaser: leaser, etag: `"stale"`}
+	err := leaser.uploadLease(ctx, lease)
+	require.Error(t, err)
+	assert.True(t, isConditionNotMet(err))
+}
+
+func TestAcquireLeaseReturnsErrStoreNotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ms-error-code", string(azblob.ServiceCodeContainerNotFound))
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	assert.False(t, ok)
+	assert.Equal(t, ErrStoreNotFound, err)
+	assert.Equal(t, eph.ErrStoreNotFound, err, "the EventProcessorHost should recognize the error")
+}
+
+func TestAcquireLeaseIgnoresMissingBlob(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ms-error-code", string(azblob.ServiceCodeBlobNotFound))
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	assert.False(t, ok)
+	assert.NoError(t, err, "a missing lease blob isn't a missing store")
+}
+
+func TestLeaseLostHandlerCalledWhenRenewalShowsLeaseLost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ms-error-code", string(azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation))
+		w.WriteHeader(http.StatusConflict)
+	}))
+	defer server.Close()
+
+	lost := make(chan string, 1)
+	leaser := newServerLeaser(t, server, WithLeaseLostHandler(func(partitionID string) {
+		lost <- partitionID
+	}))
+	leaser.leases["2"] = &storageLease{Lease: &eph.Lease{PartitionID: "2"}, leaser: leaser, Token: "my-token"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	_, ok, err := leaser.RenewLease(ctx, "2")
+	require.Error(t, err)
+	assert.False(t, ok)
+
+	select {
+	case partitionID := <-lost:
+		assert.Equal(t, "2", partitionID)
+	case <-ctx.Done():
+		t.Fatal("the lease lost handler should have been called")
+	}
+}
+
+func TestLeaseLostHandlerNotCalledForTransientFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	var calls int32
+	leaser := newServerLeaser(t, server, WithLeaseLostHandler(func(string) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	leaser.containerURL = noRetryContainerURL(t, server)
+	leaser.leases["2"] = &storageLease{Lease: &eph.Lease{PartitionID: "2"}, leaser: leaser, Token: "my-token"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	_, _, err := leaser.RenewLease(ctx, "2")
+	require.Error(t, err)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+}
+
+func TestStorageOperationErrorCarriesRequestID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ms-request-id", "some-request-id")
+		w.Header().Set("x-ms-error-code", string(azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation))
+		w.WriteHeader(http.StatusConflict)
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+	leaser.leases["0"] = &storageLease{
+		Lease: &eph.Lease{
+			PartitionID: "0",
+		},
+		leaser: leaser,
+		Token:  "my-token",
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	_, _, err := leaser.RenewLease(ctx, "0")
+	require.Error(t, err)
+
+	opErr, ok := err.(*StorageOperationError)
+	require.True(t, ok, "should be a storage operation error")
+	assert.Equal(t, "RenewLease", opErr.Operation)
+	assert.Equal(t, "0", opErr.PartitionID)
+	assert.Equal(t, "some-request-id", opErr.RequestID)
+	assert.Equal(t, http.StatusConflict, opErr.StatusCode)
+	assert.Contains(t, opErr.Error(), "some-request-id")
+
+	_, ok = opErr.Unwrap().(azblob.StorageError)
+	assert.True(t, ok, "should unwrap to the azblob error")
+}
+
+func TestWatchLeasesDropsWhenSlow(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	changes, err := leaser.WatchLeases(context.Background())
+	require.NoError(t, err)
+
+	// nobody is receiving, so this must not block once the buffer is full
+	for i := 0; i < leaseChangeBuffer*2; i++ {
+		leaser.notifyLeaseChange("0", "", "me")
+	}
+	require.NoError(t, leaser.Close())
+
+	count := 0
+	for change := range changes {
+		assert.Equal(t, "0", change.PartitionID)
+		assert.Equal(t, "me", change.NewOwner)
+		count++
+	}
+	assert.Equal(t, leaseChangeBuffer, count)
+
+	_, err = leaser.WatchLeases(context.Background())
+	assert.Error(t, err, "shouldn't be able to watch a closed leaser")
+}
+
+func TestWatchLeasesClosesOnContextDone(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	changes, err := leaser.WatchLeases(ctx)
+	require.NoError(t, err)
+	cancel()
+
+	select {
+	case _, ok := <-changes:
+		assert.False(t, ok, "channel should be closed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel was not closed after the context was done")
+	}
+	assert.NoError(t, leaser.Close())
+}
+
+func TestMinCheckpointInterval(t *testing.T) {
+	var uploads int32
+	var lastUpload atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut && r.URL.Query().Get("comp") == "" {
+			body, _ := ioutil.ReadAll(r.Body)
+			lastUpload.Store(body)
+			atomic.AddInt32(&uploads, 1)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	interval := 500 * time.Millisecond
+	leaser := newServerLeaser(t, server, WithMinCheckpointInterval(interval))
+	leaser.leases["0"] = &storageLease{
+		Lease: &eph.Lease{
+			PartitionID: "0",
+		},
+		leaser: leaser,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	var sequence int64
+	start := time.Now()
+	for time.Since(start) < 2*time.Second {
+		sequence++
+		require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("", sequence, time.Now())))
+		assert.NoError(t, leaser.persistDirtyPartitions(ctx))
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// a write every 100ms would be ~20 uploads; the interval should hold it to ~4
+	count := atomic.LoadInt32(&uploads)
+	assert.True(t, count >= 3 && count <= 5, "expected writes every %v, but got %d uploads", interval, count)
+
+	// the carried over dirty partition should be written with the newest checkpoint once eligible
+	time.Sleep(interval)
+	require.NoError(t, leaser.persistDirtyPartitions(ctx))
+	var uploaded storageLease
+	require.NoError(t, json.Unmarshal(lastUpload.Load().([]byte), &uploaded))
+	assert.Equal(t, sequence, uploaded.Checkpoint.SequenceNumber)
+}
+
+func TestOwnershipVerification(t *testing.T) {
+	cases := []struct {
+		Name      string
+		Owner     string
+		Token     string
+		Violation bool
+	}{
+		{Name: "SoleOwner", Owner: "me", Token: "my-token"},
+		{Name: "OtherOwner", Owner: "someone-else", Token: "their-token", Violation: true},
+		{Name: "OtherToken", Owner: "me", Token: "their-token", Violation: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("x-ms-lease-state", string(azblob.LeaseStateLeased))
+				w.Write([]byte(`{"partitionID":"0","epoch":2,"owner":"` + c.Owner + `","token":"` + c.Token + `"}`))
+			}))
+			defer server.Close()
+
+			var violations []*OwnershipViolationError
+			leaser := newServerLeaser(t, server, WithOwnershipVerification(func(violation *OwnershipViolationError) {
+				violations = append(violations, violation)
+			}))
+			lease := &storageLease{
+				Lease: &eph.Lease{
+					PartitionID: "0",
+					Owner:       "me",
+				},
+				Token: "my-token",
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+			defer cancel()
+			err := leaser.verifyLeaseOwnership(ctx, lease)
+			if !c.Violation {
+				assert.NoError(t, err)
+				assert.Empty(t, violations)
+				return
+			}
+
+			require.Error(t, err)
+			_, ok := err.(*OwnershipViolationError)
+			assert.True(t, ok, "should be an ownership violation")
+			require.Len(t, violations, 1)
+			assert.Equal(t, c.Owner, violations[0].ActualOwner)
+			assert.Equal(t, c.Token, violations[0].ActualToken)
+		})
+	}
+}
+
+type (
+	mapCheckpointer struct {
+		checkpoints map[string]persist.Checkpoint
+		mu          sync.Mutex
+	}
+)
+
+func TestMirrorCheckpointerReceivesUpdates(t *testing.T) {
+	mirror := newMapCheckpointer()
+	leaser := newOfflineLeaser(t, WithMirrorCheckpointer(mirror))
+
+	checkpoint := persist.NewCheckpoint("1024", 10, time.Now())
+	require.NoError(t, leaser.UpdateCheckpoint(context.Background(), "0", checkpoint))
+
+	primary, ok := leaser.GetCheckpoint(context.Background(), "0")
+	require.True(t, ok)
+	assert.Equal(t, checkpoint.SequenceNumber, primary.SequenceNumber)
+
+	mirrored, ok := mirror.GetCheckpoint(context.Background(), "0")
+	require.True(t, ok, "the checkpoint should have been mirrored")
+	assert.Equal(t, checkpoint.SequenceNumber, mirrored.SequenceNumber)
+}
+
+func TestMirrorCheckpointerFallback(t *testing.T) {
+	mirror := newMapCheckpointer()
+	checkpoint := persist.NewCheckpoint("2048", 20, time.Now())
+	require.NoError(t, mirror.UpdateCheckpoint(context.Background(), "0", checkpoint))
+	leaser := newOfflineLeaser(t, WithMirrorCheckpointer(mirror))
+
+	// the lease blob has no checkpoint, as if it was lost from the primary account
+	got, ok := leaser.GetCheckpoint(context.Background(), "0")
+	require.True(t, ok)
+	assert.Equal(t, checkpoint.SequenceNumber, got.SequenceNumber, "should fall back to the mirror")
+
+	ensured, err := leaser.EnsureCheckpoint(context.Background(), "0")
+	require.NoError(t, err)
+	assert.Equal(t, checkpoint.SequenceNumber, ensured.SequenceNumber, "should seed the lease from the mirror")
+
+	// once the primary has a checkpoint, it is preferred over the mirror
+	require.NoError(t, mirror.UpdateCheckpoint(context.Background(), "0", persist.NewCheckpoint("4096", 40, time.Now())))
+	got, _ = leaser.GetCheckpoint(context.Background(), "0")
+	assert.Equal(t, checkpoint.SequenceNumber, got.SequenceNumber)
+}
+
+func TestAcquireLeaseEpochExhausted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fmt.Sprintf(`{"partitionID":"0","epoch":%d}`, eph.MaxEpoch)))
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	assert.False(t, ok)
+	assert.Equal(t, eph.ErrEpochExhausted, err)
+
+	_, ok, err = leaser.StealLease(ctx, "0")
+	assert.False(t, ok)
+	assert.Equal(t, eph.ErrEpochExhausted, err)
+}
+
+func TestAcquireAnyAvailableSkipsHeldPartitions(t *testing.T) {
+	states := map[string]azblob.LeaseStateType{
+		"0": azblob.LeaseStateAvailable,
+		"1": azblob.LeaseStateLeased,
+		"2": azblob.LeaseStateExpired,
+		"3": azblob.LeaseStateAvailable,
+	}
+	var (
+		mu       sync.Mutex
+		attempts []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		partitionID := strings.TrimPrefix(r.URL.Path, "/somecontainer/")
+		switch {
+		case r.Method == http.MethodHead:
+			w.Header().Set("x-ms-lease-state", string(states[partitionID]))
+		case r.Method == http.MethodGet:
+			w.Write([]byte(`{"partitionID":"` + partitionID + `","epoch":1}`))
+		case r.Method == http.MethodPut && r.URL.Query().Get("comp") == "lease":
+			mu.Lock()
+			attempts = append(attempts, partitionID)
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+	leaser.processor = new(eph.EventProcessorHost)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	acquired, err := leaser.AcquireAnyAvailable(ctx, []string{"0", "1", "2", "3"}, 2)
+	require.NoError(t, err)
+
+	var ids []string
+	for _, lease := range acquired {
+		ids = append(ids, lease.GetPartitionID())
+	}
+	assert.Equal(t, []string{"0", "2"}, ids)
+	assert.Equal(t, []string{"0", "2"}, attempts, "only available partitions, up to max, should be acquired")
+	assert.Equal(t, []string{"0", "2"}, leaser.OwnedPartitions())
+}
+
+func TestAcquireAnyAvailableRejectsNonPositiveMax(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	_, err := leaser.AcquireAnyAvailable(context.Background(), []string{"0"}, 0)
+	assert.Error(t, err)
+}
+
+func TestAcquireLeaseUsesTokenGenerator(t *testing.T) {
+	const token = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	proposed := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet:
+			w.Write([]byte(`{"partitionID":"0","epoch":1}`))
+		case r.Method == http.MethodPut && r.URL.Query().Get("comp") == "lease":
+			proposed <- r.Header.Get("x-ms-proposed-lease-id")
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server, WithTokenGenerator(func() (string, error) {
+		return token, nil
+	}))
+	leaser.processor = new(eph.EventProcessorHost)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	lease, ok, err := leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, token, <-proposed)
+	assert.Equal(t, token, lease.(*storageLease).Token)
+}
+
+func TestAcquireLeaseFailsWhenTokenGenerationFails(t *testing.T) {
+	var leaseRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("comp") == "lease" {
+			atomic.AddInt32(&leaseRequests, 1)
+		}
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`{"partitionID":"0","epoch":1}`))
+		}
+	}))
+	defer server.Close()
+	generateErr := errors.New("no entropy")
+	leaser := newServerLeaser(t, server, WithTokenGenerator(func() (string, error) {
+		return "", generateErr
+	}))
+	leaser.processor = new(eph.EventProcessorHost)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	assert.Equal(t, generateErr, err)
+	assert.False(t, ok)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&leaseRequests), "no lease should be requested without a token")
+	assert.Empty(t, leaser.OwnedPartitions())
+}
+
+func TestAcquireLeaseChildSpans(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte(`{"partitionID":"0","epoch":1}`))
+		case http.MethodPut:
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+	processor := new(eph.EventProcessorHost)
+	leaser.processor = processor
+
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok, "should have acquired")
+
+	spans := make(map[string]*mocktracer.MockSpan)
+	for _, span := range tracer.FinishedSpans() {
+		spans[span.OperationName] = span
+	}
+	parent, ok := spans["storage.LeaserCheckpointer.AcquireLease"]
+	require.True(t, ok, "should have an AcquireLease span")
+
+	expected := map[string]uint16{
+		"storage.LeaserCheckpointer.getLease":         http.StatusOK,
+		"storage.LeaserCheckpointer.acquireBlobLease": http.StatusCreated,
+		"storage.LeaserCheckpointer.uploadLease":      http.StatusCreated,
+	}
+	for name, status := range expected {
+		span, ok := spans[name]
+		require.True(t, ok, "should have a %s span", name)
+		assert.Equal(t, parent.SpanContext.TraceID, span.SpanContext.TraceID, "%s should be part of the acquire trace", name)
+		assert.Equal(t, "0", span.Tag(partitionIDTag))
+		assert.Equal(t, status, span.Tag(string(tag.HTTPStatusCode)))
+	}
+}
+
+func TestSpanDecoratorAppliedAfterDefaultTags(t *testing.T) {
+	leaser, _ := newFakeBlobLeaser(t, WithSpanDecorator(func(span opentracing.Span) {
+		span.SetTag("tenant", "contoso")
+		span.SetBaggageItem("correlationID", "abc")
+	}))
+
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	_, err := leaser.EnsureLease(ctx, "0")
+	require.NoError(t, err)
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok, "should have acquired")
+
+	spans := tracer.FinishedSpans()
+	require.NotEmpty(t, spans)
+	for _, span := range spans {
+		assert.Equal(t, "contoso", span.Tag("tenant"), "%s should be decorated", span.OperationName)
+		assert.Equal(t, "abc", span.BaggageItem("correlationID"), "%s should carry the baggage", span.OperationName)
+		assert.Equal(t, "azure.storage", span.Tag("eh.eventprocessorhost.kind"), "%s should keep its default tags", span.OperationName)
+	}
+}
+
+func TestGetLeaseSpanTaggedWithPartitionOfRootLeaseBlobs(t *testing.T) {
+	leaser, blobs := newFakeBlobLeaser(t)
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+
+	_, err := leaser.EnsureLease(ctx, "0")
+	require.NoError(t, err)
+	body, _, err := blobs.GetBlob(ctx, leaseBlobName("0"))
+	require.NoError(t, err)
+	_, err = blobs.PutBlob(ctx, "other/1", body, azblob.BlobHTTPHeaders{}, nil, azblob.BlobAccessConditions{})
+	require.NoError(t, err)
+
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	_, err = leaser.GetOwnershipByConsumerGroup(ctx)
+	require.NoError(t, err)
+
+	reads := make(map[interface{}]*mocktracer.MockSpan)
+	for _, span := range tracer.FinishedSpans() {
+		if span.OperationName == "storage.LeaserCheckpointer.getLease" {
+			reads[span.Tag(blobNameTag)] = span
+		}
+	}
+	require.Len(t, reads, 2)
+	assert.Equal(t, "0", reads["0"].Tag(partitionIDTag))
+	assert.Nil(t, reads["other/1"].Tag(partitionIDTag), "a blob under a consumer group prefix isn't this leaser's partition")
+}
+
+func TestWithSpanDecoratorRejectsNil(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	assert.Error(t, WithSpanDecorator(nil)(leaser))
+}
+
+func TestSecondaryReadEndpointFallback(t *testing.T) {
+	var primaryReqs, secondaryReqs int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&primaryReqs, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	checkpoint := persist.NewCheckpoint("4096", 40, time.Now())
+	body, err := json.Marshal(&storageLease{
+		Lease: &eph.Lease{
+			PartitionID: "0",
+			Epoch:       3,
+		},
+		Checkpoint: &checkpoint,
+	})
+	require.NoError(t, err)
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&secondaryReqs, 1)
+		w.Write(body)
+	}))
+	defer secondary.Close()
+
+	leaser := newServerLeaser(t, primary, WithSecondaryReadEndpoint())
+	require.NotNil(t, leaser.secondaryURL)
+	// don't retry the failing primary, so the test doesn't wait on the retry back off
+	leaser.containerURL = noRetryContainerURL(t, primary)
+	leaser.secondaryURL = noRetryContainerURL(t, secondary)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	read, err := leaser.GetCheckpointFromStorage(ctx, "0")
+	require.NoError(t, err)
+	assert.Equal(t, checkpoint.SequenceNumber, read.SequenceNumber)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&primaryReqs))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&secondaryReqs))
+
+	// lease decisions must not be made from the secondary
+	_, _, err = leaser.StealLease(ctx, "0")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&secondaryReqs), "stealing a lease should only read from the primary")
+}
+
+func TestPruneLeases(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?>` +
+				`<EnumerationResults ContainerName="somecontainer"><Blobs>` +
+				`<Blob><Name>0</Name><Properties><LeaseState>leased</LeaseState></Properties></Blob>` +
+				`<Blob><Name>1</Name><Properties><LeaseState>available</LeaseState></Properties></Blob>` +
+				`<Blob><Name>2</Name><Properties><LeaseState>available</LeaseState></Properties></Blob>` +
+				`<Blob><Name>3</Name><Properties><LeaseState>leased</LeaseState></Properties></Blob>` +
+				`<Blob><Name>other/2</Name><Properties><LeaseState>available</LeaseState></Properties></Blob>` +
+				`</Blobs><NextMarker /></EnumerationResults>`))
+		case http.MethodDelete:
+			mu.Lock()
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/somecontainer/"))
+			mu.Unlock()
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	removed, err := leaser.PruneLeases(ctx, []string{"0", "1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2"}, removed, "only the unleased blob of a removed partition should be pruned")
+	assert.Equal(t, []string{"2"}, deleted)
+}
+
+func TestWarmStartLoadsLeasesHeldByThisHost(t *testing.T) {
+	held := &storageLease{Lease: &eph.Lease{PartitionID: "0", Owner: "me"}, Token: "my-token"}
+	held.setCheckpoint(&persist.Checkpoint{Offset: "1024", SequenceNumber: 10})
+	heldBody, err := held.marshal()
+	require.NoError(t, err)
+	blobs := leaseBlobs{
+		"0": heldBody,
+		"1": leaseBlob(t, "1", &persist.Checkpoint{Offset: "2048", SequenceNumber: 20}),
+	}
+
+	var writes int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Query().Get("comp") == "list":
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?>` +
+				`<EnumerationResults ContainerName="somecontainer"><Blobs>` +
+				`<Blob><Name>0</Name><Properties><LeaseState>leased</LeaseState></Properties></Blob>` +
+				`<Blob><Name>1</Name><Properties><LeaseState>leased</LeaseState></Properties></Blob>` +
+				`<Blob><Name>2</Name><Properties><LeaseState>available</LeaseState></Properties></Blob>` +
+				`</Blobs><NextMarker /></EnumerationResults>`))
+		case r.Method == http.MethodGet:
+			blobs.ServeHTTP(w, r)
+		default:
+			atomic.AddInt32(&writes, 1)
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server, WithWarmStart())
+	defer leaser.Close()
+
+	host := new(eph.EventProcessorHost)
+	require.NoError(t, eph.WithOwnerIdentity("me")(host))
+	leaser.SetEventHostProcessor(host)
+
+	assert.Equal(t, []string{"0"}, leaser.OwnedPartitions(), "only the lease held by this host should be loaded")
+	checkpoint, ok := leaser.GetCheckpoint(context.Background(), "0")
+	assert.True(t, ok)
+	assert.Equal(t, "1024", checkpoint.Offset)
+	assert.Equal(t, int64(10), checkpoint.SequenceNumber)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&writes), "warm starting should not acquire or write any lease")
+}
+
+func TestEnsureCheckpointAtSeedsEmptyCheckpoint(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	ctx := context.Background()
+
+	seed := persist.NewCheckpointFromEndOfStream()
+	checkpoint, err := leaser.EnsureCheckpointAt(ctx, "0", seed)
+	require.NoError(t, err)
+	assert.Equal(t, seed.Offset, checkpoint.Offset)
+	require.NotNil(t, leaser.leases["0"].Checkpoint)
+	assert.Equal(t, seed.Offset, leaser.leases["0"].Checkpoint.Offset)
+	assert.Contains(t, leaser.dirtyPartitions, "0", "the seeded checkpoint should be persisted")
+}
+
+func TestEnsureCheckpointAtKeepsExistingCheckpoint(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	ctx := context.Background()
+
+	existing := persist.NewCheckpoint("1024", 10, time.Now())
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", existing))
+
+	checkpoint, err := leaser.EnsureCheckpointAt(ctx, "0", persist.NewCheckpointFromEndOfStream())
+	require.NoError(t, err)
+	assert.Equal(t, existing.Offset, checkpoint.Offset)
+	assert.Equal(t, existing.SequenceNumber, leaser.leases["0"].Checkpoint.SequenceNumber)
+
+	_, err = leaser.EnsureCheckpointAt(ctx, "1", persist.NewCheckpointFromEndOfStream())
+	assert.Equal(t, ErrPartitionNotOwned, err, "should not seed a partition which isn't owned")
+}
+
+func TestUpdateCheckpointMonotonic(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	ctx := context.Background()
+
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("200", 20, time.Now())), "moving forward should be allowed")
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("200", 20, time.Now())), "the same checkpoint should be allowed")
+
+	err := leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now()))
+	require.Error(t, err)
+	regression, ok := err.(*ErrCheckpointRegression)
+	require.True(t, ok, "should be a checkpoint regression error")
+	assert.Equal(t, int64(20), regression.StoredSequence)
+	assert.Equal(t, int64(10), regression.AttemptedSequence)
+	assert.Equal(t, int64(20), leaser.leases["0"].Checkpoint.SequenceNumber, "stored checkpoint shouldn't move backwards")
+}
+
+func TestUpdateCheckpointMonotonicOptionUndoesRewind(t *testing.T) {
+	leaser := newOfflineLeaser(t, WithAllowRewind(), WithMonotonicCheckpoints())
+	ctx := context.Background()
+
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("200", 20, time.Now())))
+	err := leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now()))
+	_, ok := err.(*ErrCheckpointRegression)
+	assert.True(t, ok, "should be a checkpoint regression error")
+}
+
+func TestUpdateCheckpointRewindAllowedWithOption(t *testing.T) {
+	logger := new(recordingLogger)
+	leaser := newOfflineLeaser(t, WithAllowRewind(), WithLogger(logger))
+	ctx := context.Background()
+
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("200", 20, time.Now())))
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+	assert.Equal(t, int64(10), leaser.leases["0"].Checkpoint.SequenceNumber)
+	require.Len(t, logger.entries, 1)
+	assert.Equal(t, "info", logger.entries[0].level, "an allowed rewind isn't an error")
+}
+
+func TestCheckpointEventRejectsClientSideEvent(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	ctx := context.Background()
+
+	assert.Equal(t, ErrEventNotReceived, leaser.CheckpointEvent(ctx, "0", eventhub.NewEventFromString("not received")))
+	assert.Equal(t, ErrEventNotReceived, leaser.CheckpointEvent(ctx, "0", nil))
+	assert.Nil(t, leaser.leases["0"].Checkpoint, "nothing should have been checkpointed")
+}
+
+func TestCheckpointLag(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	for _, partitionID := range []string{"1", "2"} {
+		leaser.leases[partitionID] = &storageLease{
+			Lease: &eph.Lease{
+				PartitionID: partitionID,
+			},
+			leaser: leaser,
+		}
+	}
+	ctx := context.Background()
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "1", persist.NewCheckpoint("500", 50, time.Now())))
+	leaser.leases["2"].setCheckpoint(&persist.Checkpoint{EnqueueTime: time.Now()})
+
+	lags, err := leaser.CheckpointLag(ctx, map[string]PartitionRuntime{
+		"0": {PartitionID: "0", LastSequenceNumber: 25},
+		"1": {PartitionID: "1", LastSequenceNumber: 50},
+		"2": {PartitionID: "2", LastSequenceNumber: 75},
+		"3": {PartitionID: "3", LastSequenceNumber: 99},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{"0": 15, "1": 0}, lags, "partitions not owned, without runtime info or positioned by time should be skipped")
+}
+
+func TestLeaseSchemaVersions(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		err  bool
+	}{
+		{name: "v0 without a version", body: `{"partitionID":"0","epoch":3,"owner":"me","token":"t"}`},
+		{name: "v1", body: `{"partitionID":"0","epoch":3,"owner":"me","token":"t","schemaVersion":1}`},
+		{name: "newer than supported", body: `{"partitionID":"0","epoch":3,"owner":"me","token":"t","schemaVersion":2}`, err: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var uploaded []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.Method {
+				case http.MethodGet:
+					w.Write([]byte(c.body))
+				case http.MethodPut:
+					uploaded, _ = ioutil.ReadAll(r.Body)
+					w.WriteHeader(http.StatusCreated)
+				}
+			}))
+			defer server.Close()
+			leaser := newServerLeaser(t, server)
+
+			ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+			defer cancel()
+			lease, err := leaser.getLease(ctx, "0")
+			if c.err {
+				require.Error(t, err)
+				versionErr, ok := err.(*ErrUnsupportedLeaseVersion)
+				require.True(t, ok, "should be an unsupported version error")
+				assert.Equal(t, "0", versionErr.PartitionID)
+				assert.Equal(t, 2, versionErr.Version)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, leaseSchemaVersion, lease.SchemaVersion)
+			assert.Equal(t, int64(3), lease.GetEpoch())
+
+			require.NoError(t, leaser.uploadLease(ctx, lease))
+			var written map[string]interface{}
+			require.NoError(t, json.Unmarshal(uploaded, &written))
+			assert.Equal(t, float64(leaseSchemaVersion), written["schemaVersion"], "uploads should be written in the current version")
+		})
+	}
+}
+
+func TestUpdateCheckpointDoesNotWaitOnLeasesMu(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+
+	// simulate a slow call to Azure Storage made while holding leasesMu
+	leaser.leasesMu.Lock()
+	defer leaser.leasesMu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- leaser.UpdateCheckpoint(context.Background(), "0", persist.NewCheckpoint("100", 10, time.Now()))
+	}()
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(shortTimeout):
+		t.Fatal("UpdateCheckpoint should not wait on leasesMu")
+	}
+}
+
+func TestPartitionStaysDirtyWhenUpdatedDuringPersist(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	ctx := context.Background()
+
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+	persisting := leaser.dirtySnapshot()
+
+	// a newer checkpoint arrives while the older one is being persisted
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("200", 20, time.Now())))
+	leaser.clearDirty("0", persisting["0"])
+	assert.Contains(t, leaser.dirtyPartitions, "0", "the newer checkpoint still needs to be persisted")
+
+	leaser.clearDirty("0", leaser.dirtySnapshot()["0"])
+	assert.NotContains(t, leaser.dirtyPartitions, "0")
+	assert.NotContains(t, leaser.dirtySince, "0")
+}
+
+func TestUpdateCheckpointForUnownedPartition(t *testing.T) {
+	ctx := context.Background()
+	checkpoint := persist.NewCheckpoint("100", 10, time.Now())
+
+	strict := newOfflineLeaser(t)
+	err := strict.UpdateCheckpoint(ctx, "1", checkpoint)
+	assert.Equal(t, ErrPartitionNotOwned, err)
+
+	logger := new(recordingLogger)
+	lenient := newOfflineLeaser(t, WithLenientCheckpoint(), WithLogger(logger))
+	assert.NoError(t, lenient.UpdateCheckpoint(ctx, "1", checkpoint), "lenient checkpoints should skip the partition")
+	assert.NotContains(t, lenient.dirtyPartitions, "1")
+	require.Len(t, logger.entries, 1)
+	assert.Equal(t, "info", logger.entries[0].level)
+	assert.Equal(t, []interface{}{"partitionID", "1"}, logger.entries[0].keyvals[:2])
+
+	require.NoError(t, lenient.UpdateCheckpoint(ctx, "0", checkpoint), "owned partitions should still be checkpointed")
+}
+
+func TestCopyCheckpointRequiresSourceAndProcessor(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	ctx := context.Background()
+	assert.Error(t, leaser.CopyCheckpoint(ctx, "0", "0", nil))
+	assert.Error(t, leaser.CopyCheckpoint(ctx, "0", "0", newOfflineLeaser(t)))
+}
+
+func TestWithLeaseDuration(t *testing.T) {
+	cases := []struct {
+		name     string
+		duration time.Duration
+		expected time.Duration
+		err      bool
+	}{
+		{name: "below minimum", duration: 10 * time.Second, err: true},
+		{name: "above maximum", duration: 90 * time.Second, err: true},
+		{name: "rounds below minimum", duration: 14400 * time.Millisecond, err: true},
+		{name: "negative", duration: -5 * time.Second, err: true},
+		{name: "minimum", duration: MinLeaseDuration, expected: MinLeaseDuration},
+		{name: "maximum", duration: MaxLeaseDuration, expected: MaxLeaseDuration},
+		{name: "rounded to the second", duration: 30400 * time.Millisecond, expected: 30 * time.Second},
+		{name: "infinite", duration: InfiniteLeaseDuration, expected: InfiniteLeaseDuration},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			leaser, err := NewStorageLeaserCheckpointer(azblob.NewAnonymousCredential(), "foo", "somecontainer", azure.PublicCloud, WithLeaseDuration(c.duration))
+			if c.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.expected, leaser.leaseDuration)
+		})
+	}
+}
+
+func TestAcquireBlobLeaseSendsDuration(t *testing.T) {
+	cases := map[time.Duration]string{
+		20 * time.Second:      "20",
+		InfiniteLeaseDuration: "-1",
+	}
+
+	for duration, expected := range cases {
+		var sent string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sent = r.Header.Get("x-ms-lease-duration")
+			w.WriteHeader(http.StatusCreated)
+		}))
+		leaser := newServerLeaser(t, server, WithLeaseDuration(duration))
+
+		ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+		require.NoError(t, leaser.acquireBlobLease(ctx, "0", "my-token"))
+		assert.Equal(t, expected, sent)
+		cancel()
+		server.Close()
+	}
+}
+
+func TestInfiniteLeaseNeverLapses(t *testing.T) {
+	clock := newFakeClock()
+	leaser := newOfflineLeaser(t, WithLeaseDuration(InfiniteLeaseDuration))
+	leaser.clock = clock
+	lease := &storageLease{Lease: &eph.Lease{PartitionID: "0"}, leaser: leaser, renewedAt: clock.Now()}
+
+	clock.Advance(24 * time.Hour)
+	assert.False(t, leaser.renewalLapsed(lease))
+}
+
+func TestGetCheckpoints(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	leaser.leases["1"] = &storageLease{Lease: &eph.Lease{PartitionID: "1"}, leaser: leaser}
+	ctx := context.Background()
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Time{})))
+
+	checkpoints := leaser.GetCheckpoints(ctx)
+	require.Len(t, checkpoints, 2)
+	assert.Equal(t, int64(10), checkpoints["0"].SequenceNumber)
+	assert.Equal(t, persist.NewCheckpointFromStartOfStream(), checkpoints["1"], "partitions without a checkpoint start from the start of the stream")
+
+	single, ok := leaser.GetCheckpoint(ctx, "1")
+	require.True(t, ok)
+	assert.Equal(t, single, checkpoints["1"])
+}
+
+func TestPersistDirtyPartitionsBoundsConcurrency(t *testing.T) {
+	const (
+		partitions  = 12
+		maxPersists = 3
+	)
+
+	var inFlight, maxInFlight, puts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			seen := atomic.LoadInt32(&maxInFlight)
+			if current <= seen || atomic.CompareAndSwapInt32(&maxInFlight, seen, current) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		if r.URL.Query().Get("comp") == "lease" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		atomic.AddInt32(&puts, 1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server, WithMaxConcurrentPersists(maxPersists))
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	for i := 0; i < partitions; i++ {
+		partitionID := strconv.Itoa(i)
+		leaser.leases[partitionID] = &storageLease{Lease: &eph.Lease{PartitionID: partitionID}, leaser: leaser, Token: "my-token"}
+		require.NoError(t, leaser.UpdateCheckpoint(ctx, partitionID, persist.NewCheckpoint("100", 10, time.Time{})))
+	}
+
+	require.NoError(t, leaser.persistDirtyPartitions(ctx))
+	assert.Equal(t, int32(partitions), atomic.LoadInt32(&puts), "every dirty partition should be persisted")
+	assert.True(t, atomic.LoadInt32(&maxInFlight) <= maxPersists, "at most %d writes should be in flight, saw %d", maxPersists, maxInFlight)
+	assert.Empty(t, leaser.dirtySnapshot())
+}
+
+func TestWithMaxConcurrentPersistsRejectsNonPositive(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	assert.Error(t, WithMaxConcurrentPersists(0)(leaser))
+	assert.Equal(t, DefaultMaxConcurrentPersists, leaser.maxPersists)
+}
+
+func TestSynchronousCheckpointIsUploadedBeforeReturning(t *testing.T) {
+	blob := new(etagServer)
+	server := httptest.NewServer(blob)
+	defer server.Close()
+	leaser := newServerLeaser(t, server, WithSynchronousCheckpoints())
+	leaser.leases["0"] = &storageLease{Lease: &eph.Lease{PartitionID: "0"}, leaser: leaser, Token: "my-token"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("2048", 20, time.Time{})))
+	assert.Empty(t, leaser.dirtySnapshot(), "synchronous checkpoints shouldn't be left for the persistence loop")
+
+	stored, err := leaser.getLease(ctx, "0")
+	require.NoError(t, err)
+	require.NotNil(t, stored.checkpoint())
+	assert.Equal(t, "2048", stored.checkpoint().Offset)
+	assert.Equal(t, int64(20), stored.checkpoint().SequenceNumber)
+}
+
+func TestSynchronousCheckpointReturnsUploadErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ms-error-code", string(azblob.ServiceCodeLeaseIDMismatchWithBlobOperation))
+		w.WriteHeader(http.StatusPreconditionFailed)
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server, WithSynchronousCheckpoints())
+	leaser.leases["0"] = &storageLease{Lease: &eph.Lease{PartitionID: "0"}, leaser: leaser, Token: "my-token"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	err := leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("2048", 20, time.Time{}))
+	require.Error(t, err)
+	opErr, ok := err.(*StorageOperationError)
+	require.True(t, ok, "should be a storage operation error")
+	assert.Equal(t, "PutBlob", opErr.Operation)
+}
+
+func TestLeaseInstanceIDRoundTrip(t *testing.T) {
+	lease := &storageLease{Lease: &eph.Lease{PartitionID: "0", Owner: "me"}, InstanceID: "some-instance"}
+	bits, err := lease.marshal()
+	require.NoError(t, err)
+	assert.Contains(t, string(bits), `"instanceID":"some-instance"`)
+
+	var legacy storageLease
+	require.NoError(t, json.Unmarshal([]byte(`{"partitionID":"0","owner":"me"}`), &legacy))
+	assert.Empty(t, legacy.InstanceID, "leases written before instance IDs have none")
+}
+
+func TestDetectSplitBrainRequiresProcessor(t *testing.T) {
+	_, err := newOfflineLeaser(t).DetectSplitBrain(context.Background(), "0")
+	assert.Error(t, err)
+}
+
+func TestResetForgetsLeasesAndDirtyCheckpoints(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+	leaser.leases["0"] = &storageLease{Lease: &eph.Lease{PartitionID: "0"}, leaser: leaser, Token: "my-token"}
+
+	ctx := context.Background()
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+	leaser.Reset()
+
+	_, owned := leaser.ownedLease("0")
+	assert.False(t, owned)
+	assert.Empty(t, leaser.dirtySnapshot())
+	assert.Empty(t, leaser.dirtySince)
+	assert.Error(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("200", 20, time.Now())), "the partition is no longer owned")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests), "the lease blobs should be left untouched")
+}
+
+// bootstrapServer serves an existing container holding the lease blobs of existing, and records the lease blobs created
+type bootstrapServer struct {
+	existing []string
+	mu       sync.Mutex
+	created  []string
+}
+
+func (b *bootstrapServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("comp") == "list":
+		w.Header().Set("Content-Type", "application/xml")
+		body := `<?xml version="1.0" encoding="utf-8"?><EnumerationResults ContainerName="somecontainer"><Blobs>`
+		for _, name := range b.existing {
+			body += `<Blob><Name>` + name + `</Name><Properties><LeaseState>available</LeaseState></Properties></Blob>`
+		}
+		w.Write([]byte(body + `</Blobs><NextMarker /></EnumerationResults>`))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPut:
+		b.mu.Lock()
+		b.created = append(b.created, strings.TrimPrefix(r.URL.Path, "/somecontainer/"))
+		b.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func TestBootstrapCreatesOnlyMissingLeases(t *testing.T) {
+	handler := &bootstrapServer{existing: []string{"0", "1"}}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	leaser := newContainerURLLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	require.NoError(t, leaser.Bootstrap(ctx, []string{"0", "1", "2", "3"}))
+	sort.Strings(handler.created)
+	assert.Equal(t, []string{"2", "3"}, handler.created)
+}
+
+func TestBootstrapShortCircuitsWhenLeasesExist(t *testing.T) {
+	handler := &bootstrapServer{existing: []string{"0", "1"}}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	leaser := newContainerURLLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		require.NoError(t, leaser.Bootstrap(ctx, []string{"0", "1"}))
+	}
+	assert.Empty(t, handler.created, "nothing should be written when the store and leases exist")
+}
+
+// memoryBlobs serves blobs from memory, keyed by blob name, accepting any lease operation
+type memoryBlobs struct {
+	mu         sync.Mutex
+	blobs      map[string][]byte
+	leaseCalls []string
+}
+
+func newMemoryBlobs() *memoryBlobs {
+	return &memoryBlobs{blobs: make(map[string][]byte)}
+}
+
+func (m *memoryBlobs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name := strings.TrimPrefix(r.URL.Path, "/somecontainer/")
+	switch {
+	case r.URL.Query().Get("comp") == "lease":
+		m.leaseCalls = append(m.leaseCalls, name+":"+r.Header.Get("x-ms-lease-action"))
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodHead:
+		w.Header().Set("x-ms-lease-state", string(azblob.LeaseStateAvailable))
+	case r.Method == http.MethodPut:
+		body, _ := ioutil.ReadAll(r.Body)
+		m.blobs[name] = body
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodDelete:
+		delete(m.blobs, name)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		body, ok := m.blobs[name]
+		if !ok {
+			w.Header().Set("x-ms-error-code", string(azblob.ServiceCodeBlobNotFound))
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	}
+}
+
+func (m *memoryBlobs) get(name string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	body, ok := m.blobs[name]
+	return body, ok
+}
+
+func TestSeparateCheckpointBlobsPersistWithoutRewritingLease(t *testing.T) {
+	blobs := newMemoryBlobs()
+	server := httptest.NewServer(blobs)
+	defer server.Close()
+	leaser := newServerLeaser(t, server, WithSeparateCheckpointBlobs())
+	leaser.setLease(&storageLease{Lease: &eph.Lease{PartitionID: "0"}, leaser: leaser, Token: "my-token"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("1024", 10, time.Now())))
+	require.NoError(t, leaser.persistDirtyPartitions(ctx))
+
+	body, ok := blobs.get("0.checkpoint")
+	require.True(t, ok, "the checkpoint blob should be written")
+	var checkpoint persist.Checkpoint
+	require.NoError(t, json.Unmarshal(body, &checkpoint))
+	assert.Equal(t, "1024", checkpoint.Offset)
+
+	_, ok = blobs.get("0")
+	assert.False(t, ok, "the lease blob should not be rewritten")
+	assert.Equal(t, []string{"0:renew"}, blobs.leaseCalls, "the lease should be renewed before persisting the checkpoint")
+}
+
+func TestSeparateCheckpointBlobsMigrateFromLeaseBlobs(t *testing.T) {
+	blobs := newMemoryBlobs()
+	blobs.blobs["0"] = leaseBlob(t, "0", &persist.Checkpoint{Offset: "1024", SequenceNumber: 10})
+	server := httptest.NewServer(blobs)
+	defer server.Close()
+	leaser := newServerLeaser(t, server, WithSeparateCheckpointBlobs())
+	leaser.processor = new(eph.EventProcessorHost)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	checkpoint, err := leaser.GetCheckpointFromStorage(ctx, "0")
+	require.NoError(t, err)
+	assert.Equal(t, "1024", checkpoint.Offset, "a partition without a checkpoint blob should use the lease blob's checkpoint")
+
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+	checkpoint, _ = leaser.GetCheckpoint(ctx, "0")
+	assert.Equal(t, "1024", checkpoint.Offset)
+
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("4096", 40, time.Now())))
+	require.NoError(t, leaser.persistDirtyPartitions(ctx))
+	checkpoint, err = leaser.GetCheckpointFromStorage(ctx, "0")
+	require.NoError(t, err)
+	assert.Equal(t, "4096", checkpoint.Offset, "the migrated checkpoint should be read from the checkpoint blob")
+}
+
+func TestSeparateCheckpointBlobsLoadedWhenLeaseAcquired(t *testing.T) {
+	blobs := newMemoryBlobs()
+	blobs.blobs["0"] = leaseBlob(t, "0", &persist.Checkpoint{Offset: "1024", SequenceNumber: 10})
+	checkpointBody, err := json.Marshal(persist.Checkpoint{Offset: "4096", SequenceNumber: 40})
+	require.NoError(t, err)
+	blobs.blobs["0.checkpoint"] = checkpointBody
+	server := httptest.NewServer(blobs)
+	defer server.Close()
+	leaser := newServerLeaser(t, server, WithSeparateCheckpointBlobs())
+	leaser.processor = new(eph.EventProcessorHost)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	_, ok, err := leaser.AcquireLease(ctx, "0")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	checkpoint, _ := leaser.GetCheckpoint(ctx, "0")
+	assert.Equal(t, "4096", checkpoint.Offset, "the checkpoint blob should take precedence over the lease blob")
+	assert.Equal(t, int64(40), checkpoint.SequenceNumber)
+}
+
+// newContainerURLLeaser builds a leaser from a container URL served by the test server, without retries in the pipeline
+func newContainerURLLeaser(t *testing.T, server *httptest.Server, opts ...LeaserCheckpointerOption) *LeaserCheckpointer {
+	leaser, err := NewStorageLeaserCheckpointerFromContainerURL(noRetryContainerURL(t, server), azure.PublicCloud, opts...)
+	require.NoError(t, err)
+	return leaser
+}
+
+func TestConcurrentEnsureStoreBothSucceed(t *testing.T) {
+	const hosts = 2
+	var (
+		checked sync.WaitGroup
+		created int32
+	)
+	checked.Add(hosts)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			// both hosts find the container missing before either creates it
+			w.WriteHeader(http.StatusNotFound)
+			checked.Done()
+			return
+		}
+
+		checked.Wait()
+		if atomic.AddInt32(&created, 1) > 1 {
+			w.Header().Set("x-ms-error-code", string(azblob.ServiceCodeContainerAlreadyExists))
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	errs := make(chan error, hosts)
+	for i := 0; i < hosts; i++ {
+		leaser := newContainerURLLeaser(t, server)
+		go func() {
+			errs <- leaser.EnsureStore(ctx)
+		}()
+	}
+
+	for i := 0; i < hosts; i++ {
+		assert.NoError(t, <-errs)
+	}
+	assert.Equal(t, int32(hosts), atomic.LoadInt32(&created))
+}
+
+func TestEnsureStoreChecksContainerProperties(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	require.NoError(t, leaser.EnsureStore(ctx))
+	require.Len(t, requests, 1, "an existing container should need a single request")
+	assert.True(t, strings.HasPrefix(requests[0], http.MethodGet+" /somecontainer?"), "the container's properties should be read rather than the account's containers listed")
+	assert.NotContains(t, requests[0], "comp=list")
+}
+
+func TestEnsureStoreRetriesTransientCreateFailures(t *testing.T) {
+	var creates int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if atomic.AddInt32(&creates, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	leaser := newContainerURLLeaser(t, server, WithEnsureStoreRetry(3, 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	require.NoError(t, leaser.EnsureStore(ctx))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&creates))
+}
+
+func TestEnsureStoreDoesNotRetryClientErrors(t *testing.T) {
+	var creates int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&creates, 1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+	leaser := newContainerURLLeaser(t, server, WithEnsureStoreRetry(3, 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	require.Error(t, leaser.EnsureStore(ctx))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&creates))
+}
+
+func TestSeedCheckpointsFromTime(t *testing.T) {
+	blob := new(etagServer)
+	server := httptest.NewServer(blob)
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+	clock := newFakeClock()
+	leaser.clock = clock
+	leaser.leases["0"] = &storageLease{Lease: &eph.Lease{PartitionID: "0"}, leaser: leaser, Token: "my-token"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("4096", 40, clock.Now())))
+
+	assert.Error(t, leaser.SeedCheckpointsFromTime(ctx, []string{"0"}, clock.Now().Add(time.Hour)), "a time in the future can't be seeded")
+	assert.Error(t, leaser.SeedCheckpointsFromTime(ctx, []string{"0", "1"}, clock.Now()), "every partition must be owned")
+	assert.Equal(t, 0, blob.puts, "nothing should be written when validation fails")
+
+	seedTime := clock.Now().Add(-2 * time.Hour)
+	require.NoError(t, leaser.SeedCheckpointsFromTime(ctx, []string{"0"}, seedTime))
+	assert.Empty(t, leaser.dirtySnapshot(), "the seeded checkpoint replaces the unpersisted one")
+
+	stored, err := leaser.getLease(ctx, "0")
+	require.NoError(t, err)
+	seeded := stored.checkpoint()
+	require.NotNil(t, seeded)
+	assert.Empty(t, seeded.Offset)
+	assert.True(t, seedTime.Equal(seeded.EnqueueTime))
+}
+
+func TestLeaseMetadataWrittenOnCreateAndUpdate(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		metadata []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Query().Get("comp") == "lease":
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPut:
+			mu.Lock()
+			metadata = append(metadata, r.Header.Get("x-ms-meta-tenant"))
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server, WithLeaseMetadata(map[string]string{"tenant": "contoso"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	created, err := leaser.createOrGetLease(ctx, "0", nil)
+	require.NoError(t, err)
+	created.Token = "my-token"
+	leaser.leases["0"] = created
+
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("1024", 10, time.Now())))
+	require.NoError(t, leaser.persistDirtyPartitions(ctx))
+	assert.Equal(t, []string{"contoso", "contoso"}, metadata, "the metadata should be written on create and on each update")
+}
+
+func TestOwnedPartitionsReflectsAcquisitionsAndReleases(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	assert.Equal(t, []string{"0"}, leaser.OwnedPartitions())
+
+	for _, partitionID := range []string{"2", "1"} {
+		leaser.setLease(&storageLease{Lease: &eph.Lease{PartitionID: partitionID}})
+	}
+	assert.Equal(t, []string{"0", "1", "2"}, leaser.OwnedPartitions())
+
+	leaser.removeLease("0")
+	assert.Equal(t, []string{"1", "2"}, leaser.OwnedPartitions())
+}
+
+func TestSuggestedRenewalDelayIsSpreadAndStable(t *testing.T) {
+	leaser := newOfflineLeaser(t, WithLeaseDuration(40*time.Second))
+
+	delays := make(map[time.Duration]bool)
+	min, max := time.Duration(math.MaxInt64), time.Duration(0)
+	for i := 0; i < 32; i++ {
+		partitionID := strconv.Itoa(i)
+		delay := leaser.SuggestedRenewalDelay(partitionID)
+		assert.Equal(t, delay, leaser.SuggestedRenewalDelay(partitionID), "the delay should be stable for a partition")
+		assert.True(t, delay >= 20*time.Second && delay < 30*time.Second, "delay %v should be within half to three quarters of the lease duration", delay)
+
+		delays[delay] = true
+		if delay < min {
+			min = delay
+		}
+		if delay > max {
+			max = delay
+		}
+	}
+	assert.True(t, len(delays) > 16, "the delays should differ between partitions")
+	assert.True(t, max-min > 5*time.Second, "the delays should be spread across the range, got %v to %v", min, max)
+}
+
+type recordingMetrics struct {
+	mu        sync.Mutex
+	acquired  []string
+	lost      []string
+	persists  []string
+	owned     []int
+	reapplied []string
+}
+
+func (m *recordingMetrics) LeaseAcquired(partitionID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.acquired = append(m.acquired, partitionID)
+}
+
+func (m *recordingMetrics) LeaseLost(partitionID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lost = append(m.lost, partitionID)
+}
+
+func (m *recordingMetrics) CheckpointPersisted(partitionID string, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.persists = append(m.persists, partitionID)
+}
+
+func (m *recordingMetrics) OwnedPartitions(count int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.owned = append(m.owned, count)
+}
+
+func (m *recordingMetrics) CheckpointReapplied(partitionID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reapplied = append(m.reapplied, partitionID)
+}
+
+func TestMetricsRecorderObservesOwnershipAndPersists(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("comp") == "lease" {
+			w.Header().Set("x-ms-error-code", string(azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation))
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+	metrics := new(recordingMetrics)
+	leaser := newServerLeaser(t, server, WithMetricsRecorder(metrics), WithSynchronousCheckpoints())
+	leaser.setLease(&storageLease{Lease: &eph.Lease{PartitionID: "0"}, leaser: leaser, Token: "my-token"})
+	leaser.setLease(&storageLease{Lease: &eph.Lease{PartitionID: "1"}, leaser: leaser, Token: "my-token"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("1024", 10, time.Now())))
+	_, _, err := leaser.RenewLease(ctx, "1")
+	require.Error(t, err)
+	leaser.removeLease("1")
+
+	assert.Equal(t, []int{1, 2, 1}, metrics.owned)
+	assert.Equal(t, []string{"0"}, metrics.persists)
+	assert.Equal(t, []string{"1"}, metrics.lost)
+}
+
+func TestWithMetricsRecorderRejectsNil(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	assert.Error(t, WithMetricsRecorder(nil)(leaser))
+}
+
+func TestWithLeaseMetadataRejectsEmptyKeys(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	assert.Error(t, WithLeaseMetadata(map[string]string{"": "value"})(leaser))
+}
+
+func TestErrorsReceivesPersistFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("x-ms-error-code", string(azblob.ServiceCodeLeaseIDMismatchWithLeaseOperation))
+		w.WriteHeader(http.StatusConflict)
+	}))
+	defer server.Close()
+	leaser := newServerLeaser(t, server)
+	leaser.leases["0"] = &storageLease{Lease: &eph.Lease{PartitionID: "0"}, leaser: leaser, Token: "my-token"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	require.NoError(t, leaser.UpdateCheckpoint(ctx, "0", persist.NewCheckpoint("100", 10, time.Now())))
+	require.Error(t, leaser.persistDirtyPartitions(ctx))
+
+	select {
+	case err := <-leaser.Errors():
+		persistErr, ok := err.(*PersistError)
+		require.True(t, ok, "should be a persist error")
+		assert.Equal(t, "0", persistErr.PartitionID)
+		assert.True(t, isLeaseConflict(persistErr.Unwrap()))
+	default:
+		t.Fatal("the persist failure should have been sent")
+	}
+
+	require.NoError(t, leaser.Close())
+	_, open := <-leaser.Errors()
+	assert.False(t, open, "the channel should be closed with the leaser")
+	require.NoError(t, leaser.Close())
+}
+
+func TestErrorsDropsWhenReceiverFallsBehind(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	for i := 0; i < persistErrorBuffer+10; i++ {
+		leaser.notifyPersistError("0", errors.New("storage is down"))
+	}
+	assert.Len(t, leaser.Errors(), persistErrorBuffer)
+
+	require.NoError(t, leaser.Close())
+	leaser.notifyPersistError("0", errors.New("after close"))
+}
+
+func BenchmarkUpdateCheckpoint(b *testing.B) {
+	const partitions = 1024
+	leaser := newOfflineLeaser(b)
+	for i := 1; i < partitions; i++ {
+		partitionID := strconv.Itoa(i)
+		leaser.leases[partitionID] = &storageLease{
+			Lease: &eph.Lease{
+				PartitionID: partitionID,
+			},
+			leaser: leaser,
+		}
+	}
+
+	// sequence numbers only ever move forward across runs, so no update is rejected as a rewind
+	var seq int64
+	run := func(b *testing.B) {
+		var next int32
+		b.RunParallel(func(pb *testing.PB) {
+			// each goroutine checkpoints its own partition, as a receiver for each partition would
+			partitionID := strconv.Itoa(int(atomic.AddInt32(&next, 1)-1) % partitions)
+			for pb.Next() {
+				n := atomic.AddInt64(&seq, 1)
+				if err := leaser.UpdateCheckpoint(context.Background(), partitionID, persist.NewCheckpoint(strconv.FormatInt(n, 10), n, time.Time{})); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	b.Run("Idle", run)
+	b.Run("StorageBusy", func(b *testing.B) {
+		// simulate calls to Azure Storage for other partitions repeatedly holding leasesMu
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				leaser.leasesMu.Lock()
+				time.Sleep(time.Millisecond)
+				leaser.leasesMu.Unlock()
+			}
+		}()
+		run(b)
+	})
+}
+
+type (
+	recordingLogger struct {
+		mu      sync.Mutex
+		entries []logEntry
+	}
+
+	logEntry struct {
+		level   string
+		msg     string
+		keyvals []interface{}
+	}
+)
+
+func (l *recordingLogger) Debug(_ context.Context, msg string, keyvals ...interface{}) {
+	l.record("debug", msg, keyvals)
+}
+
+func (l *recordingLogger) Info(_ context.Context, msg string, keyvals ...interface{}) {
+	l.record("info", msg, keyvals)
+}
+
+func (l *recordingLogger) Error(_ context.Context, msg string, keyvals ...interface{}) {
+	l.record("error", msg, keyvals)
+}
+
+func (l *recordingLogger) record(level, msg string, keyvals []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, logEntry{level: level, msg: msg, keyvals: keyvals})
+}
+
+func TestWithLoggerReceivesAcquireErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	logger := new(recordingLogger)
+	leaser := newServerLeaser(t, server, WithLogger(logger))
+	leaser.containerURL = noRetryContainerURL(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	_, ok, _ := leaser.AcquireLease(ctx, "3")
+	assert.False(t, ok)
+
+	require.Len(t, logger.entries, 1)
+	entry := logger.entries[0]
+	assert.Equal(t, "error", entry.level)
+	assert.Equal(t, "failed to read lease", entry.msg)
+	require.Len(t, entry.keyvals, 4)
+	assert.Equal(t, []interface{}{"partitionID", "3"}, entry.keyvals[:2])
+	assert.Equal(t, "error", entry.keyvals[2])
+}
+
+func TestWithLoggerRejectsNil(t *testing.T) {
+	_, err := NewStorageLeaserCheckpointer(azblob.NewAnonymousCredential(), "foo", "somecontainer", azure.PublicCloud, WithLogger(nil))
+	assert.Error(t, err)
+}
+
+func TestFormatLogEntry(t *testing.T) {
+	assert.Equal(t, "acquired lease partitionID=0 epoch=2", formatLogEntry("acquired lease", []interface{}{"partitionID", "0", "epoch", 2}))
+	assert.Equal(t, "odd key=(missing)", formatLogEntry("odd", []interface{}{"key"}))
+}
+
+func TestEndpointOverrideDirectsRequests(t *testing.T) {
+	paths := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		w.Header().Set("x-ms-lease-state", string(azblob.LeaseStateAvailable))
+	}))
+	defer server.Close()
+
+	var accounts []string
+	leaser, err := NewStorageLeaserCheckpointer(azblob.NewAnonymousCredential(), "foo", "somecontainer", azure.PublicCloud, WithEndpointOverride(func(accountName string) (*url.URL, error) {
+		accounts = append(accounts, accountName)
+		return url.Parse(server.URL + "/" + accountName)
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, accounts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	state, err := leaser.LeaseState(ctx, "0")
+	require.NoError(t, err)
+	assert.Equal(t, azblob.LeaseStateAvailable, state)
+	assert.Equal(t, "/foo/somecontainer/0", <-paths)
+}
+
+func TestEndpointOverrideAppliesToSecondaryEndpoint(t *testing.T) {
+	override := WithEndpointOverride(func(accountName string) (*url.URL, error) {
+		return url.Parse("https://" + accountName + ".blob.local.azurestack.external")
+	})
+	leaser, err := NewStorageLeaserCheckpointer(azblob.NewAnonymousCredential(), "foo", "somecontainer", azure.PublicCloud, WithSecondaryReadEndpoint(), override)
+	require.NoError(t, err)
+
+	primary := leaser.containerURL.URL()
+	secondary := leaser.secondaryURL.URL()
+	assert.Equal(t, "https://foo.blob.local.azurestack.external/somecontainer", primary.String())
+	assert.Equal(t, "https://foo-secondary.blob.local.azurestack.external/somecontainer", secondary.String())
+}
+
+func TestEndpointOverrideRejectsInvalidURLs(t *testing.T) {
+	overrides := map[string]func(string) (*url.URL, error){
+		"nil":      func(string) (*url.URL, error) { return nil, nil },
+		"relative": func(string) (*url.URL, error) { return url.Parse("/accounts/foo") },
+		"scheme":   func(string) (*url.URL, error) { return url.Parse("ftp://foo.example.com") },
+		"error":    func(string) (*url.URL, error) { return nil, errors.New("no endpoint for account") },
+	}
+	for name, override := range overrides {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewStorageLeaserCheckpointer(azblob.NewAnonymousCredential(), "foo", "somecontainer", azure.PublicCloud, WithEndpointOverride(override))
+			assert.Error(t, err)
+		})
+	}
+
+	containerURL := azblob.NewContainerURL(url.URL{Scheme: "https", Host: "foo.blob.core.windows.net", Path: "/somecontainer"}, azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{}))
+	_, err := NewStorageLeaserCheckpointerFromContainerURL(&containerURL, azure.PublicCloud, WithEndpointOverride(func(string) (*url.URL, error) {
+		return url.Parse("https://foo.example.com")
+	}))
+	assert.Error(t, err, "the override isn't supported with a container URL")
+}
+
+func TestOperationTimeoutBoundsStuckCalls(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the blob of partition 1 hangs, as on a stuck connection
+		if strings.HasSuffix(r.URL.Path, "/1") {
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+			return
+		}
+		w.Write([]byte(`{"partitionID":"0","epoch":1}`))
+	}))
+	defer server.Close()
+	defer close(release)
+	leaser := newServerLeaser(t, server, WithOperationTimeout(50*time.Millisecond))
+	leaser.containerURL = noRetryContainerURL(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := leaser.getLease(ctx, "0")
+	require.NoError(t, err, "calls which respond within the timeout should succeed")
+
+	start := time.Now()
+	_, err = leaser.getLease(ctx, "1")
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second, "the stuck read should fail after the operation timeout, not the caller's deadline")
+	assert.NoError(t, ctx.Err(), "the caller's context should be unaffected")
+}
+
+func TestWithOperationTimeoutRejectsNonPositive(t *testing.T) {
+	leaser := newOfflineLeaser(t)
+	assert.Error(t, WithOperationTimeout(0)(leaser))
+}
+
+// newServerLeaser builds a LeaserCheckpointer whose container is served by the test server
+func newServerLeaser(t *testing.T, server *httptest.Server, opts ...LeaserCheckpointerOption) *LeaserCheckpointer {
+	serverURL, err := url.Parse(server.URL + "/somecontainer")
+	require.NoError(t, err)
+	leaser, err := NewStorageLeaserCheckpointer(azblob.NewAnonymousCredential(), "foo", "somecontainer", azure.PublicCloud, opts...)
+	require.NoError(t, err)
+	containerURL := azblob.NewContainerURL(*serverURL, azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{}))
+	leaser.containerURL = &containerURL
+	return leaser
+}
+
+// noRetryContainerURL builds a container URL served by the test server which doesn't retry failed requests
+func noRetryContainerURL(t *testing.T, server *httptest.Server) *azblob.ContainerURL {
+	serverURL, err := url.Parse(server.URL + "/somecontainer")
+	require.NoError(t, err)
+	containerURL := azblob.NewContainerURL(*serverURL, azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{
+		Retry: azblob.RetryOptions{
+			MaxTries: 1,
+		},
+	}))
+	return &containerURL
+}
+
+// newOfflineLeaser builds a LeaserCheckpointer which owns partition "0" without talking to Azure Storage
+func newOfflineLeaser(t testing.TB, opts ...LeaserCheckpointerOption) *LeaserCheckpointer {
+	cred := azblob.NewSharedKeyCredential("foo", "Zm9vCg==")
+	leaser, err := NewStorageLeaserCheckpointer(cred, "foo", "somecontainer", azure.PublicCloud, opts...)
+	require.NoError(t, err)
+	leaser.leases["0"] = &storageLease{
+		Lease: &eph.Lease{
+			PartitionID: "0",
+		},
+		leaser: leaser,
+	}
+	return leaser
+}
+
+func (ts *testSuite) leaserWithEPHAndLeases(opts ...eph.EventProcessorHostOption) (*LeaserCheckpointer, func()) {
+	leaser, del := ts.leaserWithEPH(opts...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	for _, partitionID := range leaser.processor.GetPartitionIDs() {
+		lease, err := leaser.EnsureLease(ctx, partitionID)
+		ts.NoError(err)
+		ts.Equal(partitionID, lease.GetPartitionID())
+	}
+
+	return leaser, del
+}
+
+func (ts *testSuite) leaserWithEPH(opts ...eph.EventProcessorHostOption) (*LeaserCheckpointer, func()) {
+	leaser, del := ts.newLeaser()
+	hub, delHub := ts.RandomHub()
+	delAll := func() {
+		delHub()
+		del()
+	}
+
+	provider, err := aad.NewJWTProvider(aad.JWTProviderWithEnvironmentVars())
+	if !ts.NoError(err) {
+		delAll()
+		ts.FailNow("could not build a new JWT provider from env")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+	defer cancel()
+	processor, err := eph.New(ctx, ts.Namespace, *hub.Name, provider, nil, nil, opts...)
+	if !ts.NoError(err) {
+		delAll()
+		ts.FailNow("could not create a new eph")
+	}
+	leaser.SetEventHostProcessor(processor)
+	if !ts.NoError(leaser.EnsureStore(ctx)) {
+		delAll()
+		ts.FailNow("could not ensure store")
+	}
+
+	return leaser, delAll
+}
+
+func (ts *testSuite) containerMetadata(ctx context.Context, leaser *LeaserCheckpointer) azblob.Metadata {
+	res, err := leaser.containerURL.GetPropertiesAndMetadata(ctx, azblob.LeaseAccessConditions{})
+	ts.Require().NoError(err)
+	return res.NewMetadata()
+}
+
+func (ts *testSuite) newLeaser(opts ...LeaserCheckpointerOption) (*LeaserCheckpointer, func()) {
+	containerName := strings.ToLower(ts.RandomName("stortest", 4))
+	cred, err := NewAADSASCredential(ts.SubscriptionID, ts.ResourceGroup, ts.AccountName, containerName, AADSASCredentialWithEnvironmentVars())
+	ts.Require().NoError(err)
+	leaser, err := NewStorageLeaserCheckpointer(cred, ts.AccountName, containerName, ts.Env, opts...)
+	ts.Require().NoError(err)
+	return leaser, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shortTimeout)
+		defer cancel()
+		if err := leaser.DeleteStore(ctx); err != nil {
+			ts.T().Fatal(err)
+		}
+	}
+}
+
+func newMapCheckpointer() *mapCheckpointer {
+	return &mapCheckpointer{
+		checkpoints: make(map[string]persist.Checkpoint),
+	}
+}
+
+func (mc *mapCheckpointer) StoreExists(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+func (mc *mapCheckpointer) EnsureStore(ctx context.Context) error {
+	return nil
+}
+
+func (mc *mapCheckpointer) DeleteStore(ctx context.Context) error {
+	return nil
+}
+
+func (mc *mapCheckpointer) SetEventHostProcessor(eph *eph.EventProcessorHost) {}
+
+func (mc *mapCheckpointer) GetCheckpoint(ctx context.Context, partitionID string) (persist.Checkpoint, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	checkpoint, ok := mc.checkpoints[partitionID]
+	return checkpoint, ok
+}
+
+func (mc *mapCheckpointer) EnsureCheckpoint(ctx context.Context, partitionID string) (persist.Checkpoint, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	checkpoint, ok := mc.checkpoints[partitionID]
+	if !ok {
+		checkpoint = persist.NewCheckpointFromStartOfStream()
+		mc.checkpoints[partitionID] = checkpoint
+	}
+	return checkpoint, nil
+}
+
+func (mc *mapCheckpointer) UpdateCheckpoint(ctx context.Context, partitionID string, checkpoint persist.Checkpoint) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.checkpoints[partitionID] = checkpoint
+	return nil
+}
+
+func (mc *mapCheckpointer) DeleteCheckpoint(ctx context.Context, partitionID string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	delete(mc.checkpoints, partitionID)
+	return nil
+}
+
+func (mc *mapCheckpointer) Close() error {
+	return nil
+}